@@ -0,0 +1,307 @@
+// Package client lets other programs run BitTorrent downloads. A Client owns the
+// listener for incoming peers and the limits shared by every torrent added to it.
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// Config configures a Client
+type Config struct {
+	// DataDir is where torrents are downloaded to
+	DataDir string
+	// ListenAddr accepts incoming peer connections, empty to only dial out
+	ListenAddr string
+	// MaxConns is the number of peer connections shared by all torrents,
+	// MaxHalfOpen how many of them may be dialing at once and MaxUnchoked how
+	// many peers may download from us at once
+	MaxConns    int
+	MaxHalfOpen int
+	MaxUnchoked int
+	// DownloadRate and UploadRate cap the bytes per second of all torrents
+	// together, zero for unlimited
+	DownloadRate int64
+	UploadRate   int64
+	// Storage holds the downloaded data, files under DataDir when nil
+	Storage peer.Storage
+	// Allocation is how files under DataDir are allocated when Storage is nil,
+	// Torrent.SetAllocation overrides it
+	Allocation peer.Allocation
+	// Blocklist is a file of IP ranges no peer may be in, in eMule ipfilter.dat,
+	// P2P or CIDR format. Client.ReloadBlocklist reads it again.
+	Blocklist string
+	// Cache limits the memory used to cache pieces in front of Storage. Zero
+	// limits take DefaultConfig's, a negative limit turns that cache off.
+	Cache peer.CacheConfig
+	// Seed keeps torrents running once they complete, uploading to other peers
+	// until they are paused or stopped
+	Seed bool
+}
+
+// DefaultConfig is used for any Config field left empty
+var DefaultConfig = Config{
+	DataDir:     "downloads",
+	ListenAddr:  ":6881",
+	MaxConns:    200,
+	MaxHalfOpen: 20,
+	MaxUnchoked: 20,
+	Cache:       peer.DefaultCacheConfig,
+}
+
+// Client runs any number of torrents at once
+type Client struct {
+	Config Config
+
+	mu       sync.Mutex
+	listener net.Listener
+	limits   *peer.Limits
+	cache    *peer.CachedStorage
+	torrents map[[20]byte]*Torrent
+	events   subscribers
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// New creates a client and starts listening for incoming peers
+func New(config Config) (*Client, error) {
+	if config.DataDir == "" {
+		config.DataDir = DefaultConfig.DataDir
+	}
+	if config.MaxConns == 0 {
+		config.MaxConns = DefaultConfig.MaxConns
+	}
+	if config.MaxHalfOpen == 0 {
+		config.MaxHalfOpen = DefaultConfig.MaxHalfOpen
+	}
+	if config.MaxUnchoked == 0 {
+		config.MaxUnchoked = DefaultConfig.MaxUnchoked
+	}
+	if config.Storage == nil {
+		storage := peer.NewFileStorage(config.DataDir)
+		storage.Allocation = config.Allocation
+		config.Storage = storage
+	}
+	if config.Cache.WriteBytes == 0 {
+		config.Cache.WriteBytes = DefaultConfig.Cache.WriteBytes
+	}
+	if config.Cache.ReadBytes == 0 {
+		config.Cache.ReadBytes = DefaultConfig.Cache.ReadBytes
+	}
+	if config.Cache.FlushBytes == 0 {
+		config.Cache.FlushBytes = DefaultConfig.Cache.FlushBytes
+	}
+	if config.Cache.FlushAge == 0 {
+		config.Cache.FlushAge = DefaultConfig.Cache.FlushAge
+	}
+	limits := peer.NewLimits(config.MaxConns)
+	limits.SetConnLimits(config.MaxConns, config.MaxHalfOpen, config.MaxUnchoked)
+	limits.Download.SetRate(config.DownloadRate)
+	limits.Upload.SetRate(config.UploadRate)
+	limits.Blocklist = &peer.Blocklist{}
+	if config.Blocklist != "" {
+		err := limits.Blocklist.LoadFile(config.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Client{
+		Config:   config,
+		limits:   limits,
+		cache:    peer.NewCachedStorage(config.Storage, config.Cache),
+		torrents: map[[20]byte]*Torrent{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if config.ListenAddr != "" {
+		listener, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = listener
+		go c.accept()
+	}
+	return c, nil
+}
+
+// AddMagnet adds a torrent from a magnet link, its metadata is fetched once it is started
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	m, err := magneturi.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(m, nil)
+}
+
+// AddTorrentFile adds the torrent described by a .torrent file
+func (c *Client) AddTorrentFile(path string) (*Torrent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mi, err := peer.ReadTorrentFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddTorrent(mi)
+}
+
+// AddTorrent adds the torrent of a .torrent file that was already read or created
+func (c *Client) AddTorrent(mi *peer.MetaInfo) (*Torrent, error) {
+	return c.add(magneturi.FromTorrent(mi), &mi.Info)
+}
+
+func (c *Client) add(m magneturi.MagnetURI, info *peer.TorrentInfo) (*Torrent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.torrents == nil {
+		return nil, errors.New("Client is closed")
+	}
+	if _, ok := c.torrents[m.InfoHash]; ok {
+		return nil, errors.New("Torrent has already been added")
+	}
+	m.Port = c.port()
+	t := newTorrent(c, m, info)
+	c.torrents[m.InfoHash] = t
+	return t, nil
+}
+
+// SetConnLimits changes the connections, dials in progress and unchoked peers
+// shared by all torrents
+func (c *Client) SetConnLimits(maxConns, maxHalfOpen, maxUnchoked int) {
+	c.limits.SetConnLimits(maxConns, maxHalfOpen, maxUnchoked)
+}
+
+// ReloadBlocklist reads Config.Blocklist again, connected peers are kept. The old
+// ranges stay in use if the file cannot be read.
+func (c *Client) ReloadBlocklist() error {
+	if c.Config.Blocklist == "" {
+		return errors.New("No blocklist is configured")
+	}
+	return c.limits.Blocklist.LoadFile(c.Config.Blocklist)
+}
+
+// BlocklistStats reports the size of the blocklist and the peers it kept out
+func (c *Client) BlocklistStats() peer.BlocklistStats {
+	return c.limits.Blocklist.Stats()
+}
+
+// BanIP keeps every torrent from connecting to ip for duration. Peers that send
+// bad data are banned for an hour on their own.
+func (c *Client) BanIP(ip net.IP, duration time.Duration) {
+	c.limits.Ban(ip, duration)
+}
+
+// SetRateLimits changes the bytes per second of all torrents together, zero for unlimited
+func (c *Client) SetRateLimits(download, upload int64) {
+	c.limits.Download.SetRate(download)
+	c.limits.Upload.SetRate(upload)
+}
+
+// RateLimits returns the limits of SetRateLimits, or of the schedule while one
+// of its times applies
+func (c *Client) RateLimits() (download, upload int64) {
+	return c.limits.Download.Rate(), c.limits.Upload.Rate()
+}
+
+// SetRateSchedule gives times of day rate limits of their own, outside of them
+// the limits of SetRateLimits apply
+func (c *Client) SetRateSchedule(download, upload []peer.RateSchedule) {
+	c.limits.Download.SetSchedule(download)
+	c.limits.Upload.SetSchedule(upload)
+}
+
+// CacheStats reports how the piece cache shared by the client's torrents is used
+func (c *Client) CacheStats() peer.CacheStats {
+	return c.cache.Stats()
+}
+
+// Torrents lists every torrent that has been added and not stopped
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Torrent finds a torrent by infohash, nil when it has not been added
+func (c *Client) Torrent(infoHash [20]byte) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.torrents[infoHash]
+}
+
+func (c *Client) remove(t *Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.torrents[t.InfoHash()] == t {
+		delete(c.torrents, t.InfoHash())
+	}
+}
+
+// Close stops every torrent and the listener
+func (c *Client) Close() error {
+	for _, t := range c.Torrents() {
+		t.Stop()
+	}
+	c.mu.Lock()
+	c.torrents = nil
+	c.mu.Unlock()
+	c.cancel()
+	if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+// port is the port announced to trackers, zero when not listening
+func (c *Client) port() uint16 {
+	if c.listener == nil {
+		return 0
+	}
+	addr, ok := c.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+	return uint16(addr.Port)
+}
+
+// accept hands incoming connections to the torrent they ask for
+func (c *Client) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if addr != nil && c.limits.Blocklist.BlockInbound(addr.IP) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			infoHash, err := peer.AcceptHandshake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			c.mu.Lock()
+			t := c.torrents[infoHash]
+			c.mu.Unlock()
+			if t == nil {
+				conn.Close()
+				return
+			}
+			t.addConn(conn)
+		}()
+	}
+}
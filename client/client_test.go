@@ -0,0 +1,492 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// startSeeder serves every piece of content to anyone who asks, speaking just enough
+// of the peer wire protocol for a leecher: handshake, bitfield, unchoke and pieces
+func startSeeder(t *testing.T, mi *peer.MetaInfo, content []byte) peer.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSeed(conn, mi, content)
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveSeed(conn net.Conn, mi *peer.MetaInfo, content []byte) {
+	defer conn.Close()
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	copy(handshake[48:], "-SEED0-000000000000")
+	conn.Write(handshake)
+
+	numPieces := mi.Info.NumPieces()
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bitfield[i/8] |= 128 >> uint(i%8)
+	}
+	writeMessage(conn, 5, bitfield)
+	writeMessage(conn, 1, nil)
+	for {
+		var length uint32
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length == 0 {
+			continue
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		if body[0] != 6 || len(body) != 13 {
+			continue
+		}
+		index := binary.BigEndian.Uint32(body[1:5])
+		begin := binary.BigEndian.Uint32(body[5:9])
+		blockLength := binary.BigEndian.Uint32(body[9:13])
+		offset := int(index)*mi.Info.PieceLength + int(begin)
+		payload := make([]byte, 8, 8+blockLength)
+		copy(payload, body[1:9])
+		payload = append(payload, content[offset:offset+int(blockLength)]...)
+		writeMessage(conn, 7, payload)
+	}
+}
+
+func writeMessage(conn net.Conn, id uint8, payload []byte) {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)+1))
+	buf[4] = id
+	conn.Write(append(buf, payload...))
+}
+
+// newTestTorrent creates a .torrent of random content split over two files
+func newTestTorrent(t *testing.T, name string, size int) (string, *peer.MetaInfo, []byte) {
+	dir := t.TempDir()
+	content := make([]byte, size)
+	rand.Read(content)
+	root := filepath.Join(dir, name)
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "a.bin"), content[:size/3], 0644)
+	os.WriteFile(filepath.Join(root, "b.bin"), content[size/3:], 0644)
+	mi, err := peer.CreateTorrent(root, peer.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".torrent")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := mi.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return path, mi, content
+}
+
+func TestClientDownloadsTorrents(t *testing.T) {
+	c, err := New(Config{DataDir: t.TempDir(), ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type download struct {
+		torrent *Torrent
+		content []byte
+	}
+	var downloads []download
+	for _, name := range []string{"first", "second"} {
+		path, mi, content := newTestTorrent(t, name, 300000+rand.Intn(100000))
+		torrent, err := c.AddTorrentFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrent.AddPeers([]peer.Peer{startSeeder(t, mi, content), startSeeder(t, mi, content)})
+		if err := torrent.Start(); err != nil {
+			t.Fatal(err)
+		}
+		downloads = append(downloads, download{torrent, content})
+	}
+	if len(c.Torrents()) != 2 {
+		t.Errorf("got %d torrents want 2", len(c.Torrents()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for _, d := range downloads {
+		if err := d.torrent.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+		stats := d.torrent.Stats()
+		if stats.State != StateCompleted || stats.BytesCompleted != int64(len(d.content)) {
+			t.Errorf("got stats %+v", stats)
+		}
+		var got []byte
+		for _, f := range d.torrent.Files() {
+			data, err := os.ReadFile(filepath.Join(c.Config.DataDir, filepath.FromSlash(f.Path)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, data...)
+		}
+		if !bytes.Equal(got, d.content) {
+			t.Errorf("downloaded content of %s does not match", d.torrent.Name())
+		}
+	}
+}
+
+func TestAnnounceCompleted(t *testing.T) {
+	tracker := httptest.NewServer(magneturi.NewTrackerServer(nil))
+	defer tracker.Close()
+	c, err := New(Config{DataDir: t.TempDir(), ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	path, mi, content := newTestTorrent(t, "announced", 200000)
+	torrent, err := c.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.AddTrackers([]string{tracker.URL + "/announce"}); err != nil {
+		t.Fatal(err)
+	}
+	torrent.AddPeers([]peer.Peer{startSeeder(t, mi, content)})
+	if err := torrent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The tracker counts us as a seed that completed the torrent once it hears
+	// of the completion, with nothing left
+	m := magneturi.MagnetURI{InfoHash: mi.InfoHash, Trackers: []string{tracker.URL + "/announce"}}
+	var result magneturi.ScrapeResult
+	for ctx.Err() == nil {
+		result = m.Scrape(ctx)[0]
+		if result.Err == nil && result.Completed == 1 && result.Seeders == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got scrape %+v, want one seed that completed", result)
+}
+
+func TestTorrentPauseAndStop(t *testing.T) {
+	c, err := New(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	path, mi, content := newTestTorrent(t, "paused", 200000)
+	torrent, err := c.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.Start()
+	torrent.Pause()
+	if state := torrent.Stats().State; state != StatePaused {
+		t.Errorf("got state %s after pause", state)
+	}
+	torrent.AddPeers([]peer.Peer{startSeeder(t, mi, content)})
+	torrent.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.Stop()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Errorf("got error %v after stopping a completed torrent", err)
+	}
+	if len(c.Torrents()) != 0 {
+		t.Errorf("stopped torrent is still listed")
+	}
+}
+
+// startStalledSeeder accepts connections and never answers, keeping a download busy
+func startStalledSeeder(t *testing.T) peer.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	dataDir := t.TempDir()
+	t.Run("download", func(t *testing.T) {
+		c, err := New(Config{DataDir: dataDir, ListenAddr: "127.0.0.1:0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, mi, _ := newTestTorrent(t, "leak", 200000)
+		torrent, err := c.AddTorrentFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrent.AddPeers([]peer.Peer{startStalledSeeder(t), startStalledSeeder(t)})
+		torrent.Start()
+		for deadline := time.Now().Add(5 * time.Second); torrent.Stats().Peers < 2; {
+			if time.Now().After(deadline) {
+				t.Fatal("peers were never connected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		resume := filepath.Join(dataDir, "."+fmt.Sprintf("%x", mi.InfoHash)+".resume")
+		if _, err := os.Stat(resume); err != nil {
+			t.Errorf("resume data was not saved: %v", err)
+		}
+	})
+
+	// The seeders are closed by the subtest's cleanup, so nothing should be left over
+	var n int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if n = runtime.NumGoroutine(); n <= baseline {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<16)
+	t.Errorf("%d goroutines are still running, %d before the client started\n%s",
+		n, baseline, buf[:runtime.Stack(buf, true)])
+}
+
+func TestTorrentEvents(t *testing.T) {
+	c, err := New(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	path, mi, content := newTestTorrent(t, "events", 200000)
+	torrent, err := c.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := torrent.Subscribe(1000)
+	defer unsubscribe()
+	torrent.AddPeers([]peer.Peer{startSeeder(t, mi, content)})
+	torrent.Start()
+
+	counts := map[peer.EventType]int{}
+	timeout := time.After(20 * time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			if e.Torrent != torrent {
+				t.Fatalf("got an event of another torrent")
+			}
+			counts[e.Type]++
+			done = e.Type == peer.EventStateChanged && e.State == StateCompleted
+		case <-timeout:
+			t.Fatalf("torrent never completed, got events %v", counts)
+		}
+	}
+	if counts[peer.EventPieceVerified] != mi.Info.NumPieces() {
+		t.Errorf("got %d pieces verified want %d", counts[peer.EventPieceVerified], mi.Info.NumPieces())
+	}
+	if counts[peer.EventPeerConnected] != 1 || counts[peer.EventCompleted] != 1 {
+		t.Errorf("got events %v", counts)
+	}
+	stats := torrent.Stats()
+	if len(stats.Files) != 2 || stats.KnownPeers != 1 || stats.DownloadRate <= 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestClientStorage(t *testing.T) {
+	storage := peer.NewMemoryStorage()
+	dataDir := t.TempDir()
+	c, err := New(Config{DataDir: dataDir, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	path, mi, content := newTestTorrent(t, "memory", 100000)
+	torrent, err := c.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.AddPeers([]peer.Peer{startSeeder(t, mi, content)})
+	torrent.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := storage.OpenTorrent(&mi.Info, mi.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for piece := 0; piece < mi.Info.NumPieces(); piece++ {
+		buf := make([]byte, mi.Info.PieceSize(piece))
+		if _, err := ts.ReadAt(piece, buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("stored content does not match")
+	}
+	if entries, _ := os.ReadDir(dataDir); len(entries) != 0 {
+		t.Errorf("memory storage wrote %d entries to the data dir", len(entries))
+	}
+}
+
+func TestSeedAndSelectFiles(t *testing.T) {
+	path, mi, content := newTestTorrent(t, "seeded", 300000)
+	dir := filepath.Dir(path)
+	if have, err := peer.VerifyStorage(&mi.Info, mi.InfoHash, peer.NewFileStorage(dir), nil); err != nil || have.Count() != mi.Info.NumPieces() {
+		t.Fatalf("verified %d pieces: %v", have.Count(), err)
+	}
+	seeder, err := New(Config{DataDir: dir, ListenAddr: "127.0.0.1:0", Seed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	seeding, err := seeder.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeding.Start()
+	for deadline := time.Now().Add(10 * time.Second); seeding.Stats().State != StateSeeding; {
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent is %s, not seeding", seeding.Stats().State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leecher, err := New(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	torrent, err := leecher.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.SelectFiles([]int{1})
+	if err := torrent.AddTrackers([]string{"udp://127.0.0.1:1/announce"}); err != nil {
+		t.Fatal(err)
+	}
+	addr := seeder.listener.Addr().(*net.TCPAddr)
+	torrent.AddPeers([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	torrent.Start()
+	if torrent.AddTrackers([]string{"udp://other.example:6969"}) == nil {
+		t.Error("added a tracker to a running torrent")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files := torrent.Files()
+	if files[0].Wanted || !files[1].Wanted {
+		t.Errorf("got files %+v want only the second", files)
+	}
+	got, err := os.ReadFile(filepath.Join(leecher.Config.DataDir, filepath.FromSlash(files[1].Path)))
+	if err != nil || !bytes.Equal(got, content[len(content)/3:]) {
+		t.Errorf("second file was not downloaded from the seed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(leecher.Config.DataDir, filepath.FromSlash(files[0].Path))); !os.IsNotExist(err) {
+		t.Errorf("unselected file was written: %v", err)
+	}
+	if state := seeding.Stats().State; state != StateSeeding {
+		t.Errorf("seed is %s after the leecher finished", state)
+	}
+}
+
+func TestTorrentDetails(t *testing.T) {
+	path, mi, content := newTestTorrent(t, "details", 100000)
+	seeder := startSeeder(t, mi, content)
+	c, err := New(Config{DataDir: t.TempDir(), ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	torrent, err := c.AddTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.AddTrackers([]string{"udp://127.0.0.1:1/announce"}); err != nil {
+		t.Fatal(err)
+	}
+	torrent.SetFilePriority(0, peer.PriorityNone)
+	torrent.SetFilePriority(1, peer.PriorityHigh)
+	torrent.AddPeers([]peer.Peer{seeder})
+	torrent.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files := torrent.Files()
+	if files[0].Wanted || files[1].Priority != peer.PriorityHigh {
+		t.Errorf("got files %+v", files)
+	}
+	if pieces := torrent.Pieces(); pieces.Count() == 0 || pieces.Len() != mi.Info.NumPieces() {
+		t.Errorf("got %d of %d pieces", pieces.Count(), pieces.Len())
+	}
+	trackers := torrent.Trackers()
+	if len(trackers) != 1 || trackers[0].Announced.IsZero() || trackers[0].Err == nil {
+		t.Errorf("got trackers %+v, want a failed announce", trackers)
+	}
+	if peers := torrent.Peers(); peers != nil {
+		t.Errorf("got peers %+v of a finished torrent", peers)
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/laurentlousky/stream/peer"
+)
+
+// Event is something that happened to one of a client's torrents
+type Event struct {
+	peer.Event
+	Torrent *Torrent
+	State   State // set for EventStateChanged
+}
+
+// subscribers fans events out to the channels returned by Subscribe
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[chan Event]*Torrent // nil Torrent receives every torrent's events
+}
+
+// Subscribe returns a channel receiving the events of every torrent of the client
+// and a func that unsubscribes and closes it. Rather than hold up a download,
+// events are dropped while the channel's buffer is full.
+func (c *Client) Subscribe(buffer int) (<-chan Event, func()) {
+	return c.events.subscribe(nil, buffer)
+}
+
+// Subscribe is like Client.Subscribe but only receives this torrent's events
+func (t *Torrent) Subscribe(buffer int) (<-chan Event, func()) {
+	return t.client.events.subscribe(t, buffer)
+}
+
+func (s *subscribers) subscribe(t *Torrent, buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	s.mu.Lock()
+	if s.subs == nil {
+		s.subs = map[chan Event]*Torrent{}
+	}
+	s.subs[ch] = t
+	s.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (s *subscribers) publish(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, t := range s.subs {
+		if t != nil && t != e.Torrent {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (t *Torrent) publish(e peer.Event) {
+	t.client.events.publish(Event{Event: e, Torrent: t})
+}
+
+func (t *Torrent) publishState(state State) {
+	e := peer.NewEvent(peer.EventStateChanged, t.InfoHash())
+	t.client.events.publish(Event{Event: e, Torrent: t, State: state})
+}
@@ -0,0 +1,618 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+const (
+	reannounceInterval       = 5 * time.Minute
+	stopAnnounceTimeout      = 5 * time.Second
+	completedAnnounceTimeout = time.Minute
+)
+
+// ErrStopped is returned by Wait once a torrent has been stopped
+var ErrStopped = errors.New("Torrent was stopped")
+
+// State is where a torrent is in its lifecycle
+type State int
+
+// The states of a torrent
+const (
+	StatePaused State = iota
+	StateFetchingMetadata
+	StateDownloading
+	StateCompleted
+	StateFailed
+	StateStopped
+	StateSeeding // completed and uploading, when Config.Seed is set
+)
+
+func (s State) String() string {
+	return [...]string{"paused", "fetching metadata", "downloading", "completed", "failed", "stopped", "seeding"}[s]
+}
+
+// Stats is a snapshot of a torrent's progress
+type Stats struct {
+	State           State
+	PiecesCompleted int
+	Pieces          int
+	BytesCompleted  int64
+	BytesTotal      int64
+	Downloaded      int64   // bytes received from peers in verified pieces
+	Uploaded        int64   // bytes sent to peers
+	DownloadRate    float64 // bytes per second over the last few seconds
+	UploadRate      float64
+	ETA             time.Duration
+	Peers           int // connected
+	KnownPeers      int
+	Files           []File
+}
+
+// File is a file of the torrent and how much of it is downloaded
+type File struct {
+	Path      string
+	Length    int64
+	Completed int64
+	Wanted    bool
+	Priority  peer.Priority
+	Padding   bool // BEP 47 padding, never written
+}
+
+// TrackerStatus is how the last announce to a tracker went
+type TrackerStatus struct {
+	URL       string
+	Announced time.Time // zero until the first announce
+	Seeders   int
+	Leechers  int
+	Peers     int // returned by the last announce
+	Err       error
+}
+
+// Torrent is a handle to a torrent added to a Client
+type Torrent struct {
+	client *Client
+	magnet magneturi.MagnetURI
+	file   *peer.File
+
+	mu         sync.Mutex
+	state      State
+	download   *peer.Download
+	cancel     context.CancelFunc
+	rates      [4]int64              // download, upload, and the same per peer
+	conns      [3]int                // connection, half-open and unchoke limits
+	selected   []int                 // indexes of the wanted files, nil for all of them
+	priorities map[int]peer.Priority // by file index, overriding selected
+	trackers   map[string]TrackerStatus
+	// announcedCompleted is set once trackers were told the download completed,
+	// or when it was complete from the start
+	announcedCompleted bool
+	running            chan struct{} // closed when the current run returns
+	done               chan struct{} // closed once the torrent completes, fails or is stopped
+	err                error
+}
+
+func newTorrent(c *Client, m magneturi.MagnetURI, info *peer.TorrentInfo) *Torrent {
+	t := &Torrent{
+		client: c,
+		magnet: m,
+		file: &peer.File{
+			InfoHash: m.InfoHash,
+			Name:     m.Name,
+			WebSeeds: m.WebSeeds,
+			Metadata: info,
+		},
+		state: StatePaused,
+		done:  make(chan struct{}),
+	}
+	t.magnet.OnEvent = t.onTrackerEvent
+	t.magnet.Stats = t.announceStats
+	return t
+}
+
+// InfoHash identifies the torrent
+func (t *Torrent) InfoHash() [20]byte {
+	return t.magnet.InfoHash
+}
+
+// Name is the torrent's name, from the metadata once it is known
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file.Metadata != nil {
+		return t.file.Metadata.Name
+	}
+	return t.magnet.Name
+}
+
+// MagnetLink is a magnet link of the torrent with its current trackers
+func (t *Torrent) MagnetLink() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.magnet.String()
+}
+
+// AddPeers adds peers we already know about to the ones the trackers return
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.Peers = append(t.file.Peers, peers...)
+	if t.download != nil {
+		t.download.AddPeers(peers)
+	}
+}
+
+// SetAllocation chooses how the torrent's files are allocated, it applies from the
+// next Start. Only the file storage the client uses by default supports it.
+func (t *Torrent) SetAllocation(allocation peer.Allocation) error {
+	storage, ok := t.client.Config.Storage.(*peer.FileStorage)
+	if !ok {
+		return errors.New("Storage does not support allocation modes")
+	}
+	storage.SetAllocation(t.InfoHash(), allocation)
+	return nil
+}
+
+// AddTrackers adds announce URLs to the torrent's trackers. It fails while the
+// torrent is running.
+func (t *Torrent) AddTrackers(trackers []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		return errors.New("Trackers cannot be added while the torrent is running")
+	}
+	t.magnet.AddTrackers(trackers...)
+	return nil
+}
+
+// SelectFiles only downloads the files at indexes, in the order of Files. It can
+// be called before the metadata is known and applies from the next Start.
+func (t *Torrent) SelectFiles(indexes []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.selected = append([]int{}, indexes...)
+	t.applySelection()
+}
+
+// SetFilePriority changes how soon the file at index is downloaded,
+// peer.PriorityNone leaves it out. A running torrent is restarted for it to
+// apply, which fails once the torrent has finished.
+func (t *Torrent) SetFilePriority(index int, priority peer.Priority) error {
+	return t.SetFilePriorities(map[int]peer.Priority{index: priority})
+}
+
+// SetFilePriorities is SetFilePriority for several files at once, restarting a
+// running torrent only once
+func (t *Torrent) SetFilePriorities(priorities map[int]peer.Priority) error {
+	t.mu.Lock()
+	if t.priorities == nil {
+		t.priorities = map[int]peer.Priority{}
+	}
+	for index, priority := range priorities {
+		t.priorities[index] = priority
+	}
+	t.applySelection()
+	running := t.cancel != nil
+	t.mu.Unlock()
+	if !running {
+		return nil
+	}
+	t.Pause()
+	return t.Start()
+}
+
+// applySelection hands the wanted files and their priorities to the download
+// once there is one
+func (t *Torrent) applySelection() {
+	if t.download == nil || t.selected == nil && t.priorities == nil {
+		return
+	}
+	for i := range t.file.Metadata.FileList() {
+		t.download.SetFilePriority(i, t.filePriority(i))
+	}
+}
+
+// filePriority combines the selected files with the priorities of each
+func (t *Torrent) filePriority(index int) peer.Priority {
+	if p, ok := t.priorities[index]; ok {
+		return p
+	}
+	if t.selected == nil {
+		return peer.PriorityNormal
+	}
+	for _, selected := range t.selected {
+		if selected == index {
+			return peer.PriorityNormal
+		}
+	}
+	return peer.PriorityNone
+}
+
+// SetRateLimits caps the torrent's bytes per second, zero for unlimited
+func (t *Torrent) SetRateLimits(download, upload int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates[0], t.rates[1] = download, upload
+	t.applyRates()
+}
+
+// RateLimits returns the limits of SetRateLimits
+func (t *Torrent) RateLimits() (download, upload int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rates[0], t.rates[1]
+}
+
+// SetPeerRateLimits caps the bytes per second of each of the torrent's connections
+func (t *Torrent) SetPeerRateLimits(download, upload int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates[2], t.rates[3] = download, upload
+	t.applyRates()
+}
+
+// SetConnLimits caps the torrent's connections, dials in progress and unchoked
+// peers on top of the client's limits, zero for no cap of its own
+func (t *Torrent) SetConnLimits(maxConns, maxHalfOpen, maxUnchoked int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns = [3]int{maxConns, maxHalfOpen, maxUnchoked}
+	t.applyRates()
+}
+
+// applyRates hands the rate and connection limits to the download once there is one
+func (t *Torrent) applyRates() {
+	if t.download == nil {
+		return
+	}
+	t.download.DownloadLimit.SetRate(t.rates[0])
+	t.download.UploadLimit.SetRate(t.rates[1])
+	t.download.SetPeerRates(t.rates[2], t.rates[3])
+	t.download.SetConnLimits(t.conns[0], t.conns[1], t.conns[2])
+}
+
+// Start runs the torrent in the background until it completes or is paused
+func (t *Torrent) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return errors.New("Torrent has already finished")
+	default:
+	}
+	if t.cancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(t.client.ctx)
+	running := make(chan struct{})
+	t.cancel = cancel
+	t.running = running
+	go func() {
+		defer close(running)
+		err := t.run(ctx)
+		if ctx.Err() != nil {
+			// Tell the trackers we left, ctx itself is already done
+			stopCtx, cancel := context.WithTimeout(context.Background(), stopAnnounceTimeout)
+			t.magnet.AnnounceStopped(stopCtx)
+			cancel()
+		}
+		t.finish(ctx, err)
+	}()
+	return nil
+}
+
+// Pause stops the torrent's connections, Start resumes it
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	cancel, running := t.cancel, t.running
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-running
+}
+
+// Stop pauses the torrent for good and removes it from its client
+func (t *Torrent) Stop() {
+	t.Pause()
+	t.mu.Lock()
+	stopped := false
+	select {
+	case <-t.done:
+	default:
+		t.state = StateStopped
+		t.err = ErrStopped
+		close(t.done)
+		stopped = true
+	}
+	t.mu.Unlock()
+	if stopped {
+		t.publishState(StateStopped)
+	}
+	t.client.remove(t)
+}
+
+// Wait blocks until the torrent completes, fails or is stopped, or ctx is done
+func (t *Torrent) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Err is why the torrent failed, or ErrStopped, nil while it can still run
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Stats returns a snapshot of the torrent's progress
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	stats := Stats{State: t.state}
+	download := t.download
+	t.mu.Unlock()
+	if download == nil {
+		stats.Files = t.Files()
+		return stats
+	}
+	ds := download.Stats()
+	stats.PiecesCompleted, stats.Pieces = ds.PiecesCompleted, ds.Pieces
+	stats.Downloaded, stats.DownloadRate, stats.ETA = ds.Downloaded, ds.DownloadRate, ds.ETA
+	stats.Uploaded, stats.UploadRate = ds.Uploaded, ds.UploadRate
+	stats.Peers, stats.KnownPeers = ds.Peers, ds.KnownPeers
+	stats.Files = toFiles(ds.Files)
+	for _, f := range ds.Files {
+		stats.BytesTotal += f.Length
+		stats.BytesCompleted += f.Completed
+	}
+	return stats
+}
+
+// Peers returns a snapshot of the connected peers, none while the torrent is
+// not running
+func (t *Torrent) Peers() []peer.PeerStats {
+	t.mu.Lock()
+	download := t.download
+	running := t.cancel != nil
+	t.mu.Unlock()
+	if download == nil || !running {
+		return nil
+	}
+	return download.Peers()
+}
+
+// Pieces returns the verified pieces, empty until the metadata is known
+func (t *Torrent) Pieces() peer.Bitfield {
+	t.mu.Lock()
+	download := t.download
+	t.mu.Unlock()
+	if download == nil {
+		return peer.Bitfield{}
+	}
+	return download.Have()
+}
+
+// Trackers reports the last announce to each of the torrent's trackers
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trackers := make([]TrackerStatus, len(t.magnet.Trackers))
+	for i, url := range t.magnet.Trackers {
+		trackers[i] = t.trackers[url]
+		trackers[i].URL = url
+	}
+	return trackers
+}
+
+// onTrackerEvent records the result of an announce before publishing it,
+// announces run in parallel so it is called from several goroutines
+func (t *Torrent) onTrackerEvent(e peer.Event) {
+	if e.Type == peer.EventTrackerAnnounce {
+		t.mu.Lock()
+		if t.trackers == nil {
+			t.trackers = map[string]TrackerStatus{}
+		}
+		t.trackers[e.Tracker] = TrackerStatus{
+			URL:       e.Tracker,
+			Announced: e.Time,
+			Seeders:   e.Seeders,
+			Leechers:  e.Leechers,
+			Peers:     e.NumPeers,
+			Err:       e.Err,
+		}
+		t.mu.Unlock()
+	}
+	t.publish(e)
+}
+
+// Files lists the torrent's files, empty until the metadata is known
+func (t *Torrent) Files() []File {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var progress []peer.FileProgress
+	if t.download != nil {
+		progress = t.download.Files()
+	} else if t.file.Metadata != nil {
+		for i, f := range t.file.Metadata.FileList() {
+			priority := t.filePriority(i)
+			progress = append(progress, peer.FileProgress{TorrentFile: f, Wanted: priority != peer.PriorityNone, Priority: priority})
+		}
+	}
+	return toFiles(progress)
+}
+
+func toFiles(progress []peer.FileProgress) []File {
+	files := make([]File, len(progress))
+	for i, f := range progress {
+		files[i] = File{
+			Path:      strings.Join(f.Path, "/"),
+			Length:    f.Length,
+			Completed: f.Completed,
+			Wanted:    f.Wanted,
+			Priority:  f.Priority,
+			Padding:   f.Padding(),
+		}
+	}
+	return files
+}
+
+func (t *Torrent) setState(state State) {
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+	t.publishState(state)
+}
+
+func (t *Torrent) addConn(conn net.Conn) {
+	t.mu.Lock()
+	download := t.download
+	t.mu.Unlock()
+	if download == nil {
+		conn.Close()
+		return
+	}
+	download.AddConn(conn)
+}
+
+func (t *Torrent) run(ctx context.Context) error {
+	t.setState(StateFetchingMetadata)
+	peers, err := t.magnet.RequestPeers(ctx)
+	t.mu.Lock()
+	haveMetadata := t.file.Metadata != nil
+	t.mu.Unlock()
+	if err != nil && !haveMetadata {
+		return err
+	}
+	t.AddPeers(peers)
+	if !haveMetadata {
+		t.mu.Lock()
+		fetch := &peer.File{InfoHash: t.file.InfoHash, Name: t.file.Name, Peers: t.file.Peers}
+		t.mu.Unlock()
+		err = fetch.GetMetadata(ctx, t.client.limits)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.file.Metadata = fetch.Metadata
+		t.mu.Unlock()
+		t.publish(peer.NewEvent(peer.EventMetadataReceived, t.InfoHash()))
+	}
+
+	t.mu.Lock()
+	if t.download == nil {
+		t.download, err = peer.NewDownload(t.file, t.client.cache, t.client.limits)
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		t.download.OnEvent = t.onDownloadEvent
+		t.download.Seed = t.client.Config.Seed
+		t.applyRates()
+		t.applySelection()
+		stats := t.download.Stats()
+		t.announcedCompleted = stats.BytesCompleted == stats.BytesWanted
+	}
+	download := t.download
+	t.mu.Unlock()
+	t.setState(StateDownloading)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go t.reannounce(ctx)
+	return download.Run(ctx)
+}
+
+// onDownloadEvent publishes the download's events, a seeding download only
+// reports completion rather than return
+func (t *Torrent) onDownloadEvent(e peer.Event) {
+	t.publish(e)
+	if e.Type != peer.EventCompleted {
+		return
+	}
+	if t.client.Config.Seed {
+		t.setState(StateSeeding)
+	}
+	t.mu.Lock()
+	announce := !t.announcedCompleted
+	t.announcedCompleted = true
+	t.mu.Unlock()
+	if announce {
+		go func() {
+			ctx, cancel := context.WithTimeout(t.client.ctx, completedAnnounceTimeout)
+			defer cancel()
+			t.magnet.AnnounceCompleted(ctx)
+		}()
+	}
+}
+
+// announceStats is what trackers are told of the torrent's transfer, its size
+// is known once the download exists
+func (t *Torrent) announceStats() (magneturi.AnnounceStats, bool) {
+	t.mu.Lock()
+	download := t.download
+	t.mu.Unlock()
+	if download == nil {
+		return magneturi.AnnounceStats{}, false
+	}
+	stats := download.Stats()
+	return magneturi.AnnounceStats{
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.BytesWanted - stats.BytesCompleted,
+	}, true
+}
+
+func (t *Torrent) reannounce(ctx context.Context) {
+	ticker := time.NewTicker(reannounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			peers, err := t.magnet.RequestPeers(ctx)
+			if err == nil {
+				t.AddPeers(peers)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// finish records how a run ended, a paused run leaves the torrent resumable
+func (t *Torrent) finish(ctx context.Context, err error) {
+	t.mu.Lock()
+	t.cancel = nil
+	if ctx.Err() != nil {
+		paused := t.state != StateStopped
+		if paused {
+			t.state = StatePaused
+		}
+		t.mu.Unlock()
+		if paused {
+			t.publishState(StatePaused)
+		}
+		return
+	}
+	state := StateCompleted
+	if err != nil {
+		state = StateFailed
+		t.err = err
+	}
+	t.state = state
+	close(t.done)
+	t.mu.Unlock()
+	t.publishState(state)
+}
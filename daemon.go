@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/laurentlousky/stream/rpc"
+)
+
+// shutdownTimeout is how long the daemon waits for calls in progress when it stops
+const shutdownTimeout = 5 * time.Second
+
+// runDaemon runs torrents in the background until interrupted, for the other
+// commands and Transmission remotes to control over RPC
+func runDaemon(args []string) error {
+	flags := newFlagSet("daemon")
+	dir := flags.String("o", "downloads", "directory to save the torrents in")
+	seed := flags.Bool("seed", false, "keep seeding torrents once downloaded")
+	socket := flags.String("socket", defaultSocket(), "Unix socket to serve RPC on, empty to disable")
+	listen := flags.String("listen", "", "HTTP address to serve RPC on as well, like 127.0.0.1:9091")
+	auth := flags.String("auth", os.Getenv("BITTY_RPC_AUTH"), "user:password HTTP callers have to give, required to -listen beyond loopback")
+	cf := addClientFlags(flags)
+	err := parseArgs(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if *socket == "" && *listen == "" {
+		return usageFailure(flags, errors.New("-socket or -listen is required"))
+	}
+	user, password, _ := strings.Cut(*auth, ":")
+	if *auth != "" && password == "" {
+		return usageFailure(flags, errors.New("-auth needs a user:password"))
+	}
+	if *listen != "" && password == "" && !isLoopback(*listen) {
+		return usageFailure(flags, fmt.Errorf("Anyone who can reach %s could control the daemon, give -auth or listen on 127.0.0.1", *listen))
+	}
+	c, err := cf.newClient(flags, *dir, *seed)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if *socket != "" {
+		l, err := listenUnix(*socket)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	for _, arg := range flags.Args() {
+		t, err := addTorrent(c, arg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		t.AddTrackers(cf.Trackers)
+		t.Start()
+	}
+
+	mux := http.NewServeMux()
+	rpcServer := rpc.NewServer(c)
+	rpcServer.Username, rpcServer.Password = user, password
+	mux.Handle(rpc.Path, rpcServer)
+	server := &http.Server{Handler: mux}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		if !*cf.Quiet {
+			fmt.Printf("RPC listening on %s %s \n", l.Addr().Network(), l.Addr())
+		}
+		go func(l net.Listener) { errs <- server.Serve(l) }(l)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	events, unsubscribe := c.Subscribe(256)
+	defer unsubscribe()
+	for running := true; running; {
+		select {
+		case e := <-events:
+			line := describeEvent(e, *cf.Verbose)
+			if line != "" && !*cf.Quiet {
+				fmt.Printf("%s %s: %s \n", time.Now().Format("2006-01-02 15:04:05"), e.Torrent.Name(), line)
+			}
+		case err = <-errs:
+			running = false
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	if !*cf.Quiet {
+		fmt.Println("Stopping torrents...")
+	}
+	// Being stopped is how a daemon is meant to end
+	return err
+}
+
+// defaultSocket is the Unix socket the daemon listens on unless told otherwise
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "bitty.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bitty-%d.sock", os.Getuid()))
+}
+
+// daemonAddr is where the other commands look for a daemon, BITTY_RPC names
+// another socket or an http:// URL
+func daemonAddr() string {
+	if addr := os.Getenv("BITTY_RPC"); addr != "" {
+		return addr
+	}
+	return defaultSocket()
+}
+
+// isLoopback is whether a listen address only takes connections from this machine
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// listenUnix listens on a socket only its owner can connect to, replacing the
+// socket of a daemon that did not exit cleanly
+func listenUnix(path string) (net.Listener, error) {
+	if dialDaemon(path) != nil {
+		return nil, fmt.Errorf("A daemon is already running on %s", path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
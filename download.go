@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// runDownload downloads torrents until they all complete, or seeds them on
+// with -seed until interrupted. A running daemon is handed the torrents instead.
+func runDownload(args []string) error {
+	flags := newFlagSet("download")
+	dir := flags.String("o", "downloads", "directory to save the torrents in")
+	files := flags.String("files", "", "indexes of the files to download as listed by info, like 0,2-4 (default all)")
+	seed := flags.Bool("seed", false, "keep seeding once downloaded, until interrupted")
+	local := flags.Bool("local", false, "download here even when a daemon is running, which otherwise takes the torrents")
+	cf := addClientFlags(flags)
+	err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	selection, err := parseSelection(*files)
+	if err != nil {
+		return usageFailure(flags, err)
+	}
+	if !*local {
+		if d := dialDaemon(daemonAddr()); d != nil {
+			return addToDaemon(d, flags, selection, cf)
+		}
+	}
+	c, err := cf.newClient(flags, *dir, *seed)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var torrents []*client.Torrent
+	for _, arg := range flags.Args() {
+		t, err := addTorrent(c, arg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		t.AddTrackers(cf.Trackers)
+		if selection != nil {
+			t.SelectFiles(selection)
+		}
+		torrents = append(torrents, t)
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	for _, t := range torrents {
+		t.Start()
+	}
+	return watch(ctx, c, torrents, cf)
+}
+
+// runSeed checks the data of a .torrent already on disk, then seeds it,
+// downloading whatever is missing or corrupt first
+func runSeed(args []string) error {
+	flags := newFlagSet("seed")
+	dir := flags.String("o", "downloads", "directory the torrent was saved in")
+	cf := addClientFlags(flags)
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	mi, err := readTorrentFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	c, err := cf.newClient(flags, *dir, true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	err = checkPieces(mi, *dir, *cf.Quiet)
+	if err != nil {
+		return err
+	}
+	return seedTorrent(c, mi, cf)
+}
+
+// runServe makes a torrent of local files and seeds them from where they are
+func runServe(args []string) error {
+	flags := newFlagSet("serve")
+	output := flags.String("torrent", "", "also write the .torrent to this path")
+	var webSeeds stringList
+	flags.Var(&webSeeds, "w", "web seed URL, can be repeated")
+	private := flags.Bool("private", false, "set the private flag")
+	cf := addClientFlags(flags)
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	root := filepath.Clean(flags.Arg(0))
+	// The torrent's files are found under the parent of root, by the torrent's name
+	c, err := cf.newClient(flags, filepath.Dir(root), true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	mi, err := peer.CreateTorrent(root, peer.CreateOptions{
+		Trackers: cf.Trackers,
+		WebSeeds: webSeeds,
+		Private:  *private,
+	})
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		err = writeTorrentFile(mi, *output)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(magneturi.FromTorrent(mi).String())
+	err = checkPieces(mi, filepath.Dir(root), *cf.Quiet)
+	if err != nil {
+		return err
+	}
+	return seedTorrent(c, mi, cf)
+}
+
+// seedTorrent seeds a torrent whose data has been checked until interrupted
+func seedTorrent(c *client.Client, mi *peer.MetaInfo, cf *clientFlags) error {
+	t, err := c.AddTorrent(mi)
+	if err != nil {
+		return err
+	}
+	t.AddTrackers(cf.Trackers)
+	ctx, stop := interruptContext()
+	defer stop()
+	t.Start()
+	return watch(ctx, c, []*client.Torrent{t}, cf)
+}
+
+// addTorrent adds a magnet link or a .torrent file to the client
+func addTorrent(c *client.Client, arg string) (*client.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return c.AddMagnet(arg)
+	}
+	return c.AddTorrentFile(arg)
+}
@@ -0,0 +1,159 @@
+package magneturi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/laurentlousky/stream/peer"
+)
+
+const (
+	httpTrackerTimeout = 30 * time.Second
+	// maxHTTPTrackerResponse bounds what is read of a tracker's response
+	maxHTTPTrackerResponse = 1 << 20
+)
+
+// httpEvents names the announce events in an HTTP tracker's query
+var httpEvents = map[int32]string{eventCompleted: "completed", eventStarted: "started", eventStopped: "stopped"}
+
+// isHTTPTracker is whether a tracker is announced to over HTTP (BEP 3)
+func isHTTPTracker(tracker string) bool {
+	return strings.HasPrefix(tracker, "http://") || strings.HasPrefix(tracker, "https://")
+}
+
+// announceResult is what a tracker answered an announce with
+type announceResult struct {
+	Peers    []peer.Peer
+	Seeders  int
+	Leechers int
+}
+
+// announceHTTP announces to an HTTP tracker. One request returns both the IPv4
+// and IPv6 peers, compact in peers and peers6 (BEP 7, BEP 23).
+func (m *MagnetURI) announceHTTP(ctx context.Context, tracker string, event int32) (announceResult, error) {
+	var response announceResult
+	req := m.newAnnounceRequest(event)
+	query := url.Values{}
+	query.Set("info_hash", string(req.InfoHash[:]))
+	query.Set("peer_id", string(req.PeerID[:]))
+	query.Set("port", strconv.Itoa(int(req.Port)))
+	query.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	query.Set("left", strconv.FormatInt(req.Left, 10))
+	query.Set("key", strconv.FormatUint(uint64(req.Key), 16))
+	query.Set("compact", "1")
+	if name, ok := httpEvents[event]; ok {
+		query.Set("event", name)
+	}
+	dict, err := httpTrackerRequest(ctx, tracker, query)
+	if err != nil {
+		return response, err
+	}
+	setAnnounced(announcedTorrent{tracker, "", m.InfoHash}, event)
+
+	response.Seeders, _ = dictInt(dict, "complete")
+	response.Leechers, _ = dictInt(dict, "incomplete")
+	switch peers := dict["peers"].(type) {
+	case string:
+		body := peers[:len(peers)-len(peers)%(net.IPv4len+2)]
+		response.Peers, err = peer.ParseCompactPeers([]byte(body), net.IPv4len)
+		if err != nil {
+			return response, err
+		}
+	case []interface{}:
+		// Trackers that ignore compact list dictionaries of ip and port
+		for _, entry := range peers {
+			entry, _ := entry.(map[string]interface{})
+			ip, _ := entry["ip"].(string)
+			port, ok := dictInt(entry, "port")
+			if p := (peer.Peer{IP: net.ParseIP(ip), Port: uint16(port)}); p.IP != nil && ok {
+				response.Peers = append(response.Peers, p)
+			}
+		}
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		body := peers6[:len(peers6)-len(peers6)%(net.IPv6len+2)]
+		peers, err := peer.ParseCompactPeers([]byte(body), net.IPv6len)
+		if err != nil {
+			return response, err
+		}
+		response.Peers = append(response.Peers, peers...)
+	}
+	return response, nil
+}
+
+// scrapeHTTP scrapes an HTTP tracker, whose scrape URL is its announce URL with
+// the last "announce" of the path replaced by "scrape"
+func (m *MagnetURI) scrapeHTTP(ctx context.Context, tracker string) ScrapeResult {
+	result := ScrapeResult{Tracker: tracker}
+	i := strings.LastIndex(tracker, "/")
+	if !strings.HasPrefix(tracker[i+1:], "announce") {
+		result.Err = fmt.Errorf("Tracker %s does not support scrape", tracker)
+		return result
+	}
+	scrapeURL := tracker[:i+1] + "scrape" + strings.TrimPrefix(tracker[i+1:], "announce")
+	dict, err := httpTrackerRequest(ctx, scrapeURL, url.Values{"info_hash": {string(m.InfoHash[:])}})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	file, ok := files[string(m.InfoHash[:])].(map[string]interface{})
+	if !ok {
+		result.Err = fmt.Errorf("Tracker %s does not know the torrent", tracker)
+		return result
+	}
+	result.Seeders, _ = dictInt(file, "complete")
+	result.Completed, _ = dictInt(file, "downloaded")
+	result.Leechers, _ = dictInt(file, "incomplete")
+	return result
+}
+
+// httpTrackerRequest adds query to a tracker URL, which may have a query of its
+// own, and decodes the bencoded dictionary it answers with
+func httpTrackerRequest(ctx context.Context, tracker string, query url.Values) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpTrackerTimeout)
+	defer cancel()
+	separator := "?"
+	if strings.Contains(tracker, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tracker+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker %s responded with %s", tracker, resp.Status)
+	}
+	decoded, err := bencode.Decode(io.LimitReader(resp.Body, maxHTTPTrackerResponse))
+	if err != nil {
+		return nil, fmt.Errorf("Tracker %s sent a bad response: %v", tracker, err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Tracker %s sent a bad response", tracker)
+	}
+	if failure, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: tracker, Message: failure}
+	}
+	return dict, nil
+}
+
+// dictInt reads an integer of a decoded bencode dictionary
+func dictInt(dict map[string]interface{}, key string) (int, bool) {
+	n, ok := dict[key].(int64)
+	return int(n), ok
+}
@@ -0,0 +1,50 @@
+package magneturi
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/laurentlousky/stream/peer"
+)
+
+func TestHTTPTracker(t *testing.T) {
+	tracker := NewTrackerServer(nil)
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+	infoHash := [20]byte{8}
+	v4 := peer.Peer{IP: net.ParseIP("192.0.2.1"), Port: 6881}
+	v6 := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	tracker.announce(infoHash, [20]byte{1}, v4, 0, eventStarted, 0, false)
+	tracker.announce(infoHash, [20]byte{2}, v6, 10, eventStarted, 0, false)
+
+	m := MagnetURI{InfoHash: infoHash, Trackers: []string{server.URL + "/announce"}}
+	var announces []peer.Event
+	m.OnEvent = func(e peer.Event) { announces = append(announces, e) }
+	got, err := m.RequestPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].IP.Equal(v4.IP) || !got[1].IP.Equal(v6.IP) {
+		t.Errorf("got peers %v want %s and %s", got, v4, v6)
+	}
+	if len(announces) != 1 || announces[0].Seeders != 1 || announces[0].Leechers != 2 {
+		t.Errorf("got announce events %+v want 1 seeder and 2 leechers", announces)
+	}
+
+	results := m.Scrape(context.Background())
+	if results[0].Err != nil || results[0].Seeders != 1 || results[0].Leechers != 2 {
+		t.Errorf("got scrape %+v want 1 seeder and 2 leechers", results[0])
+	}
+
+	m.AnnounceStopped(context.Background())
+	if results := m.Scrape(context.Background()); results[0].Leechers != 1 {
+		t.Errorf("got scrape %+v after stopping want 1 leecher", results[0])
+	}
+
+	m.Trackers = []string{server.URL + "/nowhere"}
+	if _, err := m.RequestPeers(context.Background()); err == nil {
+		t.Error("announcing to a missing tracker succeeded")
+	}
+}
@@ -1,7 +1,11 @@
 package magneturi
 
 import (
+	"bytes"
+	"context"
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
@@ -11,56 +15,161 @@ import (
 
 // MagnetURI https://en.wikipedia.org/wiki/Magnet_URI_scheme
 type MagnetURI struct {
-	InfoHash [20]byte // xt
+	InfoHash [20]byte // xt=urn:btih, or the v2 infohash truncated when there is only that
 	Name     string   // dn
 	Trackers []string // tr
+	WebSeeds []string // ws
+	// InfoHashV2 is the SHA-256 infohash of a v2 or hybrid torrent, xt=urn:btmh (BEP 52)
+	InfoHashV2 [32]byte
+	// Port is the port we accept peers on, announced to trackers. Zero when we
+	// do not accept peers, so trackers do not hand out an address nobody answers.
+	Port uint16
+	// UDPTracker overrides DefaultUDPTrackerConfig for this torrent's announces
+	UDPTracker *UDPTrackerConfig
+	// Stats reports the transfer that is announced, known is false while the
+	// size of the torrent is unknown. Without it nothing is announced as
+	// transferred.
+	Stats func() (stats AnnounceStats, known bool)
+	// OnEvent receives the result of every tracker announce, trackers are
+	// announced to in parallel so it may be called from several goroutines at once
+	OnEvent func(peer.Event)
 }
 
-// Parse converts a Magnet URI string into a MagnetURI struct
-func Parse(uri string) MagnetURI {
-	queryStr := strings.Split(uri, "magnet:?")[1]
-	params, err := url.ParseQuery(queryStr)
-	if err != nil {
-		panic(err)
+// Parse converts a Magnet URI string into a MagnetURI struct. It fails when uri
+// is not a magnet link or has no BitTorrent infohash.
+func Parse(uri string) (MagnetURI, error) {
+	if !strings.HasPrefix(uri, "magnet:?") {
+		return MagnetURI{}, fmt.Errorf("%q is not a magnet link", uri)
 	}
-	// TODO: Check that magnet uri is actually valid and UDP?
-	trackers := params["tr"]
-	for i := 0; i < len(trackers); i++ {
-		trackers[i] = strings.Split(trackers[i], "udp://")[1]
-		trackers[i] = strings.Trim(trackers[i], "/announce")
+	params, err := url.ParseQuery(strings.TrimPrefix(uri, "magnet:?"))
+	if err != nil {
+		return MagnetURI{}, err
 	}
 	magnetURI := MagnetURI{
-		Name:     params["dn"][0],
-		Trackers: trackers,
+		Name:     params.Get("dn"),
+		WebSeeds: params["ws"],
+	}
+	magnetURI.AddTrackers(params["tr"]...)
+	hasV1, hasV2 := false, false
+	for _, xt := range params["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			magnetURI.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return MagnetURI{}, err
+			}
+			hasV1 = true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			// A multihash, only SHA-256 (0x12) of 32 bytes (0x20) is used
+			multihash, _ := hex.DecodeString(strings.TrimPrefix(xt, "urn:btmh:"))
+			if len(multihash) == 34 && multihash[0] == 0x12 && multihash[1] == 0x20 {
+				copy(magnetURI.InfoHashV2[:], multihash[2:])
+				hasV2 = true
+			}
+		}
+	}
+	if !hasV1 && !hasV2 {
+		return MagnetURI{}, errors.New("Magnet link has no BitTorrent infohash")
 	}
-	infoHash, _ := hex.DecodeString(strings.Split(params["xt"][0], "urn:btih:")[1])
-	copy(magnetURI.InfoHash[:20], infoHash)
-	return magnetURI
+	if !hasV1 {
+		copy(magnetURI.InfoHash[:], magnetURI.InfoHashV2[:])
+	}
+	return magnetURI, nil
 }
 
-// Download a Magnet URI torrent to the file system
-func (m *MagnetURI) Download() error {
-	fmt.Println("Getting peers...")
-	peers, err := m.requestPeers()
-	file := &peer.File{
-		Name:     m.Name,
-		InfoHash: m.InfoHash,
-		Peers:    peers,
+// decodeInfoHash reads a v1 infohash in hex or, as some older links have it, in base32
+func decodeInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	b, err := hex.DecodeString(s)
+	if len(s) == 32 {
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
 	}
-	fmt.Println("Getting metadata...")
-	err = file.GetMetadata()
-	if err != nil {
-		return err
+	if err != nil || len(b) != len(infoHash) {
+		return infoHash, fmt.Errorf("Bad infohash %q in magnet link", s)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+// FromTorrent builds the magnet link of a torrent file
+func FromTorrent(mi *peer.MetaInfo) MagnetURI {
+	m := MagnetURI{
+		InfoHash:   mi.InfoHash,
+		InfoHashV2: mi.InfoHashV2,
+		Name:       mi.Info.Name,
+		WebSeeds:   mi.URLList,
 	}
-	fmt.Println("Preparing for download...")
-	err = file.Metadata.PrepareForDownload()
+	m.AddTrackers(mi.Trackers()...)
+	return m
+}
+
+// AddTrackers adds announce URLs to the torrent's trackers, skipping the ones it
+// already has. UDP trackers are kept as host:port.
+func (m *MagnetURI) AddTrackers(trackers ...string) {
+	for _, tracker := range trackers {
+		if strings.HasPrefix(tracker, "udp://") {
+			tracker = strings.TrimPrefix(tracker, "udp://")
+			tracker = strings.TrimSuffix(tracker, "/announce")
+		}
+		known := false
+		for _, t := range m.Trackers {
+			known = known || t == tracker
+		}
+		if !known && tracker != "" {
+			m.Trackers = append(m.Trackers, tracker)
+		}
+	}
+}
+
+// String encodes the MagnetURI as a magnet link
+func (m MagnetURI) String() string {
+	var params []string
+	// A v2 only torrent has no v1 infohash, just the truncated v2 one
+	if m.InfoHashV2 == [32]byte{} || !bytes.Equal(m.InfoHash[:], m.InfoHashV2[:20]) {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.InfoHashV2 != [32]byte{} {
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	for _, tracker := range m.Trackers {
+		if !strings.Contains(tracker, "://") {
+			tracker = "udp://" + tracker + "/announce"
+		}
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Download a Magnet URI torrent's movie into storage, cancelling ctx stops it cleanly.
+// Progress is reported through onEvent, which is called from several goroutines.
+func (m MagnetURI) Download(ctx context.Context, storage peer.Storage, onEvent func(peer.Event)) error {
+	m.OnEvent = onEvent
+	peers, err := m.RequestPeers(ctx)
 	if err != nil {
 		return err
 	}
-	fmt.Println("Beginning download...")
-	peer.DownloadMovie(file)
+	// Leave the swarm even when ctx was cancelled, with a deadline of our own
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), stopAnnounceTimeout)
+		defer cancel()
+		m.AnnounceStopped(stopCtx)
+	}()
+	file := &peer.File{
+		Name:     m.Name,
+		InfoHash: m.InfoHash,
+		Peers:    peers,
+		WebSeeds: m.WebSeeds,
+	}
+	err = file.GetMetadata(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	onEvent(peer.NewEvent(peer.EventMetadataReceived, m.InfoHash))
+	return peer.DownloadMovie(ctx, file, storage, onEvent)
 }
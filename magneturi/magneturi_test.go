@@ -1,10 +1,16 @@
 package magneturi
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestParse(t *testing.T) {
 	magnetURI := "magnet:?xt=urn:btih:E7F6991C3DC80E62C986521EABCF03AF2420FC9A&dn=Hot%20Rod%20(2007)%20720p%20BrRip%20x264%20-%20YIFY&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969%2Fannounce&tr=udp%3A%2F%2F9.rarbg.to%3A2920%2Fannounce&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337&tr=udp%3A%2F%2Ftracker.internetwarriors.net%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.pirateparty.gr%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.cyberia.is%3A6969%2Fannounce"
-	got := Parse(magnetURI)
+	got, err := Parse(magnetURI)
+	if err != nil {
+		t.Fatal(err)
+	}
 	want := MagnetURI{
 		Name: "Hot Rod (2007) 720p BrRip x264 - YIFY",
 	}
@@ -27,3 +33,70 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestString(t *testing.T) {
+	m := MagnetURI{
+		InfoHash: [20]byte{0xe7, 0xf6},
+		Name:     "Some Name (2020)",
+		Trackers: []string{"tracker.example.com:6969"},
+		WebSeeds: []string{"http://mirror.example/files/"},
+	}
+	got, err := Parse(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHash != m.InfoHash || got.Name != m.Name {
+		t.Errorf("got %+v want %+v from %s", got, m, m.String())
+	}
+	if len(got.Trackers) != 1 || got.Trackers[0] != m.Trackers[0] {
+		t.Errorf("got trackers %v want %v", got.Trackers, m.Trackers)
+	}
+	if len(got.WebSeeds) != 1 || got.WebSeeds[0] != m.WebSeeds[0] {
+		t.Errorf("got web seeds %v want %v", got.WebSeeds, m.WebSeeds)
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	v2 := "1220" + strings.Repeat("ab", 32)
+	got, err := Parse("magnet:?xt=urn:btmh:" + v2 + "&dn=v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHashV2[0] != 0xab || got.InfoHash[19] != 0xab {
+		t.Errorf("got infohashes %x and %x", got.InfoHash, got.InfoHashV2)
+	}
+	if s := got.String(); strings.Contains(s, "btih") || !strings.Contains(s, "urn:btmh:"+v2) {
+		t.Errorf("v2 only magnet encoded as %s", s)
+	}
+
+	hybrid, err := Parse("magnet:?xt=urn:btih:" + strings.Repeat("cd", 20) + "&xt=urn:btmh:" + v2 + "&dn=hybrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hybrid.InfoHash[0] != 0xcd || hybrid.InfoHashV2[0] != 0xab {
+		t.Errorf("got infohashes %x and %x", hybrid.InfoHash, hybrid.InfoHashV2)
+	}
+	if again, _ := Parse(hybrid.String()); again.InfoHash != hybrid.InfoHash || again.InfoHashV2 != hybrid.InfoHashV2 {
+		t.Errorf("hybrid magnet %s did not round trip", hybrid.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, uri := range []string{"", "magnet:", "http://example.com/?xt=urn:btih:" + strings.Repeat("ab", 20),
+		"magnet:?dn=name", "magnet:?xt=urn:btih:abcd", "magnet:?xt=urn:btih:" + strings.Repeat("zz", 20), "magnet:?xt=%zz"} {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("%q was accepted", uri)
+		}
+	}
+	// Base32 infohashes of older links, and trackers of any scheme
+	got, err := Parse("magnet:?xt=urn:btih:" + strings.Repeat("AE", 16) + "&tr=http%3A%2F%2Ft.example%2Fannounce&tr=udp%3A%2F%2Fannounce.example%3A80%2Fannounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHash[0] != 0x01 || got.Name != "" {
+		t.Errorf("got %+v", got)
+	}
+	if len(got.Trackers) != 2 || got.Trackers[0] != "http://t.example/announce" || got.Trackers[1] != "announce.example:80" {
+		t.Errorf("got trackers %q", got.Trackers)
+	}
+}
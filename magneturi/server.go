@@ -0,0 +1,390 @@
+package magneturi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/laurentlousky/stream/peer"
+)
+
+const (
+	actionScrape            = 2
+	defaultNumWant          = 50
+	maxNumWant              = 200
+	scrapeRequestSize       = 16
+	maxScrapeInfoHashes     = 74 // the most that fit in a single UDP scrape response
+	connectionIDWindow      = time.Minute
+	sweepInterval           = time.Minute
+	defaultAnnounceInterval = 30 * time.Minute
+)
+
+// TrackerServer is a BitTorrent tracker that keeps swarms in memory and answers
+// UDP (BEP 15) and HTTP announce and scrape requests
+type TrackerServer struct {
+	// Interval is how long peers are told to wait between announces
+	Interval time.Duration
+	// PeerTimeout is how long a peer stays in a swarm without announcing again
+	PeerTimeout time.Duration
+	// AllowList restricts the tracker to these infohashes when it is not empty
+	AllowList map[[20]byte]bool
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	completed map[[20]byte]int // by infohash, kept once its swarm is forgotten
+	lastSweep time.Time
+	secret    [20]byte
+}
+
+type swarm struct {
+	Peers map[string]*swarmPeer
+}
+
+type swarmPeer struct {
+	Peer      peer.Peer
+	PeerID    [20]byte
+	Left      int64
+	LastSeen  time.Time
+	Completed bool // already counted in completed
+}
+
+type scrapeResponseEntry struct {
+	Seeders   int32
+	Completed int32
+	Leechers  int32
+}
+
+// NewTrackerServer creates a tracker, allowing every infohash if allowList is empty
+func NewTrackerServer(allowList [][20]byte) *TrackerServer {
+	t := &TrackerServer{
+		Interval:    defaultAnnounceInterval,
+		PeerTimeout: 2 * defaultAnnounceInterval,
+		swarms:      map[[20]byte]*swarm{},
+		completed:   map[[20]byte]int{},
+	}
+	if len(allowList) > 0 {
+		t.AllowList = map[[20]byte]bool{}
+		for _, infoHash := range allowList {
+			t.AllowList[infoHash] = true
+		}
+	}
+	rand.Read(t.secret[:])
+	return t
+}
+
+// announce records the peer in the infohash's swarm and returns up to numWant other
+// peers along with the swarm's seeder and leecher counts. UDP announces only get
+// peers of the address family they were sent over (sameFamily).
+func (t *TrackerServer) announce(infoHash [20]byte, peerID [20]byte, p peer.Peer, left int64,
+	event int32, numWant int, sameFamily bool) ([]peer.Peer, int, int, error) {
+	if t.AllowList != nil && !t.AllowList[infoHash] {
+		return nil, 0, 0, errors.New("Torrent is not tracked by this tracker")
+	}
+	if numWant <= 0 || numWant > maxNumWant {
+		numWant = defaultNumWant
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep()
+	s, ok := t.swarms[infoHash]
+	if !ok {
+		s = &swarm{Peers: map[string]*swarmPeer{}}
+		t.swarms[infoHash] = s
+	}
+	t.expire(s)
+	key := p.String()
+	if event == eventStopped {
+		delete(s.Peers, key)
+	} else {
+		sp := s.Peers[key]
+		if sp == nil {
+			sp = &swarmPeer{Peer: p}
+			s.Peers[key] = sp
+		}
+		// Clients repeat completed when an announce is retried
+		if event == eventCompleted && !sp.Completed {
+			sp.Completed = true
+			t.completed[infoHash]++
+		}
+		sp.Peer, sp.PeerID, sp.Left, sp.LastSeen = p, peerID, left, time.Now()
+	}
+	var peers []peer.Peer
+	isIPv4 := p.IP.To4() != nil
+	for k, sp := range s.Peers {
+		if len(peers) >= numWant {
+			break
+		}
+		// A peer that announced port 0 does not accept connections, it is only counted
+		if k == key || sp.Peer.Port == 0 || (sameFamily && (sp.Peer.IP.To4() != nil) != isIPv4) {
+			continue
+		}
+		peers = append(peers, sp.Peer)
+	}
+	seeders, leechers := s.counts()
+	if len(s.Peers) == 0 && t.AllowList == nil {
+		delete(t.swarms, infoHash)
+	}
+	return peers, seeders, leechers, nil
+}
+
+// scrape returns the seeders, completed downloads and leechers of each infohash
+func (t *TrackerServer) scrape(infoHashes [][20]byte) []scrapeResponseEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]scrapeResponseEntry, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		entries[i].Completed = int32(t.completed[infoHash])
+		s, ok := t.swarms[infoHash]
+		if !ok {
+			continue
+		}
+		t.expire(s)
+		seeders, leechers := s.counts()
+		entries[i].Seeders, entries[i].Leechers = int32(seeders), int32(leechers)
+	}
+	return entries
+}
+
+// expire drops peers that have not announced within PeerTimeout
+func (t *TrackerServer) expire(s *swarm) {
+	for key, sp := range s.Peers {
+		if time.Since(sp.LastSeen) > t.PeerTimeout {
+			delete(s.Peers, key)
+		}
+	}
+}
+
+// sweep expires every swarm once a sweepInterval, and forgets the empty ones
+// unless there is an allow list. Otherwise each infohash ever announced would
+// be kept for good.
+func (t *TrackerServer) sweep() {
+	if time.Since(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = time.Now()
+	for infoHash, s := range t.swarms {
+		t.expire(s)
+		if len(s.Peers) == 0 && t.AllowList == nil {
+			delete(t.swarms, infoHash)
+		}
+	}
+}
+
+func (s *swarm) counts() (int, int) {
+	seeders, leechers := 0, 0
+	for _, sp := range s.Peers {
+		if sp.Left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// connectionID is derived from the client's address and the current window so it
+// can be validated without storing it, it stays valid for up to two windows
+func (t *TrackerServer) connectionID(ip net.IP, window int64) int64 {
+	h := sha1.New()
+	h.Write(t.secret[:])
+	h.Write(ip.To16())
+	binary.Write(h, binary.BigEndian, window)
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)))
+}
+
+func (t *TrackerServer) validConnectionID(ip net.IP, id int64) bool {
+	window := time.Now().Unix() / int64(connectionIDWindow/time.Second)
+	return id == t.connectionID(ip, window) || id == t.connectionID(ip, window-1)
+}
+
+// ServeUDP answers UDP tracker requests read from conn until it is closed
+func (t *TrackerServer) ServeUDP(conn net.PacketConn) error {
+	readData := make([]byte, bufferSize)
+	for {
+		bytesRead, addr, err := conn.ReadFrom(readData)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		response := t.handleUDP(readData[:bytesRead], udpAddr)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (t *TrackerServer) handleUDP(data []byte, addr *net.UDPAddr) []byte {
+	var header connectionRequest
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &header)
+	if err != nil {
+		return nil
+	}
+	writeBuffer := bytes.NewBuffer(make([]byte, 0, bufferSize))
+	if header.Action == actionConnect {
+		if header.ConnectionID != connectionID {
+			return nil
+		}
+		window := time.Now().Unix() / int64(connectionIDWindow/time.Second)
+		binary.Write(writeBuffer, binary.BigEndian, connectionResponse{
+			Action:        actionConnect,
+			TransactionID: header.TransactionID,
+			ConnectionID:  t.connectionID(addr.IP, window),
+		})
+		return writeBuffer.Bytes()
+	}
+	if !t.validConnectionID(addr.IP, header.ConnectionID) {
+		return udpError(header.TransactionID, "Connection ID expired")
+	}
+	switch header.Action {
+	case actionAnnounce:
+		var req announceRequest
+		err = binary.Read(bytes.NewReader(data), binary.BigEndian, &req)
+		if err != nil {
+			return udpError(header.TransactionID, "Malformed announce request")
+		}
+		p := peer.Peer{IP: addr.IP, Port: req.Port}
+		peers, seeders, leechers, err := t.announce(req.InfoHash, req.PeerID, p, req.Left, req.Event, int(req.NumWant), true)
+		if err != nil {
+			return udpError(header.TransactionID, err.Error())
+		}
+		binary.Write(writeBuffer, binary.BigEndian, announceResponseHeader{
+			Action:        actionAnnounce,
+			TransactionID: header.TransactionID,
+			Interval:      int32(t.Interval / time.Second),
+			Leechers:      int32(leechers),
+			Seeders:       int32(seeders),
+		})
+		for _, p := range peers {
+			compact := p.Compact()
+			if writeBuffer.Len()+len(compact) > bufferSize {
+				break
+			}
+			writeBuffer.Write(compact)
+		}
+	case actionScrape:
+		body := data[scrapeRequestSize:]
+		infoHashes := make([][20]byte, 0, len(body)/20)
+		for i := 0; i+20 <= len(body) && len(infoHashes) < maxScrapeInfoHashes; i += 20 {
+			var infoHash [20]byte
+			copy(infoHash[:], body[i:i+20])
+			infoHashes = append(infoHashes, infoHash)
+		}
+		binary.Write(writeBuffer, binary.BigEndian, errorResponseHeader{
+			Action:        actionScrape,
+			TransactionID: header.TransactionID,
+		})
+		binary.Write(writeBuffer, binary.BigEndian, t.scrape(infoHashes))
+	default:
+		return udpError(header.TransactionID, fmt.Sprintf("Unknown action %d", header.Action))
+	}
+	return writeBuffer.Bytes()
+}
+
+func udpError(transactionID int32, message string) []byte {
+	writeBuffer := bytes.NewBuffer(make([]byte, 0, bufferSize))
+	binary.Write(writeBuffer, binary.BigEndian, errorResponseHeader{
+		Action:        actionError,
+		TransactionID: transactionID,
+	})
+	writeBuffer.WriteString(message)
+	return writeBuffer.Bytes()
+}
+
+// ServeHTTP answers HTTP tracker requests on /announce and /scrape. Peers are always
+// returned in the compact format, IPv6 peers under peers6 (BEP 7, BEP 23)
+func (t *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var response map[string]interface{}
+	var err error
+	switch r.URL.Path {
+	case "/announce":
+		response, err = t.httpAnnounce(r)
+	case "/scrape":
+		response, err = t.httpScrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		response = map[string]interface{}{"failure reason": err.Error()}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	bencode.Marshal(w, response)
+}
+
+func (t *TrackerServer) httpAnnounce(r *http.Request) (map[string]interface{}, error) {
+	query := r.URL.Query()
+	var infoHash, peerID [20]byte
+	if len(query.Get("info_hash")) != 20 || len(query.Get("peer_id")) != 20 {
+		return nil, errors.New("info_hash and peer_id must be 20 bytes")
+	}
+	copy(infoHash[:], query.Get("info_hash"))
+	copy(peerID[:], query.Get("peer_id"))
+	portNum, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return nil, errors.New("Invalid port")
+	}
+	// Without left a peer would count as a seeder
+	left, err := strconv.ParseInt(query.Get("left"), 10, 64)
+	if err != nil || left < 0 {
+		return nil, errors.New("Invalid left")
+	}
+	numWant, _ := strconv.Atoi(query.Get("numwant"))
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	events := map[string]int32{"started": eventStarted, "completed": eventCompleted, "stopped": eventStopped}
+	p := peer.Peer{IP: net.ParseIP(host), Port: uint16(portNum)}
+	peers, seeders, leechers, err := t.announce(infoHash, peerID, p, left, events[query.Get("event")], numWant, false)
+	if err != nil {
+		return nil, err
+	}
+	var peers4, peers6 bytes.Buffer
+	for _, p := range peers {
+		if p.IP.To4() != nil {
+			peers4.Write(p.Compact())
+		} else {
+			peers6.Write(p.Compact())
+		}
+	}
+	return map[string]interface{}{
+		"interval":   int(t.Interval / time.Second),
+		"complete":   seeders,
+		"incomplete": leechers,
+		"peers":      peers4.String(),
+		"peers6":     peers6.String(),
+	}, nil
+}
+
+func (t *TrackerServer) httpScrape(r *http.Request) (map[string]interface{}, error) {
+	var infoHashes [][20]byte
+	for _, s := range r.URL.Query()["info_hash"] {
+		if len(s) != 20 {
+			return nil, errors.New("info_hash must be 20 bytes")
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], s)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	files := map[string]interface{}{}
+	for i, entry := range t.scrape(infoHashes) {
+		files[string(infoHashes[i][:])] = map[string]interface{}{
+			"complete":   int(entry.Seeders),
+			"downloaded": int(entry.Completed),
+			"incomplete": int(entry.Leechers),
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
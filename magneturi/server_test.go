@@ -0,0 +1,188 @@
+package magneturi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/laurentlousky/stream/peer"
+)
+
+func newTestTrackerServer(t *testing.T, allowList [][20]byte) (*TrackerServer, string) {
+	tracker := NewTrackerServer(allowList)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tracker.ServeUDP(conn)
+	t.Cleanup(func() { conn.Close() })
+	return tracker, conn.LocalAddr().String()
+}
+
+func testAnnounce(t *testing.T, addr string, infoHash [20]byte, peerID string, port uint16) (announceResponse, error) {
+	s := &trackerSession{Tracker: addr, Network: "udp4", Config: testTrackerConfig}
+	t.Cleanup(s.close)
+	m := MagnetURI{InfoHash: infoHash}
+	req := m.newAnnounceRequest(eventNone)
+	copy(req.PeerID[:], peerID)
+	req.Port = port
+	return s.announce(context.Background(), req)
+}
+
+func TestTrackerServerUDP(t *testing.T) {
+	_, addr := newTestTrackerServer(t, nil)
+	infoHash := [20]byte{1}
+	if _, err := testAnnounce(t, addr, infoHash, "-AA0001-000000000001", 1000); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := testAnnounce(t, addr, infoHash, "-AA0001-000000000002", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.body.Peers) != 1 || resp.body.Peers[0].Port != 1000 {
+		t.Errorf("got peers %v want the first announcer", resp.body.Peers)
+	}
+	if resp.header.Leechers != 2 {
+		t.Errorf("got %d leechers want 2", resp.header.Leechers)
+	}
+	// A client that does not listen announces port 0 and is not handed out
+	if req := (&MagnetURI{}).newAnnounceRequest(eventNone); req.Port != 0 {
+		t.Errorf("announced port %d without one set", req.Port)
+	}
+	if _, err := testAnnounce(t, addr, infoHash, "-AA0001-000000000003", 0); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = testAnnounce(t, addr, infoHash, "-AA0001-000000000002", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.body.Peers) != 1 || resp.header.Leechers != 3 {
+		t.Errorf("got peers %v and %d leechers, want the port 0 peer only counted", resp.body.Peers, resp.header.Leechers)
+	}
+
+	// Scrape the swarm over the same UDP session machinery
+	s := &trackerSession{Tracker: addr, Network: "udp4", Config: testTrackerConfig}
+	defer s.close()
+	if err := s.connect(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	req := bytes.NewBuffer(nil)
+	transactionID := newTransactionID()
+	binary.Write(req, binary.BigEndian, connectionRequest{s.ConnectionID, actionScrape, transactionID})
+	req.Write(infoHash[:])
+	data, err := s.request(context.Background(), req.Bytes(), transactionID, testTrackerConfig.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry scrapeResponseEntry
+	binary.Read(bytes.NewReader(data[8:]), binary.BigEndian, &entry)
+	if entry.Leechers != 3 || entry.Seeders != 0 {
+		t.Errorf("got scrape %+v want 3 leechers", entry)
+	}
+}
+
+func TestTrackerServerAllowList(t *testing.T) {
+	_, addr := newTestTrackerServer(t, [][20]byte{{1}})
+	_, err := testAnnounce(t, addr, [20]byte{2}, "-AA0001-000000000001", 1000)
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) {
+		t.Fatalf("got error %v want a TrackerError", err)
+	}
+}
+
+func TestTrackerServerHTTP(t *testing.T) {
+	tracker := NewTrackerServer(nil)
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+	infoHash := [20]byte{3}
+	v6 := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	tracker.announce(infoHash, [20]byte{9}, v6, 0, eventStarted, 0, false)
+
+	query := url.Values{}
+	query.Set("info_hash", string(infoHash[:]))
+	query.Set("peer_id", "-AA0001-000000000001")
+	query.Set("port", "1000")
+	query.Set("left", "10")
+	query.Set("compact", "1")
+	resp, err := http.Get(server.URL + "/announce?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Complete   int    `bencode:"complete"`
+		Incomplete int    `bencode:"incomplete"`
+		Peers6     string `bencode:"peers6"`
+	}
+	if err := bencode.Unmarshal(resp.Body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Complete != 1 || got.Incomplete != 1 {
+		t.Errorf("got %d complete and %d incomplete want 1 and 1", got.Complete, got.Incomplete)
+	}
+	if !bytes.Equal([]byte(got.Peers6), v6.Compact()) {
+		t.Errorf("got peers6 %x want %x", got.Peers6, v6.Compact())
+	}
+}
+
+func TestScrape(t *testing.T) {
+	_, addr := newTestTrackerServer(t, nil)
+	m := MagnetURI{InfoHash: [20]byte{4}, Trackers: []string{addr}, UDPTracker: &testTrackerConfig}
+	if _, err := m.RequestPeers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	results := m.Scrape(context.Background())
+	if len(results) != 1 || results[0].Err != nil || results[0].Leechers != 1 || results[0].Seeders != 0 {
+		t.Errorf("got scrape %+v want 1 leecher", results)
+	}
+}
+
+func TestTrackerServerSwarms(t *testing.T) {
+	tracker := NewTrackerServer(nil)
+	infoHash := [20]byte{5}
+	p := peer.Peer{IP: net.ParseIP("192.0.2.1"), Port: 6881}
+	tracker.announce(infoHash, [20]byte{1}, p, 10, eventStarted, 0, false)
+	// A retried completed announce counts once
+	for i := 0; i < 2; i++ {
+		tracker.announce(infoHash, [20]byte{1}, p, 0, eventCompleted, 0, false)
+	}
+	if got := tracker.scrape([][20]byte{infoHash})[0]; got.Completed != 1 || got.Seeders != 1 {
+		t.Errorf("got %+v want 1 completed and 1 seeder", got)
+	}
+	tracker.announce(infoHash, [20]byte{1}, p, 0, eventStopped, 0, false)
+	if len(tracker.swarms) != 0 {
+		t.Errorf("%d swarms left once every peer stopped", len(tracker.swarms))
+	}
+	if got := tracker.scrape([][20]byte{infoHash})[0]; got.Completed != 1 || got.Seeders != 0 {
+		t.Errorf("got %+v want the completed count kept after the swarm is gone", got)
+	}
+
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+	query := url.Values{}
+	query.Set("info_hash", string(infoHash[:]))
+	query.Set("peer_id", "-AA0001-000000000001")
+	query.Set("port", "1000")
+	resp, err := http.Get(server.URL + "/announce?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Failure string `bencode:"failure reason"`
+	}
+	if err := bencode.Unmarshal(resp.Body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failure == "" || len(tracker.swarms) != 0 {
+		t.Errorf("an announce without left got %q", got.Failure)
+	}
+}
@@ -2,32 +2,33 @@ package magneturi
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
-	"math"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/laurentlousky/stream/peer"
 )
 
 const (
-	port                    uint16 = 6888
-	bufferSize                     = 2048
-	connectionID                   = 0x41727101980
-	actionConnect                  = 0
-	actionAnnounce                 = 1
-	actionError                    = 3
-	eventNone                      = 0
-	eventCompleted                 = 1
-	eventStarted                   = 2
-	eventStopped                   = 3
-	announceMinResponseSize        = 20
-	peerSize                       = 6
-	maxRequestAttempts             = 2
+	bufferSize              = 2048
+	connectionID            = 0x41727101980
+	actionConnect           = 0
+	actionAnnounce          = 1
+	actionError             = 3
+	eventNone               = 0
+	eventCompleted          = 1
+	eventStarted            = 2
+	eventStopped            = 3
+	announceMinResponseSize = 20
+	errorMinResponseSize    = 8
+	connectionIDLifetime    = time.Minute
+	stopAnnounceTimeout     = 5 * time.Second
 )
 
 type connectionRequest struct {
@@ -74,143 +75,585 @@ type announceResponseBody struct {
 	Peers []peer.Peer
 }
 
-type client struct {
-	Socket  net.Conn
+type scrapeRequest struct {
+	ConnectionID  int64
+	Action        int32
+	TransactionID int32
+	InfoHash      [20]byte
+}
+
+// ScrapeResult is what a tracker knows of a torrent's swarm, or why it could not tell
+type ScrapeResult struct {
+	Tracker   string
+	Seeders   int
+	Completed int // downloads the tracker has seen finish
+	Leechers  int
+	Err       error
+}
+
+// errorResponseHeader precedes the human readable message of an actionError response
+type errorResponseHeader struct {
+	Action        int32
+	TransactionID int32
+}
+
+// UDPTrackerConfig controls how requests to UDP trackers are retransmitted
+type UDPTrackerConfig struct {
+	// Timeout is the base timeout, attempt n waits Timeout * 2^n for a response
+	Timeout time.Duration
+	// MaxRetransmits is the largest n tried before giving up on a request
+	MaxRetransmits int
+}
+
+// DefaultUDPTrackerConfig follows the 15 * 2^n (0-8) schedule from BEP 15
+var DefaultUDPTrackerConfig = UDPTrackerConfig{
+	Timeout:        15 * time.Second,
+	MaxRetransmits: 8,
+}
+
+// TrackerError is returned when a tracker answers a request with an error action
+type TrackerError struct {
 	Tracker string
+	Message string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("Tracker %s responded with error: %s", e.Tracker, e.Message)
+}
+
+// trackerSession is the UDP association with a single tracker. The connection ID
+// from a connect exchange is reused for every request until it expires.
+type trackerSession struct {
+	mu           sync.Mutex
+	Socket       net.Conn
+	Tracker      string
+	Network      string // udp4 or udp6, the tracker replies with peers of the same family
+	Config       UDPTrackerConfig
+	ConnectionID int64
+	ConnectedAt  time.Time
+	LastUsed     time.Time // guarded by sessionsMu
+}
+
+// trackerNetworks are announced to separately so a dual-stack tracker returns
+// both its IPv4 and IPv6 peers (BEP 15)
+var trackerNetworks = []string{"udp4", "udp6"}
+
+// sessionKey identifies a cached session, torrents with a tracker config of
+// their own get sessions of their own
+type sessionKey struct {
+	Tracker string
+	Network string
+	Config  UDPTrackerConfig
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[sessionKey]*trackerSession{}
+)
+
+// getTrackerSession returns the cached session for a tracker, creating it if
+// needed. Sessions that have gone unused since their connection ID expired are
+// closed and dropped, so trackers no longer announced to do not pile up.
+func getTrackerSession(tracker string, network string, config UDPTrackerConfig) *trackerSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	now := time.Now()
+	for key, s := range sessions {
+		if now.Sub(s.LastUsed) >= connectionIDLifetime && s.expire() {
+			delete(sessions, key)
+		}
+	}
+	key := sessionKey{tracker, network, config}
+	s, ok := sessions[key]
+	if !ok {
+		s = &trackerSession{Tracker: tracker, Network: network, Config: config}
+		sessions[key] = s
+	}
+	s.LastUsed = now
+	return s
+}
+
+// expire closes the session once its connection ID has expired and reports
+// whether it did. A session that is in use does not expire.
+func (s *trackerSession) expire() bool {
+	if !s.mu.TryLock() {
+		return false
+	}
+	defer s.mu.Unlock()
+	if s.Socket != nil && time.Since(s.ConnectedAt) < connectionIDLifetime {
+		return false
+	}
+	s.close()
+	return true
+}
+
+// announcedTorrent is a torrent announced to a tracker, which is told when the
+// torrent stops. UDP trackers are announced to over each network family.
+type announcedTorrent struct {
+	Tracker  string
+	Network  string // empty for HTTP trackers
+	InfoHash [20]byte
+}
+
+var (
+	announcedMu sync.Mutex
+	announced   = map[announcedTorrent]bool{}
+)
+
+// hasAnnounced is whether the torrent has an announce answered by the tracker
+// that was not stopped since
+func hasAnnounced(a announcedTorrent) bool {
+	announcedMu.Lock()
+	defer announcedMu.Unlock()
+	return announced[a]
+}
+
+// setAnnounced records an answered announce, a stopped one leaves the swarm
+func setAnnounced(a announcedTorrent, event int32) {
+	announcedMu.Lock()
+	defer announcedMu.Unlock()
+	if event == eventStopped {
+		delete(announced, a)
+	} else {
+		announced[a] = true
+	}
 }
 
 func newTransactionID() int32 {
 	return int32(rand.Uint32())
 }
 
-func (m *MagnetURI) requestPeers() ([]peer.Peer, error) {
-	var c client
-	var announceResp announceResponse
+// RequestPeers announces to the torrent's trackers and returns the peers of the first one to answer
+func (m *MagnetURI) RequestPeers(ctx context.Context) ([]peer.Peer, error) {
+	type result struct {
+		peers []peer.Peer
+		err   error
+	}
+	// Ask every tracker at once and take the first one to answer, a tracker that
+	// never responds would otherwise hold up the rest for its whole retransmit schedule.
+	// Returning cancels the announces still in flight.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(m.Trackers))
 	for _, tracker := range m.Trackers {
-		c.Tracker = tracker
-		connectResp, err := c.connect()
-		if err != nil {
-			continue
+		go func(tracker string) {
+			peers, err := m.announceTracker(ctx, tracker, eventNone)
+			results <- result{peers, err}
+		}(tracker)
+	}
+	for range m.Trackers {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.peers, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		announceReq := m.newAnnounceRequest(connectResp)
-		announceResp, err := c.announce(announceReq)
-		if err != nil {
+	}
+	return nil, errors.New("Failed to request peers")
+}
+
+// AnnounceStopped tells every tracker we announced to that we are leaving the swarm.
+// It returns once they have all answered or ctx is done.
+func (m *MagnetURI) AnnounceStopped(ctx context.Context) {
+	m.announceAll(ctx, eventStopped)
+}
+
+// AnnounceCompleted tells every tracker that we finished downloading the
+// torrent, which is not sent when it was complete from the start. It returns
+// once they have all answered or ctx is done.
+func (m *MagnetURI) AnnounceCompleted(ctx context.Context) {
+	m.announceAll(ctx, eventCompleted)
+}
+
+// announceAll sends an event to every tracker at once
+func (m *MagnetURI) announceAll(ctx context.Context, event int32) {
+	var wg sync.WaitGroup
+	for _, tracker := range m.Trackers {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			m.announceTracker(ctx, tracker, event)
+		}(tracker)
+	}
+	wg.Wait()
+}
+
+// announceTracker announces to an HTTP tracker, or over every network family
+// a UDP tracker is reachable on
+func (m *MagnetURI) announceTracker(ctx context.Context, tracker string, event int32) ([]peer.Peer, error) {
+	var response announceResult
+	var err error
+	attempted := true
+	switch {
+	case isHTTPTracker(tracker):
+		attempted = event != eventStopped || hasAnnounced(announcedTorrent{tracker, "", m.InfoHash})
+		if attempted {
+			response, err = m.announceHTTP(ctx, tracker, event)
+		}
+	case strings.Contains(tracker, "://"):
+		attempted = event != eventStopped
+		err = fmt.Errorf("Tracker %s has an unsupported scheme", tracker)
+	default:
+		response, attempted, err = m.announceUDP(ctx, tracker, event)
+	}
+	if m.OnEvent != nil && attempted {
+		e := peer.NewEvent(peer.EventTrackerAnnounce, m.InfoHash)
+		e.Tracker, e.Seeders, e.Leechers, e.NumPeers, e.Err = tracker, response.Seeders, response.Leechers, len(response.Peers), err
+		m.OnEvent(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.Peers, nil
+}
+
+// announceUDP announces over udp4 and udp6 at once. Once a family answers the
+// other gets one more base timeout, a tracker that is only reachable over one
+// of them would otherwise hold the announce for its whole retransmit schedule.
+func (m *MagnetURI) announceUDP(ctx context.Context, tracker string, event int32) (announceResult, bool, error) {
+	type result struct {
+		resp announceResponse
+		err  error
+	}
+	var response announceResult
+	config := m.TrackerConfig()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(trackerNetworks))
+	started := 0
+	for _, network := range trackerNetworks {
+		a := announcedTorrent{tracker, network, m.InfoHash}
+		if event == eventStopped && !hasAnnounced(a) {
 			continue
 		}
-		if announceResp.header.Action == actionAnnounce {
-			fmt.Printf("Announced successfully to: %s \n", c.Tracker)
-			if len(announceResp.body.Peers) > 0 {
-				fmt.Printf("Current peers %v \n", announceResp.body.Peers)
+		s := getTrackerSession(tracker, network, config)
+		started++
+		go func(s *trackerSession) {
+			resp, err := s.announce(ctx, m.newAnnounceRequest(event))
+			if err == nil {
+				setAnnounced(a, event)
 			}
-			fmt.Printf("Seeders: %v \n", announceResp.header.Seeders)
-			fmt.Printf("Leechers: %v \n", announceResp.header.Leechers)
+			results <- result{resp, err}
+		}(s)
+	}
+	var lastErr error = errors.New("Tracker is not reachable")
+	announced := false
+	for i := 0; i < started; i++ {
+		r := <-results
+		if r.err != nil {
+			if !announced {
+				lastErr = r.err
+			}
+			continue
+		}
+		if !announced {
+			grace := time.AfterFunc(config.Timeout, cancel)
+			defer grace.Stop()
+		}
+		announced = true
+		response.Peers = append(response.Peers, r.resp.body.Peers...)
+		response.Seeders += int(r.resp.header.Seeders)
+		response.Leechers += int(r.resp.header.Leechers)
+	}
+	if !announced {
+		return response, started > 0, lastErr
+	}
+	return response, true, nil
+}
+
+// Scrape asks every tracker of the torrent, in parallel, how many peers are in
+// its swarm without joining it. Results are in the order of m.Trackers.
+func (m *MagnetURI) Scrape(ctx context.Context) []ScrapeResult {
+	results := make([]ScrapeResult, len(m.Trackers))
+	var wg sync.WaitGroup
+	for i, tracker := range m.Trackers {
+		wg.Add(1)
+		go func(i int, tracker string) {
+			defer wg.Done()
+			results[i] = m.scrapeTracker(ctx, tracker)
+		}(i, tracker)
+	}
+	wg.Wait()
+	return results
+}
+
+// scrapeTracker scrapes over the first network family the tracker answers on,
+// both families see the same swarm
+func (m *MagnetURI) scrapeTracker(ctx context.Context, tracker string) ScrapeResult {
+	if isHTTPTracker(tracker) {
+		return m.scrapeHTTP(ctx, tracker)
+	}
+	result := ScrapeResult{Tracker: tracker, Err: errors.New("Tracker is not reachable")}
+	if strings.Contains(tracker, "://") {
+		result.Err = fmt.Errorf("Tracker %s has an unsupported scheme", tracker)
+		return result
+	}
+	for _, network := range trackerNetworks {
+		s := getTrackerSession(tracker, network, m.TrackerConfig())
+		entry, err := s.scrape(ctx, m.InfoHash)
+		if err != nil {
+			result.Err = err
+			continue
 		}
-		return announceResp.body.Peers, nil
+		result.Seeders, result.Completed, result.Leechers = int(entry.Seeders), int(entry.Completed), int(entry.Leechers)
+		result.Err = nil
+		break
 	}
-	if c.Socket != nil {
-		c.Socket.Close()
+	return result
+}
+
+// TrackerConfig returns the UDP tracker config to use, DefaultUDPTrackerConfig unless overridden
+func (m *MagnetURI) TrackerConfig() UDPTrackerConfig {
+	if m.UDPTracker != nil {
+		return *m.UDPTracker
 	}
-	return announceResp.body.Peers, errors.New("Failed to request peers")
+	return DefaultUDPTrackerConfig
+}
+
+// AnnounceStats is the transfer of a torrent that is announced to trackers
+type AnnounceStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64 // bytes of the wanted files still to download
 }
 
-func (m *MagnetURI) newAnnounceRequest(cr connectionResponse) announceRequest {
+// unknownLeft is announced as left while the size of the torrent is unknown, so
+// trackers count us as a leecher
+const unknownLeft = 1<<31 - 1
+
+func (m *MagnetURI) newAnnounceRequest(event int32) announceRequest {
+	var stats AnnounceStats
+	known := false
+	if m.Stats != nil {
+		stats, known = m.Stats()
+	}
+	if !known {
+		stats.Left = unknownLeft
+	}
 	ar := announceRequest{
-		ConnectionID:  cr.ConnectionID,
-		Action:        actionAnnounce,
-		TransactionID: newTransactionID(),
-		InfoHash:      m.InfoHash,
-		Downloaded:    0,
-		Left:          2000000000, //idk how to get this
-		Uploaded:      0,
-		Event:         eventNone,
-		IP:            0,
-		Key:           uint32(newTransactionID()),
-		NumWant:       -1,
-		Port:          port,
+		Action:     actionAnnounce,
+		InfoHash:   m.InfoHash,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Uploaded:   stats.Uploaded,
+		Event:      event,
+		IP:         0,
+		Key:        uint32(newTransactionID()),
+		NumWant:    -1,
+		Port:       m.Port,
 	}
 	copy(ar.PeerID[:20], peer.PeerID)
 	return ar
 }
 
-func (c *client) connect() (connectionResponse, error) {
+func (s *trackerSession) announce(ctx context.Context, announceReq announceRequest) (announceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var response announceResponse
+	// Connecting and announcing share one retransmit schedule. The connection ID
+	// can expire while we are still retransmitting.
+	for n := 0; n <= s.Config.MaxRetransmits; n++ {
+		err := s.connect(ctx, s.timeout(n))
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return response, err
+		}
+		announceReq.ConnectionID = s.ConnectionID
+		announceReq.TransactionID = newTransactionID()
+		data, err := s.request(ctx, &announceReq, announceReq.TransactionID, s.timeout(n))
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return response, err
+		}
+		return s.parseAnnounce(data)
+	}
+	s.close()
+	return response, fmt.Errorf("Tracker %s did not respond to announce after %d attempts",
+		s.Tracker, s.Config.MaxRetransmits+1)
+}
+
+func (s *trackerSession) scrape(ctx context.Context, infoHash [20]byte) (scrapeResponseEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entry scrapeResponseEntry
+	for n := 0; n <= s.Config.MaxRetransmits; n++ {
+		err := s.connect(ctx, s.timeout(n))
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return entry, err
+		}
+		req := scrapeRequest{
+			ConnectionID:  s.ConnectionID,
+			Action:        actionScrape,
+			TransactionID: newTransactionID(),
+			InfoHash:      infoHash,
+		}
+		data, err := s.request(ctx, &req, req.TransactionID, s.timeout(n))
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return entry, err
+		}
+		// The action and transaction ID come before the counts
+		if len(data) < 8+12 {
+			return entry, fmt.Errorf("Scrape response too short. %d < %d", len(data), 8+12)
+		}
+		if action := int32(binary.BigEndian.Uint32(data)); action != actionScrape {
+			return entry, fmt.Errorf("Scrape action response not equal to %d, instead is %d", actionScrape, action)
+		}
+		err = binary.Read(bytes.NewReader(data[8:]), binary.BigEndian, &entry)
+		return entry, err
+	}
+	s.close()
+	return entry, fmt.Errorf("Tracker %s did not respond to scrape after %d attempts",
+		s.Tracker, s.Config.MaxRetransmits+1)
+}
+
+func (s *trackerSession) parseAnnounce(data []byte) (announceResponse, error) {
+	var response announceResponse
+	if len(data) < announceMinResponseSize {
+		return response, fmt.Errorf("Announce response too short. %d < %d", len(data), announceMinResponseSize)
+	}
+	binary.Read(bytes.NewReader(data), binary.BigEndian, &response.header)
+	if response.header.Action != actionAnnounce {
+		return response,
+			fmt.Errorf("Announce action response not equal to %d, instead is %d", actionAnnounce, response.header.Action)
+	}
+	// An IPv6 announce gets 18 byte peers instead of 6 byte ones
+	ipLen := net.IPv4len
+	if s.Network == "udp6" {
+		ipLen = net.IPv6len
+	}
+	body := data[announceMinResponseSize:]
+	body = body[:len(body)-len(body)%(ipLen+2)]
+	var err error
+	response.body.Peers, err = peer.ParseCompactPeers(body, ipLen)
+	return response, err
+}
+
+// connect obtains a connection ID unless the cached one is still valid, waiting
+// up to timeout for the tracker. The socket is kept when it times out, the
+// caller retransmits on its own schedule.
+func (s *trackerSession) connect(ctx context.Context, timeout time.Duration) error {
+	if s.Socket != nil && time.Since(s.ConnectedAt) < connectionIDLifetime {
+		return nil
+	}
+	if s.Socket == nil {
+		raddr, err := net.ResolveUDPAddr(s.Network, s.Tracker)
+		if err != nil {
+			return err
+		}
+		s.Socket, err = net.DialUDP(s.Network, nil, raddr)
+		if err != nil {
+			return err
+		}
+	}
 	payload := connectionRequest{
 		ConnectionID:  connectionID,
 		Action:        actionConnect,
 		TransactionID: newTransactionID(),
 	}
-	var response connectionResponse
-	raddr, err := net.ResolveUDPAddr("udp", c.Tracker)
-	if err != nil {
-		return response, err
+	data, err := s.request(ctx, &payload, payload.TransactionID, timeout)
+	if isTimeout(err) {
+		return err
 	}
-	c.Socket, err = net.DialUDP("udp", nil, raddr)
 	if err != nil {
-		return response, err
+		s.close()
+		return err
 	}
-	_, _, err = c.request(&payload, &response)
-	if response.TransactionID != payload.TransactionID {
-		return response, errors.New("TransactionID from request does not match response")
+	var response connectionResponse
+	err = binary.Read(bytes.NewReader(data), binary.BigEndian, &response)
+	if err != nil {
+		s.close()
+		return err
 	}
 	if response.Action != actionConnect {
-		return response,
-			fmt.Errorf("Connect action response not equal to %d, instead is %d", actionConnect, response.Action)
+		s.close()
+		return fmt.Errorf("Connect action response not equal to %d, instead is %d", actionConnect, response.Action)
 	}
-	return response, nil
+	s.ConnectionID = response.ConnectionID
+	s.ConnectedAt = time.Now()
+	return nil
 }
 
-func (c *client) announce(announceReq announceRequest) (announceResponse, error) {
-	var response announceResponse
-	readBuffer, bytesRead, err := c.request(&announceReq, &response.header)
+// request sends the payload once and waits up to timeout for the response with a matching
+// transaction ID. Responses to earlier transmissions of other requests are skipped.
+func (s *trackerSession) request(ctx context.Context, payload interface{}, transactionID int32,
+	timeout time.Duration) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	writeBuffer := bytes.NewBuffer(make([]byte, 0, bufferSize))
+	binary.Write(writeBuffer, binary.BigEndian, payload)
+	_, err := s.Socket.Write(writeBuffer.Bytes())
 	if err != nil {
-		return response, errors.New("Failed to announce")
-	}
-	if bytesRead > announceMinResponseSize {
-		numPeers := (bytesRead - announceMinResponseSize) / peerSize
-		for i := 0; i < numPeers; i++ {
-			var p peer.Peer
-			var ipBuf [4]byte
-			err = binary.Read(readBuffer, binary.BigEndian, &ipBuf)
-			err = binary.Read(readBuffer, binary.BigEndian, &p.Port)
-			p.IP = net.IPv4(ipBuf[0], ipBuf[1], ipBuf[2], ipBuf[3])
-			if err != nil {
-				break
-			}
-			response.body.Peers = append(response.body.Peers, p)
-		}
+		return nil, err
 	}
-	return response, nil
-}
-
-func (c *client) request(payload interface{}, response interface{}) (*bytes.Buffer, int, error) {
-	// timeout: 15 * 2 ^ n (0-8)
-	// every 15 * 2 ^ n seconds where n is the number of the request attempt.
-	for attempts := 0; attempts < maxRequestAttempts; attempts++ {
-		timeoutDuration := time.Second * time.Duration(15*int(math.Pow(2.0, float64(attempts))))
-		c.Socket.SetReadDeadline(time.Now().Add(timeoutDuration))
-
-		writeBuffer := bytes.NewBuffer(make([]byte, 0, bufferSize))
-		binary.Write(writeBuffer, binary.BigEndian, payload)
-		_, err := c.Socket.Write(writeBuffer.Bytes())
-		if err != nil {
-			return nil, 0, err
+	s.Socket.SetReadDeadline(time.Now().Add(timeout))
+	// Cancelling ctx cuts the wait short without closing the session's socket
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			s.Socket.SetReadDeadline(time.Now())
+		case <-stop:
 		}
+	}()
+	for {
 		readData := make([]byte, bufferSize)
-		bytesRead, err := c.Socket.Read(readData)
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			attempts++
-			continue
+		bytesRead, err := s.Socket.Read(readData)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
-		readBuffer := bytes.NewBuffer(readData[:bytesRead])
-		err = binary.Read(readBuffer, binary.BigEndian, response)
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return nil, bytesRead, err
+		var header errorResponseHeader
+		err = binary.Read(bytes.NewReader(readData[:bytesRead]), binary.BigEndian, &header)
+		if err != nil || header.TransactionID != transactionID {
+			continue
 		}
+		if header.Action == actionError {
+			return nil, &TrackerError{
+				Tracker: s.Tracker,
+				Message: string(readData[errorMinResponseSize:bytesRead]),
+			}
+		}
+		return readData[:bytesRead], nil
+	}
+}
+
+// timeout for attempt n is Timeout * 2^n
+func (s *trackerSession) timeout(n int) time.Duration {
+	return s.Config.Timeout << uint(n)
+}
+
+func (s *trackerSession) close() {
+	if s.Socket != nil {
+		s.Socket.Close()
+		s.Socket = nil
+	}
+	s.ConnectedAt = time.Time{}
+}
 
-		// Success
-		return readBuffer, bytesRead, nil
+func isTimeout(err error) bool {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
 	}
-	return nil, 0, errors.New("Failed to connect to make request after 8 attempts")
+	return false
 }
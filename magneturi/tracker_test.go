@@ -0,0 +1,328 @@
+package magneturi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laurentlousky/stream/peer"
+)
+
+var testTrackerConfig = UDPTrackerConfig{
+	Timeout:        20 * time.Millisecond,
+	MaxRetransmits: 3,
+}
+
+// fakeTracker answers connect and announce requests with a fixed list of peers
+type fakeTracker struct {
+	mu       sync.Mutex
+	Socket   *net.UDPConn
+	Peers    []peer.Peer
+	Error    string // when set, announces are answered with an error action
+	Drop     int    // number of incoming packets to ignore
+	Connects int
+	Announce int
+	Events   []int32
+}
+
+func newFakeTracker(t *testing.T, network string, addr string, peers []peer.Peer) *fakeTracker {
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Skipf("cannot resolve %s: %v", addr, err)
+	}
+	socket, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	f := &fakeTracker{Socket: socket, Peers: peers}
+	go f.serve()
+	t.Cleanup(func() { socket.Close() })
+	return f
+}
+
+func (f *fakeTracker) Addr() string {
+	return f.Socket.LocalAddr().String()
+}
+
+func (f *fakeTracker) serve() {
+	buf := make([]byte, bufferSize)
+	for {
+		n, raddr, err := f.Socket.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		if f.Drop > 0 {
+			f.Drop--
+			f.mu.Unlock()
+			continue
+		}
+		var header connectionRequest
+		binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &header)
+		resp := &bytes.Buffer{}
+		switch {
+		case header.Action == actionConnect:
+			f.Connects++
+			binary.Write(resp, binary.BigEndian, connectionResponse{
+				Action:        actionConnect,
+				TransactionID: header.TransactionID,
+				ConnectionID:  1234,
+			})
+		case header.Action == actionAnnounce && f.Error != "":
+			binary.Write(resp, binary.BigEndian, errorResponseHeader{
+				Action:        actionError,
+				TransactionID: header.TransactionID,
+			})
+			resp.WriteString(f.Error)
+		case header.Action == actionAnnounce:
+			var req announceRequest
+			binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &req)
+			f.Announce++
+			f.Events = append(f.Events, req.Event)
+			binary.Write(resp, binary.BigEndian, announceResponseHeader{
+				Action:        actionAnnounce,
+				TransactionID: header.TransactionID,
+				Interval:      1800,
+				Seeders:       int32(len(f.Peers)),
+			})
+			for _, p := range f.Peers {
+				resp.Write(p.Compact())
+			}
+		}
+		f.mu.Unlock()
+		f.Socket.WriteToUDP(resp.Bytes(), raddr)
+	}
+}
+
+func (f *fakeTracker) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Connects, f.Announce
+}
+
+func TestRequestPeersIPv6(t *testing.T) {
+	want := []peer.Peer{
+		{IP: net.ParseIP("::1"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::2"), Port: 51413},
+	}
+	tracker := newFakeTracker(t, "udp6", "[::1]:0", want)
+	m := MagnetURI{Trackers: []string{tracker.Addr()}, UDPTracker: &testTrackerConfig}
+
+	got, err := m.RequestPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d peers want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].IP.Equal(want[i].IP) || got[i].Port != want[i].Port {
+			t.Errorf("got peer %s want %s", got[i], want[i])
+		}
+	}
+}
+
+func TestTrackerSessionReusesConnectionID(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	m := MagnetURI{}
+	s := &trackerSession{Tracker: tracker.Addr(), Network: "udp4", Config: testTrackerConfig}
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connects, announces := tracker.counts(); connects != 1 || announces != 3 {
+		t.Errorf("got %d connects and %d announces, want 1 and 3", connects, announces)
+	}
+
+	// Once the connection ID expires a new connect exchange is required
+	s.ConnectedAt = time.Now().Add(-connectionIDLifetime)
+	if _, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone)); err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := tracker.counts(); connects != 2 {
+		t.Errorf("got %d connects after expiry, want 2", connects)
+	}
+}
+
+func TestTrackerSessionsExpire(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	m := MagnetURI{}
+	key := sessionKey{tracker.Addr(), "udp4", testTrackerConfig}
+	other := sessionKey{"127.0.0.1:1", "udp4", testTrackerConfig}
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		for _, k := range []sessionKey{key, other} {
+			if s, ok := sessions[k]; ok {
+				s.close()
+				delete(sessions, k)
+			}
+		}
+	})
+	s := getTrackerSession(key.Tracker, key.Network, key.Config)
+	if _, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone)); err != nil {
+		t.Fatal(err)
+	}
+	cached := func() bool {
+		getTrackerSession(other.Tracker, other.Network, other.Config)
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		return sessions[key] == s
+	}
+
+	// An idle session whose connection ID is still valid is kept
+	sessionsMu.Lock()
+	s.LastUsed = time.Now().Add(-connectionIDLifetime)
+	sessionsMu.Unlock()
+	if !cached() {
+		t.Fatal("dropped a session with a valid connection ID")
+	}
+	s.ConnectedAt = time.Now().Add(-connectionIDLifetime)
+	if cached() || s.Socket != nil {
+		t.Error("kept a session whose connection ID expired")
+	}
+}
+
+func TestTrackerSessionRetransmits(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	tracker.mu.Lock()
+	tracker.Drop = 2
+	tracker.mu.Unlock()
+	m := MagnetURI{}
+	s := &trackerSession{Tracker: tracker.Addr(), Network: "udp4", Config: testTrackerConfig}
+	defer s.close()
+	if _, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone)); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.mu.Lock()
+	tracker.Drop = 100
+	tracker.mu.Unlock()
+	s.ConnectedAt = time.Time{}
+	s.Config.MaxRetransmits = 1
+	if _, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone)); err == nil {
+		t.Error("expected announce to a silent tracker to fail")
+	}
+	// Connect and announce share the schedule, not one each
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if sent := 100 - tracker.Drop; sent != 2 {
+		t.Errorf("sent %d packets to a silent tracker want 2", sent)
+	}
+}
+
+func TestTrackerSessionError(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	tracker.mu.Lock()
+	tracker.Error = "torrent not registered"
+	tracker.mu.Unlock()
+	m := MagnetURI{}
+	s := &trackerSession{Tracker: tracker.Addr(), Network: "udp4", Config: testTrackerConfig}
+	defer s.close()
+
+	_, err := s.announce(context.Background(), m.newAnnounceRequest(eventNone))
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) {
+		t.Fatalf("got error %v want a TrackerError", err)
+	}
+	if trackerErr.Message != "torrent not registered" {
+		t.Errorf("got message %q want %q", trackerErr.Message, "torrent not registered")
+	}
+}
+
+func TestAnnounceStopped(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	m := MagnetURI{InfoHash: [20]byte{3}, Trackers: []string{tracker.Addr()}, UDPTracker: &testTrackerConfig}
+	if _, err := m.RequestPeers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.AnnounceStopped(context.Background())
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if n := len(tracker.Events); n != 2 || tracker.Events[n-1] != eventStopped {
+		t.Errorf("got events %v want a stopped announce last", tracker.Events)
+	}
+}
+
+func TestRequestPeersCancel(t *testing.T) {
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	tracker.mu.Lock()
+	tracker.Drop = 1000
+	tracker.mu.Unlock()
+	config := UDPTrackerConfig{Timeout: time.Minute, MaxRetransmits: 8}
+	m := MagnetURI{InfoHash: [20]byte{4}, Trackers: []string{tracker.Addr()}, UDPTracker: &config}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := m.RequestPeers(ctx)
+	if err == nil {
+		t.Fatal("expected announce to a silent tracker to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled announce took %s", elapsed)
+	}
+}
+
+func TestRequestPeersSilentFamily(t *testing.T) {
+	want := []peer.Peer{{IP: net.ParseIP("192.0.2.1"), Port: 6881}}
+	tracker := newFakeTracker(t, "udp4", "127.0.0.1:0", want)
+	silent := newFakeTracker(t, "udp4", "127.0.0.1:0", nil)
+	silent.mu.Lock()
+	silent.Drop = 1000
+	silent.mu.Unlock()
+	config := UDPTrackerConfig{Timeout: 20 * time.Millisecond, MaxRetransmits: 8}
+	m := MagnetURI{InfoHash: [20]byte{6}, Trackers: []string{tracker.Addr()}, UDPTracker: &config}
+	// The tracker's IPv6 side never answers
+	s := getTrackerSession(tracker.Addr(), "udp6", config)
+	socket, err := net.Dial("udp4", silent.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Socket = socket
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		for _, network := range trackerNetworks {
+			key := sessionKey{tracker.Addr(), network, config}
+			if s, ok := sessions[key]; ok {
+				s.close()
+				delete(sessions, key)
+			}
+		}
+	})
+
+	start := time.Now()
+	got, err := m.RequestPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].IP.Equal(want[0].IP) {
+		t.Errorf("got peers %v want %v", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("a silent family held the announce for %s", elapsed)
+	}
+	silent.mu.Lock()
+	defer silent.mu.Unlock()
+	if silent.Drop == 1000 {
+		t.Error("the IPv6 side was not asked")
+	}
+}
+
+func TestRequestPeersUnsupportedScheme(t *testing.T) {
+	m := MagnetURI{InfoHash: [20]byte{7}}
+	m.AddTrackers("wss://tracker.example/announce")
+	if _, err := m.announceTracker(context.Background(), m.Trackers[0], eventNone); err == nil {
+		t.Error("announcing to a wss:// tracker succeeded")
+	}
+}
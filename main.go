@@ -1,15 +1,327 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/laurentlousky/stream/client"
 	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
 )
 
+// Exit codes
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitInterrupted = 130 // what shells report for a program killed by Ctrl-C
+)
+
+// command is a subcommand of bitty
+type command struct {
+	Name    string
+	Args    string // what follows the flags in the usage
+	Summary string
+	Run     func(args []string) error
+}
+
+// commands is filled in by init, the usage refers back to it
+var commands []command
+
+func init() {
+	commands = []command{
+		{"download", "<magnet or .torrent>...", "Download torrents", runDownload},
+		{"tui", "[magnet or .torrent]...", "Manage torrents in an interactive terminal UI", runTUI},
+		{"seed", "<.torrent>", "Check data already downloaded and seed it", runSeed},
+		{"serve", "<file or directory>", "Make a torrent of local files and seed them", runServe},
+		{"info", "<magnet or .torrent>", "Show a torrent's metadata and files", runInfo},
+		{"magnet", "<.torrent>", "Print the magnet link of a .torrent", runMagnet},
+		{"create", "<file or directory>", "Write a .torrent for local files", runCreate},
+		{"verify", "<.torrent>", "Check downloaded data against its hashes", runVerify},
+		{"scrape", "<magnet or .torrent>", "Ask the trackers how many peers a torrent has", runScrape},
+		{"tracker", "", "Run a UDP and HTTP tracker", runTracker},
+		{"daemon", "[magnet or .torrent]...", "Run torrents in the background, controlled over RPC", runDaemon},
+		{"list", "", "List the torrents of the daemon", runList},
+		{"pause", "<id>... | all", "Pause torrents of the daemon", runPause},
+		{"resume", "<id>... | all", "Resume torrents of the daemon", runResume},
+		{"remove", "<id>... | all", "Remove torrents from the daemon, keeping their data", runRemove},
+		{"limit", "[id]... | all", "Change the rate limits of the daemon or of its torrents", runLimit},
+	}
+}
+
+// usageError is a command line that cannot be run, its usage has been printed
+type usageError struct {
+	error
+}
+
 func main() {
-	m := magneturi.Parse(os.Args[1])
-	err := m.Download()
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs a command line and returns the exit code
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	name, rest := args[0], args[1:]
+	if isTorrentArg(name) {
+		// bitty <magnet> downloads, as it did before there were commands
+		name, rest = "download", args
+	}
+	switch name {
+	case "help", "-h", "-help", "--help":
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "bitty: unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	err := cmd.Run(rest)
+	var usageErr usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintln(os.Stderr, "Interrupted")
+		return exitInterrupted
+	default:
+		fmt.Fprintf(os.Stderr, "bitty %s: %v\n", cmd.Name, err)
+		return exitFailure
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: bitty <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintln(w, "\nRun bitty <command> -h for the flags of a command.")
+}
+
+// newFlagSet makes the flag set of a command, errors are returned to run
+// rather than exiting
+func newFlagSet(name string) *flag.FlagSet {
+	cmd := findCommand(name)
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: bitty %s [flags] %s\n\n%s\n", cmd.Name, cmd.Args, cmd.Summary)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out, "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// parseArgs parses the flags of a command and checks it got at least min
+// arguments and at most max, -1 for no limit
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) error {
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		// The flag package printed the error and the usage
+		return usageError{err}
+	}
+	if flags.NArg() < min || max >= 0 && flags.NArg() > max {
+		flags.Usage()
+		return usageError{errors.New("Wrong number of arguments")}
+	}
+	return nil
+}
+
+// usageFailure prints a problem with the command line and the usage
+func usageFailure(flags *flag.FlagSet, err error) error {
+	fmt.Fprintf(flags.Output(), "%v\n\n", err)
+	flags.Usage()
+	return usageError{err}
+}
+
+// interruptContext is done on Ctrl-C or SIGTERM, so torrents stop cleanly
+// instead of being killed mid-write
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// clientFlags are the flags shared by the commands that run torrents
+type clientFlags struct {
+	Port     *int
+	Down     *string
+	Up       *string
+	MaxConns *int
+	Trackers stringList
+	Verbose  *bool
+	Quiet    *bool
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientFlags {
+	cf := &clientFlags{}
+	cf.Port = flags.Int("port", 6881, "port to accept peers on, 0 to only connect out")
+	cf.Down = flags.String("down", "", "download limit in bytes per second, with an optional K, M or G suffix")
+	cf.Up = flags.String("up", "", "upload limit in bytes per second, with an optional K, M or G suffix")
+	cf.MaxConns = flags.Int("max-conns", client.DefaultConfig.MaxConns, "most peer connections at once")
+	flags.Var(&cf.Trackers, "t", "tracker announce URL to add, can be repeated")
+	cf.Verbose = flags.Bool("v", false, "also print tracker announces, failed pieces and banned peers")
+	cf.Quiet = flags.Bool("q", false, "only print errors")
+	return cf
+}
+
+// newClient makes a client saving torrents under dir. Bad flag values are
+// reported as usage errors.
+func (cf *clientFlags) newClient(flags *flag.FlagSet, dir string, seed bool) (*client.Client, error) {
+	if *cf.Verbose && *cf.Quiet {
+		return nil, usageFailure(flags, errors.New("-v and -q cannot be used together"))
+	}
+	down, err := parseRate(*cf.Down)
+	if err != nil {
+		return nil, usageFailure(flags, err)
+	}
+	up, err := parseRate(*cf.Up)
 	if err != nil {
-		println(err.Error())
+		return nil, usageFailure(flags, err)
+	}
+	if *cf.Port < 0 || *cf.Port > 65535 {
+		return nil, usageFailure(flags, fmt.Errorf("Bad port %d", *cf.Port))
+	}
+	listenAddr := ""
+	if *cf.Port != 0 {
+		listenAddr = fmt.Sprintf(":%d", *cf.Port)
+	}
+	return client.New(client.Config{
+		DataDir:      dir,
+		ListenAddr:   listenAddr,
+		MaxConns:     *cf.MaxConns,
+		DownloadRate: down,
+		UploadRate:   up,
+		Seed:         seed,
+	})
+}
+
+// parseRate reads a rate like 500K or 1.5M in bytes per second, empty or 0
+// for unlimited
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	number, multiplier := s, 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Bad rate %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// parseSelection reads file indexes like 0,2-4, empty for every file
+func parseSelection(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var indexes []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		begin, err := strconv.Atoi(first)
+		end := begin
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || begin < 0 || end < begin {
+			return nil, fmt.Errorf("Bad file selection %q", part)
+		}
+		for i := begin; i <= end; i++ {
+			indexes = append(indexes, i)
+		}
 	}
+	return indexes, nil
+}
+
+// isTorrentArg is whether an argument names a torrent rather than a command
+func isTorrentArg(arg string) bool {
+	return strings.HasPrefix(arg, "magnet:") || strings.HasSuffix(arg, ".torrent")
+}
+
+// readTorrentFile reads a .torrent from disk
+func readTorrentFile(path string) (*peer.MetaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return peer.ReadTorrentFile(f)
+}
+
+// readMagnet reads a magnet link, or makes one from a .torrent whose metadata
+// is returned as well
+func readMagnet(arg string) (magneturi.MagnetURI, *peer.MetaInfo, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		m, err := magneturi.Parse(arg)
+		return m, nil, err
+	}
+	mi, err := readTorrentFile(arg)
+	if err != nil {
+		return magneturi.MagnetURI{}, nil, err
+	}
+	return magneturi.FromTorrent(mi), mi, nil
+}
+
+// writeTorrentFile saves a .torrent to path
+func writeTorrentFile(mi *peer.MetaInfo, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = mi.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	for s, want := range map[string]int64{"": 0, "0": 0, "512": 512, "500K": 500 << 10, "1.5m": 3 << 19, "2G": 2 << 30} {
+		got, err := parseRate(s)
+		if err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"K", "-1", "fast", "1KB"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("parseRate(%q) was accepted", s)
+		}
+	}
+
+	got, err := parseSelection("0, 2-4,7")
+	if err != nil || !reflect.DeepEqual(got, []int{0, 2, 3, 4, 7}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	for _, s := range []string{"a", "1-", "-1", "4-2", "1,,2"} {
+		if _, err := parseSelection(s); err == nil {
+			t.Errorf("parseSelection(%q) was accepted", s)
+		}
+	}
+
+	ids, err := parseIDs([]string{"3", "#4", "0123456789abcdef0123456789ABCDEF01234567"})
+	if err != nil || !reflect.DeepEqual(ids, []interface{}{3, 4, "0123456789abcdef0123456789ABCDEF01234567"}) {
+		t.Errorf("got %v, %v", ids, err)
+	}
+	if ids, err := parseIDs([]string{"1", "all"}); ids != nil || err != nil {
+		t.Errorf("all got %v, %v", ids, err)
+	}
+	for _, s := range []string{"0", "abc", "-1"} {
+		if _, err := parseIDs([]string{s}); err == nil {
+			t.Errorf("parseIDs(%q) was accepted", s)
+		}
+	}
+	wanted, unwanted := splitSelection([]int{1, 3, 9}, 4)
+	if !reflect.DeepEqual(wanted, []int{1, 3}) || !reflect.DeepEqual(unwanted, []int{0, 2}) {
+		t.Errorf("got %v and %v", wanted, unwanted)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	t.Setenv("BITTY_RPC", filepath.Join(t.TempDir(), "none.sock"))
+	for _, c := range []struct {
+		Args []string
+		Code int
+	}{
+		{nil, exitUsage},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"help"}, 0},
+		{[]string{"info"}, exitUsage},
+		{[]string{"magnet", "-nope", "a.torrent"}, exitUsage},
+		{[]string{"magnet", "-h"}, 0},
+		{[]string{"magnet", "missing.torrent"}, exitFailure},
+		{[]string{"download", "-down", "fast", "missing.torrent"}, exitUsage},
+		{[]string{"list"}, exitFailure},
+		{[]string{"pause"}, exitUsage},
+		{[]string{"limit", "1"}, exitUsage},
+		{[]string{"daemon", "-socket", ""}, exitUsage},
+		{[]string{"daemon", "-socket", "", "-listen", ":0"}, exitUsage},
+	} {
+		if code := run(c.Args); code != c.Code {
+			t.Errorf("%v exited with %d want %d", c.Args, code, c.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// legacyPadPrefix names the padding files of torrents made before BEP 47
+const legacyPadPrefix = "_____padding_file_"
+
+// Padding reports whether the file only holds zeros that align the next file on
+// a piece. Padding files are never written, their zeros need not be downloaded.
+func (f TorrentFile) Padding() bool {
+	return strings.Contains(f.Attr, "p") ||
+		len(f.Path) > 0 && strings.HasPrefix(f.Path[len(f.Path)-1], legacyPadPrefix)
+}
+
+// Executable reports whether the file gets the executable bit
+func (f TorrentFile) Executable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+// Hidden reports whether the file is meant to be hidden, which is left to the
+// file name on systems other than Windows
+func (f TorrentFile) Hidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// Symlink reports whether the file is a symlink to SymlinkPath
+func (f TorrentFile) Symlink() bool {
+	return strings.Contains(f.Attr, "l") && len(f.SymlinkPath) > 0
+}
+
+// paddingBlocks marks, by piece, the blocks that lie entirely in padding files
+func (t *TorrentInfo) paddingBlocks() map[int][]bool {
+	padding := map[int][]bool{}
+	pieceLength := int64(t.PieceLength)
+	for _, file := range t.FileList() {
+		if !file.Padding() || file.Length == 0 {
+			continue
+		}
+		end := file.Offset + file.Length
+		for piece := file.Offset / pieceLength; piece*pieceLength < end; piece++ {
+			begin := piece * pieceLength
+			size := t.PieceSize(int(piece))
+			for block := 0; block*maxRequestLength < size; block++ {
+				blockBegin := begin + int64(block*maxRequestLength)
+				blockEnd := blockBegin + maxRequestLength
+				if blockEnd > begin+int64(size) {
+					blockEnd = begin + int64(size)
+				}
+				if blockBegin < file.Offset || blockEnd > end {
+					continue
+				}
+				if padding[int(piece)] == nil {
+					padding[int(piece)] = make([]bool, (size+maxRequestLength-1)/maxRequestLength)
+				}
+				padding[int(piece)][block] = true
+			}
+		}
+	}
+	return padding
+}
+
+// checkSymlinks makes sure every symlink points inside the torrent and no file
+// is written through one
+func (t *TorrentInfo) checkSymlinks() error {
+	files := t.FileList()
+	for _, link := range files {
+		if !link.Symlink() {
+			continue
+		}
+		for _, part := range link.SymlinkPath {
+			if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+				return fmt.Errorf("Symlink %q has a bad target %q", strings.Join(link.Path, "/"), strings.Join(link.SymlinkPath, "/"))
+			}
+		}
+		prefix := strings.Join(link.Path, "/") + "/"
+		for _, file := range files {
+			if strings.HasPrefix(strings.Join(file.Path, "/"), prefix) {
+				return fmt.Errorf("File %q is inside symlink %q", strings.Join(file.Path, "/"), strings.Join(link.Path, "/"))
+			}
+		}
+	}
+	return nil
+}
+
+// createSymlink links a symlink of the torrent to its target, relative to the
+// link so the download can be moved
+func (t *fileTorrent) createSymlink(file int) error {
+	root := t.Dir
+	if !t.Info.singleFile() {
+		root = filepath.Join(t.Dir, t.paths[file][0])
+	}
+	link := t.path(file)
+	target := root
+	for _, name := range t.Files[file].SymlinkPath {
+		name, err := sanitizeName(name)
+		if err != nil {
+			return fmt.Errorf("Symlink %s: %v", link, err)
+		}
+		target = filepath.Join(target, name)
+	}
+	if !inside(root, target) {
+		return fmt.Errorf("Symlink %s points outside the torrent", link)
+	}
+	target, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = t.within(link)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(link), 0755)
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Readlink(link); err == nil {
+		if existing == target {
+			return nil
+		}
+		os.Remove(link)
+	}
+	return os.Symlink(target, link)
+}
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAttrInfo is a torrent of a file, padding up to the next piece, an
+// executable file and a symlink to it
+func testAttrInfo() (*TorrentInfo, []byte) {
+	pieceLength := 2 * maxRequestLength
+	a, b := testContent(100, 5), testContent(pieceLength+10, 6)
+	stream := append(append(append([]byte(nil), a...), make([]byte, pieceLength-len(a))...), b...)
+	var hashes []byte
+	for i := 0; i < len(stream); i += pieceLength {
+		end := i + pieceLength
+		if end > len(stream) {
+			end = len(stream)
+		}
+		hash := sha1.Sum(stream[i:end])
+		hashes = append(hashes, hash[:]...)
+	}
+	info := &TorrentInfo{
+		Name:        "attrs",
+		PieceLength: pieceLength,
+		Pieces:      string(hashes),
+		Files: []fileInfo{
+			{Length: len(a), Path: []string{"a"}, SHA1: strings.Repeat("s", 20)},
+			{Length: pieceLength - len(a), Path: []string{".pad", "32668"}, Attr: "p"},
+			{Length: len(b), Path: []string{"bin", "b"}, Attr: "x"},
+			{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"bin", "b"}},
+		},
+	}
+	return info, stream
+}
+
+func TestFileAttributes(t *testing.T) {
+	info, _ := testAttrInfo()
+	var buf bytes.Buffer
+	err := (&MetaInfo{Info: *info}).Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := ReadTorrentFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := mi.Info.FileList()
+	if !files[1].Padding() || files[0].Padding() || !files[2].Executable() || !files[3].Symlink() {
+		t.Errorf("attributes were lost: %+v", files)
+	}
+	if string(files[0].SHA1) != strings.Repeat("s", 20) || strings.Join(files[3].SymlinkPath, "/") != "bin/b" {
+		t.Errorf("got sha1 %q and symlink path %v", files[0].SHA1, files[3].SymlinkPath)
+	}
+	if legacy := (TorrentFile{Path: []string{"t", "_____padding_file_0"}}); !legacy.Padding() {
+		t.Error("a BitComet padding file is not padding")
+	}
+
+	// The second block of the first piece is all padding
+	padding := info.paddingBlocks()
+	if len(padding) != 1 || len(padding[0]) != 2 || padding[0][0] || !padding[0][1] {
+		t.Errorf("got padding blocks %v", padding)
+	}
+
+	for _, bad := range [][]string{{".."}, {"bin", "..", ".."}, {""}, {"/etc"}} {
+		info, _ := testAttrInfo()
+		info.Files[3].SymlinkPath = bad
+		if info.checkSymlinks() == nil {
+			t.Errorf("symlink to %q was accepted", bad)
+		}
+	}
+	info, _ = testAttrInfo()
+	info.Files = append(info.Files, fileInfo{Length: 1, Path: []string{"link", "escape"}})
+	if info.checkSymlinks() == nil {
+		t.Error("a file inside a symlink was accepted")
+	}
+}
+
+func TestFileStorageAttributes(t *testing.T) {
+	info, stream := testAttrInfo()
+	if err := info.PrepareForDownload(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	storage := NewFileStorage(dir)
+	ts, err := storage.OpenTorrent(info, [20]byte{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < info.NumPieces(); i++ {
+		begin := i * info.PieceLength
+		if _, err := ts.WriteAt(i, stream[begin:begin+info.PieceSize(i)], 0); err != nil {
+			t.Fatal(err)
+		}
+		ts.MarkComplete(i)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "attrs", ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding was written: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		stat, err := os.Stat(filepath.Join(dir, "attrs", "bin", "b"))
+		if err != nil || stat.Mode()&0100 == 0 {
+			t.Errorf("executable file has mode %v: %v", stat.Mode(), err)
+		}
+		target, err := os.Readlink(filepath.Join(dir, "attrs", "link"))
+		if err != nil || target != filepath.Join("bin", "b") {
+			t.Errorf("symlink points to %q: %v", target, err)
+		}
+	}
+
+	// The pieces holding padding are still complete, and read back with zeros
+	ts, err = storage.OpenTorrent(info, [20]byte{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	got := make([]byte, info.PieceSize(0))
+	if !ts.Completed(0) {
+		t.Fatal("piece with padding is not complete after reopening")
+	}
+	if _, err := ts.ReadAt(0, got, 0); err != nil || !bytes.Equal(got, stream[:len(got)]) {
+		t.Errorf("read back piece 0 wrong: %v", err)
+	}
+}
+
+func TestWebSeedSkipsPadding(t *testing.T) {
+	info, stream := testAttrInfo()
+	info.Files = info.Files[:3]
+	files := map[string][]byte{"/attrs/a": stream[:100], "/attrs/bin/b": stream[info.PieceLength:]}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			t.Errorf("requested %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	d, err := NewDownload(&File{InfoHash: [20]byte{5}, Metadata: info, WebSeeds: []string{server.URL}},
+		NewMemoryStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
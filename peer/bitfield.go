@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield is a set of pieces of a torrent. It is kept in the format of the
+// bitfield message: the high bit of the first byte is piece 0, and the spare
+// bits of the last byte are always zero.
+type Bitfield struct {
+	bits []byte
+	n    int
+}
+
+// NewBitfield returns an empty bitfield of n pieces
+func NewBitfield(n int) Bitfield {
+	return Bitfield{bits: make([]byte, (n+7)/8), n: n}
+}
+
+// ParseBitfield reads the payload of a bitfield message for a torrent of n pieces.
+// It must be exactly long enough and its spare bits must be zero.
+func ParseBitfield(payload []byte, n int) (Bitfield, error) {
+	b := NewBitfield(n)
+	if len(payload) != len(b.bits) {
+		return b, fmt.Errorf("Bitfield of %d bytes for %d pieces", len(payload), n)
+	}
+	copy(b.bits, payload)
+	if spare := b.spareMask(); len(b.bits) > 0 && b.bits[len(b.bits)-1]&spare != 0 {
+		return NewBitfield(n), errors.New("Bitfield has spare bits set")
+	}
+	return b, nil
+}
+
+// spareMask selects the unused bits of the last byte
+func (b Bitfield) spareMask() byte {
+	if b.n%8 == 0 {
+		return 0
+	}
+	return 0xff >> uint(b.n%8)
+}
+
+// Len is the number of pieces
+func (b Bitfield) Len() int {
+	return b.n
+}
+
+// Has reports whether piece i is set, pieces out of range are not
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i >= b.n {
+		return false
+	}
+	return b.bits[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// Set adds piece i, it returns false if i is out of range
+func (b *Bitfield) Set(i int) bool {
+	if i < 0 || i >= b.n {
+		return false
+	}
+	b.bits[i/8] |= 0x80 >> uint(i%8)
+	return true
+}
+
+// Clear removes piece i
+func (b *Bitfield) Clear(i int) {
+	if i >= 0 && i < b.n {
+		b.bits[i/8] &^= 0x80 >> uint(i%8)
+	}
+}
+
+// Count is the number of pieces set
+func (b Bitfield) Count() int {
+	count := 0
+	for _, x := range b.bits {
+		count += bits.OnesCount8(x)
+	}
+	return count
+}
+
+// Indexes lists the pieces set in order
+func (b Bitfield) Indexes() []int {
+	var indexes []int
+	for i, x := range b.bits {
+		for x != 0 {
+			j := bits.LeadingZeros8(x)
+			indexes = append(indexes, i*8+j)
+			x &^= 0x80 >> uint(j)
+		}
+	}
+	return indexes
+}
+
+// And returns the pieces set in both bitfields, which must be the same length
+func (b Bitfield) And(other Bitfield) Bitfield {
+	and := NewBitfield(b.n)
+	for i := range and.bits {
+		if i < len(other.bits) {
+			and.bits[i] = b.bits[i] & other.bits[i]
+		}
+	}
+	return and
+}
+
+// Not returns the pieces that are not set
+func (b Bitfield) Not() Bitfield {
+	not := NewBitfield(b.n)
+	for i, x := range b.bits {
+		not.bits[i] = ^x
+	}
+	if len(not.bits) > 0 {
+		not.bits[len(not.bits)-1] &^= b.spareMask()
+	}
+	return not
+}
+
+// Clone returns a copy of the bitfield
+func (b Bitfield) Clone() Bitfield {
+	return Bitfield{bits: append([]byte(nil), b.bits...), n: b.n}
+}
+
+// Bytes is the payload of a bitfield message, it must not be modified
+func (b Bitfield) Bytes() []byte {
+	return b.bits
+}
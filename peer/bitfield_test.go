@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBitfield(t *testing.T) {
+	b := NewBitfield(10)
+	if len(b.Bytes()) != 2 {
+		t.Fatalf("got %d bytes for 10 pieces want 2", len(b.Bytes()))
+	}
+	for _, i := range []int{0, 7, 9} {
+		if !b.Set(i) {
+			t.Errorf("Set(%d) failed", i)
+		}
+	}
+	if b.Set(10) || b.Set(-1) {
+		t.Error("Set accepted a piece out of range")
+	}
+	if b.Has(10) || !b.Has(9) || b.Has(8) {
+		t.Error("Has is wrong at the end of the bitfield")
+	}
+	if got := b.Bytes(); got[0] != 0x81 || got[1] != 0x40 {
+		t.Errorf("got bytes %x want 8140", got)
+	}
+	if got := b.Indexes(); !reflect.DeepEqual(got, []int{0, 7, 9}) {
+		t.Errorf("got indexes %v", got)
+	}
+
+	not := b.Not()
+	if not.Count() != 7 || not.Bytes()[1]&0x3f != 0 {
+		t.Errorf("Not set %d pieces or the spare bits: %x", not.Count(), not.Bytes())
+	}
+	if b.And(not).Count() != 0 {
+		t.Error("a bitfield and its complement share pieces")
+	}
+	clone := b.Clone()
+	clone.Clear(0)
+	if !b.Has(0) || clone.Has(0) || clone.Count() != 2 {
+		t.Error("Clone shares its bits with the original")
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	for _, tc := range []struct {
+		payload []byte
+		n       int
+		ok      bool
+	}{
+		{[]byte{0xff, 0xc0}, 10, true},
+		{[]byte{0xff, 0xe0}, 10, false}, // spare bit set
+		{[]byte{0xff}, 10, false},       // too short
+		{[]byte{0xff, 0, 0}, 10, false}, // too long
+		{[]byte{0xff}, 8, true},
+		{nil, 0, true},
+	} {
+		b, err := ParseBitfield(tc.payload, tc.n)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseBitfield(%x, %d) error %v", tc.payload, tc.n, err)
+			continue
+		}
+		if tc.ok && b.Count() != len(b.Indexes()) {
+			t.Errorf("ParseBitfield(%x, %d) count %d", tc.payload, tc.n, b.Count())
+		}
+	}
+}
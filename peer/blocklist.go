@@ -0,0 +1,265 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Blocklist is a set of IP ranges that peers must not be in. It reads eMule
+// ipfilter.dat files, PeerGuardian P2P text files and lists of CIDRs or single
+// addresses, and can be reloaded while it is in use.
+type Blocklist struct {
+	mu      sync.RWMutex
+	ranges  []ipRange // sorted and merged
+	peers   int64
+	inbound int64
+}
+
+// BlocklistStats counts what a blocklist kept out
+type BlocklistStats struct {
+	Ranges  int
+	Peers   int64 // peers from trackers and users that were never dialed
+	Inbound int64 // incoming connections closed before their handshake
+}
+
+// ipRange is an inclusive range of addresses, IPv4 ones are kept in their 16
+// byte form so both families share one sorted list
+type ipRange struct {
+	First, Last [16]byte
+}
+
+// NewBlocklist reads a blocklist, see Load
+func NewBlocklist(r io.Reader) (*Blocklist, error) {
+	b := &Blocklist{}
+	return b, b.Load(r)
+}
+
+// LoadBlocklistFile reads a blocklist from a file, see Load
+func LoadBlocklistFile(path string) (*Blocklist, error) {
+	b := &Blocklist{}
+	return b, b.LoadFile(path)
+}
+
+// Load replaces the ranges with the ones read from r. Each line is an eMule
+// range with its access level ("1.2.3.0 - 1.2.3.255 , 000 , name", levels of
+// 128 and above are not blocked), a P2P range ("name:1.2.3.0-1.2.3.255"), a
+// range of two addresses, a CIDR or a single address. Blank lines and lines
+// starting with # or // are skipped. The ranges are left as they were if any
+// line is malformed.
+func (b *Blocklist) Load(r io.Reader) error {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, blocked, err := parseBlocklistLine(line)
+		if err != nil {
+			return fmt.Errorf("Blocklist line %d: %v", n, err)
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	ranges = mergeRanges(ranges)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ranges = ranges
+	return nil
+}
+
+// LoadFile replaces the ranges with the ones read from a file, see Load
+func (b *Blocklist) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Load(f)
+}
+
+// Contains reports whether ip is in a blocked range, a nil blocklist blocks nothing
+func (b *Blocklist) Contains(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	key, ok := ipKey(ip)
+	if !ok {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].Last[:], key[:]) >= 0
+	})
+	return i < len(b.ranges) && bytes.Compare(b.ranges[i].First[:], key[:]) <= 0
+}
+
+// BlockPeer is Contains, counting the peer as blocked if it is
+func (b *Blocklist) BlockPeer(ip net.IP) bool {
+	if !b.Contains(ip) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peers++
+	return true
+}
+
+// BlockInbound is Contains, counting the incoming connection as blocked if it is
+func (b *Blocklist) BlockInbound(ip net.IP) bool {
+	if !b.Contains(ip) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inbound++
+	return true
+}
+
+// Stats returns the number of ranges and what was blocked so far
+func (b *Blocklist) Stats() BlocklistStats {
+	if b == nil {
+		return BlocklistStats{}
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return BlocklistStats{Ranges: len(b.ranges), Peers: b.peers, Inbound: b.inbound}
+}
+
+// parseBlocklistLine parses a line of any supported format. blocked is false
+// for an eMule range whose access level allows it.
+func parseBlocklistLine(line string) (rng ipRange, blocked bool, err error) {
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		// A P2P name may hold commas too, only a number makes it an eMule line
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			rng, err = parseRange(fields[0])
+			return rng, level < 128, err
+		}
+	}
+	if rng, err = parseRange(line); err == nil {
+		return rng, true, nil
+	}
+	// The name of a P2P range may hold anything, the range follows the last colon
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if rng, err := parseRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+	return rng, false, err
+}
+
+// parseRange parses "first-last", a CIDR or a single address
+func parseRange(s string) (ipRange, error) {
+	var rng ipRange
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return rng, err
+		}
+		first := network.IP.To16()
+		last := make(net.IP, len(first))
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			// Line the mask up with the IPv4 part of the 16 byte address
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		copy(rng.First[:], first)
+		copy(rng.Last[:], last)
+		return rng, nil
+	}
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	from, ok := ipKey(parseIP(first))
+	to, ok2 := ipKey(parseIP(last))
+	if !ok || !ok2 {
+		return rng, fmt.Errorf("Bad address range %q", s)
+	}
+	if bytes.Compare(from[:], to[:]) > 0 {
+		return rng, fmt.Errorf("Range %q ends before it starts", s)
+	}
+	rng.First, rng.Last = from, to
+	return rng, nil
+}
+
+// parseIP also accepts IPv4 addresses padded with zeros, as in ipfilter.dat
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
+
+func ipKey(ip net.IP) ([16]byte, bool) {
+	var key [16]byte
+	ip = ip.To16()
+	if ip == nil {
+		return key, false
+	}
+	copy(key[:], ip)
+	return key, true
+}
+
+// mergeRanges sorts ranges and joins the ones that overlap or touch
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].First[:], ranges[j].First[:]) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.Last
+			if !increment(&next) || bytes.Compare(r.First[:], next[:]) <= 0 {
+				if bytes.Compare(r.Last[:], last.Last[:]) > 0 {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// increment adds one to the address, it returns false if it wrapped around
+func increment(key *[16]byte) bool {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# company policy
+// ipfilter.dat
+001.002.003.000 - 001.002.003.255 , 000 , Some ISP
+005.000.000.000 - 005.255.255.255 , 200 , Allowed by level
+Bad, Corp:10.0.0.10-10.0.0.20
+10.0.0.21-10.0.0.30
+192.168.0.0/16
+172.16.5.5
+2001:db8::/32
+2001:db9::1-2001:db9::ff
+`
+
+func TestBlocklist(t *testing.T) {
+	b, err := NewBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"1.2.3.0":          true,
+		"1.2.3.255":        true,
+		"1.2.4.0":          false,
+		"5.1.1.1":          false,
+		"10.0.0.9":         false,
+		"10.0.0.10":        true,
+		"10.0.0.25":        true,
+		"10.0.0.31":        false,
+		"192.168.200.1":    true,
+		"172.16.5.5":       true,
+		"172.16.5.6":       false,
+		"::ffff:1.2.3.4":   true,
+		"2001:db8:ffff::1": true,
+		"2001:db9::80":     true,
+		"2001:db9::100":    false,
+	} {
+		if got := b.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("Contains(%s) = %v want %v", ip, got, want)
+		}
+	}
+	// The two adjacent 10.0.0.x ranges are merged
+	if stats := b.Stats(); stats.Ranges != 6 {
+		t.Errorf("got %d ranges want 6", stats.Ranges)
+	}
+
+	// A bad reload keeps the old ranges
+	if err := b.Load(strings.NewReader("1.2.3.4 - nonsense , 0 , x")); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+	if !b.Contains(net.ParseIP("1.2.3.4")) {
+		t.Error("ranges were dropped by a failed reload")
+	}
+	if err := b.Load(strings.NewReader("8.8.8.8")); err != nil {
+		t.Fatal(err)
+	}
+	if b.Contains(net.ParseIP("1.2.3.4")) || !b.Contains(net.ParseIP("8.8.8.8")) {
+		t.Error("reload did not replace the ranges")
+	}
+}
+
+func TestBlocklistFiltersPeers(t *testing.T) {
+	limits := NewLimits(10)
+	limits.Blocklist, _ = NewBlocklist(strings.NewReader("10.0.0.0/8"))
+	d := newTestDownload(t, limits)
+	d.AddPeers([]Peer{{IP: net.IPv4(10, 1, 2, 3), Port: 1}, {IP: net.IPv4(11, 1, 2, 3), Port: 1}})
+	if len(d.peers) != 1 {
+		t.Errorf("got %d candidates, the blocked peer should not be one", len(d.peers))
+	}
+	if stats := limits.Blocklist.Stats(); stats.Peers != 1 {
+		t.Errorf("got %d blocked peers want 1", stats.Peers)
+	}
+}
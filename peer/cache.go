@@ -0,0 +1,510 @@
+package peer
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig limits the memory used by CachedStorage
+type CacheConfig struct {
+	// WriteBytes of verified pieces can wait to be flushed, zero writes through
+	WriteBytes int64
+	// ReadBytes of recently read pieces are kept for seeding, zero disables the read cache
+	ReadBytes int64
+	// Writes are flushed once FlushBytes are pending across the cache, or once the
+	// oldest of a torrent's is FlushAge old. Zero FlushBytes flushes them at once,
+	// zero FlushAge waits for FlushBytes however long it takes.
+	FlushBytes int64
+	FlushAge   time.Duration
+}
+
+// DefaultCacheConfig suits a handful of torrents on a desktop
+var DefaultCacheConfig = CacheConfig{
+	WriteBytes: 32 << 20,
+	ReadBytes:  64 << 20,
+	FlushBytes: 8 << 20,
+	FlushAge:   5 * time.Second,
+}
+
+// CacheStats counts how the cache has been used
+type CacheStats struct {
+	ReadHits     int64
+	ReadMisses   int64
+	Flushes      int64 // pieces written back to the storage
+	PendingBytes int64 // waiting in the write cache
+	CachedBytes  int64 // held by the read cache
+}
+
+// CachedStorage puts a bounded write-back and read cache in front of another
+// storage. Writes return once they are cached and are flushed in the background,
+// a piece is only marked complete in the storage behind it once it has been
+// written and synced there. Writers wait when the write cache is full, so a slow
+// disk slows the download down rather than growing memory.
+type CachedStorage struct {
+	Storage Storage
+	Config  CacheConfig
+
+	mu       sync.Mutex
+	flushed  *sync.Cond // signalled whenever pending bytes are written back
+	torrents map[*cachedTorrent]bool
+	waiting  int // writers waiting for room in the write cache
+	pending  int64
+	cached   int64
+	hits     int64
+	misses   int64
+	flushes  int64
+}
+
+// NewCachedStorage caches the pieces of storage within the limits of config
+func NewCachedStorage(storage Storage, config CacheConfig) *CachedStorage {
+	c := &CachedStorage{Storage: storage, Config: config, torrents: map[*cachedTorrent]bool{}}
+	c.flushed = sync.NewCond(&c.mu)
+	return c
+}
+
+// wakeFlushers has every torrent check whether its writes are due. c.mu must be held.
+func (c *CachedStorage) wakeFlushers() {
+	for t := range c.torrents {
+		t.signal()
+	}
+}
+
+// Stats returns the cache's counters across all its torrents
+func (c *CachedStorage) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		ReadHits:     atomic.LoadInt64(&c.hits),
+		ReadMisses:   atomic.LoadInt64(&c.misses),
+		Flushes:      c.flushes,
+		PendingBytes: c.pending,
+		CachedBytes:  c.cached,
+	}
+}
+
+func (c *CachedStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	storage, err := c.Storage.OpenTorrent(info, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	t := &cachedTorrent{
+		Cache:    c,
+		Storage:  storage,
+		Info:     info,
+		writes:   map[int]*cachedWrite{},
+		unsynced: map[int]bool{},
+		reads:    map[int]*list.Element{},
+		lru:      list.New(),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.torrents[t] = true
+	c.mu.Unlock()
+	go t.flusher()
+	if _, ok := storage.(FileSelector); ok {
+		return selectingTorrent{t}, nil
+	}
+	return t, nil
+}
+
+// cachedWrite is a piece waiting in the write cache
+type cachedWrite struct {
+	Segments []writeSegment
+	Size     int64
+	Complete bool // mark complete once written back
+	Since    time.Time
+}
+
+type writeSegment struct {
+	Off  int64
+	Data []byte
+}
+
+type readEntry struct {
+	Piece int
+	Data  []byte
+}
+
+type cachedTorrent struct {
+	Cache   *CachedStorage
+	Storage TorrentStorage
+	Info    *TorrentInfo
+
+	ioMu     sync.Mutex   // the storage behind the cache is used by one goroutine at a time
+	unsynced map[int]bool // pieces written back but not synced, guarded by ioMu
+	mu       sync.Mutex
+	writes   map[int]*cachedWrite
+	order    []int // pieces in the order they were written
+	reads    map[int]*list.Element
+	lru      *list.List // of *readEntry, most recent first
+	flushErr error
+	wake     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func (t *cachedTorrent) WriteAt(piece int, p []byte, off int64) (int, error) {
+	c := t.Cache
+	size := int64(len(p))
+	if c.Config.WriteBytes <= 0 {
+		t.dropRead(piece)
+		t.ioMu.Lock()
+		defer t.ioMu.Unlock()
+		t.unsynced[piece] = true
+		return t.Storage.WriteAt(piece, p, off)
+	}
+
+	c.mu.Lock()
+	for c.pending > 0 && c.pending+size > c.Config.WriteBytes {
+		// Make room whether or not the writes are due
+		c.waiting++
+		c.wakeFlushers()
+		c.flushed.Wait()
+		c.waiting--
+	}
+	c.pending += size
+	if c.pending >= c.Config.FlushBytes {
+		c.wakeFlushers()
+	}
+	c.mu.Unlock()
+
+	t.mu.Lock()
+	if t.flushErr != nil {
+		err := t.flushErr
+		t.mu.Unlock()
+		t.Cache.release(size)
+		return 0, err
+	}
+	w := t.writes[piece]
+	if w == nil {
+		w = &cachedWrite{Since: time.Now()}
+		t.writes[piece] = w
+		t.order = append(t.order, piece)
+	}
+	w.Segments = append(w.Segments, writeSegment{off, append([]byte(nil), p...)})
+	w.Size += size
+	t.mu.Unlock()
+	t.dropRead(piece)
+	t.signal()
+	return len(p), nil
+}
+
+// selectingTorrent is a cached torrent whose storage can leave out unwanted
+// files, the cache only selects files when the storage behind it does
+type selectingTorrent struct {
+	*cachedTorrent
+}
+
+// SelectFiles is passed on to the storage behind the cache
+func (t selectingTorrent) SelectFiles(wanted []bool) error {
+	t.ioMu.Lock()
+	defer t.ioMu.Unlock()
+	return t.Storage.(FileSelector).SelectFiles(wanted)
+}
+
+func (t *cachedTorrent) MarkComplete(piece int) error {
+	t.mu.Lock()
+	if t.flushErr != nil {
+		defer t.mu.Unlock()
+		return t.flushErr
+	}
+	if w := t.writes[piece]; w != nil {
+		w.Complete = true
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+	t.ioMu.Lock()
+	defer t.ioMu.Unlock()
+	return t.markComplete(piece)
+}
+
+// markComplete syncs a piece that was written back and marks it complete in
+// the storage behind the cache. t.ioMu must be held.
+func (t *cachedTorrent) markComplete(piece int) error {
+	err := t.sync(piece)
+	if err != nil {
+		return err
+	}
+	return t.Storage.MarkComplete(piece)
+}
+
+// sync flushes a piece in the storage behind the cache to the disk, when it
+// can. t.ioMu must be held.
+func (t *cachedTorrent) sync(piece int) error {
+	delete(t.unsynced, piece)
+	if syncer, ok := t.Storage.(PieceSyncer); ok {
+		return syncer.SyncPiece(piece)
+	}
+	return nil
+}
+
+func (t *cachedTorrent) Completed(piece int) bool {
+	t.mu.Lock()
+	if w := t.writes[piece]; w != nil && w.Complete {
+		t.mu.Unlock()
+		return true
+	}
+	t.mu.Unlock()
+	t.ioMu.Lock()
+	defer t.ioMu.Unlock()
+	return t.Storage.Completed(piece)
+}
+
+func (t *cachedTorrent) ReadAt(piece int, p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	t.mu.Lock()
+	if w := t.writes[piece]; w != nil {
+		// The latest write covering the whole range answers it
+		for i := len(w.Segments) - 1; i >= 0; i-- {
+			s := w.Segments[i]
+			if s.Off <= off && end <= s.Off+int64(len(s.Data)) {
+				n := copy(p, s.Data[off-s.Off:])
+				t.mu.Unlock()
+				atomic.AddInt64(&t.Cache.hits, 1)
+				return n, nil
+			}
+		}
+	}
+	if e := t.reads[piece]; e != nil {
+		t.lru.MoveToFront(e)
+		data := e.Value.(*readEntry).Data
+		if end <= int64(len(data)) {
+			n := copy(p, data[off:])
+			t.mu.Unlock()
+			atomic.AddInt64(&t.Cache.hits, 1)
+			return n, nil
+		}
+	}
+	t.mu.Unlock()
+	atomic.AddInt64(&t.Cache.misses, 1)
+
+	// Pending writes must reach the storage before it can answer
+	t.flush(piece)
+	size := int64(t.Info.PieceSize(piece))
+	if t.Cache.Config.ReadBytes <= 0 || size > t.Cache.Config.ReadBytes || end > size {
+		t.ioMu.Lock()
+		defer t.ioMu.Unlock()
+		return t.Storage.ReadAt(piece, p, off)
+	}
+	data := make([]byte, size)
+	t.ioMu.Lock()
+	_, err := t.Storage.ReadAt(piece, data, 0)
+	t.ioMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	t.addRead(piece, data)
+	return copy(p, data[off:]), nil
+}
+
+// addRead puts a whole piece in the read cache, evicting the least recently used
+func (t *cachedTorrent) addRead(piece int, data []byte) {
+	c := t.Cache
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reads[piece] != nil || t.writes[piece] != nil {
+		return
+	}
+	t.reads[piece] = t.lru.PushFront(&readEntry{piece, data})
+	c.mu.Lock()
+	c.cached += int64(len(data))
+	limit := c.Config.ReadBytes
+	over := c.cached > limit
+	c.mu.Unlock()
+	for over && t.lru.Len() > 1 {
+		e := t.lru.Back()
+		t.lru.Remove(e)
+		evicted := e.Value.(*readEntry)
+		delete(t.reads, evicted.Piece)
+		c.mu.Lock()
+		c.cached -= int64(len(evicted.Data))
+		over = c.cached > limit
+		c.mu.Unlock()
+	}
+}
+
+func (t *cachedTorrent) dropRead(piece int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.reads[piece]; e != nil {
+		t.lru.Remove(e)
+		delete(t.reads, piece)
+		t.Cache.mu.Lock()
+		t.Cache.cached -= int64(len(e.Value.(*readEntry).Data))
+		t.Cache.mu.Unlock()
+	}
+}
+
+func (t *cachedTorrent) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flusher writes pieces back in the order they were written until Close, once
+// they are due
+func (t *cachedTorrent) flusher() {
+	defer close(t.stopped)
+	var timer *time.Timer
+	var aged <-chan time.Time
+	for {
+		select {
+		case <-t.wake:
+		case <-aged:
+		case <-t.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			t.flush(-1)
+			return
+		}
+		due, wait := t.flushDue()
+		if due {
+			t.flush(-1)
+			due, wait = t.flushDue()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, aged = nil, nil
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			aged = timer.C
+		}
+	}
+}
+
+// flushDue reports whether the torrent's pending writes are to be flushed now,
+// or else how long until its oldest one is FlushAge old, zero for never
+func (t *cachedTorrent) flushDue() (bool, time.Duration) {
+	c := t.Cache
+	c.mu.Lock()
+	due := c.pending >= c.Config.FlushBytes || c.waiting > 0
+	c.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.order) == 0 {
+		return false, 0
+	}
+	if due {
+		return true, 0
+	}
+	if c.Config.FlushAge <= 0 {
+		return false, 0
+	}
+	age := time.Since(t.writes[t.order[0]].Since)
+	if age >= c.Config.FlushAge {
+		return true, 0
+	}
+	return false, c.Config.FlushAge - age
+}
+
+// flush writes back a single piece, or every pending piece when piece is -1
+func (t *cachedTorrent) flush(piece int) {
+	for {
+		t.mu.Lock()
+		index := -1
+		if piece >= 0 {
+			if t.writes[piece] != nil {
+				index = piece
+			}
+		} else if len(t.order) > 0 {
+			index = t.order[0]
+		}
+		if index < 0 {
+			t.mu.Unlock()
+			return
+		}
+		w := t.writes[index]
+		delete(t.writes, index)
+		for i, p := range t.order {
+			if p == index {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+		// Hold ioMu before letting go of mu, so nobody reads the storage in between
+		t.ioMu.Lock()
+		t.mu.Unlock()
+		err := t.writeBack(index, w)
+		t.ioMu.Unlock()
+
+		if err != nil {
+			t.mu.Lock()
+			if t.flushErr == nil {
+				t.flushErr = err
+			}
+			t.mu.Unlock()
+		}
+		c := t.Cache
+		c.mu.Lock()
+		c.flushes++
+		c.mu.Unlock()
+		c.release(w.Size)
+		if piece >= 0 {
+			return
+		}
+	}
+}
+
+func (t *cachedTorrent) writeBack(piece int, w *cachedWrite) error {
+	for _, s := range w.Segments {
+		_, err := t.Storage.WriteAt(piece, s.Data, s.Off)
+		if err != nil {
+			return err
+		}
+	}
+	t.unsynced[piece] = true
+	if w.Complete {
+		return t.markComplete(piece)
+	}
+	return nil
+}
+
+func (c *CachedStorage) release(size int64) {
+	c.mu.Lock()
+	c.pending -= size
+	c.mu.Unlock()
+	c.flushed.Broadcast()
+}
+
+// Close writes back and syncs every pending piece, then closes the storage
+// behind the cache
+func (t *cachedTorrent) Close() error {
+	close(t.stop)
+	<-t.stopped
+	t.Cache.mu.Lock()
+	delete(t.Cache.torrents, t)
+	t.Cache.mu.Unlock()
+	t.mu.Lock()
+	var cached int64
+	for piece, e := range t.reads {
+		cached += int64(len(e.Value.(*readEntry).Data))
+		delete(t.reads, piece)
+	}
+	t.lru.Init()
+	err := t.flushErr
+	t.mu.Unlock()
+	t.Cache.mu.Lock()
+	t.Cache.cached -= cached
+	t.Cache.mu.Unlock()
+	t.ioMu.Lock()
+	for piece := range t.unsynced {
+		syncErr := t.sync(piece)
+		if err == nil {
+			err = syncErr
+		}
+	}
+	closeErr := t.Storage.Close()
+	t.ioMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
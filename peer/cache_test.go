@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedStorage holds back writes to the memory storage until the gate is opened
+type gatedStorage struct {
+	*MemoryStorage
+	Gate chan struct{}
+}
+
+type gatedTorrent struct {
+	TorrentStorage
+	Gate chan struct{}
+}
+
+func (s gatedStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	ts, err := s.MemoryStorage.OpenTorrent(info, infoHash)
+	return gatedTorrent{ts, s.Gate}, err
+}
+
+func (t gatedTorrent) WriteAt(piece int, p []byte, off int64) (int, error) {
+	<-t.Gate
+	return t.TorrentStorage.WriteAt(piece, p, off)
+}
+
+func TestCachedStorageWriteBack(t *testing.T) {
+	info, content := testStorageInfo()
+	backing := gatedStorage{NewMemoryStorage(), make(chan struct{})}
+	cache := NewCachedStorage(backing, CacheConfig{WriteBytes: 32})
+	ts, err := cache.OpenTorrent(info, [20]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two pieces fit in the write cache while the storage is stuck
+	for piece := 0; piece < 2; piece++ {
+		ts.WriteAt(piece, content[piece*16:(piece+1)*16], 0)
+		ts.MarkComplete(piece)
+	}
+	if !ts.Completed(0) || cache.Stats().PendingBytes != 32 {
+		t.Fatalf("got stats %+v", cache.Stats())
+	}
+	got := make([]byte, 4)
+	ts.ReadAt(1, got, 2)
+	if !bytes.Equal(got, content[18:22]) {
+		t.Errorf("read from the write cache got %x want %x", got, content[18:22])
+	}
+
+	// The third has to wait for the storage
+	written := make(chan struct{})
+	go func() {
+		ts.WriteAt(2, content[32:], 0)
+		ts.MarkComplete(2)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write did not wait for the full cache to be flushed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(backing.Gate)
+	<-written
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := backing.MemoryStorage.OpenTorrent(info, [20]byte{1})
+	for piece := 0; piece < 3; piece++ {
+		if !stored.Completed(piece) {
+			t.Errorf("piece %d was not marked complete in the storage", piece)
+		}
+	}
+	if stats := cache.Stats(); stats.Flushes != 3 || stats.PendingBytes != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+// syncLog records the pieces synced and marked complete in a syncedStorage
+type syncLog struct {
+	mu      sync.Mutex
+	Entries []string
+}
+
+func (l *syncLog) add(entry string, piece int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Entries = append(l.Entries, fmt.Sprint(entry, piece))
+}
+
+func (l *syncLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.Entries, " ")
+}
+
+// syncedStorage is a memory storage that can sync pieces
+type syncedStorage struct {
+	*MemoryStorage
+	Log *syncLog
+}
+
+type syncedTorrent struct {
+	TorrentStorage
+	Log *syncLog
+}
+
+func (s syncedStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	ts, err := s.MemoryStorage.OpenTorrent(info, infoHash)
+	return syncedTorrent{ts, s.Log}, err
+}
+
+func (t syncedTorrent) SyncPiece(piece int) error {
+	t.Log.add("sync", piece)
+	return nil
+}
+
+func (t syncedTorrent) MarkComplete(piece int) error {
+	t.Log.add("complete", piece)
+	return t.TorrentStorage.MarkComplete(piece)
+}
+
+func TestCachedStorageSyncs(t *testing.T) {
+	info, content := testStorageInfo()
+	backing := syncedStorage{NewMemoryStorage(), &syncLog{}}
+	cache := NewCachedStorage(backing, CacheConfig{WriteBytes: 64})
+	ts, err := cache.OpenTorrent(info, [20]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.WriteAt(0, content[:16], 0)
+	ts.MarkComplete(0)
+	ts.WriteAt(1, content[16:32], 0)
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A piece is synced before it is marked complete, the rest on Close
+	if got := backing.Log.String(); got != "sync0 complete0 sync1" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCachedStorageFlushesWhenDue(t *testing.T) {
+	info, content := testStorageInfo()
+	waitFlushes := func(cache *CachedStorage, want int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if cache.Stats().Flushes == want {
+				return
+			}
+		}
+		t.Fatalf("got stats %+v want %d flushes", cache.Stats(), want)
+	}
+
+	cache := NewCachedStorage(NewMemoryStorage(), CacheConfig{WriteBytes: 64, FlushBytes: 32, FlushAge: time.Hour})
+	ts, _ := cache.OpenTorrent(info, [20]byte{1})
+	defer ts.Close()
+	ts.WriteAt(0, content[:16], 0)
+	time.Sleep(20 * time.Millisecond)
+	if stats := cache.Stats(); stats.Flushes != 0 || stats.PendingBytes != 16 {
+		t.Errorf("flushed below FlushBytes, got stats %+v", stats)
+	}
+	ts.WriteAt(1, content[16:32], 0)
+	waitFlushes(cache, 2)
+
+	cache = NewCachedStorage(NewMemoryStorage(), CacheConfig{WriteBytes: 64, FlushBytes: 64, FlushAge: 50 * time.Millisecond})
+	ts, _ = cache.OpenTorrent(info, [20]byte{2})
+	defer ts.Close()
+	start := time.Now()
+	ts.WriteAt(0, content[:16], 0)
+	waitFlushes(cache, 1)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("flushed after %s, before FlushAge", elapsed)
+	}
+}
+
+func TestCachedStorageReadCache(t *testing.T) {
+	info, content := testStorageInfo()
+	backing := NewMemoryStorage()
+	ts, _ := backing.OpenTorrent(info, [20]byte{1})
+	for piece := 0; piece < 3; piece++ {
+		ts.WriteAt(piece, content[piece*16:piece*16+info.PieceSize(piece)], 0)
+	}
+
+	cache := NewCachedStorage(backing, CacheConfig{ReadBytes: 32})
+	ts, _ = cache.OpenTorrent(info, [20]byte{1})
+	defer ts.Close()
+	buf := make([]byte, 8)
+	for _, piece := range []int{0, 0, 1, 0, 2, 1} {
+		if _, err := ts.ReadAt(piece, buf[:1], 0); err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != content[piece*16] {
+			t.Errorf("piece %d read the wrong data", piece)
+		}
+	}
+	// Piece 1 was evicted to make room for piece 2
+	if stats := cache.Stats(); stats.ReadHits != 2 || stats.ReadMisses != 4 || stats.CachedBytes != 19 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestCachedStorageSelectsFiles(t *testing.T) {
+	info, _ := testStorageInfo()
+	ts, _ := NewCachedStorage(NewMemoryStorage(), CacheConfig{}).OpenTorrent(info, [20]byte{1})
+	defer ts.Close()
+	if _, ok := ts.(FileSelector); ok {
+		t.Error("cache over memory storage selects files")
+	}
+	ts, _ = NewCachedStorage(NewFileStorage(t.TempDir()), CacheConfig{}).OpenTorrent(info, [20]byte{1})
+	defer ts.Close()
+	if _, ok := ts.(FileSelector); !ok {
+		t.Error("cache over file storage does not select files")
+	}
+}
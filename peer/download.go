@@ -0,0 +1,767 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 6 * time.Second
+
+// Limits are shared by every download of a client
+type Limits struct {
+	// Download and Upload cap the bytes per second of all downloads together
+	Download *RateLimiter
+	Upload   *RateLimiter
+	// Blocklist keeps peers out before they are connected to, nil for none.
+	// DHT and PEX are not supported, so peers only come from trackers, AddPeers
+	// and incoming connections.
+	Blocklist *Blocklist
+
+	mu    sync.Mutex
+	slots [3]slots // by slotKind
+	bans  map[string]time.Time
+}
+
+// NewLimits creates limits allowing maxConns peer connections across all
+// downloads, with unlimited rates. Dials in progress and unchoked peers are
+// limited to 20 each until SetConnLimits changes them.
+func NewLimits(maxConns int) *Limits {
+	l := &Limits{
+		Download: NewRateLimiter(0),
+		Upload:   NewRateLimiter(0),
+		bans:     map[string]time.Time{},
+	}
+	l.SetConnLimits(maxConns, 20, 20)
+	return l
+}
+
+// SetConnLimits changes the connections, dials in progress and unchoked peers
+// allowed across all downloads, zero for unlimited. Slots already in use are
+// not taken back, the new limits apply as they are given up.
+func (l *Limits) SetConnLimits(maxConns, maxHalfOpen, maxUnchoked int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.slots[slotConn].Max = maxConns
+	l.slots[slotHalfOpen].Max = maxHalfOpen
+	l.slots[slotUnchoke].Max = maxUnchoked
+}
+
+// Ban keeps every download from connecting to ip for duration
+func (l *Limits) Ban(ip net.IP, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[ip.String()] = time.Now().Add(duration)
+}
+
+// Banned reports whether ip is banned
+func (l *Limits) Banned(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.bans[ip.String()]
+	if ok && time.Now().After(until) {
+		delete(l.bans, ip.String())
+		return false
+	}
+	return ok
+}
+
+// allowed reports whether a peer at ip may be connected to, it is neither
+// banned nor blocked. The blocklist may have been reloaded since the peer was added.
+func (l *Limits) allowed(ip net.IP) bool {
+	return !l.Banned(ip) && !l.Blocklist.Contains(ip)
+}
+
+// acquire takes a slot of each kind, or none of them if any is full
+func (l *Limits) acquire(kinds ...slotKind) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range kinds {
+		if !l.slots[k].free() {
+			return false
+		}
+	}
+	for _, k := range kinds {
+		l.slots[k].Used++
+	}
+	return true
+}
+
+// release gives back a slot taken by acquire
+func (l *Limits) release(k slotKind) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.slots[k].Used--
+}
+
+// Download is a torrent being downloaded from the swarm. Verified pieces are
+// remembered, so a download that was stopped picks up where it left off when
+// Run is called again.
+type Download struct {
+	File    *File
+	Storage Storage
+	Limits  *Limits
+	// DownloadLimit and UploadLimit cap the bytes per second of this download
+	DownloadLimit *RateLimiter
+	UploadLimit   *RateLimiter
+	// OnEvent is called for every event of the download, one call at a time.
+	// It must be set before Run and should return quickly.
+	OnEvent func(Event)
+	// Seed keeps Run going once the wanted pieces are verified, uploading to
+	// peers until ctx is done
+	Seed bool
+
+	eventMu    sync.Mutex
+	rate       rateMeter  // of verified pieces received from peers
+	upRate     rateMeter  // of blocks sent to peers
+	storageMu  sync.Mutex // serializes the storage of a run
+	storage    TorrentStorage
+	mu         sync.Mutex
+	have       Bitfield   // verified and stored in full
+	partial    Bitfield   // verified, but only the wanted files of the piece were stored
+	priorities []Priority // per file
+	downloaded int64      // bytes of verified pieces received from peers
+	uploaded   int64      // bytes of blocks sent to peers
+	peers      map[string]*candidate
+	webSeeds   []*webSeed
+	active     map[*activeConn]bool
+	failed     map[int][]*outputPiece // copies of a piece that failed the hash check
+	hashFails  map[string]int         // by IP
+	slots      [3]slots               // by slotKind
+	inbound    []net.Conn
+	running    bool
+	wake       chan struct{}
+	peerRates  [2]int64 // download and upload limit of each connection
+	peerLimits map[*limitedConn]bool
+}
+
+// Priority is how soon the pieces of a file are downloaded
+type Priority int
+
+// The priorities of a file, pieces shared by several files go by the highest
+const (
+	PriorityNone Priority = iota // not downloaded
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	return [...]string{"skip", "low", "normal", "high"}[p]
+}
+
+// FileProgress is how much of a file has been downloaded
+type FileProgress struct {
+	TorrentFile
+	Completed int64
+	Wanted    bool
+	Priority  Priority
+}
+
+// DownloadStats is a snapshot of a download's progress
+type DownloadStats struct {
+	PiecesCompleted int
+	Pieces          int
+	BytesCompleted  int64 // of the wanted files
+	BytesWanted     int64
+	Downloaded      int64   // bytes of verified pieces received from peers
+	Uploaded        int64   // bytes sent to peers
+	DownloadRate    float64 // bytes per second over the last few seconds
+	UploadRate      float64
+	ETA             time.Duration
+	Peers           int // connected
+	KnownPeers      int
+	Files           []FileProgress
+}
+
+// NewDownload prepares a download of the file's torrent into storage. The file's
+// metadata must be known. A nil limits allows 50 connections.
+func NewDownload(file *File, storage Storage, limits *Limits) (*Download, error) {
+	if file.Metadata == nil {
+		return nil, errors.New("Metadata is required to start a download")
+	}
+	err := file.Metadata.PrepareForDownload()
+	if err != nil {
+		return nil, err
+	}
+	if limits == nil {
+		limits = NewLimits(50)
+	}
+	d := &Download{
+		File:          file,
+		Storage:       storage,
+		Limits:        limits,
+		DownloadLimit: NewRateLimiter(0),
+		UploadLimit:   NewRateLimiter(0),
+		priorities:    make([]Priority, len(file.Metadata.FileList())),
+		partial:       NewBitfield(file.Metadata.NumPieces()),
+		peers:         map[string]*candidate{},
+		active:        map[*activeConn]bool{},
+		failed:        map[int][]*outputPiece{},
+		hashFails:     map[string]int{},
+		wake:          make(chan struct{}, 1),
+		peerLimits:    map[*limitedConn]bool{},
+	}
+	for i := range d.priorities {
+		d.priorities[i] = PriorityNormal
+	}
+	// Pick up the pieces an earlier download left in the storage
+	ts, err := storage.OpenTorrent(file.Metadata, file.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	d.loadHave(ts)
+	err = ts.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, seed := range file.WebSeeds {
+		d.webSeeds = append(d.webSeeds, &webSeed{URL: seed})
+	}
+	d.AddPeers(file.Peers)
+	return d, nil
+}
+
+// AddPeers adds peers to the swarm. While the download runs the best of them are
+// connected to, as many as the connection limits allow.
+func (d *Download) AddPeers(peers []Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range peers {
+		if _, ok := d.peers[p.String()]; ok || d.Limits.Blocklist.BlockPeer(p.IP) {
+			continue
+		}
+		d.peers[p.String()] = &candidate{Peer: p}
+	}
+	d.signal()
+}
+
+// AddConn hands an incoming connection whose handshake was read by AcceptHandshake
+// to the download. It is closed if the download is not running or has no free
+// connection slot.
+func (d *Download) AddConn(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.running {
+		conn.Close()
+		return
+	}
+	d.inbound = append(d.inbound, conn)
+	d.signal()
+}
+
+func (d *Download) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetFileWanted chooses whether a file is downloaded, at normal priority, it
+// applies the next time Run is called
+func (d *Download) SetFileWanted(index int, wanted bool) {
+	priority := PriorityNone
+	if wanted {
+		priority = PriorityNormal
+	}
+	d.SetFilePriority(index, priority)
+}
+
+// SetFilePriority changes how soon a file is downloaded, PriorityNone leaves it
+// out. It applies the next time Run is called.
+func (d *Download) SetFilePriority(index int, priority Priority) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if index >= 0 && index < len(d.priorities) && priority >= PriorityNone && priority <= PriorityHigh {
+		d.priorities[index] = priority
+	}
+}
+
+// Run downloads every piece of the wanted files that is still missing. It returns
+// nil once they are all verified and written, unless Seed is set, or ctx's error
+// when it is cancelled.
+// Either way every peer connection is closed and the storage is closed, which
+// flushes it, before it returns.
+func (d *Download) Run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return errors.New("Download is already running")
+	}
+	d.running = true
+	// Every known peer may be dialed again on each run
+	for _, c := range d.peers {
+		c.Failures, c.RetryAt = 0, time.Time{}
+	}
+	d.signal()
+	d.mu.Unlock()
+	defer d.stopRunning()
+
+	storage, err := d.Storage.OpenTorrent(d.File.Metadata, d.File.InfoHash)
+	if err != nil {
+		return err
+	}
+	d.storageMu.Lock()
+	d.storage = storage
+	d.storageMu.Unlock()
+	// Pieces that have gone from the disk are downloaded again
+	d.mu.Lock()
+	d.loadHave(storage)
+	d.mu.Unlock()
+	defer func() {
+		d.storageMu.Lock()
+		d.storage = nil
+		d.storageMu.Unlock()
+		closeErr := storage.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	var skipped []bool // files the storage leaves out
+	if selector, ok := storage.(FileSelector); ok {
+		d.mu.Lock()
+		wanted := make([]bool, len(d.priorities))
+		skipped = make([]bool, len(d.priorities))
+		for i, priority := range d.priorities {
+			wanted[i] = priority != PriorityNone
+			skipped[i] = !wanted[i]
+		}
+		d.mu.Unlock()
+		err = selector.SelectFiles(wanted)
+		if err != nil {
+			return err
+		}
+	}
+	// A partly stored piece is downloaded again once none of its files is
+	// skipped
+	d.mu.Lock()
+	for _, index := range d.partial.Indexes() {
+		if d.have.Has(index) || d.storedWhole(index, skipped) {
+			d.partial.Clear(index)
+		}
+	}
+	d.mu.Unlock()
+
+	needed := d.neededPieces()
+	inputPieces := make(chan *inputPiece, len(needed))
+	outputPieces := make(chan *outputPiece)
+	padding := d.File.Metadata.paddingBlocks()
+	for _, i := range needed {
+		inputPieces <- &inputPiece{Index: i, Length: d.File.Metadata.PieceSize(i), Padding: padding[i]}
+	}
+
+	var wg sync.WaitGroup
+	defer func() {
+		// Workers only return once their connection is closed
+		cancel()
+		wg.Wait()
+	}()
+	dial := func(c *candidate) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.runPeer(ctx, c, nil, inputPieces, outputPieces)
+		}()
+	}
+	// Web seeds are tried again from scratch on each run
+	for _, ws := range d.webSeeds {
+		ws.Failures = 0
+		wg.Add(1)
+		go func(ws *webSeed) {
+			defer wg.Done()
+			d.runWebSeed(ctx, ws, inputPieces, outputPieces)
+		}(ws)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	rechoke := time.NewTicker(rechokeInterval)
+	defer rechoke.Stop()
+	seeding := false
+	for round, remaining := 0, len(needed); remaining > 0 || d.Seed; {
+		if remaining == 0 && !seeding {
+			seeding = true
+			d.emit(NewEvent(EventCompleted, d.File.InfoHash))
+		}
+		select {
+		case <-d.wake:
+			d.mu.Lock()
+			conns := d.inbound
+			d.inbound = nil
+			for _, conn := range conns {
+				addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+				if addr != nil && !d.Limits.allowed(addr.IP) ||
+					!d.acquireSlots(slotConn) {
+					conn.Close()
+					continue
+				}
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					d.runPeer(ctx, nil, conn, inputPieces, outputPieces)
+				}(conn)
+			}
+			d.mu.Unlock()
+			d.connectCandidates(time.Now(), dial)
+		case <-ticker.C:
+			d.connectCandidates(time.Now(), dial)
+		case <-rechoke.C:
+			round++
+			d.rechoke(round%3 == 0)
+		case donePiece := <-outputPieces:
+			if donePiece.Failed {
+				for _, e := range d.pieceFailed(donePiece) {
+					d.emit(e)
+				}
+				inputPieces <- donePiece.Input
+				continue
+			}
+			for _, e := range d.smartBan(donePiece) {
+				d.emit(e)
+			}
+			d.storageMu.Lock()
+			_, err = storage.WriteAt(donePiece.Index, donePiece.Buff, 0)
+			if err == nil {
+				err = storage.MarkComplete(donePiece.Index)
+			}
+			d.storageMu.Unlock()
+			if err != nil {
+				return err
+			}
+			d.mu.Lock()
+			if d.storedWhole(donePiece.Index, skipped) {
+				d.have.Set(donePiece.Index)
+				for a := range d.active {
+					a.Conn.queueHave(donePiece.Index)
+				}
+			} else {
+				d.partial.Set(donePiece.Index)
+			}
+			d.downloaded += int64(len(donePiece.Buff))
+			e := NewEvent(EventPieceVerified, d.File.InfoHash)
+			e.Piece, e.Peer, e.WebSeed = donePiece.Index, donePiece.Peer, donePiece.WebSeed
+			e.PiecesCompleted, e.Pieces = d.have.Count(), d.have.Len()
+			d.mu.Unlock()
+			d.rate.add(int64(len(donePiece.Buff)))
+			d.emit(e)
+			remaining--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.emit(NewEvent(EventCompleted, d.File.InfoHash))
+	return nil
+}
+
+// loadHave takes the verified pieces from storage that was just opened
+func (d *Download) loadHave(storage TorrentStorage) {
+	d.have = NewBitfield(d.File.Metadata.NumPieces())
+	for i := 0; i < d.have.Len(); i++ {
+		if storage.Completed(i) {
+			d.have.Set(i)
+		}
+	}
+}
+
+// storedWhole reports whether every file of a piece was written, none of them
+// is skipped
+func (d *Download) storedWhole(index int, skipped []bool) bool {
+	if skipped == nil {
+		return true
+	}
+	info := d.File.Metadata
+	files := info.FileList()
+	begin := pieceOffset(info, index)
+	for _, seg := range segments(files, begin, begin+int64(info.PieceSize(index))) {
+		if skipped[seg.File] && !files[seg.File].Padding() {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Download) emit(e Event) {
+	if d.OnEvent == nil {
+		return
+	}
+	d.eventMu.Lock()
+	defer d.eventMu.Unlock()
+	d.OnEvent(e)
+}
+
+// SetPeerRates limits the bytes per second of every connection on its own, zero
+// for unlimited. It applies to the current connections too.
+func (d *Download) SetPeerRates(download, upload int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.peerRates = [2]int64{download, upload}
+	for c := range d.peerLimits {
+		c.Down[len(c.Down)-1].SetRate(download)
+		c.Up[len(c.Up)-1].SetRate(upload)
+	}
+}
+
+// limitConn charges the connection to the global, download and peer limiters
+func (d *Download) limitConn(ctx context.Context, conn net.Conn) *limitedConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := newLimitedConn(ctx, conn,
+		[]*RateLimiter{d.Limits.Download, d.DownloadLimit, NewRateLimiter(d.peerRates[0])},
+		[]*RateLimiter{d.Limits.Upload, d.UploadLimit, NewRateLimiter(d.peerRates[1])})
+	d.peerLimits[c] = true
+	return c
+}
+
+func (d *Download) forgetConn(c *limitedConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.peerLimits, c)
+}
+
+func (d *Download) stopRunning() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+	for _, conn := range d.inbound {
+		conn.Close()
+	}
+	d.inbound = nil
+}
+
+// neededPieces are the missing pieces that overlap a wanted file, those of
+// higher priority files first
+func (d *Download) neededPieces() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := d.File.Metadata
+	pieceLength := int64(info.PieceLength)
+	priorities := make([]Priority, d.have.Len())
+	for i, file := range info.FileList() {
+		if d.priorities[i] == PriorityNone || file.Length == 0 {
+			continue
+		}
+		first := int(file.Offset / pieceLength)
+		last := int((file.Offset + file.Length - 1) / pieceLength)
+		for index := first; index <= last; index++ {
+			if d.priorities[i] > priorities[index] {
+				priorities[index] = d.priorities[i]
+			}
+		}
+	}
+	var needed []int
+	for index, priority := range priorities {
+		if priority != PriorityNone && !d.have.Has(index) && !d.partial.Has(index) {
+			needed = append(needed, index)
+		}
+	}
+	sort.SliceStable(needed, func(i, j int) bool {
+		return priorities[needed[i]] > priorities[needed[j]]
+	})
+	return needed
+}
+
+// runPeer downloads pieces from a single peer, either a dialed candidate or an
+// incoming conn. The connection slot, and the half-open slot of a dial, must be
+// taken and are given back when it returns.
+func (d *Download) runPeer(ctx context.Context, c *candidate, conn net.Conn,
+	inputPieces chan *inputPiece, outputPieces chan *outputPiece) {
+	var received int64
+	var err error
+	connected := false
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.releaseSlot(slotConn)
+		if c != nil {
+			d.connDone(c, connected, received, err, time.Now())
+		}
+		d.signal()
+	}()
+	if conn == nil {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", c.Peer.String())
+		d.mu.Lock()
+		d.releaseSlot(slotHalfOpen)
+		d.signal()
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	defer conn.Close()
+	limited := d.limitConn(ctx, conn)
+	defer d.forgetConn(limited)
+	conn = limited
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	p := newPeerConnection(d.File, conn)
+	defer p.close()
+	p.OnEvent = d.emit
+	p.Serve = d.serveBlock
+	d.mu.Lock()
+	var have Bitfield
+	if d.have.Count() > 0 {
+		have = d.have.Clone()
+	}
+	a := &activeConn{Candidate: c, Conn: p, Started: time.Now()}
+	d.active[a] = true
+	d.mu.Unlock()
+	p.OnInterested = func() { d.unchokeNow(a) }
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.active, a)
+		received, _ = p.received()
+		if a.Unchoked {
+			d.releaseSlot(slotUnchoke)
+		}
+	}()
+	if c == nil {
+		err = p.sendHandshake()
+	} else {
+		err = p.handshake()
+	}
+	if err != nil {
+		return
+	}
+	connected = true
+	e := NewEvent(EventPeerConnected, d.File.InfoHash)
+	e.Peer = p.peer()
+	d.emit(e)
+	defer func() {
+		e := NewEvent(EventPeerDisconnected, d.File.InfoHash)
+		e.Peer = p.peer()
+		d.emit(e)
+	}()
+	if have.Len() > 0 {
+		err = p.sendBitfield(have)
+		if err != nil {
+			return
+		}
+	}
+	if !d.Complete() {
+		err = p.startDownloading()
+		if err != nil {
+			return
+		}
+	}
+	err = beginDownload(ctx, p, inputPieces, outputPieces)
+}
+
+// serveBlock reads a block of a verified piece for an unchoked peer
+func (d *Download) serveBlock(index, begin, length int) ([]byte, error) {
+	d.mu.Lock()
+	ok := d.have.Has(index)
+	d.mu.Unlock()
+	if !ok || begin < 0 || begin+length > d.File.Metadata.PieceSize(index) {
+		return nil, fmt.Errorf("Cannot serve %d bytes at %d of piece %d", length, begin, index)
+	}
+	d.storageMu.Lock()
+	defer d.storageMu.Unlock()
+	if d.storage == nil {
+		return nil, errors.New("Download is not running")
+	}
+	block := make([]byte, length)
+	_, err := d.storage.ReadAt(index, block, int64(begin))
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.uploaded += int64(length)
+	d.mu.Unlock()
+	d.upRate.add(int64(length))
+	return block, nil
+}
+
+// Complete reports whether every piece of the wanted files is verified
+func (d *Download) Complete() bool {
+	return len(d.neededPieces()) == 0
+}
+
+// Progress returns the verified and total piece counts and the bytes received from peers
+func (d *Download) Progress() (int, int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.have.Count(), d.have.Len(), d.downloaded
+}
+
+// Have returns the verified pieces
+func (d *Download) Have() Bitfield {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.have.Clone()
+}
+
+// NumPeers is the number of peers we currently have a connection with
+func (d *Download) NumPeers() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.active)
+}
+
+// Stats returns a snapshot of the download's progress
+func (d *Download) Stats() DownloadStats {
+	files := d.Files()
+	d.mu.Lock()
+	stats := DownloadStats{
+		PiecesCompleted: d.have.Count(),
+		Pieces:          d.have.Len(),
+		Downloaded:      d.downloaded,
+		Uploaded:        d.uploaded,
+		Peers:           len(d.active),
+		KnownPeers:      len(d.peers),
+		Files:           files,
+	}
+	d.mu.Unlock()
+	for _, f := range files {
+		if f.Wanted && !f.Padding() {
+			stats.BytesWanted += f.Length
+			stats.BytesCompleted += f.Completed
+		}
+	}
+	stats.DownloadRate = d.rate.rate()
+	stats.UploadRate = d.upRate.rate()
+	if stats.DownloadRate > 0 {
+		remaining := float64(stats.BytesWanted - stats.BytesCompleted)
+		stats.ETA = time.Duration(remaining / stats.DownloadRate * float64(time.Second))
+	}
+	return stats
+}
+
+// Files reports the progress of every file in the torrent
+func (d *Download) Files() []FileProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := d.File.Metadata
+	pieceLength := int64(info.PieceLength)
+	var progress []FileProgress
+	for i, file := range info.FileList() {
+		fp := FileProgress{TorrentFile: file, Wanted: d.priorities[i] != PriorityNone, Priority: d.priorities[i]}
+		for offset := file.Offset; offset < file.Offset+file.Length; {
+			index := offset / pieceLength
+			pieceEnd := (index + 1) * pieceLength
+			if pieceEnd > file.Offset+file.Length {
+				pieceEnd = file.Offset + file.Length
+			}
+			if d.have.Has(int(index)) || fp.Wanted && d.partial.Has(int(index)) {
+				fp.Completed += pieceEnd - offset
+			}
+			offset = pieceEnd
+		}
+		progress = append(progress, fp)
+	}
+	return progress
+}
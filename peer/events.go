@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is how far back transfer rates are averaged
+const rateWindow = 10 * time.Second
+
+// EventType is what an Event reports
+type EventType int
+
+// The kinds of events. EventStateChanged is only sent by the client package,
+// which tracks the lifecycle of its torrents.
+const (
+	EventPieceVerified EventType = iota
+	EventPieceFailed
+	EventPeerConnected
+	EventPeerDisconnected
+	EventTrackerAnnounce
+	EventMetadataReceived
+	EventStateChanged
+	EventCompleted
+	EventPeerBanned
+	EventWebSeedFailed
+)
+
+func (t EventType) String() string {
+	return [...]string{"piece verified", "piece failed", "peer connected", "peer disconnected",
+		"tracker announce", "metadata received", "state changed", "completed", "peer banned", "web seed failed"}[t]
+}
+
+// Event is something that happened to a torrent. Only the fields that apply to
+// its Type are set.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	InfoHash [20]byte
+	Piece    int
+	Peer     Peer
+	WebSeed  string // the URL, set instead of Peer for a web seed
+	// Set for EventPieceVerified: how many pieces are verified out of how many
+	PiecesCompleted int
+	Pieces          int
+	// Set for EventTrackerAnnounce
+	Tracker  string
+	Seeders  int
+	Leechers int
+	NumPeers int // peers returned by the tracker
+	// Why a piece failed, an announce did not succeed or a peer was banned
+	Err error
+}
+
+// NewEvent returns an event of the given type that happened now
+func NewEvent(eventType EventType, infoHash [20]byte) Event {
+	return Event{Type: eventType, Time: time.Now(), InfoHash: infoHash, Piece: -1}
+}
+
+// rateMeter averages a byte count over the last rateWindow
+type rateMeter struct {
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+type rateSample struct {
+	Time  time.Time
+	Bytes int64
+}
+
+func (r *rateMeter) add(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.trim(time.Now()), rateSample{time.Now(), n})
+}
+
+// rate is the average bytes per second over the window
+func (r *rateMeter) rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = r.trim(time.Now())
+	var total int64
+	for _, s := range r.samples {
+		total += s.Bytes
+	}
+	return float64(total) / rateWindow.Seconds()
+}
+
+func (r *rateMeter) trim(now time.Time) []rateSample {
+	i := 0
+	for i < len(r.samples) && now.Sub(r.samples[i].Time) > rateWindow {
+		i++
+	}
+	return r.samples[i:]
+}
@@ -3,10 +3,10 @@ package peer
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
-	"net"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jackpal/bencode-go"
@@ -23,11 +23,15 @@ const (
 	msgTypeData       = 1
 	msgTypeReject     = 2
 	metadataPieceSize = 16384 //16KiB
+	// A peer may fetch the whole metadata this many times per metadataRequestWindow
+	metadataRequestRounds = 2
+	metadataRequestWindow = time.Minute
 )
 
 type extMessage struct {
 	ID      uint8
 	Bencode interface{}
+	Data    []byte // appended after the bencoded dict, used for metadata pieces
 }
 
 type extMetadataMessage struct {
@@ -37,7 +41,8 @@ type extMetadataMessage struct {
 }
 
 type extHandshakeDict struct {
-	M map[string]int `bencode:"m"`
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size"`
 }
 
 type metadataRequest struct {
@@ -56,42 +61,6 @@ type metadataResponseDict struct {
 	TotalSize int `bencode:"total_size"`
 }
 
-// GetMetadata gets the file's metadata from a peer and assigns it to the *File
-func (file *File) GetMetadata() error {
-	for i := 0; i < len(file.Peers); i++ {
-		conn, err := net.DialTimeout("tcp", file.Peers[i].String(), 6*time.Second)
-		if err != nil {
-			continue
-		}
-		defer conn.Close()
-		p := newPeerConnection(file, conn)
-		err = p.handshake()
-		if err != nil {
-			continue
-		}
-		for {
-			message, err := p.readMessage()
-			if err != nil {
-				break
-			}
-			// keep reading until we hit an ext message (it's all we care about for metadata)
-			if message.ID == msgExtended {
-				metadata, err := p.handleExtMessage(message)
-				if err != nil {
-					break
-				}
-				if metadata != nil {
-					file.Metadata = metadata
-					return nil
-				}
-			}
-		}
-		conn.Close()
-		continue
-	}
-	return errors.New("Could not get metadata from any of the peers")
-}
-
 // The bit selected for the extension protocol
 // is bit 20 from the right (counting starts at 0).
 func checkExtensions(h handshake) error {
@@ -102,6 +71,13 @@ func checkExtensions(h handshake) error {
 }
 
 func (p *peerConnection) handleExtMessage(m message) (*TorrentInfo, error) {
+	if len(m.Payload) == 0 {
+		return nil, errors.New("Extended message without an ID")
+	}
+	err := checkBencodeLengths(m.Payload[1:])
+	if err != nil {
+		return nil, err
+	}
 	reader := bytes.NewReader(m.Payload)
 	var extMessageID uint8
 	binary.Read(reader, binary.BigEndian, &extMessageID)
@@ -116,7 +92,8 @@ func (p *peerConnection) handleExtMessage(m message) (*TorrentInfo, error) {
 			return nil, err
 		}
 	}
-	if extMessageID == p.ExtMetadata {
+	// Peers send ut_metadata messages with the ID we assigned in our handshake
+	if extMessageID == uint8(extMsgMetadata) {
 		metadata, err := p.handleExtMetadata(m)
 		if err != nil {
 			return nil, err
@@ -128,26 +105,86 @@ func (p *peerConnection) handleExtMessage(m message) (*TorrentInfo, error) {
 	return nil, nil
 }
 
-func (p *peerConnection) extHandshake(bencodeData extHandshakeDict) error {
+// checkBencodeLengths makes sure no string of the bencoded value at the start of
+// data claims to be longer than data, as the decoder allocates strings up front
+func checkBencodeLengths(data []byte) error {
+	depth := 0
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case c == 'd' || c == 'l':
+			depth++
+			i++
+		case c == 'e' && depth > 0:
+			depth--
+			i++
+		case c == 'i':
+			end := bytes.IndexByte(data[i:], 'e')
+			if end < 0 {
+				return errors.New("Unterminated bencoded integer")
+			}
+			i += end + 1
+		case c >= '0' && c <= '9':
+			colon := bytes.IndexByte(data[i:], ':')
+			if colon < 0 {
+				return errors.New("Bencoded string without a length")
+			}
+			length, err := strconv.Atoi(string(data[i : i+colon]))
+			if err != nil || length > len(data)-i-colon-1 {
+				return fmt.Errorf("Bencoded string of length %q is too long", data[i:i+colon])
+			}
+			i += colon + 1 + length
+		default:
+			return fmt.Errorf("Unexpected %q in bencoded data", c)
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+	return errors.New("Bencoded data is truncated")
+}
+
+// sendExtHandshake sends our extension handshake, once per connection
+func (p *peerConnection) sendExtHandshake() error {
+	if p.SentExtHandshake {
+		return nil
+	}
 	m := message{
 		ID: msgExtended,
 	}
-	extM := extMessage{
-		ID: extMsgHandshake,
-		Bencode: extHandshakeDict{
-			M: map[string]int{
-				"ut_metadata": extMsgMetadata,
-			},
+	dict := map[string]interface{}{
+		"m": map[string]int{
+			extMetadata: extMsgMetadata,
 		},
 	}
+	// Only advertise metadata_size when we can serve the metadata (BEP 9)
+	if p.File.Metadata != nil && len(p.File.Metadata.Raw) > 0 {
+		dict["metadata_size"] = len(p.File.Metadata.Raw)
+	}
+	extM := extMessage{
+		ID:      extMsgHandshake,
+		Bencode: dict,
+	}
 	err := p.writeExtMessage(m, extM)
 	if err != nil {
 		return err
 	}
+	p.SentExtHandshake = true
+	return nil
+}
 
-	if val, ok := bencodeData.M[extMetadata]; ok {
-		p.ExtMetadata = uint8(val)
-		p.extReqMetadata(0)
+func (p *peerConnection) extHandshake(bencodeData extHandshakeDict) error {
+	err := p.sendExtHandshake()
+	if err != nil {
+		return err
+	}
+	val, ok := bencodeData.M[extMetadata]
+	if !ok || val == 0 {
+		return nil
+	}
+	p.ExtMetadata = uint8(val)
+	p.MetadataSize = bencodeData.MetadataSize
+	if p.Fetcher != nil {
+		return p.Fetcher.setSize(p.MetadataSize)
 	}
 	return nil
 }
@@ -184,54 +221,70 @@ func (p *peerConnection) handleExtMetadata(m message) (*TorrentInfo, error) {
 	}
 	switch extMsg.Bencode.Type {
 	case msgTypeRequest:
-		break
+		return nil, p.sendMetadataPiece(extMsg.Bencode.Piece)
 	case msgTypeData:
+		// Ignore pieces we didn't ask for
+		if p.Fetcher == nil {
+			return nil, nil
+		}
 		var buf bytes.Buffer
 		reader.WriteTo(&buf)
 		extMsg.Metadata = buf.Bytes()
-		metadata, err := p.recvMetadata(extMsg)
-		if err != nil {
-			return nil, err
-		}
-		if metadata != nil {
-			return metadata, nil
+		return p.Fetcher.received(p, extMsg.Bencode.Piece, extMsg.Metadata)
+	case msgTypeReject:
+		if p.Fetcher != nil {
+			p.Fetcher.rejected(p, extMsg.Bencode.Piece)
 		}
 		return nil, nil
-	case msgTypeReject:
-		return nil, errors.New("Metadata request rejected by peer")
 	}
 	return nil, errors.New("Unknown extended message")
 }
 
-func (p *peerConnection) recvMetadata(m extMetadataMessage) (*TorrentInfo, error) {
-	reader := bytes.NewReader(m.Metadata)
-	if m.Bencode.Piece != p.CurrentMetadataPiece {
-		return nil, errors.New("Received the incorrect metadata piece")
+// sendMetadataPiece answers a metadata request with the requested 16KiB slice of the
+// info dictionary, or a reject if we don't have the metadata or the peer asks too often
+func (p *peerConnection) sendMetadataPiece(piece int) error {
+	if p.ExtMetadata == 0 {
+		return errors.New("Peer requested metadata without supporting ut_metadata")
 	}
-	if p.MetadataSize == 0 {
-		p.MetadataSize = m.Bencode.TotalSize
+	m := message{
+		ID: msgExtended,
 	}
-
-	lastPiece := reader.Size() < metadataPieceSize ||
-		(p.MetadataSize-(int(reader.Size())+p.MetadataBuff.Len())) == 0
-	_, err := reader.WriteTo(p.MetadataBuff)
-	if err != nil {
-		return nil, err
+	extM := extMessage{
+		ID:      p.ExtMetadata,
+		Bencode: metadataRequest{Type: msgTypeReject, Piece: piece},
 	}
-	var info TorrentInfo
-	if lastPiece {
-		// decode entire metadata now that we have all the pieces
-		hash := sha1.Sum(p.MetadataBuff.Bytes())
-		if hash == p.File.InfoHash {
-			err = bencode.Unmarshal(p.MetadataBuff, &info)
-			info.MetadataSize = p.MetadataSize
-			return &info, nil
+	if p.File.Metadata != nil && p.allowMetadataRequest() {
+		raw := p.File.Metadata.Raw
+		begin := piece * metadataPieceSize
+		if piece >= 0 && begin < len(raw) {
+			end := begin + metadataPieceSize
+			if end > len(raw) {
+				end = len(raw)
+			}
+			extM.Bencode = metadataResponseDict{
+				Type:      msgTypeData,
+				Piece:     piece,
+				TotalSize: len(raw),
+			}
+			extM.Data = raw[begin:end]
 		}
-		return nil, errors.New("Metadata SHA-1 does not match info hash")
 	}
-	p.CurrentMetadataPiece++
-	p.extReqMetadata(p.CurrentMetadataPiece)
-	return nil, nil
+	return p.writeExtMessage(m, extM)
+}
+
+// allowMetadataRequest limits each peer to fetching the metadata metadataRequestRounds
+// times per window, anything beyond that is rejected
+func (p *peerConnection) allowMetadataRequest() bool {
+	if time.Since(p.MetadataRequestsSince) > metadataRequestWindow {
+		p.MetadataRequestsSince = time.Now()
+		p.MetadataRequests = 0
+	}
+	numPieces := (len(p.File.Metadata.Raw) + metadataPieceSize - 1) / metadataPieceSize
+	if p.MetadataRequests >= numPieces*metadataRequestRounds {
+		return false
+	}
+	p.MetadataRequests++
+	return true
 }
 
 // <len><id><extId><ext payload>
@@ -245,6 +298,7 @@ func (p *peerConnection) writeExtMessage(m message, extM extMessage) error {
 	if err != nil {
 		return err
 	}
+	payload.Write(extM.Data)
 	m.Payload = payload.Bytes()
 	err = p.writeMessage(m)
 	if err != nil {
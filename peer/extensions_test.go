@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// servingPair connects a peerConnection holding file to a remote that has done the
+// extension handshake, with the local side reading and handling messages
+func servingPair(t *testing.T, file *File) *peerConnection {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	p := newPeerConnection(file, local)
+	go func() {
+		for {
+			m, err := p.readMessage()
+			if err != nil {
+				return
+			}
+			p.handleMessage(m)
+		}
+	}()
+	r := newPeerConnection(&File{}, remote)
+	err := r.writeExtMessage(message{ID: msgExtended}, extMessage{
+		ID:      extMsgHandshake,
+		Bencode: extHandshakeDict{M: map[string]int{extMetadata: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dict extHandshakeDict
+	bencode.Unmarshal(bytes.NewReader(m.Payload[1:]), &dict)
+	if file.Metadata != nil && dict.MetadataSize != len(file.Metadata.Raw) {
+		t.Fatalf("got metadata_size %d want %d", dict.MetadataSize, len(file.Metadata.Raw))
+	}
+	return r
+}
+
+func requestMetadataPiece(t *testing.T, r *peerConnection, piece int) (metadataResponseDict, []byte) {
+	err := r.writeExtMessage(message{ID: msgExtended}, extMessage{
+		ID:      uint8(extMsgMetadata),
+		Bencode: metadataRequest{Type: msgTypeRequest, Piece: piece},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Payload[0] != 3 {
+		t.Fatalf("got extended ID %d want the remote's ut_metadata ID 3", m.Payload[0])
+	}
+	reader := bytes.NewReader(m.Payload[1:])
+	var dict metadataResponseDict
+	decoded, err := bencode.Decode(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := decoded.(map[string]interface{})
+	dict.Type = int(values["msg_type"].(int64))
+	dict.Piece = int(values["piece"].(int64))
+	if size, ok := values["total_size"].(int64); ok {
+		dict.TotalSize = int(size)
+	}
+	var data bytes.Buffer
+	reader.WriteTo(&data)
+	return dict, data.Bytes()
+}
+
+func TestServeMetadata(t *testing.T) {
+	raw := bytes.Repeat([]byte("x"), 2*metadataPieceSize+100)
+	r := servingPair(t, &File{Metadata: &TorrentInfo{Raw: raw}})
+
+	for piece := 0; piece < 3; piece++ {
+		dict, data := requestMetadataPiece(t, r, piece)
+		if dict.Type != msgTypeData || dict.Piece != piece || dict.TotalSize != len(raw) {
+			t.Fatalf("got response %+v for piece %d", dict, piece)
+		}
+		end := (piece + 1) * metadataPieceSize
+		if end > len(raw) {
+			end = len(raw)
+		}
+		if !bytes.Equal(data, raw[piece*metadataPieceSize:end]) {
+			t.Errorf("piece %d data mismatch, got %d bytes", piece, len(data))
+		}
+	}
+	if dict, _ := requestMetadataPiece(t, r, 3); dict.Type != msgTypeReject {
+		t.Errorf("got type %d for out of range piece want reject", dict.Type)
+	}
+
+	// Each peer may fetch the metadata metadataRequestRounds times per window
+	for i := 0; i < 3; i++ {
+		requestMetadataPiece(t, r, 0)
+	}
+	if dict, _ := requestMetadataPiece(t, r, 0); dict.Type != msgTypeReject {
+		t.Errorf("got type %d after exceeding the rate limit want reject", dict.Type)
+	}
+}
+
+func TestServeMetadataWithoutMetadata(t *testing.T) {
+	r := servingPair(t, &File{})
+	if dict, _ := requestMetadataPiece(t, r, 0); dict.Type != msgTypeReject {
+		t.Errorf("got type %d want reject", dict.Type)
+	}
+}
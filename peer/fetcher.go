@@ -0,0 +1,267 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxMetadataPeers    = 30
+	maxMetadataSize     = 8 * 1024 * 1024
+	metadataDialTimeout = 6 * time.Second
+	// metadataSlotWait is how often a peer waiting for a free connection slot checks again
+	metadataSlotWait = 250 * time.Millisecond
+)
+
+// metadataFetcher downloads the info dictionary from many peers at once. Each peer
+// that supports ut_metadata is handed the next missing piece, pieces a peer rejects
+// are handed to other peers, and the assembled dictionary is checked against the infohash.
+type metadataFetcher struct {
+	mu       sync.Mutex
+	File     *File
+	Size     int
+	Pieces   [][]byte
+	Received int
+	Pending  map[int]int // number of peers each piece is requested from
+	Done     bool
+	Result   chan *TorrentInfo
+}
+
+// GetMetadata fetches the file's metadata from its peers and assigns it to the *File.
+// It returns as soon as one verified copy is assembled or when ctx is cancelled.
+// Peers are connected to within limits, skipping banned and blocked ones. A nil
+// limits allows 30 connections.
+func (file *File) GetMetadata(ctx context.Context, limits *Limits) error {
+	if limits == nil {
+		limits = NewLimits(maxMetadataPeers)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := &metadataFetcher{
+		File:    file,
+		Pending: map[int]int{},
+		Result:  make(chan *TorrentInfo, 1),
+	}
+	peers := make(chan Peer, len(file.Peers))
+	for _, p := range file.Peers {
+		peers <- p
+	}
+	close(peers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxMetadataPeers && i < len(file.Peers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range peers {
+				if !limits.allowed(p.IP) {
+					continue
+				}
+				if !waitForSlots(ctx, limits) {
+					return
+				}
+				f.fetchFrom(ctx, p, limits)
+			}
+		}()
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case info := <-f.Result:
+		// Stop the other peers and wait for their sockets to close
+		cancel()
+		<-workersDone
+		file.Metadata = info
+		return nil
+	case <-workersDone:
+		select {
+		case info := <-f.Result:
+			file.Metadata = info
+			return nil
+		default:
+		}
+		return errors.New("Could not get metadata from any of the peers")
+	case <-ctx.Done():
+		<-workersDone
+		return ctx.Err()
+	}
+}
+
+// waitForSlots takes a connection and a half-open slot of limits once they are
+// free, it returns false if ctx is done first
+func waitForSlots(ctx context.Context, limits *Limits) bool {
+	ticker := time.NewTicker(metadataSlotWait)
+	defer ticker.Stop()
+	for !limits.acquire(slotConn, slotHalfOpen) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// fetchFrom requests metadata pieces from a single peer until it fails or ctx is
+// done. It gives back the slots waitForSlots took.
+func (f *metadataFetcher) fetchFrom(ctx context.Context, peer Peer, limits *Limits) {
+	defer limits.release(slotConn)
+	dialer := net.Dialer{Timeout: metadataDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
+	limits.release(slotHalfOpen)
+	if err != nil {
+		return
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	p := newPeerConnection(f.File, conn)
+	defer p.close()
+	p.Fetcher = f
+	defer f.release(p)
+	err = p.handshake()
+	if err != nil {
+		return
+	}
+	err = p.sendExtHandshake()
+	if err != nil {
+		return
+	}
+	for ctx.Err() == nil {
+		if p.ExtMetadata != 0 && p.MetadataPiece < 0 {
+			piece, ok := f.next(p)
+			if ok {
+				err = p.extReqMetadata(piece)
+				if err != nil {
+					return
+				}
+			}
+		}
+		message, err := p.readMessageWithin(timeoutDuration)
+		if err != nil {
+			return
+		}
+		// keep reading until we hit an ext message (it's all we care about for metadata)
+		if message.ID == msgExtended {
+			_, err = p.handleExtMessage(message)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// setSize sets the metadata size from the first peer to advertise it,
+// peers that disagree with it are dropped
+func (f *metadataFetcher) setSize(size int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("Invalid metadata size %d", size)
+	}
+	if f.Size == 0 {
+		f.Size = size
+		f.Pieces = make([][]byte, (size+metadataPieceSize-1)/metadataPieceSize)
+	}
+	if size != f.Size {
+		return fmt.Errorf("Peer metadata size %d does not match %d", size, f.Size)
+	}
+	return nil
+}
+
+// next picks the piece to request from p, preferring pieces nobody has been asked for
+func (f *metadataFetcher) next(p *peerConnection) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	best := -1
+	for i, piece := range f.Pieces {
+		if piece != nil || p.RejectedPieces[i] {
+			continue
+		}
+		if best < 0 || f.Pending[i] < f.Pending[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	f.Pending[best]++
+	p.MetadataPiece = best
+	return best, true
+}
+
+func (f *metadataFetcher) rejected(p *peerConnection, piece int) {
+	p.RejectedPieces[piece] = true
+	f.release(p)
+}
+
+// release returns the piece p was asked for so another peer can be asked
+func (f *metadataFetcher) release(p *peerConnection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p.MetadataPiece >= 0 {
+		f.Pending[p.MetadataPiece]--
+		p.MetadataPiece = -1
+	}
+}
+
+// received stores a piece and returns the decoded metadata once every piece has arrived
+func (f *metadataFetcher) received(p *peerConnection, piece int, data []byte) (*TorrentInfo, error) {
+	if piece != p.MetadataPiece {
+		return nil, errors.New("Received the incorrect metadata piece")
+	}
+	f.release(p)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Done {
+		return nil, nil
+	}
+	expected := f.Size - piece*metadataPieceSize
+	if expected > metadataPieceSize {
+		expected = metadataPieceSize
+	}
+	if len(data) != expected {
+		return nil, fmt.Errorf("Metadata piece %d has length %d, expected %d", piece, len(data), expected)
+	}
+	if f.Pieces[piece] == nil {
+		f.Pieces[piece] = data
+		f.Received++
+	}
+	if f.Received < len(f.Pieces) {
+		return nil, nil
+	}
+
+	// decode entire metadata now that we have all the pieces
+	raw := bytes.Join(f.Pieces, nil)
+	if !matchesInfoHash(raw, f.File.InfoHash) {
+		// We can't tell which peer sent the bad piece, so start over
+		for i := range f.Pieces {
+			f.Pieces[i] = nil
+		}
+		f.Received = 0
+		return nil, errors.New("Metadata does not match info hash")
+	}
+	info, err := parseInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	f.Done = true
+	f.Result <- info
+	return info, nil
+}
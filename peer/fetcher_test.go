@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSeeder accepts connections and serves the file's metadata on each of them
+func startSeeder(t *testing.T, file *File) Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p := newPeerConnection(file, conn)
+				if p.handshake() != nil {
+					return
+				}
+				for {
+					m, err := p.readMessage()
+					if err != nil || p.handleMessage(m) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func testMetadata(t *testing.T) (*TorrentInfo, [20]byte) {
+	info := &TorrentInfo{
+		Name:        "test",
+		PieceLength: minPieceLength,
+		Length:      3000 * minPieceLength,
+		Pieces:      string(bytes.Repeat([]byte{7}, 3000*20)),
+	}
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info, infoHash
+}
+
+func TestGetMetadataFromManyPeers(t *testing.T) {
+	info, infoHash := testMetadata(t)
+	if len(info.Raw) <= 3*metadataPieceSize {
+		t.Fatalf("metadata of %d bytes is too small to span several pieces", len(info.Raw))
+	}
+	seed := &File{InfoHash: infoHash, Metadata: info}
+	file := &File{
+		InfoHash: infoHash,
+		Peers: []Peer{
+			{IP: net.ParseIP("127.0.0.1"), Port: 1},   // nothing listening
+			startSeeder(t, &File{InfoHash: infoHash}), // rejects every request
+			startSeeder(t, seed),
+			startSeeder(t, seed),
+			startSeeder(t, seed),
+		},
+	}
+
+	err := file.GetMetadata(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file.Metadata.Raw, info.Raw) || file.Metadata.Name != info.Name {
+		t.Errorf("got metadata %q", file.Metadata.Name)
+	}
+}
+
+func TestGetMetadataCancel(t *testing.T) {
+	// A peer that accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	file := &File{Peers: []Peer{{IP: addr.IP, Port: uint16(addr.Port)}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = file.GetMetadata(ctx, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("GetMetadata took %s to return after cancellation", time.Since(start))
+	}
+}
+
+func TestGetMetadataWithinLimits(t *testing.T) {
+	info, infoHash := testMetadata(t)
+	blocked, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("no 127.0.0.2:", err)
+	}
+	defer blocked.Close()
+	dialed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := blocked.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- struct{}{}
+			conn.Close()
+		}
+	}()
+	addr := blocked.Addr().(*net.TCPAddr)
+	banned := Peer{IP: net.ParseIP("127.0.0.3"), Port: 1}
+
+	var silent connCounter
+	limits := NewLimits(2)
+	limits.Blocklist, _ = NewBlocklist(strings.NewReader("127.0.0.2\n"))
+	limits.Ban(banned.IP, time.Hour)
+	file := &File{InfoHash: infoHash, Peers: []Peer{{IP: addr.IP, Port: uint16(addr.Port)}, banned}}
+	for i := 0; i < 5; i++ {
+		file.Peers = append(file.Peers, silent.listen(t))
+	}
+	file.Peers = append(file.Peers, startSeeder(t, &File{InfoHash: infoHash, Metadata: info}))
+
+	// The silent peers hold both connections until the handshakes time out
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := file.GetMetadata(ctx, limits); err == nil {
+		t.Error("got metadata past peers that never answer")
+	}
+	silent.mu.Lock()
+	peak := silent.peak
+	silent.mu.Unlock()
+	if peak != 2 {
+		t.Errorf("%d peers were connected at once with a limit of 2", peak)
+	}
+	if len(dialed) != 0 {
+		t.Error("a blocked peer was dialed")
+	}
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	if used := limits.slots[slotConn].Used + limits.slots[slotHalfOpen].Used; used != 0 {
+		t.Errorf("%d slots were not given back", used)
+	}
+}
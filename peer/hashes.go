@@ -0,0 +1,159 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// maxHashes is the most hashes asked for or sent in a hashes message
+const maxHashes = 512
+
+// hashRequest asks for hashes of a layer of a v2 file's merkle tree, with the
+// uncle hashes of ProofLayers layers above them (BEP 52). It is also the start
+// of the hashes and hash reject messages that answer it.
+type hashRequest struct {
+	Root        [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+func parseHashRequest(payload []byte) (hashRequest, error) {
+	var r hashRequest
+	if len(payload) < 48 {
+		return r, fmt.Errorf("Hash request payload of length %d", len(payload))
+	}
+	copy(r.Root[:], payload)
+	r.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	r.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	r.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return r, nil
+}
+
+func (r hashRequest) payload() []byte {
+	payload := make([]byte, 48)
+	copy(payload, r.Root[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+// handleHashRequest sends the hashes a peer asked for, or a reject when they
+// are not of a piece layer we know
+func (p *peerConnection) handleHashRequest(m message) error {
+	if len(m.Payload) != 48 {
+		return fmt.Errorf("Hash request payload of length %d", len(m.Payload))
+	}
+	req, _ := parseHashRequest(m.Payload)
+	var hashes []byte
+	ok := false
+	if p.File.Metadata != nil {
+		hashes, ok = p.File.Metadata.layerHashes(req)
+	}
+	if !ok {
+		return p.writeMessage(message{ID: msgHashReject, Payload: m.Payload})
+	}
+	return p.writeMessage(message{ID: msgHashes, Payload: append(req.payload(), hashes...)})
+}
+
+// layerHashes are the piece layer hashes asked for by req followed by their proof
+func (t *TorrentInfo) layerHashes(req hashRequest) ([]byte, bool) {
+	if req.BaseLayer != t.pieceLayerIndex() || req.Length < 1 || req.Length > maxHashes ||
+		req.Length&(req.Length-1) != 0 || req.Index%req.Length != 0 {
+		return nil, false
+	}
+	layer, ok := t.pieceLayer(req.Root)
+	if !ok {
+		return nil, false
+	}
+	hashes := make([][32]byte, len(layer)/32)
+	for i := range hashes {
+		copy(hashes[i][:], layer[i*32:])
+	}
+	width := nextPow2(len(hashes))
+	if req.Index+req.Length > width {
+		return nil, false
+	}
+	tree := merkleLayers(hashes, width, t.padHash())
+	var out []byte
+	for _, hash := range tree[0][req.Index : req.Index+req.Length] {
+		out = append(out, hash[:]...)
+	}
+	// The uncles from the root of the requested hashes upwards, the root itself is known
+	level, node := bits.TrailingZeros(uint(req.Length)), req.Index/req.Length
+	for i := 0; i < req.ProofLayers && level+i < len(tree)-1; i++ {
+		out = append(out, tree[level+i][node^1][:]...)
+		node /= 2
+	}
+	return out, true
+}
+
+// fetchPieceLayer asks the peer for the piece layer of the v2 file with the
+// pieces root, maxHashes at a time, and keeps it once it matches the root
+func (p *peerConnection) fetchPieceLayer(root [32]byte) error {
+	info := p.File.Metadata
+	file, ok := info.fileByRoot(root)
+	if !ok {
+		return fmt.Errorf("No file has pieces root %x", root)
+	}
+	pieces := info.filePieces(file.Length)
+	width := nextPow2(pieces)
+	layer := make([]byte, 0, 32*width)
+	for index := 0; index < width; index += maxHashes {
+		req := hashRequest{Root: root, BaseLayer: info.pieceLayerIndex(), Index: index, Length: width - index}
+		if req.Length > maxHashes {
+			req.Length = maxHashes
+		}
+		err := p.writeMessage(message{ID: msgHashRequest, Payload: req.payload()})
+		if err != nil {
+			return err
+		}
+		hashes, err := p.readHashes(req)
+		if err != nil {
+			return err
+		}
+		layer = append(layer, hashes...)
+	}
+	err := info.SetPieceLayer(root, layer[:32*pieces])
+	if err != nil {
+		return protocolError{err}
+	}
+	return nil
+}
+
+// readHashes handles messages until the answer to req comes
+func (p *peerConnection) readHashes(req hashRequest) ([]byte, error) {
+	for {
+		m, err := p.readMessageWithin(requestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if m.ID != msgHashes && m.ID != msgHashReject {
+			err = p.handleMessage(m)
+			if err != nil {
+				return nil, protocolError{err}
+			}
+			continue
+		}
+		got, err := parseHashRequest(m.Payload)
+		if err != nil {
+			return nil, protocolError{err}
+		}
+		if got != req {
+			continue
+		}
+		if m.ID == msgHashReject {
+			return nil, errors.New("Peer rejected the hash request")
+		}
+		if len(m.Payload) < 48+32*req.Length {
+			return nil, protocolError{fmt.Errorf("Hashes payload of length %d for %d hashes", len(m.Payload), req.Length)}
+		}
+		return m.Payload[48 : 48+32*req.Length], nil
+	}
+}
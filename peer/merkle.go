@@ -0,0 +1,375 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// merkleBlockSize is the size of the leaves of a v2 file's merkle tree
+const merkleBlockSize = 16 * 1024
+
+// errNoPieceLayer is returned when a piece of a v2 file cannot be checked
+// because the piece layer of the file is not known yet
+var errNoPieceLayer = errors.New("Piece layer of the file is not known")
+
+// treeFile is a file of a v2 file tree (BEP 52)
+type treeFile struct {
+	Path        []string // without the torrent name
+	Length      int64
+	PiecesRoot  [32]byte // zero for an empty file
+	Attr        string   // BEP 47
+	SymlinkPath []string // BEP 47
+}
+
+// pieceLayers are the piece layers of the v2 files by pieces root, read from
+// the torrent file or received from peers
+type pieceLayers struct {
+	mu     sync.Mutex
+	layers map[[32]byte][]byte
+}
+
+// parseFileTree reads the v2 part of the info dictionary, if it has one
+func (t *TorrentInfo) parseFileTree(dict map[string]interface{}) error {
+	tree, ok := dict["file tree"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if t.MetaVersion != 2 {
+		return fmt.Errorf("File tree of meta version %d", t.MetaVersion)
+	}
+	if t.PieceLength < merkleBlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("Piece length %d of a v2 torrent is not a power of two of at least 16KiB", t.PieceLength)
+	}
+	t.FileTree = nil
+	err := t.walkFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+	if len(t.FileTree) == 0 {
+		return errors.New("File tree has no files")
+	}
+	t.layers = &pieceLayers{layers: map[[32]byte][]byte{}}
+	return nil
+}
+
+// walkFileTree adds the files below a directory of the file tree in order
+func (t *TorrentInfo) walkFileTree(dir map[string]interface{}, path []string) error {
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node, ok := dir[name].(map[string]interface{})
+		if name == "" || !ok {
+			return fmt.Errorf("Bad file tree entry %q in %q", name, strings.Join(path, "/"))
+		}
+		filePath := append(append([]string(nil), path...), name)
+		leaf, ok := node[""].(map[string]interface{})
+		if !ok {
+			err := t.walkFileTree(node, filePath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		length, _ := leaf["length"].(int64)
+		root, _ := leaf["pieces root"].(string)
+		if length < 0 || (length > 0) != (len(root) == 32) {
+			return fmt.Errorf("Bad length or pieces root of %q", strings.Join(filePath, "/"))
+		}
+		file := treeFile{Path: filePath, Length: length, SymlinkPath: toStrings(leaf["symlink path"])}
+		file.Attr, _ = leaf["attr"].(string)
+		copy(file.PiecesRoot[:], root)
+		t.FileTree = append(t.FileTree, file)
+	}
+	return nil
+}
+
+// fileTreeDict is the bencoded form of FileTree
+func (t *TorrentInfo) fileTreeDict() map[string]interface{} {
+	tree := map[string]interface{}{}
+	for _, file := range t.FileTree {
+		dir := tree
+		for _, name := range file.Path[:len(file.Path)-1] {
+			sub, ok := dir[name].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				dir[name] = sub
+			}
+			dir = sub
+		}
+		leaf := map[string]interface{}{"length": file.Length}
+		if file.Length > 0 {
+			leaf["pieces root"] = string(file.PiecesRoot[:])
+		}
+		if file.Attr != "" {
+			leaf["attr"] = file.Attr
+		}
+		if len(file.SymlinkPath) > 0 {
+			leaf["symlink path"] = file.SymlinkPath
+		}
+		dir[file.Path[len(file.Path)-1]] = map[string]interface{}{"": leaf}
+	}
+	return tree
+}
+
+// v2Only reports whether the torrent only has v2 piece hashes
+func (t *TorrentInfo) v2Only() bool {
+	return len(t.FileTree) > 0 && len(t.Pieces) == 0
+}
+
+// v2Single reports whether a v2 torrent is a single file named after the torrent
+func (t *TorrentInfo) v2Single() bool {
+	return len(t.FileTree) == 1 && len(t.FileTree[0].Path) == 1
+}
+
+// treePath is the path of a file in the file tree, which leaves out the
+// torrent name that FileList starts the paths of several files with
+func (t *TorrentInfo) treePath(file TorrentFile) []string {
+	if t.singleFile() {
+		return file.Path
+	}
+	return file.Path[1:]
+}
+
+// v2FileList lays out the files of a v2 torrent, each non empty file starting on a piece
+func (t *TorrentInfo) v2FileList() []TorrentFile {
+	files := make([]TorrentFile, len(t.FileTree))
+	var offset int64
+	pieceLength := int64(t.PieceLength)
+	for i, file := range t.FileTree {
+		offset = (offset + pieceLength - 1) / pieceLength * pieceLength
+		files[i] = TorrentFile{Path: append([]string{t.Name}, file.Path...), Length: file.Length, Offset: offset,
+			Attr: file.Attr, SymlinkPath: file.SymlinkPath}
+		if t.v2Single() {
+			files[i].Path = file.Path
+		}
+		offset += file.Length
+	}
+	return files
+}
+
+// treeFileAt finds the v2 file holding a piece and where it is in the torrent
+func (t *TorrentInfo) treeFileAt(index int) (TorrentFile, treeFile, bool) {
+	begin := pieceOffset(t, index)
+	for _, file := range t.FileList() {
+		if file.Offset > begin || file.Offset+file.Length <= begin {
+			continue
+		}
+		path := strings.Join(t.treePath(file), "/")
+		for _, tf := range t.FileTree {
+			if strings.Join(tf.Path, "/") == path {
+				return file, tf, true
+			}
+		}
+		return file, treeFile{}, false
+	}
+	return TorrentFile{}, treeFile{}, false
+}
+
+// checkHybrid makes sure the v1 files of a hybrid torrent are the v2 files, each
+// starting on a piece so the piece hashes of both cover the same data
+func (t *TorrentInfo) checkHybrid() error {
+	if len(t.FileTree) == 0 || t.v2Only() {
+		return nil
+	}
+	v1 := map[string]TorrentFile{}
+	for _, file := range t.FileList() {
+		v1[strings.Join(t.treePath(file), "/")] = file
+	}
+	for _, tf := range t.FileTree {
+		file, ok := v1[strings.Join(tf.Path, "/")]
+		if !ok || file.Length != tf.Length {
+			return fmt.Errorf("Hybrid torrent's v1 and v2 files differ at %q", strings.Join(tf.Path, "/"))
+		}
+		if tf.Length > 0 && file.Offset%int64(t.PieceLength) != 0 {
+			return fmt.Errorf("File %q of a hybrid torrent does not start on a piece", strings.Join(tf.Path, "/"))
+		}
+	}
+	return nil
+}
+
+// VerifyPiece checks a piece against its SHA-1 hash and, for v2 and hybrid
+// torrents, the merkle tree of its file. The tree of a file longer than a piece
+// can only be checked once its piece layer is known.
+func (t *TorrentInfo) VerifyPiece(index int, data []byte) error {
+	if index < len(t.PiecesList) {
+		hash := sha1.Sum(data)
+		if !bytes.Equal(hash[:], t.PiecesList[index][:]) {
+			return fmt.Errorf("Index %d failed integrity check", index)
+		}
+	}
+	if len(t.FileTree) == 0 {
+		return nil
+	}
+	file, tf, ok := t.treeFileAt(index)
+	if !ok {
+		return fmt.Errorf("Index %d is not in a v2 file", index)
+	}
+	begin := pieceOffset(t, index)
+	if end := file.Offset + file.Length - begin; end < int64(len(data)) {
+		// The rest of a hybrid's piece is a padding file
+		data = data[:end]
+	}
+	leaves := blockHashes(data)
+	if tf.Length <= int64(t.PieceLength) {
+		if merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{}) != tf.PiecesRoot {
+			return fmt.Errorf("Index %d failed the v2 integrity check", index)
+		}
+		return nil
+	}
+	layer, ok := t.pieceLayer(tf.PiecesRoot)
+	if !ok {
+		if t.v2Only() {
+			return errNoPieceLayer
+		}
+		return nil
+	}
+	i := int((begin - file.Offset) / int64(t.PieceLength))
+	root := merkleRoot(leaves, t.PieceLength/merkleBlockSize, [32]byte{})
+	if !bytes.Equal(root[:], layer[i*32:(i+1)*32]) {
+		return fmt.Errorf("Index %d failed the v2 integrity check", index)
+	}
+	return nil
+}
+
+// needsPieceLayer returns the pieces root of the file holding a piece when
+// the piece cannot be checked without the file's piece layer
+func (t *TorrentInfo) needsPieceLayer(index int) ([32]byte, bool) {
+	if len(t.FileTree) == 0 {
+		return [32]byte{}, false
+	}
+	_, tf, ok := t.treeFileAt(index)
+	if !ok || tf.Length <= int64(t.PieceLength) {
+		return [32]byte{}, false
+	}
+	_, known := t.pieceLayer(tf.PiecesRoot)
+	return tf.PiecesRoot, !known
+}
+
+// filePieces is the number of pieces of a v2 file
+func (t *TorrentInfo) filePieces(length int64) int {
+	return int((length + int64(t.PieceLength) - 1) / int64(t.PieceLength))
+}
+
+// SetPieceLayer adds the piece layer of a v2 file after checking it against
+// the file's pieces root
+func (t *TorrentInfo) SetPieceLayer(root [32]byte, layer []byte) error {
+	file, ok := t.fileByRoot(root)
+	if !ok || t.layers == nil {
+		return fmt.Errorf("No file has pieces root %x", root)
+	}
+	pieces := t.filePieces(file.Length)
+	if len(layer) != 32*pieces {
+		return fmt.Errorf("Piece layer of %d bytes for %d pieces", len(layer), pieces)
+	}
+	hashes := make([][32]byte, pieces)
+	for i := range hashes {
+		copy(hashes[i][:], layer[i*32:])
+	}
+	if merkleRoot(hashes, nextPow2(pieces), t.padHash()) != root {
+		return fmt.Errorf("Piece layer does not match pieces root %x", root)
+	}
+	t.layers.mu.Lock()
+	defer t.layers.mu.Unlock()
+	t.layers.layers[root] = append([]byte(nil), layer...)
+	return nil
+}
+
+func (t *TorrentInfo) fileByRoot(root [32]byte) (treeFile, bool) {
+	for _, file := range t.FileTree {
+		if file.PiecesRoot == root && file.Length > 0 {
+			return file, true
+		}
+	}
+	return treeFile{}, false
+}
+
+func (t *TorrentInfo) pieceLayer(root [32]byte) ([]byte, bool) {
+	if t.layers == nil {
+		return nil, false
+	}
+	t.layers.mu.Lock()
+	defer t.layers.mu.Unlock()
+	layer, ok := t.layers.layers[root]
+	return layer, ok
+}
+
+// pieceLayerDict is the bencoded "piece layers" of the torrent file
+func (t *TorrentInfo) pieceLayerDict() map[string]interface{} {
+	dict := map[string]interface{}{}
+	if t.layers == nil {
+		return dict
+	}
+	t.layers.mu.Lock()
+	defer t.layers.mu.Unlock()
+	for root, layer := range t.layers.layers {
+		dict[string(root[:])] = string(layer)
+	}
+	return dict
+}
+
+// padHash is the hash of a piece past the end of a file, the root of a
+// piece's worth of zero leaves
+func (t *TorrentInfo) padHash() [32]byte {
+	return merkleRoot(nil, t.PieceLength/merkleBlockSize, [32]byte{})
+}
+
+// pieceLayerIndex is the layer of the tree holding the piece hashes, 0 being the leaves
+func (t *TorrentInfo) pieceLayerIndex() int {
+	return bits.TrailingZeros(uint(t.PieceLength / merkleBlockSize))
+}
+
+// blockHashes are the leaves of the merkle tree of data
+func blockHashes(data []byte) [][32]byte {
+	var hashes [][32]byte
+	for begin := 0; begin < len(data); begin += merkleBlockSize {
+		end := begin + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// merkleLayers builds the tree above hashes padded to width, a power of two,
+// with pad. The first layer is the padded hashes and the last is the root.
+func merkleLayers(hashes [][32]byte, width int, pad [32]byte) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = sha256.Sum256(append(layer[2*i][:], layer[2*i+1][:]...))
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// merkleRoot is the root of the tree above hashes padded to width with pad
+func merkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := merkleLayers(hashes, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+func nextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << uint(bits.Len(uint(n-1)))
+}
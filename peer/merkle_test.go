@@ -0,0 +1,247 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+)
+
+// refTree builds the merkle tree of a file the long way, padding the leaves
+// with zeros, and returns the pieces root and the piece layer
+func refTree(data []byte, pieceLength int) ([32]byte, []byte) {
+	var leaves [][32]byte
+	for i := 0; i < len(data); i += merkleBlockSize {
+		end := i + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[i:end]))
+	}
+	for len(leaves)&(len(leaves)-1) != 0 {
+		leaves = append(leaves, [32]byte{})
+	}
+	var layer []byte
+	pieces := (len(data) + pieceLength - 1) / pieceLength
+	for width := 1; len(leaves) > 1; width *= 2 {
+		if width == pieceLength/merkleBlockSize && len(data) > pieceLength {
+			for _, h := range leaves[:pieces] {
+				layer = append(layer, h[:]...)
+			}
+		}
+		var next [][32]byte
+		for i := 0; i < len(leaves); i += 2 {
+			next = append(next, sha256.Sum256(append(leaves[i][:], leaves[i+1][:]...)))
+		}
+		leaves = next
+	}
+	return leaves[0], layer
+}
+
+func testContent(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7) + seed
+	}
+	return data
+}
+
+// testV2Torrent is a v2 torrent of a file of three pieces and a small file
+func testV2Torrent(t *testing.T) (*MetaInfo, [][]byte) {
+	pieceLength := 2 * merkleBlockSize
+	a, b := testContent(2*pieceLength+100, 1), testContent(5, 2)
+	rootA, layerA := refTree(a, pieceLength)
+	rootB, _ := refTree(b, pieceLength)
+	info := TorrentInfo{
+		Name:        "v2",
+		PieceLength: pieceLength,
+		MetaVersion: 2,
+		FileTree: []treeFile{
+			{Path: []string{"a"}, Length: int64(len(a)), PiecesRoot: rootA},
+			{Path: []string{"dir", "b"}, Length: int64(len(b)), PiecesRoot: rootB},
+			{Path: []string{"empty"}},
+		},
+		layers: &pieceLayers{layers: map[[32]byte][]byte{rootA: layerA}},
+	}
+	var buf bytes.Buffer
+	err := (&MetaInfo{Info: info}).Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := ReadTorrentFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mi.Info.PrepareForDownload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces := [][]byte{a[:pieceLength], a[pieceLength : 2*pieceLength], a[2*pieceLength:], b}
+	return mi, pieces
+}
+
+func TestV2Torrent(t *testing.T) {
+	mi, pieces := testV2Torrent(t)
+	info := &mi.Info
+	if mi.InfoHashV2 != sha256.Sum256(info.Raw) || !bytes.Equal(mi.InfoHash[:], mi.InfoHashV2[:20]) {
+		t.Errorf("got infohashes %x and %x", mi.InfoHash, mi.InfoHashV2)
+	}
+	if len(info.FileTree) != 3 || info.FileTree[1].Path[1] != "b" {
+		t.Fatalf("got file tree %+v", info.FileTree)
+	}
+	if info.NumPieces() != len(pieces) {
+		t.Fatalf("got %d pieces want %d", info.NumPieces(), len(pieces))
+	}
+	// The small file starts on the piece after the last one of a
+	if files := info.FileList(); files[1].Offset != 3*int64(info.PieceLength) {
+		t.Errorf("second file at %d", files[1].Offset)
+	}
+	for i, piece := range pieces {
+		if info.PieceSize(i) != len(piece) {
+			t.Errorf("piece %d of %d bytes want %d", i, info.PieceSize(i), len(piece))
+		}
+		if err := info.VerifyPiece(i, piece); err != nil {
+			t.Errorf("piece %d: %v", i, err)
+		}
+		bad := append([]byte(nil), piece...)
+		bad[len(bad)-1]++
+		if info.VerifyPiece(i, bad) == nil {
+			t.Errorf("corrupt piece %d passed", i)
+		}
+	}
+
+	// The piece layer went through the torrent file
+	noLayers := *info
+	noLayers.layers = &pieceLayers{layers: map[[32]byte][]byte{}}
+	if err := noLayers.VerifyPiece(0, pieces[0]); !errors.Is(err, errNoPieceLayer) {
+		t.Errorf("got %v without the piece layer", err)
+	}
+	if err := noLayers.VerifyPiece(3, pieces[3]); err != nil {
+		t.Errorf("a file of one piece needs no piece layer: %v", err)
+	}
+	layer, _ := info.pieceLayer(info.FileTree[0].PiecesRoot)
+	bad := append([]byte(nil), layer...)
+	bad[0]++
+	if noLayers.SetPieceLayer(info.FileTree[0].PiecesRoot, bad) == nil {
+		t.Error("a piece layer that does not match the root was kept")
+	}
+}
+
+func TestHybridTorrent(t *testing.T) {
+	pieceLength := merkleBlockSize
+	a, b := testContent(pieceLength+10, 3), testContent(20, 4)
+	rootA, layerA := refTree(a, pieceLength)
+	rootB, _ := refTree(b, pieceLength)
+	stream := append(append(append([]byte(nil), a...), make([]byte, pieceLength-10)...), b...)
+	var hashes []byte
+	for i := 0; i < len(stream); i += pieceLength {
+		end := i + pieceLength
+		if end > len(stream) {
+			end = len(stream)
+		}
+		hash := sha1.Sum(stream[i:end])
+		hashes = append(hashes, hash[:]...)
+	}
+	info := &TorrentInfo{
+		Name:        "hybrid",
+		PieceLength: pieceLength,
+		Pieces:      string(hashes),
+		Files: []fileInfo{
+			{Length: len(a), Path: []string{"a"}},
+			{Length: pieceLength - 10, Path: []string{".pad", "16374"}},
+			{Length: len(b), Path: []string{"b"}},
+		},
+		MetaVersion: 2,
+		FileTree: []treeFile{
+			{Path: []string{"a"}, Length: int64(len(a)), PiecesRoot: rootA},
+			{Path: []string{"b"}, Length: int64(len(b)), PiecesRoot: rootB},
+		},
+	}
+	if err := info.PrepareForDownload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.SetPieceLayer(rootA, layerA); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < info.NumPieces(); i++ {
+		begin := i * pieceLength
+		if err := info.VerifyPiece(i, stream[begin:begin+info.PieceSize(i)]); err != nil {
+			t.Errorf("piece %d: %v", i, err)
+		}
+	}
+	// Data matching the v1 hash but not the v2 tree fails
+	info.PiecesList[2] = sha1.Sum([]byte("other"))
+	info.FileTree[1].PiecesRoot = [32]byte{}
+	if info.VerifyPiece(2, []byte("other")) == nil {
+		t.Error("a piece failing the v2 check passed")
+	}
+
+	info.Files[2].Length++
+	if err := info.checkHybrid(); err == nil {
+		t.Error("v1 and v2 files that differ were accepted")
+	}
+}
+
+func TestHashRequests(t *testing.T) {
+	mi, pieces := testV2Torrent(t)
+	root := mi.Info.FileTree[0].PiecesRoot
+	layer, _ := mi.Info.pieceLayer(root)
+
+	// Three piece hashes and a pad hash, the proof of the first two is the hash of the others
+	hashes, ok := mi.Info.layerHashes(hashRequest{Root: root, BaseLayer: 1, Index: 0, Length: 2, ProofLayers: 1})
+	if !ok || len(hashes) != 3*32 {
+		t.Fatalf("got %d bytes of hashes", len(hashes))
+	}
+	if !bytes.Equal(hashes[:64], layer[:64]) {
+		t.Error("got the wrong hashes")
+	}
+	left := sha256.Sum256(hashes[:64])
+	if sha256.Sum256(append(left[:], hashes[64:]...)) != root {
+		t.Error("the proof does not lead to the root")
+	}
+	for _, req := range []hashRequest{
+		{Root: root, BaseLayer: 0, Index: 0, Length: 2},
+		{Root: root, BaseLayer: 1, Index: 1, Length: 2},
+		{Root: root, BaseLayer: 1, Index: 0, Length: 3},
+		{Root: [32]byte{1}, BaseLayer: 1, Index: 0, Length: 2},
+	} {
+		if _, ok := mi.Info.layerHashes(req); ok {
+			t.Errorf("%+v was answered", req)
+		}
+	}
+
+	// A peer that only has the metadata fetches the layer from one that has it
+	seed := &File{InfoHash: mi.InfoHash, Metadata: &mi.Info}
+	info, err := parseInfo(mi.Info.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leech := &File{InfoHash: mi.InfoHash, Metadata: info}
+	here, there := net.Pipe()
+	server := newPeerConnection(seed, there)
+	defer server.close()
+	go func() {
+		for {
+			m, err := server.readMessage()
+			if err != nil || server.handleMessage(m) != nil {
+				return
+			}
+		}
+	}()
+	client := newPeerConnection(leech, here)
+	defer client.close()
+	if _, missing := info.needsPieceLayer(0); !missing {
+		t.Fatal("the leech already has the piece layer")
+	}
+	if err := client.fetchPieceLayer(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.VerifyPiece(1, pieces[1]); err != nil {
+		t.Error(err)
+	}
+	if err := client.fetchPieceLayer(mi.Info.FileTree[1].PiecesRoot); err == nil {
+		t.Error("got a piece layer for a file of one piece")
+	}
+}
@@ -6,8 +6,11 @@ import (
 )
 
 type fileInfo struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr"`         // BEP 47
+	SymlinkPath []string `bencode:"symlink path"` // BEP 47
+	SHA1        string   `bencode:"sha1"`         // BEP 47
 }
 
 // TorrentInfo represents the info section of a torrent file (the metadata)
@@ -17,9 +20,16 @@ type TorrentInfo struct {
 	Length       int        `bencode:"length"`
 	Name         string     `bencode:"name"`
 	Files        []fileInfo `bencode:"files"`
+	Private      int        `bencode:"private"`
+	Source       string     `bencode:"source"`
+	Attr         string     `bencode:"attr"` // of a single file torrent (BEP 47)
+	MetaVersion  int        `bencode:"meta version"`
+	FileTree     []treeFile // the files of a v2 or hybrid torrent, from "file tree"
 	PiecesList   [][20]byte
 	MetadataSize int
+	Raw          []byte // the bencoded info dictionary, served to peers over ut_metadata
 	Movie        movie
+	layers       *pieceLayers
 }
 
 type movie struct {
@@ -34,6 +44,94 @@ type movie struct {
 	NumPieces        int
 }
 
+// TorrentFile is a file of the torrent and where it sits in the torrent's byte stream
+type TorrentFile struct {
+	Path   []string // starting with the torrent name
+	Length int64
+	Offset int64
+	// Attr holds the BEP 47 attributes: p for padding, x executable, h hidden and l symlink
+	Attr        string
+	SymlinkPath []string // the target of a symlink, from the torrent's root
+	SHA1        []byte   // of the whole file, when the torrent gives it
+}
+
+// FileList lists the torrent's files, a single file torrent has one file named after the torrent
+func (t *TorrentInfo) FileList() []TorrentFile {
+	if t.v2Only() {
+		return t.v2FileList()
+	}
+	if len(t.Files) == 0 {
+		return []TorrentFile{{Path: []string{t.Name}, Length: int64(t.Length), Attr: t.Attr}}
+	}
+	files := make([]TorrentFile, len(t.Files))
+	var offset int64
+	for i, file := range t.Files {
+		files[i] = TorrentFile{
+			Path:        append([]string{t.Name}, file.Path...),
+			Length:      int64(file.Length),
+			Offset:      offset,
+			Attr:        file.Attr,
+			SymlinkPath: file.SymlinkPath,
+		}
+		if file.SHA1 != "" {
+			files[i].SHA1 = []byte(file.SHA1)
+		}
+		offset += int64(file.Length)
+	}
+	return files
+}
+
+// singleFile reports whether the torrent is a single file named after the torrent
+func (t *TorrentInfo) singleFile() bool {
+	if t.v2Only() {
+		return t.v2Single()
+	}
+	return len(t.Files) == 0
+}
+
+// TotalLength is the size of all the torrent's files together
+func (t *TorrentInfo) TotalLength() int64 {
+	var total int64
+	for _, file := range t.FileList() {
+		total += file.Length
+	}
+	return total
+}
+
+// NumPieces is the number of pieces in the torrent
+func (t *TorrentInfo) NumPieces() int {
+	if t.v2Only() {
+		var end int64
+		for _, file := range t.FileList() {
+			if file.Offset+file.Length > end {
+				end = file.Offset + file.Length
+			}
+		}
+		return t.filePieces(end)
+	}
+	return len(t.Pieces) / 20
+}
+
+// PieceSize is the length of a piece, only the last piece can be shorter than PieceLength
+func (t *TorrentInfo) PieceSize(index int) int {
+	begin := int64(index) * int64(t.PieceLength)
+	end := begin + int64(t.PieceLength)
+	if t.v2Only() {
+		// The last piece of every file may be short
+		for _, file := range t.FileList() {
+			fileEnd := file.Offset + file.Length
+			if file.Offset <= begin && begin < fileEnd && fileEnd < end {
+				end = fileEnd
+			}
+		}
+		return int(end - begin)
+	}
+	if total := t.TotalLength(); end > total {
+		end = total
+	}
+	return int(end - begin)
+}
+
 // PrepareForDownload rearranges the metadata to allow for easier calculations when downloading
 func (t *TorrentInfo) PrepareForDownload() error {
 	var err error = nil
@@ -41,6 +139,15 @@ func (t *TorrentInfo) PrepareForDownload() error {
 	t.setMovieSize()
 	t.setMovieBounds()
 	t.seMovietNumPieces()
+	if err == nil {
+		err = t.checkHybrid()
+	}
+	if err == nil {
+		err = t.checkSymlinks()
+	}
+	if len(t.FileTree) > 0 && t.layers == nil {
+		t.layers = &pieceLayers{layers: map[[32]byte][]byte{}}
+	}
 	return err
 }
 
@@ -2,15 +2,14 @@ package peer
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"os"
-	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -38,6 +37,9 @@ const (
 	msgCancel        uint8 = 8
 	msgPort          uint8 = 9
 	msgExtended      uint8 = 20
+	msgHashRequest   uint8 = 21
+	msgHashes        uint8 = 22
+	msgHashReject    uint8 = 23
 )
 
 var haveMetadata bool = false
@@ -53,6 +55,7 @@ type File struct {
 	InfoHash [20]byte
 	Name     string
 	Peers    []Peer
+	WebSeeds []string // URLs of HTTP servers holding the files (BEP 19)
 	Metadata *TorrentInfo
 }
 
@@ -60,19 +63,65 @@ type File struct {
 // and that peer is not choking the client. A block is uploaded by a client when
 // the client is not choking a peer, and that peer is interested in the client.
 type peerConnection struct {
-	Socket               net.Conn
-	File                 *File
-	AmChoking            bool
-	AmInterested         bool
-	PeerChoking          bool
-	PeerInterested       bool
-	ExtMetadata          uint8
-	CurrentMetadataPiece int
-	MetadataSize         int
-	MetadataBuff         *bytes.Buffer
-	Done                 bool
-	Bitfield             []byte
-	CurrentPiece         *pieceState
+	Socket                net.Conn
+	File                  *File
+	AmChoking             bool
+	AmInterested          bool
+	PeerChoking           bool
+	PeerInterested        bool
+	ExtMetadata           uint8
+	SentExtHandshake      bool
+	MetadataSize          int // as advertised by the peer
+	Fetcher               *metadataFetcher
+	MetadataPiece         int          // piece requested through Fetcher, -1 when idle
+	RejectedPieces        map[int]bool // metadata pieces this peer refused to send
+	MetadataRequests      int
+	MetadataRequestsSince time.Time
+	Done                  bool
+	PeerV2                bool     // set the BEP 52 bit in its handshake
+	Bitfield              Bitfield // empty until the metadata is known
+	CurrentPiece          *pieceState
+	OnEvent               func(Event)
+	// Serve reads a block of a piece we have for the peer, nil to serve nothing
+	Serve func(index, begin, length int) ([]byte, error)
+	// OnInterested is called when the peer becomes interested in our pieces
+	OnInterested func()
+	sentChoking  bool // whether the peer was last told it is choked
+
+	// mu guards the state shared with the download. Messages are only written
+	// by the connection's goroutine, queued ones go out before the next read.
+	mu           sync.Mutex
+	choking      bool // whether the download wants the peer choked
+	pendingHaves []int
+	blockBytes   int64 // of piece blocks received
+	sentBytes    int64 // of piece blocks sent
+	lastBlock    time.Time
+	downRate     rateMeter
+	upRate       rateMeter
+
+	// Set up by startIO once the handshake is done
+	ioOnce   sync.Once
+	incoming chan message
+	outgoing chan []byte // frames
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed when the reader returns, after readErr is set
+	readErr  error
+}
+
+func (p *peerConnection) emit(e Event) {
+	if p.OnEvent != nil {
+		p.OnEvent(e)
+	}
+}
+
+// peer is the address of the other end of the connection
+func (p *peerConnection) peer() Peer {
+	addr, ok := p.Socket.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return Peer{}
+	}
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
 }
 
 type pieceState struct {
@@ -81,6 +130,7 @@ type pieceState struct {
 	Requested  int
 	Backlog    int
 	Buff       []byte
+	Sources    []Peer // that sent each block
 }
 
 type handshake struct {
@@ -98,121 +148,194 @@ type message struct {
 }
 
 type inputPiece struct {
-	Index  int
-	Hash   [20]byte
-	Length int
+	Index    int
+	Length   int
+	Excluded map[string]bool // IPs that sent a copy failing the hash check
+	Padding  []bool          // blocks that are all padding, left zero without being requested
 }
 
 type outputPiece struct {
-	Index int
-	Buff  []byte
+	Index   int
+	Buff    []byte
+	Peer    Peer   // that sent the piece
+	Sources []Peer // that sent each block
+	WebSeed string // the URL, when a web seed sent the piece instead of a peer
+	Input   *inputPiece
+	Failed  bool // the hash check
+}
+
+// protocolError is a message from a peer that breaks the protocol
+type protocolError struct {
+	error
 }
 
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
-// DownloadMovie only downloads the largest file (the movie) from the torrent
-func DownloadMovie(file *File) error {
-	inputPieces := make(chan *inputPiece, file.Metadata.Movie.NumPieces)
-	outputPieces := make(chan *outputPiece)
-	for i := file.Metadata.Movie.StartPiece; i < file.Metadata.Movie.EndPiece; i++ {
-		length, err := file.Metadata.calculatePieceSize(i)
-		if err != nil {
-			return err
-		}
-		inputPieces <- &inputPiece{i, file.Metadata.PiecesList[i], length}
-	}
-
-	for i := 0; i < len(file.Peers); i++ {
-		go startDownloadWorker(file, file.Peers[i], inputPieces, outputPieces)
-	}
-
-	f, err := os.Create("movies/" + file.Metadata.Movie.Path[len(file.Metadata.Movie.Path)-1])
-	if err != nil {
-		return err
-	}
-	for i := 0; i < file.Metadata.Movie.NumPieces; i++ {
-		donePiece := <-outputPieces
-		percentDone := ((float32(i) + 1) / float32(file.Metadata.Movie.NumPieces)) * 100
-		f.WriteAt(donePiece.Buff, int64(donePiece.Index*file.Metadata.PieceLength))
-		fmt.Printf("Downloaded piece at index %d, of length: %d \n", donePiece.Index, len(donePiece.Buff))
-		fmt.Printf("Currently downloading from %d peers \n", runtime.NumGoroutine()-1)
-		fmt.Printf("Percent done: %0.2f %% \n", percentDone)
-	}
+// Compact encodes the peer in the compact format used by trackers, 6 bytes
+// for an IPv4 peer and 18 bytes for an IPv6 peer (BEP 7)
+func (p Peer) Compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+	return buf
+}
 
-	return nil
+// ParseCompactPeers decodes a list of compact peers where each address is ipLen bytes
+// long (net.IPv4len or net.IPv6len) and followed by a big endian port
+func ParseCompactPeers(buf []byte, ipLen int) ([]Peer, error) {
+	entrySize := ipLen + 2
+	if len(buf)%entrySize != 0 {
+		return nil, fmt.Errorf("Received malformed peers of length %d", len(buf))
+	}
+	peers := make([]Peer, len(buf)/entrySize)
+	for i := range peers {
+		entry := buf[i*entrySize : (i+1)*entrySize]
+		ip := make(net.IP, ipLen)
+		copy(ip, entry[:ipLen])
+		peers[i] = Peer{IP: ip, Port: binary.BigEndian.Uint16(entry[ipLen:])}
+	}
+	return peers, nil
 }
 
-func startDownloadWorker(file *File, peer Peer, inputPieces chan *inputPiece, outputPieces chan *outputPiece) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 6*time.Second)
+// DownloadMovie only downloads the largest file (the movie) from the torrent into
+// storage. It returns once the movie is written or ctx is done, sending the
+// download's events to onEvent.
+func DownloadMovie(ctx context.Context, file *File, storage Storage, onEvent func(Event)) error {
+	d, err := NewDownload(file, storage, nil)
 	if err != nil {
-		return
+		return err
 	}
-	p := newPeerConnection(file, conn)
-	err = p.peerWireProtocol()
-	if err != nil {
-		conn.Close()
-		return
+	for i, f := range file.Metadata.FileList() {
+		d.SetFileWanted(i, f.Length == int64(file.Metadata.Movie.Size) || len(file.Metadata.Files) == 0)
 	}
-	beginDownload(p, inputPieces, outputPieces)
+	d.OnEvent = onEvent
+	return d.Run(ctx)
 }
 
-func beginDownload(p *peerConnection, inputPieces chan *inputPiece, outputPieces chan *outputPiece) {
-	for piece := range inputPieces {
-		if !p.hasPiece(piece.Index) {
+// beginDownload downloads pieces from the peer until the connection fails or
+// ctx is done. Pieces failing the hash check are handed back as Failed so the
+// download can tell who sent them.
+func beginDownload(ctx context.Context, p *peerConnection, inputPieces chan *inputPiece, outputPieces chan *outputPiece) error {
+	misses := 0
+	ip := p.peer().IP.String()
+	for {
+		var piece *inputPiece
+		select {
+		case piece = <-inputPieces:
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// Nothing is left to download for now, the peer can still download from us
+			err := p.serveFor(time.Second)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !p.Bitfield.Has(piece.Index) || piece.Excluded[ip] {
 			inputPieces <- piece
+			// Once the peer lacks every queued piece, wait for it to announce more
+			misses++
+			if misses > cap(inputPieces) {
+				misses = 0
+				message, err := p.readMessageWithin(timeoutDuration)
+				if err != nil && !isTimeout(err) {
+					return err
+				}
+				if err == nil {
+					err = p.handleMessage(message)
+					if err != nil {
+						return protocolError{err}
+					}
+				}
+			}
 			continue
 		}
+		misses = 0
+		info := p.File.Metadata
+		if root, ok := info.needsPieceLayer(piece.Index); ok && (info.v2Only() || p.PeerV2) {
+			err := p.fetchPieceLayer(root)
+			if err != nil {
+				inputPieces <- piece
+				return err
+			}
+		}
 		buf, err := p.attemptDownloadPiece(piece)
 		if err != nil {
-			log.Println("Failed to download piece", err)
 			inputPieces <- piece // Put piece back on the queue
 			p.Socket.Close()
-			return
+			return err
 		}
-		err = validatePiece(piece, buf)
+		done := &outputPiece{Index: piece.Index, Buff: buf, Peer: p.peer(), Sources: p.CurrentPiece.Sources, Input: piece}
+		err = info.VerifyPiece(piece.Index, buf)
 		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", piece.Index)
-			inputPieces <- piece // Put piece back on the queue
-			continue
+			e := NewEvent(EventPieceFailed, p.File.InfoHash)
+			e.Piece, e.Peer, e.Err = piece.Index, p.peer(), err
+			p.emit(e)
+			done.Failed = true
+		}
+		select {
+		case outputPieces <- done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		outputPieces <- &outputPiece{piece.Index, buf}
 	}
 }
 
-func validatePiece(piece *inputPiece, downloadedData []byte) error {
-	hash := sha1.Sum(downloadedData)
-	if !bytes.Equal(hash[:], piece.Hash[:]) {
-		return fmt.Errorf("Index %d failed integrity check", piece.Index)
+// serveFor answers the peer's messages, which uploads to it when it is
+// unchoked, for the duration
+func (p *peerConnection) serveFor(duration time.Duration) error {
+	deadline := time.Now().Add(duration)
+	for wait := duration; wait > 0; wait = time.Until(deadline) {
+		m, err := p.readMessageWithin(wait)
+		if err == errWaitTimeout {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = p.handleMessage(m)
+		if err != nil {
+			return protocolError{err}
+		}
 	}
 	return nil
 }
 
+func isTimeout(err error) bool {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	return false
+}
+
 func newPeerConnection(file *File, socket net.Conn) (p *peerConnection) {
 	return &peerConnection{
-		Socket:               socket,
-		File:                 file,
-		AmChoking:            true,
-		AmInterested:         false,
-		PeerChoking:          true,
-		PeerInterested:       false,
-		CurrentMetadataPiece: 0,
-		MetadataSize:         0,
-		MetadataBuff:         &bytes.Buffer{},
-		Bitfield:             newBitfield(file),
+		Socket:         socket,
+		File:           file,
+		AmChoking:      true,
+		AmInterested:   false,
+		PeerChoking:    true,
+		PeerInterested: false,
+		MetadataPiece:  -1,
+		RejectedPieces: map[int]bool{},
+		Bitfield:       newBitfield(file),
+		choking:        true,
+		sentChoking:    true,
 	}
 }
 
-func newBitfield(file *File) []byte {
-	piecesPerByte := 8
-	hashLength := 20
-	hashPiecesLength := 0
-	if file.Metadata != nil {
-		hashPiecesLength = len(file.Metadata.Pieces)
+func newBitfield(file *File) Bitfield {
+	if file.Metadata == nil {
+		return Bitfield{}
 	}
-	numPieces := hashPiecesLength / hashLength
-	return make([]byte, numPieces/piecesPerByte)
+	return NewBitfield(file.Metadata.NumPieces())
 }
 
 func (p *peerConnection) peerWireProtocol() error {
@@ -220,7 +343,12 @@ func (p *peerConnection) peerWireProtocol() error {
 	if err != nil {
 		return err
 	}
-	err = p.sendInterested()
+	return p.startDownloading()
+}
+
+// startDownloading tells the peer we are interested and waits for it to unchoke us
+func (p *peerConnection) startDownloading() error {
+	err := p.sendInterested()
 	if err != nil {
 		return err
 	}
@@ -231,91 +359,140 @@ func (p *peerConnection) peerWireProtocol() error {
 		}
 		err = p.handleMessage(message)
 		if err != nil {
-			return err
+			return protocolError{err}
 		}
 	}
 	return nil
 }
 
 func (p *peerConnection) handshake() error {
+	err := p.sendHandshake()
+	if err != nil {
+		return err
+	}
+	var response handshake
+	err = p.read(&response, handshakeSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p.File.InfoHash[:], response.InfoHash[:]) {
+		return fmt.Errorf("Expected infohash %x but got %x", p.File.InfoHash, response.InfoHash)
+	}
+	p.PeerV2 = response.Reserved[7]&0x10 != 0
+	return nil
+}
+
+func (p *peerConnection) sendHandshake() error {
 	reserved := [8]byte{0, 0, 0, 0, 0, 0, 0, 0}
 	reserved[5] |= 0x10
+	if p.File.Metadata != nil && len(p.File.Metadata.FileTree) > 0 {
+		reserved[7] |= 0x10 // BEP 52
+	}
 	payload := handshake{
 		PStrLen:  protocolLen,
 		Reserved: reserved,
 		InfoHash: p.File.InfoHash,
 	}
-	var response handshake
 	copy(payload.PStr[:19], protocolStr)
 	copy(payload.PeerID[:20], PeerID)
-	p.write(&payload)
-	err := p.read(&response, handshakeSize)
-	if !bytes.Equal(payload.InfoHash[:], response.InfoHash[:]) {
-		return fmt.Errorf("Expected infohash %x but got %x", payload.InfoHash, response.InfoHash)
-	}
+	return p.write(&payload)
+}
 
+// AcceptHandshake reads the handshake of an incoming connection and returns the
+// infohash the peer wants, the reply is sent once the torrent is found
+func AcceptHandshake(conn net.Conn) ([20]byte, error) {
+	var h handshake
+	p := peerConnection{Socket: conn}
+	err := p.read(&h, handshakeSize)
 	if err != nil {
-		return err
+		return h.InfoHash, err
 	}
-	return nil
+	if h.PStrLen != protocolLen || string(h.PStr[:]) != protocolStr {
+		return h.InfoHash, errors.New("Peer does not speak the BitTorrent protocol")
+	}
+	return h.InfoHash, nil
 }
 
 func (p *peerConnection) handleMessage(m message) error {
 	switch m.ID {
 	case msgChoke:
+		p.mu.Lock()
 		p.AmChoking = true
+		p.mu.Unlock()
 	case msgUnchoke:
+		p.mu.Lock()
 		p.AmChoking = false
+		p.mu.Unlock()
 	case msgInterested:
+		p.mu.Lock()
 		p.PeerInterested = true
+		p.mu.Unlock()
+		if p.OnInterested != nil {
+			p.OnInterested()
+		}
 	case msgNotInterested:
+		p.mu.Lock()
 		p.PeerInterested = false
+		p.mu.Unlock()
 	case msgHave:
+		if len(m.Payload) != 4 {
+			return fmt.Errorf("Have payload of length %d", len(m.Payload))
+		}
+		// Without metadata the connection only fetches it, so pieces are not tracked
 		index := int(binary.BigEndian.Uint32(m.Payload))
-		p.setPiece(index)
+		p.mu.Lock()
+		ok := p.Bitfield.Set(index)
+		p.mu.Unlock()
+		if !ok && p.File.Metadata != nil {
+			return fmt.Errorf("Have for piece %d out of range", index)
+		}
 	case msgBitfield:
-		p.Bitfield = m.Payload
+		if p.File.Metadata == nil {
+			return nil
+		}
+		bitfield, err := ParseBitfield(m.Payload, p.Bitfield.Len())
+		if err != nil {
+			return protocolError{err}
+		}
+		p.mu.Lock()
+		p.Bitfield = bitfield
+		p.mu.Unlock()
 	case msgRequest:
-		payload := 0
-		p.write(&payload)
+		err := p.handleRequest(m)
+		if err != nil {
+			return err
+		}
+	case msgHashRequest:
+		err := p.handleHashRequest(m)
+		if err != nil {
+			return err
+		}
 	case msgPiece:
 		err := p.handlePiece(m)
 		if err != nil {
 			return err
 		}
-	case msgCancel:
-		payload := 0
-		p.write(&payload)
-	case msgPort:
-		payload := 0
-		p.write(&payload)
+	case msgExtended:
+		_, err := p.handleExtMessage(m)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (p *peerConnection) setPiece(index int) {
-	bitInByte := index % 8
-	byteIndex := index / 8
-	// start at the beginning of the byte, then shift right
-	var newBit uint8 = 128 >> bitInByte
-	p.Bitfield[byteIndex] |= newBit
-}
-
-func (p *peerConnection) hasPiece(index int) bool {
-	bitInByte := index % 8
-	byteIndex := index / 8
-	if byteIndex < 0 || byteIndex >= len(p.Bitfield) {
-		return false
-	}
-	return p.Bitfield[byteIndex]>>(7-bitInByte)&1 != 0
-}
-
 func (p *peerConnection) attemptDownloadPiece(piece *inputPiece) ([]byte, error) {
 	state := pieceState{
-		Index: piece.Index,
-		Buff:  make([]byte, piece.Length),
+		Index:   piece.Index,
+		Buff:    make([]byte, piece.Length),
+		Sources: make([]Peer, (piece.Length+maxRequestLength-1)/maxRequestLength),
 	}
 	p.CurrentPiece = &state
+	for block, padding := range piece.Padding {
+		if padding {
+			state.Downloaded += blockLength(piece.Length, block)
+		}
+	}
 	// Setting a deadline helps get unresponsive peers unstuck.
 	// 30 seconds is more than enough time to download a 262 KB piece
 	// p.Socket.SetDeadline(time.Now().Add(30 * time.Second))
@@ -325,13 +502,18 @@ func (p *peerConnection) attemptDownloadPiece(piece *inputPiece) ([]byte, error)
 		// If unchoked, send requests until we have enough unfulfilled requests
 		if !p.AmChoking {
 			for state.Backlog < maxBacklog && state.Requested < piece.Length {
-				blockSize := maxRequestLength
-				leftToRequest := piece.Length - state.Requested
-				// Last block might be shorter than the typical block
-				if leftToRequest < blockSize {
-					blockSize = leftToRequest
+				blockSize := blockLength(piece.Length, state.Requested/maxRequestLength)
+				if block := state.Requested / maxRequestLength; block < len(piece.Padding) && piece.Padding[block] {
+					state.Requested += blockSize
+					continue
 				}
 
+				if limited, ok := p.Socket.(*limitedConn); ok {
+					err := limited.waitToRequest()
+					if err != nil {
+						return nil, err
+					}
+				}
 				err := p.requestPiece(piece.Index, state.Requested, blockSize)
 				if err != nil {
 					return nil, err
@@ -341,11 +523,14 @@ func (p *peerConnection) attemptDownloadPiece(piece *inputPiece) ([]byte, error)
 			}
 		}
 
-		message, err := p.readMessage()
+		message, err := p.readMessageWithin(requestTimeout)
 		if err != nil {
 			return nil, err
 		}
-		p.handleMessage(message)
+		err = p.handleMessage(message)
+		if err != nil {
+			return nil, protocolError{err}
+		}
 	}
 
 	return state.Buff, nil
@@ -375,6 +560,9 @@ func (p *peerConnection) handlePiece(m message) error {
 	if len(m.Payload) < 8 {
 		return fmt.Errorf("Payload too short. %d < 8", len(m.Payload))
 	}
+	if p.CurrentPiece == nil {
+		return errors.New("Received a piece that was not requested")
+	}
 	parsedIndex := int(binary.BigEndian.Uint32(m.Payload[0:4]))
 	if parsedIndex != p.CurrentPiece.Index {
 		return fmt.Errorf("Expected index %d, got %d", p.CurrentPiece.Index, parsedIndex)
@@ -388,59 +576,202 @@ func (p *peerConnection) handlePiece(m message) error {
 		return fmt.Errorf("Data too long [%d] for offset %d with length %d", len(data), begin, len(p.CurrentPiece.Buff))
 	}
 	copy(p.CurrentPiece.Buff[begin:], data)
+	p.CurrentPiece.Sources[begin/maxRequestLength] = p.peer()
 	bytesWritten := len(data)
 	p.CurrentPiece.Downloaded += bytesWritten
 	p.CurrentPiece.Backlog--
+	p.mu.Lock()
+	p.blockBytes += int64(bytesWritten)
+	p.lastBlock = time.Now()
+	p.mu.Unlock()
+	p.downRate.add(int64(bytesWritten))
 	return nil
 }
 
-func (p *peerConnection) sendInterested() error {
-	m := message{
-		Length: 1,
-		ID:     msgInterested,
+// blockLength is the length of a block of a piece, the last block may be shorter
+func blockLength(pieceLength, block int) int {
+	if left := pieceLength - block*maxRequestLength; left < maxRequestLength {
+		return left
 	}
-	return p.writeMessage(m)
+	return maxRequestLength
 }
 
-// <len><id><payload>
-func (p *peerConnection) writeMessage(m message) error {
-	writeBuffer := bytes.NewBuffer(make([]byte, 0, bufferSize))
-	var length uint32 = uint32(len(m.Payload) + 1) // ID + payload
-	err := binary.Write(writeBuffer, binary.BigEndian, &length)
-	if err != nil {
-		return err
+// handleRequest sends the block a peer asked for, if it is unchoked. Requests
+// of a choked peer are dropped as the peer knows they will not be answered.
+func (p *peerConnection) handleRequest(m message) error {
+	if len(m.Payload) != 12 {
+		return fmt.Errorf("Request payload of length %d", len(m.Payload))
 	}
-	err = binary.Write(writeBuffer, binary.BigEndian, &m.ID)
-	if err != nil {
-		return err
+	index := int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	if length > maxRequestLength {
+		return fmt.Errorf("Requested block of %d bytes", length)
+	}
+	if p.sentChoking || p.Serve == nil {
+		return nil
 	}
-	err = binary.Write(writeBuffer, binary.BigEndian, &m.Payload)
+	block, err := p.Serve(index, begin, length)
 	if err != nil {
-		return err
+		return nil
 	}
-	_, err = p.Socket.Write(writeBuffer.Bytes())
+	payload := make([]byte, 8, 8+len(block))
+	copy(payload, m.Payload[:8])
+	err = p.writeMessage(message{ID: msgPiece, Payload: append(payload, block...)})
 	if err != nil {
 		return err
 	}
+	p.mu.Lock()
+	p.sentBytes += int64(len(block))
+	p.mu.Unlock()
+	p.upRate.add(int64(len(block)))
 	return nil
 }
 
-func (p *peerConnection) readMessage() (message, error) {
-	var m message
-	err := p.read(&m.Length, 4)
-	if err != nil {
-		return m, err
+// PeerStats is a snapshot of a connection to a peer
+type PeerStats struct {
+	Peer           Peer
+	Incoming       bool
+	Choked         bool // the peer will not send us blocks
+	Choking        bool // we will not send the peer blocks
+	PeerInterested bool // the peer wants pieces we have
+	Pieces         int  // the peer has, of the torrent's pieces
+	Downloaded     int64
+	Uploaded       int64
+	DownloadRate   float64 // bytes per second over the last few seconds
+	UploadRate     float64
+}
+
+// stats is a snapshot of the connection, it can be called from any goroutine
+func (p *peerConnection) stats() PeerStats {
+	p.mu.Lock()
+	stats := PeerStats{
+		Peer:           p.peer(),
+		Choked:         p.AmChoking,
+		Choking:        p.choking,
+		PeerInterested: p.PeerInterested,
+		Pieces:         p.Bitfield.Count(),
+		Downloaded:     p.blockBytes,
+		Uploaded:       p.sentBytes,
+	}
+	p.mu.Unlock()
+	stats.DownloadRate = p.downRate.rate()
+	stats.UploadRate = p.upRate.rate()
+	return stats
+}
+
+// received is how many bytes of blocks the peer sent us and when the last one came
+func (p *peerConnection) received() (int64, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blockBytes, p.lastBlock
+}
+
+func (p *peerConnection) interested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.PeerInterested
+}
+
+// setChoking queues a choke or unchoke message if it changes what the peer was told
+func (p *peerConnection) setChoking(choking bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.choking = choking
+}
+
+// queueHave queues a have message for a piece we just verified
+func (p *peerConnection) queueHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pendingHaves = append(p.pendingHaves, index)
+}
+
+// sendQueued writes the messages queued by the download
+func (p *peerConnection) sendQueued() error {
+	p.mu.Lock()
+	haves := p.pendingHaves
+	p.pendingHaves = nil
+	choking := p.choking
+	p.mu.Unlock()
+	if choking != p.sentChoking {
+		id := msgUnchoke
+		if choking {
+			id = msgChoke
+		}
+		err := p.writeMessage(message{ID: id})
+		if err != nil {
+			return err
+		}
+		p.sentChoking = choking
 	}
-	err = p.read(&m.ID, 1)
-	if err != nil {
-		return m, err
+	for _, index := range haves {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(index))
+		err := p.writeMessage(message{ID: msgHave, Payload: payload})
+		if err != nil {
+			return err
+		}
 	}
-	m.Payload = make([]byte, m.Length-1)
-	err = p.read(&m.Payload, int(m.Length-1))
+	return nil
+}
+
+// sendBitfield tells the peer which pieces we have
+func (p *peerConnection) sendBitfield(have Bitfield) error {
+	return p.writeMessage(message{ID: msgBitfield, Payload: have.Bytes()})
+}
+
+func (p *peerConnection) sendInterested() error {
+	m := message{
+		Length: 1,
+		ID:     msgInterested,
+	}
+	return p.writeMessage(m)
+}
+
+// writeMessage queues <len><id><payload> for the connection's writer
+func (p *peerConnection) writeMessage(m message) error {
+	frame := make([]byte, 5, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(m.Payload)+1)) // ID + payload
+	frame[4] = m.ID
+	p.startIO()
+	select {
+	case p.outgoing <- append(frame, m.Payload...):
+		return nil
+	case <-p.done:
+		return p.readErr
+	}
+}
+
+// readMessage waits for the next message, keep-alives are not returned. It only
+// fails once the connection is closed or idle for connIdleTimeout.
+func (p *peerConnection) readMessage() (message, error) {
+	return p.readMessageWithin(0)
+}
+
+// readMessageWithin is readMessage giving up with a timeout error after timeout,
+// zero waits for as long as the connection lives. The connection stays usable
+// after a timeout.
+func (p *peerConnection) readMessageWithin(timeout time.Duration) (message, error) {
+	p.startIO()
+	err := p.sendQueued()
 	if err != nil {
-		return m, err
+		return message{}, err
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case m := <-p.incoming:
+		return m, nil
+	case <-p.done:
+		return message{}, p.readErr
+	case <-expired:
+		return message{}, errWaitTimeout
 	}
-	return m, nil
 }
 
 func (p *peerConnection) write(payload interface{}) error {
@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCompactPeers(t *testing.T) {
+	peers := []Peer{
+		{IP: net.ParseIP("192.168.1.2"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+	}
+	for _, want := range peers {
+		ipLen := net.IPv6len
+		if want.IP.To4() != nil {
+			ipLen = net.IPv4len
+		}
+		buf := want.Compact()
+		if len(buf) != ipLen+2 {
+			t.Fatalf("got compact length %d for %s", len(buf), want)
+		}
+		got, err := ParseCompactPeers(buf, ipLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got[0].IP.Equal(want.IP) || got[0].Port != want.Port {
+			t.Errorf("got %s want %s", got[0], want)
+		}
+	}
+	if _, err := ParseCompactPeers(make([]byte, 17), net.IPv6len); err == nil {
+		t.Error("expected error for truncated peers6")
+	}
+}
+
+func TestHandshakeIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer listener.Close()
+	file := &File{InfoHash: [20]byte{1, 2, 3}}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, handshakeSize)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write(buf) // echo the handshake, it carries the same infohash
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	remote := Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	conn, err := net.Dial("tcp", remote.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newPeerConnection(file, conn)
+	if err := p.handshake(); err != nil {
+		t.Fatal(err)
+	}
+}
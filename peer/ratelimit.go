@@ -0,0 +1,240 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimitChunk is the most a limited connection reads or writes in one go,
+// so a single call cannot take a large share of the bucket at once
+const rateLimitChunk = 16 * 1024
+
+// RateSchedule is a rate that applies during part of each day. Start and End
+// are offsets from local midnight, an End before Start runs past midnight.
+type RateSchedule struct {
+	Start, End     time.Duration
+	BytesPerSecond int64
+}
+
+func (s RateSchedule) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if s.Start <= s.End {
+		return offset >= s.Start && offset < s.End
+	}
+	return offset >= s.Start || offset < s.End
+}
+
+// RateLimiter is a token bucket in bytes per second, shared by everything it
+// limits. A rate of zero is unlimited. Its rate and schedule can be changed
+// while it is in use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateSchedule
+	tokens   float64
+	last     time.Time
+}
+
+// NewRateLimiter creates a limiter of bytesPerSecond, zero for unlimited
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond, last: time.Now()}
+}
+
+// SetRate changes the rate used outside of the schedule
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+}
+
+// SetSchedule replaces the times of day with a rate of their own, the first
+// entry that contains the current time wins
+func (l *RateLimiter) SetSchedule(schedule []RateSchedule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = append([]RateSchedule(nil), schedule...)
+}
+
+// Rate is the rate in effect right now, zero when unlimited
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentRate(time.Now())
+}
+
+func (l *RateLimiter) currentRate(now time.Time) int64 {
+	for _, s := range l.schedule {
+		if s.contains(now) {
+			return s.BytesPerSecond
+		}
+	}
+	return l.rate
+}
+
+// refill adds the tokens earned since the last call, holding at most a second's worth
+func (l *RateLimiter) refill(now time.Time) int64 {
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if burst := float64(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	return rate
+}
+
+// take spends n tokens, going into debt if needed, and returns how long to wait
+// for the debt to be paid back
+func (l *RateLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.refill(time.Now())
+	if rate <= 0 {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// debt is how long until the bucket is no longer in debt
+func (l *RateLimiter) debt() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.refill(time.Now())
+	if rate <= 0 || l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// WaitN takes n bytes from the bucket, waiting until they are paid for or ctx is done
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	return sleep(ctx, l.take(n))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedConn charges what is read and written on a connection to its limiters.
+// Time spent waiting for the limiters does not count towards read deadlines.
+type limitedConn struct {
+	net.Conn
+	ctx  context.Context
+	Down []*RateLimiter // charged for reads
+	Up   []*RateLimiter // charged for writes
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func newLimitedConn(ctx context.Context, conn net.Conn, down, up []*RateLimiter) *limitedConn {
+	return &limitedConn{Conn: conn, ctx: ctx, Down: down, Up: up}
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, l := range c.Down {
+			if d := l.take(n); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			c.pushDeadline(wait)
+			if werr := sleep(c.ctx, wait); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunk {
+			chunk = chunk[:rateLimitChunk]
+		}
+		var wait time.Duration
+		for _, l := range c.Up {
+			if d := l.take(len(chunk)); d > wait {
+				wait = d
+			}
+		}
+		if err := sleep(c.ctx, wait); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// waitToRequest holds back new block requests while the download limiters are
+// in debt, so requests are not piled up faster than they may be read
+func (c *limitedConn) waitToRequest() error {
+	var wait time.Duration
+	for _, l := range c.Down {
+		if d := l.debt(); d > wait {
+			wait = d
+		}
+	}
+	return sleep(c.ctx, wait)
+}
+
+// pushDeadline moves a read deadline back by the time spent waiting
+func (c *limitedConn) pushDeadline(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.readDeadline.IsZero() {
+		c.readDeadline = c.readDeadline.Add(d)
+		c.Conn.SetReadDeadline(c.readDeadline)
+	}
+}
@@ -0,0 +1,116 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loopbackPair connects two TCP sockets over loopback
+func loopbackPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// measureRead reads from conn for d and returns the bytes per second
+func measureRead(conn net.Conn, d time.Duration) float64 {
+	buf := make([]byte, 32*1024)
+	var total int
+	start := time.Now()
+	for time.Since(start) < d {
+		n, err := conn.Read(buf)
+		total += n
+		if err != nil {
+			break
+		}
+	}
+	return float64(total) / time.Since(start).Seconds()
+}
+
+func checkRate(t *testing.T, what string, got, want float64) {
+	t.Helper()
+	if got < want*0.8 || got > want*1.2 {
+		t.Errorf("%s: got %.0f bytes/s want %.0f within 20%%", what, got, want)
+	}
+}
+
+func flood(conn net.Conn) {
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestRateLimitedReads(t *testing.T) {
+	const rate = 256 * 1024
+	// Buckets start empty, so there is no burst to skew the measurements
+	global := NewRateLimiter(rate)
+	var rates [2]float64
+	var wg sync.WaitGroup
+	// Two connections share the global limit
+	for i := range rates {
+		client, server := loopbackPair(t)
+		go flood(server)
+		limited := newLimitedConn(context.Background(), client, []*RateLimiter{global}, nil)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rates[i] = measureRead(limited, 2*time.Second)
+		}(i)
+	}
+	wg.Wait()
+	checkRate(t, "shared global limit", rates[0]+rates[1], rate)
+
+	// Lowering the rate applies straight away, the peer limit is the tighter one here
+	global.SetRate(rate / 2)
+	client, server := loopbackPair(t)
+	go flood(server)
+	peerLimit := NewRateLimiter(rate / 4)
+	limited := newLimitedConn(context.Background(), client, []*RateLimiter{global, peerLimit}, nil)
+	checkRate(t, "peer limit", measureRead(limited, 2*time.Second), rate/4)
+}
+
+func TestRateLimitedWrites(t *testing.T) {
+	const rate = 128 * 1024
+	client, server := loopbackPair(t)
+	limit := NewRateLimiter(rate)
+	limited := newLimitedConn(context.Background(), client, nil, []*RateLimiter{limit})
+	go flood(limited)
+	checkRate(t, "upload limit", measureRead(server, 2*time.Second), rate)
+}
+
+func TestRateSchedule(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	night := RateSchedule{Start: 22 * time.Hour, End: 6 * time.Hour, BytesPerSecond: 1000}
+	l := NewRateLimiter(10)
+	l.SetSchedule([]RateSchedule{night})
+	for hour, want := range map[int]int64{23: 1000, 3: 1000, 12: 10, 6: 10} {
+		if got := l.currentRate(at(hour)); got != want {
+			t.Errorf("at %d:30 got rate %d want %d", hour, got, want)
+		}
+	}
+}
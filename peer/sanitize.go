@@ -0,0 +1,152 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLength is the longest file name most filesystems take, in bytes, less
+// room for the suffix of a partfile
+const maxNameLength = 255 - len(".part")
+
+// reservedNames cannot name a file on Windows, whatever its extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// caseInsensitive is whether files whose names differ only in case collide on
+// the usual filesystems of the platform
+var caseInsensitive = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// sanitizeName checks a file or directory name from a torrent's metadata, which
+// comes from untrusted peers, and returns it in Unicode NFC
+func sanitizeName(name string) (string, error) {
+	name = norm.NFC.String(name)
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	switch {
+	case strings.Trim(name, ". ") == "":
+		return "", fmt.Errorf("Bad file name %q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return "", fmt.Errorf("File name %q holds a separator or NUL", name)
+	case len(name) >= 2 && name[1] == ':' && 'a' <= name[0]|0x20 && name[0]|0x20 <= 'z':
+		return "", fmt.Errorf("File name %q starts with a drive", name)
+	case reservedNames[strings.TrimRight(base, " ")]:
+		return "", fmt.Errorf("File name %q is reserved", name)
+	case len(name) > maxNameLength:
+		return "", fmt.Errorf("File name %q is longer than %d bytes", name, maxNameLength)
+	}
+	return name, nil
+}
+
+// sanitizePaths returns where each file of the torrent goes, relative to the
+// download directory. Every name is checked by sanitizeName. A file whose path
+// is taken by an earlier file or by a directory gets a number added to its name.
+// Padding files are never written and get no path.
+func sanitizePaths(files []TorrentFile) ([][]string, error) {
+	paths := make([][]string, len(files))
+	for i, file := range files {
+		if file.Padding() {
+			continue
+		}
+		if len(file.Path) == 0 {
+			return nil, fmt.Errorf("File %d has no path", i)
+		}
+		path := make([]string, len(file.Path))
+		for j, name := range file.Path {
+			var err error
+			path[j], err = sanitizeName(name)
+			if err != nil {
+				return nil, fmt.Errorf("File %q: %v", strings.Join(file.Path, "/"), err)
+			}
+		}
+		paths[i] = path
+	}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		for j := 1; j < len(path); j++ {
+			dirs[pathKey(path[:j])] = true
+		}
+	}
+	taken := map[string]bool{}
+	for _, path := range paths {
+		if path == nil {
+			continue
+		}
+		name := path[len(path)-1]
+		for n := 1; taken[pathKey(path)] || dirs[pathKey(path)]; n++ {
+			path[len(path)-1] = numberedName(name, n)
+		}
+		taken[pathKey(path)] = true
+	}
+	return paths, nil
+}
+
+// pathKey is equal for the paths that end up as the same file
+func pathKey(path []string) string {
+	key := strings.Join(path, "/")
+	if caseInsensitive {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// numberedName adds n to a name before its extension, "a.txt" becomes
+// "a (1).txt", shortening it to stay within maxNameLength
+func numberedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	suffix := fmt.Sprintf(" (%d)%s", n, ext)
+	if len(suffix) > maxNameLength/2 {
+		base, suffix = name, fmt.Sprintf(" (%d)", n)
+	}
+	if cut := maxNameLength - len(suffix); len(base) > cut {
+		for cut > 0 && !utf8.RuneStart(base[cut]) {
+			cut--
+		}
+		base = base[:cut]
+	}
+	return base + suffix
+}
+
+// inside reports whether path is root or lies under it, going by the names only
+func inside(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// within makes sure a file about to be created is under the download directory
+// once the symlinks already on disk on the way to it are followed. The download
+// directory must exist.
+func (t *fileTorrent) within(path string) error {
+	if !inside(t.Dir, path) {
+		return fmt.Errorf("%s is outside %s", path, t.Dir)
+	}
+	root, err := filepath.EvalSymlinks(t.Dir)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	for {
+		_, err := os.Lstat(dir)
+		if err == nil || !inside(t.Dir, filepath.Dir(dir)) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !inside(root, resolved) {
+		return fmt.Errorf("%s leads outside %s through a symlink", path, t.Dir)
+	}
+	return nil
+}
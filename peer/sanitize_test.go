@@ -0,0 +1,162 @@
+package peer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// maliciousTorrent is the torrent file of the files, read back the way the
+// metadata of a peer would be
+func maliciousTorrent(t *testing.T, name string, files []fileInfo) *TorrentInfo {
+	info := TorrentInfo{Name: name, PieceLength: 16, Pieces: strings.Repeat("x", 20), Files: files}
+	if files == nil {
+		info.Length = 10
+	}
+	var buf bytes.Buffer
+	err := (&MetaInfo{Info: info}).Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := ReadTorrentFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mi.Info
+}
+
+func TestSanitizeName(t *testing.T) {
+	for _, name := range []string{"a", "movie.mkv", ".hidden", "a..b", "console", "COM10", strings.Repeat("é", 125)} {
+		if _, err := sanitizeName(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "...", ". .", "/etc", "a/b", `..\x`, "a\x00b", "c:", "C:x",
+		"CON", "con.txt", "Nul", "lpt1.tar.gz", "AUX .c", strings.Repeat("a", maxNameLength+1)} {
+		if _, err := sanitizeName(name); err == nil {
+			t.Errorf("%q was accepted", name)
+		}
+	}
+	// Decomposed é is stored composed
+	if got, _ := sanitizeName("e\u0301"); got != "\u00e9" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMaliciousPaths(t *testing.T) {
+	fixtures := []struct {
+		Name  string
+		Files []fileInfo
+	}{
+		{"..", nil},
+		{"../escape", nil},
+		{"/tmp/escape", nil},
+		{"t", []fileInfo{{Length: 10, Path: []string{"..", "..", "escape"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"a", "..", "..", "..", "escape"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"/etc/passwd"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{`..\..\escape`}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"C:", "escape"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"a\x00.txt"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"PRN.txt"}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{strings.Repeat("x", 1000)}}}},
+		{"t", []fileInfo{{Length: 10, Path: []string{"a", ""}}}},
+	}
+	for _, fixture := range fixtures {
+		info := maliciousTorrent(t, fixture.Name, fixture.Files)
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "downloads")
+		ts, err := NewFileStorage(dir).OpenTorrent(info, [20]byte{7})
+		if err == nil {
+			ts.WriteAt(0, make([]byte, 10), 0)
+			ts.Close()
+			t.Errorf("%q %v was accepted", fixture.Name, fixture.Files)
+		}
+		entries, _ := os.ReadDir(parent)
+		if len(entries) > 1 || len(entries) == 1 && entries[0].Name() != "downloads" {
+			t.Errorf("%q %v wrote outside the download directory", fixture.Name, fixture.Files)
+		}
+	}
+}
+
+func TestPathCollisions(t *testing.T) {
+	info := maliciousTorrent(t, "t", []fileInfo{
+		{Length: 1, Path: []string{"a.txt"}},
+		{Length: 1, Path: []string{"a.txt"}},
+		{Length: 1, Path: []string{"\u00e9"}},
+		{Length: 1, Path: []string{"e\u0301"}},
+		{Length: 1, Path: []string{"d"}},
+		{Length: 1, Path: []string{"d", "x"}},
+		{Length: 1, Path: []string{"a (1).txt"}},
+	})
+	paths, err := sanitizePaths(info.FileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"t/a.txt", "t/a (1).txt", "t/\u00e9", "t/\u00e9 (1)", "t/d (1)", "t/d/x", "t/a (1) (1).txt"}
+	for i, path := range paths {
+		if strings.Join(path, "/") != want[i] {
+			t.Errorf("file %d at %q want %q", i, strings.Join(path, "/"), want[i])
+		}
+	}
+
+	// Each file keeps its own byte
+	dir := t.TempDir()
+	ts, err := NewFileStorage(dir).OpenTorrent(info, [20]byte{8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.WriteAt(0, []byte("1234567"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, path := range want {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil || len(got) != 1 || got[0] != byte('1'+i) {
+			t.Errorf("%s holds %q: %v", path, got, err)
+		}
+	}
+
+	if len(numberedName(strings.Repeat("é", 125)+".txt", 1)) > maxNameLength {
+		t.Error("numbered name is too long")
+	}
+}
+
+func TestWritesStayInside(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	parent := t.TempDir()
+	dir, outside := filepath.Join(parent, "downloads"), filepath.Join(parent, "outside")
+	if err := os.MkdirAll(filepath.Join(dir, "t"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A directory of the torrent that is a symlink leading out, and a file that is one
+	if err := os.Symlink(outside, filepath.Join(dir, "t", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "f"), filepath.Join(dir, "t", "f")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][]string{{"sub", "a"}, {"sub", "deeper", "a"}, {"f"}} {
+		info := maliciousTorrent(t, "t", []fileInfo{{Length: 10, Path: path}})
+		ts, err := NewFileStorage(dir).OpenTorrent(info, [20]byte{9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.WriteAt(0, make([]byte, 10), 0); err == nil {
+			t.Errorf("wrote to %v", path)
+		}
+		ts.Close()
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("wrote %d files outside the download directory", len(entries))
+	}
+}
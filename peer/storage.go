@@ -0,0 +1,72 @@
+package peer
+
+// Storage holds the data of downloaded torrents. NewFileStorage, NewMmapStorage,
+// NewMemoryStorage and NewPieceBlobStorage are provided, NewCachedStorage adds a
+// cache in front of any of them, and any other implementation can be handed to
+// NewDownload.
+type Storage interface {
+	// OpenTorrent returns the storage of one torrent, its metadata is known
+	OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error)
+}
+
+// TorrentStorage stores the pieces of a single torrent. A download opens it for
+// the length of a run and calls its methods from one goroutine at a time.
+type TorrentStorage interface {
+	// ReadAt reads len(p) bytes of a piece starting at off within the piece
+	ReadAt(piece int, p []byte, off int64) (int, error)
+	// WriteAt writes p into a piece starting at off within the piece
+	WriteAt(piece int, p []byte, off int64) (int, error)
+	// MarkComplete records that the piece is written and verified
+	MarkComplete(piece int) error
+	// Completed reports whether a piece was marked complete, including in an
+	// earlier run, and is still stored
+	Completed(piece int) bool
+	// Close flushes everything written to the storage
+	Close() error
+}
+
+// FileSelector is implemented by torrent storage that can leave out the files
+// that are not wanted. A piece that spans a wanted and an unwanted file is then
+// only partly stored, and MarkComplete leaves it incomplete. An error, such as
+// the wanted files not fitting on the disk, stops the download before it starts.
+type FileSelector interface {
+	SelectFiles(wanted []bool) error
+}
+
+// PieceSyncer is implemented by torrent storage that can flush a piece to the
+// disk, so a piece marked complete survives a crash
+type PieceSyncer interface {
+	SyncPiece(piece int) error
+}
+
+// fileSegment is the part of a file that a range of the torrent covers
+type fileSegment struct {
+	File       int   // index in FileList
+	FileOffset int64 // where the segment starts in the file
+	Begin, End int64 // where the segment is in the range
+}
+
+// segments splits the torrent range [begin, end) over the files it covers
+func segments(files []TorrentFile, begin, end int64) []fileSegment {
+	var segs []fileSegment
+	for i, file := range files {
+		if file.Offset >= end || file.Offset+file.Length <= begin {
+			continue
+		}
+		from := begin
+		if file.Offset > from {
+			from = file.Offset
+		}
+		to := end
+		if file.Offset+file.Length < to {
+			to = file.Offset + file.Length
+		}
+		segs = append(segs, fileSegment{i, from - file.Offset, from - begin, to - begin})
+	}
+	return segs
+}
+
+// pieceOffset is where a piece starts in the torrent
+func pieceOffset(info *TorrentInfo, piece int) int64 {
+	return int64(piece) * int64(info.PieceLength)
+}
@@ -0,0 +1,25 @@
+package peer
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves the file's full size on the disk
+func preallocate(f *os.File, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP {
+		// Not every file system can allocate, the file is at least given its size
+		return f.Truncate(length)
+	}
+	return err
+}
+
+// freeSpace is the number of bytes an unprivileged user can still write under dir
+func freeSpace(dir string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(dir, &stat) != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
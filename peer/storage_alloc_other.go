@@ -0,0 +1,19 @@
+//go:build !linux
+
+package peer
+
+import "os"
+
+// preallocate gives the file its full size, without fallocate the space is not reserved
+func preallocate(f *os.File, length int64) error {
+	stat, err := f.Stat()
+	if err != nil || stat.Size() >= length {
+		return err
+	}
+	return f.Truncate(length)
+}
+
+// freeSpace is not known on this platform, so no check is made
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// pieceBlobStorage stores every piece as a file of its own, named after its
+// index in a directory per torrent. Pieces being written have a .part suffix
+// that is dropped once they are complete.
+type pieceBlobStorage struct {
+	Dir string
+}
+
+// NewPieceBlobStorage stores each piece of a torrent as its own blob under dir,
+// a layout suited to object stores and to seeding without the original files
+func NewPieceBlobStorage(dir string) Storage {
+	return pieceBlobStorage{Dir: dir}
+}
+
+type pieceBlobTorrent struct {
+	Dir  string
+	Info *TorrentInfo
+}
+
+func (s pieceBlobStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	dir := filepath.Join(s.Dir, hex.EncodeToString(infoHash[:]))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return pieceBlobTorrent{Dir: dir, Info: info}, nil
+}
+
+func (t pieceBlobTorrent) path(piece int) string {
+	return filepath.Join(t.Dir, strconv.Itoa(piece))
+}
+
+func (t pieceBlobTorrent) ReadAt(piece int, p []byte, off int64) (int, error) {
+	f, err := os.Open(t.path(piece))
+	if os.IsNotExist(err) {
+		f, err = os.Open(t.path(piece) + ".part")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+func (t pieceBlobTorrent) WriteAt(piece int, p []byte, off int64) (int, error) {
+	f, err := os.OpenFile(t.path(piece)+".part", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.WriteAt(p, off)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// MarkComplete syncs the blob before it takes its final name
+func (t pieceBlobTorrent) MarkComplete(piece int) error {
+	f, err := os.OpenFile(t.path(piece)+".part", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(t.path(piece)+".part", t.path(piece))
+}
+
+func (t pieceBlobTorrent) Completed(piece int) bool {
+	stat, err := os.Stat(t.path(piece))
+	return err == nil && stat.Size() == int64(t.Info.PieceSize(piece))
+}
+
+func (t pieceBlobTorrent) Close() error {
+	return nil
+}
@@ -0,0 +1,468 @@
+package peer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Allocation is how FileStorage lays out a torrent's files before their pieces arrive
+type Allocation int
+
+// The allocation modes
+const (
+	// AllocateSparse grows files as pieces are written, ranges that were never
+	// written take no disk space
+	AllocateSparse Allocation = iota
+	// AllocateFull gives the wanted files their full size before downloading, with
+	// fallocate on Linux. Files are not fragmented and a full disk shows at the start.
+	AllocateFull
+	// AllocatePartfile writes each file under a .part name and moves it into place
+	// once all of its pieces are complete
+	AllocatePartfile
+)
+
+// FileStorage writes torrents as their files under Dir, the way they are laid out
+// in the torrent. Which pieces are complete is kept in a resume file next to them.
+type FileStorage struct {
+	Dir  string
+	Mmap bool
+	// Allocation applies to torrents that were not given one with SetAllocation
+	Allocation Allocation
+
+	mu          sync.Mutex
+	allocations map[[20]byte]Allocation
+}
+
+// NewFileStorage stores torrents as plain sparse files under dir
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+// NewMmapStorage stores torrents as files under dir like NewFileStorage, but
+// reads and writes them through memory maps. Files are extended to their full
+// size when first used.
+func NewMmapStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir, Mmap: true}
+}
+
+// SetAllocation chooses the allocation of one torrent, it applies the next time
+// the torrent is opened
+func (s *FileStorage) SetAllocation(infoHash [20]byte, allocation Allocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.allocations == nil {
+		s.allocations = map[[20]byte]Allocation{}
+	}
+	s.allocations[infoHash] = allocation
+}
+
+type fileTorrent struct {
+	Dir        string
+	Mmap       bool
+	Allocation Allocation
+	Info       *TorrentInfo
+	InfoHash   [20]byte
+	Files      []TorrentFile
+
+	paths     [][]string // sanitized, relative to Dir
+	mu        sync.Mutex
+	handles   []*os.File
+	maps      [][]byte
+	wanted    []bool
+	completed []bool
+	inPlace   []bool // per file, false while a partfile is still being written
+}
+
+func (s *FileStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	if s.Mmap && !mmapSupported {
+		return nil, errors.New("Memory mapped storage is not supported on this platform")
+	}
+	s.mu.Lock()
+	allocation, ok := s.allocations[infoHash]
+	if !ok {
+		allocation = s.Allocation
+	}
+	s.mu.Unlock()
+	files := info.FileList()
+	paths, err := sanitizePaths(files)
+	if err != nil {
+		return nil, err
+	}
+	t := &fileTorrent{
+		Dir:        s.Dir,
+		Mmap:       s.Mmap,
+		Allocation: allocation,
+		Info:       info,
+		InfoHash:   infoHash,
+		Files:      files,
+		paths:      paths,
+		handles:    make([]*os.File, len(files)),
+		maps:       make([][]byte, len(files)),
+		completed:  make([]bool, info.NumPieces()),
+		inPlace:    make([]bool, len(files)),
+	}
+	for i, file := range files {
+		t.inPlace[i] = true
+		if allocation == AllocatePartfile && file.Length > 0 && !file.Padding() {
+			_, err := os.Stat(t.path(i))
+			_, partErr := os.Stat(t.path(i) + ".part")
+			t.inPlace[i] = err == nil && os.IsNotExist(partErr)
+		}
+	}
+	t.loadResume()
+	return t, nil
+}
+
+// SelectFiles keeps unwanted files from being created. It checks that the
+// wanted files fit on the disk and allocates them in full when asked to.
+func (t *fileTorrent) SelectFiles(wanted []bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wanted = append([]bool(nil), wanted...)
+
+	var needed int64
+	for i, file := range t.Files {
+		if !wanted[i] || file.Padding() {
+			continue
+		}
+		needed += file.Length
+		if stat, err := os.Stat(t.currentPath(i)); err == nil && stat.Size() <= file.Length {
+			needed -= stat.Size()
+		}
+	}
+	err := os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	if available, ok := freeSpace(t.Dir); ok && needed > available {
+		return fmt.Errorf("Not enough free space in %s: %d bytes are needed but only %d are available",
+			t.Dir, needed, available)
+	}
+
+	if t.Allocation != AllocateFull {
+		return nil
+	}
+	for i, file := range t.Files {
+		if !wanted[i] || file.Length == 0 || file.Padding() {
+			continue
+		}
+		f, err := t.open(i)
+		if err != nil {
+			return err
+		}
+		err = preallocate(f, file.Length)
+		if err != nil {
+			return fmt.Errorf("Could not allocate %s: %v", t.path(i), err)
+		}
+	}
+	return nil
+}
+
+func (t *fileTorrent) path(file int) string {
+	return filepath.Join(append([]string{t.Dir}, t.paths[file]...)...)
+}
+
+// currentPath is where the file is being written, its partfile until it is moved into place
+func (t *fileTorrent) currentPath(file int) string {
+	if !t.inPlace[file] {
+		return t.path(file) + ".part"
+	}
+	return t.path(file)
+}
+
+// open returns the file's handle, creating the file when it does not exist yet
+func (t *fileTorrent) open(file int) (*os.File, error) {
+	if t.handles[file] != nil {
+		return t.handles[file], nil
+	}
+	path := t.currentPath(file)
+	err := os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = t.within(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%s is a symlink, not written through", path)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	perm := os.FileMode(0644)
+	if t.Files[file].Executable() {
+		perm = 0755
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	t.handles[file] = f
+	if t.Mmap && t.Files[file].Length > 0 {
+		// A mapping cannot grow, so the file gets its full size up front
+		stat, err := f.Stat()
+		if err == nil && stat.Size() < t.Files[file].Length {
+			err = f.Truncate(t.Files[file].Length)
+		}
+		if err == nil {
+			t.maps[file], err = mmapFile(f, t.Files[file].Length)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (t *fileTorrent) ReadAt(piece int, p []byte, off int64) (int, error) {
+	return t.transfer(piece, p, off, false)
+}
+
+func (t *fileTorrent) WriteAt(piece int, p []byte, off int64) (int, error) {
+	return t.transfer(piece, p, off, true)
+}
+
+// transfer reads or writes the files that the range of the piece covers
+func (t *fileTorrent) transfer(piece int, p []byte, off int64, write bool) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	begin := pieceOffset(t.Info, piece) + off
+	n := 0
+	for _, seg := range segments(t.Files, begin, begin+int64(len(p))) {
+		buf := p[seg.Begin:seg.End]
+		if t.Files[seg.File].Padding() {
+			// Padding is all zeros and never stored
+			if !write {
+				for i := range buf {
+					buf[i] = 0
+				}
+			}
+			n += len(buf)
+			continue
+		}
+		if write && t.wanted != nil && !t.wanted[seg.File] {
+			n += len(buf)
+			continue
+		}
+		if !write && t.handles[seg.File] == nil {
+			// Reading a file that is not there yet must not create it
+			if _, err := os.Stat(t.currentPath(seg.File)); err != nil {
+				return n, err
+			}
+		}
+		f, err := t.open(seg.File)
+		if err != nil {
+			return n, err
+		}
+		var m int
+		switch {
+		case t.maps[seg.File] != nil && write:
+			m = copy(t.maps[seg.File][seg.FileOffset:], buf)
+		case t.maps[seg.File] != nil:
+			m = copy(buf, t.maps[seg.File][seg.FileOffset:])
+		case write:
+			m, err = f.WriteAt(buf, seg.FileOffset)
+		default:
+			m, err = f.ReadAt(buf, seg.FileOffset)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// MarkComplete leaves a piece incomplete when its writes to unwanted files were
+// dropped, it is downloaded again once they are wanted
+func (t *fileTorrent) MarkComplete(piece int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	begin := pieceOffset(t.Info, piece)
+	segs := segments(t.Files, begin, begin+int64(t.Info.PieceSize(piece)))
+	for _, seg := range segs {
+		if t.wanted != nil && !t.wanted[seg.File] && !t.Files[seg.File].Padding() {
+			return nil
+		}
+	}
+	t.completed[piece] = true
+	if t.Allocation != AllocatePartfile {
+		return nil
+	}
+	for _, seg := range segs {
+		if t.inPlace[seg.File] || !t.fileComplete(seg.File) {
+			continue
+		}
+		err := t.moveIntoPlace(seg.File)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncPiece flushes the open files the piece lies in to the disk
+func (t *fileTorrent) SyncPiece(piece int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	begin := pieceOffset(t.Info, piece)
+	for _, seg := range segments(t.Files, begin, begin+int64(t.Info.PieceSize(piece))) {
+		if f := t.handles[seg.File]; f != nil {
+			err := f.Sync()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileComplete reports whether every piece the file lies in is complete
+func (t *fileTorrent) fileComplete(file int) bool {
+	f := t.Files[file]
+	pieceLength := int64(t.Info.PieceLength)
+	for piece := f.Offset / pieceLength; piece*pieceLength < f.Offset+f.Length; piece++ {
+		if !t.completed[piece] {
+			return false
+		}
+	}
+	return true
+}
+
+// moveIntoPlace renames a finished partfile to the file's own name
+func (t *fileTorrent) moveIntoPlace(file int) error {
+	err := t.closeFile(file)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(t.currentPath(file), t.path(file))
+	if err != nil {
+		return err
+	}
+	t.inPlace[file] = true
+	return nil
+}
+
+// closeFile unmaps, syncs and closes a file if it is open
+func (t *fileTorrent) closeFile(file int) error {
+	f := t.handles[file]
+	if f == nil {
+		return nil
+	}
+	var firstErr error
+	if t.maps[file] != nil {
+		firstErr = munmapFile(t.maps[file])
+		t.maps[file] = nil
+	}
+	if err := f.Sync(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := f.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	t.handles[file] = nil
+	return firstErr
+}
+
+func (t *fileTorrent) Completed(piece int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.completed[piece]
+}
+
+// Close syncs and closes the files, then saves which pieces are complete.
+// Pieces are only recorded once they reached the disk.
+func (t *fileTorrent) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i, f := range t.handles {
+		if t.Files[i].Symlink() && (t.wanted == nil || t.wanted[i]) {
+			keep(t.createSymlink(i))
+			continue
+		}
+		if f == nil && t.Files[i].Length == 0 && !t.Files[i].Padding() && (t.wanted == nil || t.wanted[i]) {
+			// Empty files are never written to, but they are part of the torrent
+			_, err := t.open(i)
+			keep(err)
+		}
+		keep(t.closeFile(i))
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return t.saveResume()
+}
+
+// resumePath is where the complete pieces are remembered between runs
+func (t *fileTorrent) resumePath() string {
+	return filepath.Join(t.Dir, "."+hex.EncodeToString(t.InfoHash[:])+".resume")
+}
+
+// saveResume writes the complete pieces as a bitfield, replacing the old one in one step
+func (t *fileTorrent) saveResume() error {
+	bitfield := make([]byte, (len(t.completed)+7)/8)
+	for i, completed := range t.completed {
+		if completed {
+			bitfield[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	err := os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp := t.resumePath() + ".tmp"
+	err = os.WriteFile(tmp, bitfield, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.resumePath())
+}
+
+// loadResume marks the pieces of an earlier run as complete. Pieces whose files
+// have since gone missing or shrunk are downloaded again.
+func (t *fileTorrent) loadResume() {
+	bitfield, err := os.ReadFile(t.resumePath())
+	if err != nil || len(bitfield) != (len(t.completed)+7)/8 {
+		return
+	}
+	sizes := make([]int64, len(t.Files))
+	for i := range t.Files {
+		stat, err := os.Stat(t.currentPath(i))
+		if t.Files[i].Padding() {
+			sizes[i] = t.Files[i].Length
+		} else if err == nil {
+			sizes[i] = stat.Size()
+		} else {
+			sizes[i] = -1
+		}
+	}
+	for piece := range t.completed {
+		if bitfield[piece/8]&(0x80>>uint(piece%8)) == 0 {
+			continue
+		}
+		begin := pieceOffset(t.Info, piece)
+		onDisk := true
+		for _, seg := range segments(t.Files, begin, begin+int64(t.Info.PieceSize(piece))) {
+			if sizes[seg.File] < seg.FileOffset+seg.End-seg.Begin {
+				onDisk = false
+			}
+		}
+		t.completed[piece] = onDisk
+	}
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryStorage keeps torrents in memory, for tests and for streaming without
+// touching the disk. Torrents stay stored when they are closed, so a download
+// can be run again or read back from through OpenTorrent.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	torrents map[[20]byte]*memoryTorrent
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{torrents: map[[20]byte]*memoryTorrent{}}
+}
+
+type memoryTorrent struct {
+	mu        sync.Mutex
+	Info      *TorrentInfo
+	Pieces    [][]byte // allocated when first written
+	Completed []bool
+}
+
+func (s *MemoryStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		t = &memoryTorrent{
+			Info:      info,
+			Pieces:    make([][]byte, info.NumPieces()),
+			Completed: make([]bool, info.NumPieces()),
+		}
+		s.torrents[infoHash] = t
+	}
+	return memoryHandle{t}, nil
+}
+
+// memoryHandle hides the Completed field behind the TorrentStorage method
+type memoryHandle struct {
+	t *memoryTorrent
+}
+
+func (h memoryHandle) ReadAt(piece int, p []byte, off int64) (int, error) {
+	h.t.mu.Lock()
+	defer h.t.mu.Unlock()
+	if h.t.Pieces[piece] == nil {
+		return 0, errors.New("Piece has not been written")
+	}
+	if off+int64(len(p)) > int64(len(h.t.Pieces[piece])) {
+		return 0, errors.New("Read past the end of the piece")
+	}
+	return copy(p, h.t.Pieces[piece][off:]), nil
+}
+
+func (h memoryHandle) WriteAt(piece int, p []byte, off int64) (int, error) {
+	h.t.mu.Lock()
+	defer h.t.mu.Unlock()
+	if h.t.Pieces[piece] == nil {
+		h.t.Pieces[piece] = make([]byte, h.t.Info.PieceSize(piece))
+	}
+	if off+int64(len(p)) > int64(len(h.t.Pieces[piece])) {
+		return 0, errors.New("Write past the end of the piece")
+	}
+	return copy(h.t.Pieces[piece][off:], p), nil
+}
+
+func (h memoryHandle) MarkComplete(piece int) error {
+	h.t.mu.Lock()
+	defer h.t.mu.Unlock()
+	h.t.Completed[piece] = true
+	return nil
+}
+
+func (h memoryHandle) Completed(piece int) bool {
+	h.t.mu.Lock()
+	defer h.t.mu.Unlock()
+	return h.t.Completed[piece]
+}
+
+func (h memoryHandle) Close() error {
+	return nil
+}
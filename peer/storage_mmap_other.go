@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package peer
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(f *os.File, length int64) ([]byte, error) {
+	return nil, errors.New("Memory mapped storage is not supported on this platform")
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testStorageInfo is a torrent of three pieces over files of 10, 0 and 25 bytes
+func testStorageInfo() (*TorrentInfo, []byte) {
+	info := &TorrentInfo{
+		Name:        "t",
+		PieceLength: 16,
+		Pieces:      strings.Repeat("x", 3*20),
+		Files: []fileInfo{{Length: 10, Path: []string{"a"}}, {Length: 0, Path: []string{"empty"}},
+			{Length: 25, Path: []string{"dir", "b"}}},
+	}
+	content := make([]byte, 35)
+	rand.Read(content)
+	return info, content
+}
+
+func TestStorageBackends(t *testing.T) {
+	backends := map[string]func(dir string) Storage{
+		"file":   func(dir string) Storage { return NewFileStorage(dir) },
+		"mmap":   func(dir string) Storage { return NewMmapStorage(dir) },
+		"blob":   NewPieceBlobStorage,
+		"memory": func(string) Storage { return NewMemoryStorage() },
+	}
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			if name == "mmap" && !mmapSupported {
+				t.Skip("no mmap on this platform")
+			}
+			info, content := testStorageInfo()
+			infoHash := [20]byte{1}
+			storage := newStorage(t.TempDir())
+			ts, err := storage.OpenTorrent(info, infoHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for piece := 0; piece < info.NumPieces(); piece++ {
+				begin := piece * info.PieceLength
+				buf := content[begin : begin+info.PieceSize(piece)]
+				if _, err := ts.WriteAt(piece, buf, 0); err != nil {
+					t.Fatal(err)
+				}
+				if piece != 1 {
+					if err := ts.MarkComplete(piece); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := ts.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			ts, err = storage.OpenTorrent(info, infoHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ts.Close()
+			if !ts.Completed(0) || ts.Completed(1) || !ts.Completed(2) {
+				t.Errorf("completion was not kept across opens")
+			}
+			// Read across the end of the first file
+			got := make([]byte, 8)
+			if _, err := ts.ReadAt(0, got, 6); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content[6:14]) {
+				t.Errorf("got %x want %x", got, content[6:14])
+			}
+		})
+	}
+}
+
+func TestFileStorageLayout(t *testing.T) {
+	info, content := testStorageInfo()
+	dir := t.TempDir()
+	ts, err := NewFileStorage(dir).OpenTorrent(info, [20]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.(FileSelector).SelectFiles([]bool{false, true, true})
+	for piece := 0; piece < info.NumPieces(); piece++ {
+		begin := piece * info.PieceLength
+		ts.WriteAt(piece, content[begin:begin+info.PieceSize(piece)], 0)
+		ts.MarkComplete(piece)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "t", "a")); !os.IsNotExist(err) {
+		t.Errorf("unwanted file was created")
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "t", "empty")); err != nil || stat.Size() != 0 {
+		t.Errorf("empty file was not created")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "t", "dir", "b"))
+	if err != nil || !bytes.Equal(got, content[10:]) {
+		t.Errorf("got %x want %x", got, content[10:])
+	}
+
+	// The first piece lies partly in the missing file, so it is no longer complete
+	ts, _ = NewFileStorage(dir).OpenTorrent(info, [20]byte{2})
+	defer ts.Close()
+	if ts.Completed(0) || !ts.Completed(1) || !ts.Completed(2) {
+		t.Errorf("resume data does not match the files on disk")
+	}
+}
+
+func TestFileStorageAllocation(t *testing.T) {
+	info, content := testStorageInfo()
+	dir := t.TempDir()
+	storage := NewFileStorage(dir)
+	storage.SetAllocation([20]byte{3}, AllocatePartfile)
+	storage.SetAllocation([20]byte{4}, AllocateFull)
+
+	ts, _ := storage.OpenTorrent(info, [20]byte{3})
+	if err := ts.(FileSelector).SelectFiles([]bool{true, true, true}); err != nil {
+		t.Fatal(err)
+	}
+	ts.WriteAt(0, content[:16], 0)
+	ts.MarkComplete(0)
+	// The first file only lies in piece 0, the last one is still being written
+	if _, err := os.Stat(filepath.Join(dir, "t", "a")); err != nil {
+		t.Errorf("finished file was not moved into place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "t", "dir", "b.part")); err != nil {
+		t.Errorf("unfinished file is not a partfile: %v", err)
+	}
+	ts.Close()
+	ts, _ = storage.OpenTorrent(info, [20]byte{3})
+	if !ts.Completed(0) {
+		t.Errorf("piece in a moved file is not complete after reopening")
+	}
+	ts.Close()
+
+	full := filepath.Join(t.TempDir(), "full")
+	storage.Dir = full
+	ts, _ = storage.OpenTorrent(info, [20]byte{4})
+	if err := ts.(FileSelector).SelectFiles([]bool{false, true, true}); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+	if stat, err := os.Stat(filepath.Join(full, "t", "dir", "b")); err != nil || stat.Size() != 25 {
+		t.Errorf("file was not allocated in full")
+	}
+
+	// An exabyte only fits in the int of a 64-bit target
+	if _, ok := freeSpace(dir); ok && strconv.IntSize == 64 {
+		huge := &TorrentInfo{Name: "huge", PieceLength: 1 << 30, Length: math.MaxInt >> 3, Pieces: strings.Repeat("x", 20)}
+		ts, _ = NewFileStorage(dir).OpenTorrent(huge, [20]byte{5})
+		defer ts.Close()
+		if err := ts.(FileSelector).SelectFiles([]bool{true}); err == nil {
+			t.Error("expected an exabyte torrent not to fit")
+		}
+	}
+}
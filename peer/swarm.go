@@ -0,0 +1,374 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// idleTimeout is how long a connection may go without sending us a block
+	// before a better candidate can take its place
+	idleTimeout = time.Minute
+	// rechokeInterval is how often the unchoked peers are chosen again, every
+	// third round also unchokes a random peer so new peers get a chance
+	rechokeInterval = 10 * time.Second
+	// retryBackoff doubles after each failed connection to a candidate, up to maxFailures
+	retryBackoff = 30 * time.Second
+	maxFailures  = 5
+	// A peer loses timeoutPenalty of its score when its connection times out and
+	// violationPenalty when it breaks the protocol
+	timeoutPenalty   = 2
+	violationPenalty = 10
+	// banDuration is how long a peer that sent bad data is banned, which happens
+	// once a block it sent is proven wrong or after hashFailsToBan failed pieces
+	banDuration    = time.Hour
+	hashFailsToBan = 3
+)
+
+type slotKind int
+
+const (
+	slotConn     slotKind = iota // established and half-open connections
+	slotHalfOpen                 // dials still in progress
+	slotUnchoke                  // peers we let download from us
+)
+
+// slots counts the use of a limited resource, a max of zero is unlimited
+type slots struct {
+	Max  int
+	Used int
+}
+
+func (s *slots) free() bool {
+	return s.Max <= 0 || s.Used < s.Max
+}
+
+// candidate is a known peer. The higher its score, the sooner it is dialed.
+type candidate struct {
+	Peer     Peer
+	Score    int // blocks received from it, less penalties for failures
+	Failures int // in a row
+	RetryAt  time.Time
+	Active   bool // being dialed or connected
+}
+
+// activeConn is a connection of a running download
+type activeConn struct {
+	Candidate *candidate // nil for incoming connections
+	Conn      *peerConnection
+	Started   time.Time
+	Unchoked  bool // holds an unchoke slot
+	Evicted   bool
+	received  int64 // by the last rechoke
+}
+
+// score is how much an established connection is worth keeping
+func (a *activeConn) score() int {
+	if a.Candidate == nil {
+		return 0
+	}
+	return a.Candidate.Score
+}
+
+// idle reports whether the connection has gone idleTimeout without sending a block
+func (a *activeConn) idle(now time.Time) bool {
+	_, last := a.Conn.received()
+	if last.Before(a.Started) {
+		last = a.Started
+	}
+	return now.Sub(last) > idleTimeout
+}
+
+// SetConnLimits caps the connections, dials in progress and unchoked peers of
+// this download on top of the limits shared with other downloads, zero for no
+// cap of its own
+func (d *Download) SetConnLimits(maxConns, maxHalfOpen, maxUnchoked int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.slots[slotConn].Max = maxConns
+	d.slots[slotHalfOpen].Max = maxHalfOpen
+	d.slots[slotUnchoke].Max = maxUnchoked
+	d.signal()
+}
+
+// acquireSlots takes a slot of each kind from the download and the shared
+// limits, or none of them if any is full. d.mu must be held.
+func (d *Download) acquireSlots(kinds ...slotKind) bool {
+	d.Limits.mu.Lock()
+	defer d.Limits.mu.Unlock()
+	for _, k := range kinds {
+		if !d.slots[k].free() || !d.Limits.slots[k].free() {
+			return false
+		}
+	}
+	for _, k := range kinds {
+		d.slots[k].Used++
+		d.Limits.slots[k].Used++
+	}
+	return true
+}
+
+// releaseSlot gives back a slot taken by acquireSlots. d.mu must be held.
+func (d *Download) releaseSlot(k slotKind) {
+	d.Limits.mu.Lock()
+	defer d.Limits.mu.Unlock()
+	d.slots[k].Used--
+	d.Limits.slots[k].Used--
+}
+
+// readyCandidates are the candidates that may be dialed now, best first. d.mu must be held.
+func (d *Download) readyCandidates(now time.Time) []*candidate {
+	var ready []*candidate
+	for _, c := range d.peers {
+		if c.Active || c.Failures >= maxFailures || now.Before(c.RetryAt) {
+			continue
+		}
+		if d.Limits.allowed(c.Peer.IP) {
+			ready = append(ready, c)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].Score > ready[j].Score
+	})
+	return ready
+}
+
+// connectCandidates dials the best candidates while there are free slots. When
+// the connections are all taken, an idle connection is closed to make room for a
+// candidate that scores at least as well. dial starts the connection of a
+// candidate that was given a connection and a half-open slot.
+func (d *Download) connectCandidates(now time.Time, dial func(*candidate)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.readyCandidates(now) {
+		if d.acquireSlots(slotConn, slotHalfOpen) {
+			c.Active = true
+			dial(c)
+			continue
+		}
+		if !d.slotFree(slotConn) {
+			d.evictIdle(now, c.Score)
+		}
+		return
+	}
+}
+
+func (d *Download) slotFree(k slotKind) bool {
+	d.Limits.mu.Lock()
+	defer d.Limits.mu.Unlock()
+	return d.slots[k].free() && d.Limits.slots[k].free()
+}
+
+// evictIdle closes the idle connection with the lowest score if it does not beat
+// score, its slot is given back once the connection is done. d.mu must be held.
+func (d *Download) evictIdle(now time.Time, score int) {
+	var victim *activeConn
+	for a := range d.active {
+		if a.Evicted || !a.idle(now) || a.score() > score {
+			continue
+		}
+		if victim == nil || a.score() < victim.score() {
+			victim = a
+		}
+	}
+	if victim != nil {
+		victim.Evicted = true
+		victim.Conn.Socket.Close()
+	}
+}
+
+// connDone records how a connection to a candidate went, so failed peers are
+// tried again later and useful peers sooner. err is why the connection ended,
+// timeouts and protocol violations lower the score. d.mu must be held.
+func (d *Download) connDone(c *candidate, connected bool, received int64, err error, now time.Time) {
+	c.Active = false
+	c.Score += int(received / maxRequestLength)
+	var violation protocolError
+	if errors.As(err, &violation) {
+		c.Score -= violationPenalty
+	} else if isTimeout(err) {
+		c.Score -= timeoutPenalty
+	}
+	if connected && received > 0 {
+		c.Failures = 0
+		return
+	}
+	c.Failures++
+	c.Score--
+	c.RetryAt = now.Add(retryBackoff << uint(c.Failures-1))
+}
+
+// pieceFailed remembers a copy of a piece that failed the hash check, so its
+// blocks can be compared with a good copy, and lowers the score of the peers
+// that sent it. A bad copy can be a mistake, so a peer may download the piece
+// once more before it is kept from it. A peer that keeps sending bad pieces is
+// banned, the ban events are returned.
+func (d *Download) pieceFailed(piece *outputPiece) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	earlier := d.failed[piece.Index]
+	d.failed[piece.Index] = append(earlier, piece)
+	if piece.Input.Excluded == nil {
+		piece.Input.Excluded = map[string]bool{}
+	}
+	var events []Event
+	counted := map[string]bool{}
+	for _, source := range piece.Sources {
+		ip := source.IP.String()
+		if source.IP == nil || counted[ip] {
+			continue
+		}
+		counted[ip] = true
+		if sentCopy(earlier, source.IP) {
+			piece.Input.Excluded[ip] = true
+		}
+		if c, ok := d.peers[source.String()]; ok {
+			c.Score -= violationPenalty
+		}
+		d.hashFails[ip]++
+		if d.hashFails[ip] >= hashFailsToBan {
+			reason := fmt.Errorf("Sent %d pieces that failed the hash check", d.hashFails[ip])
+			events = append(events, d.ban(source, reason)...)
+		}
+	}
+	return events
+}
+
+// sentCopy is whether the IP sent a block of any of the copies
+func sentCopy(copies []*outputPiece, ip net.IP) bool {
+	for _, c := range copies {
+		for _, source := range c.Sources {
+			if source.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// smartBan compares the failed copies of a piece with the copy that passed the
+// hash check and bans the peers that sent a block that differs, the ban events
+// are returned. A peer that sent the good copy itself is let off, its bad copy
+// was a mistake it made good.
+func (d *Download) smartBan(piece *outputPiece) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	failed := d.failed[piece.Index]
+	delete(d.failed, piece.Index)
+	var events []Event
+	for _, bad := range failed {
+		for i, source := range bad.Sources {
+			begin := i * maxRequestLength
+			end := begin + maxRequestLength
+			if end > len(piece.Buff) {
+				end = len(piece.Buff)
+			}
+			if source.IP == nil || source.IP.Equal(piece.Peer.IP) {
+				continue
+			}
+			good, sent := sha1.Sum(piece.Buff[begin:end]), sha1.Sum(bad.Buff[begin:end])
+			if !bytes.Equal(good[:], sent[:]) {
+				events = append(events, d.ban(source, fmt.Errorf("Sent a bad block of piece %d", piece.Index))...)
+			}
+		}
+	}
+	return events
+}
+
+// ban bans the peer's IP and closes our connections to it. It returns the event
+// to send once d.mu, which must be held, is unlocked.
+func (d *Download) ban(peer Peer, reason error) []Event {
+	if d.Limits.Banned(peer.IP) {
+		return nil
+	}
+	d.Limits.Ban(peer.IP, banDuration)
+	for a := range d.active {
+		if a.Conn.peer().IP.Equal(peer.IP) {
+			a.Conn.Socket.Close()
+		}
+	}
+	e := NewEvent(EventPeerBanned, d.File.InfoHash)
+	e.Peer, e.Err = peer, reason
+	return []Event{e}
+}
+
+// Peers returns a snapshot of every connected peer, the fastest first
+func (d *Download) Peers() []PeerStats {
+	d.mu.Lock()
+	peers := make([]PeerStats, 0, len(d.active))
+	for a := range d.active {
+		stats := a.Conn.stats()
+		stats.Incoming = a.Candidate == nil
+		peers = append(peers, stats)
+	}
+	d.mu.Unlock()
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].DownloadRate != peers[j].DownloadRate {
+			return peers[i].DownloadRate > peers[j].DownloadRate
+		}
+		return peers[i].Peer.String() < peers[j].Peer.String()
+	})
+	return peers
+}
+
+// unchokeNow unchokes a peer that just became interested when an unchoke slot
+// is free, rather than leave it waiting for the next rechoke
+func (d *Download) unchokeNow(a *activeConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if a.Unchoked || !d.active[a] || !d.acquireSlots(slotUnchoke) {
+		return
+	}
+	a.Unchoked = true
+	a.Conn.setChoking(false)
+}
+
+// rechoke unchokes the interested peers that sent us the most since the last
+// round, as many as there are unchoke slots, and chokes the others. An optimistic
+// round also unchokes one random interested peer.
+func (d *Download) rechoke(optimistic bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var interested []*activeConn
+	rates := map[*activeConn]int64{}
+	for a := range d.active {
+		received, _ := a.Conn.received()
+		rates[a] = received - a.received
+		a.received = received
+		if a.Conn.interested() {
+			interested = append(interested, a)
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+	if optimistic && len(interested) > 1 {
+		// Move a random peer to the front, it is unchoked whatever it sent
+		i := 1 + rand.Intn(len(interested)-1)
+		interested[0], interested[i] = interested[i], interested[0]
+	}
+
+	unchoke := map[*activeConn]bool{}
+	for a := range d.active {
+		if a.Unchoked {
+			a.Unchoked = false
+			d.releaseSlot(slotUnchoke)
+		}
+	}
+	for _, a := range interested {
+		if !d.acquireSlots(slotUnchoke) {
+			break
+		}
+		a.Unchoked = true
+		unchoke[a] = true
+	}
+	for a := range d.active {
+		a.Conn.setChoking(!unchoke[a])
+	}
+}
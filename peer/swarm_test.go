@@ -0,0 +1,520 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connCounter accepts connections to many peers and never answers them, keeping
+// track of how many are open at once
+type connCounter struct {
+	mu         sync.Mutex
+	open, peak int
+}
+
+func (c *connCounter) listen(t *testing.T) Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			c.open++
+			if c.open > c.peak {
+				c.peak = c.open
+			}
+			c.mu.Unlock()
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+				c.mu.Lock()
+				c.open--
+				c.mu.Unlock()
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func newTestDownload(t *testing.T, limits *Limits) *Download {
+	info, _ := testStorageInfo()
+	d, err := NewDownload(&File{InfoHash: [20]byte{9}, Metadata: info}, NewMemoryStorage(), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestConnLimits(t *testing.T) {
+	limits := NewLimits(5)
+	var counter connCounter
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		d := newTestDownload(t, limits)
+		d.SetConnLimits(3, 2, 0)
+		for j := 0; j < 10; j++ {
+			d.AddPeers([]Peer{counter.listen(t)})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Run(ctx)
+		}()
+	}
+	time.Sleep(time.Second)
+	cancel()
+	wg.Wait()
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.peak != 5 {
+		t.Errorf("got %d connections at once want the global limit of 5", counter.peak)
+	}
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	for k, s := range limits.slots {
+		if s.Used != 0 {
+			t.Errorf("%d slots of kind %d were not given back", s.Used, k)
+		}
+	}
+}
+
+func TestCandidatesAndEviction(t *testing.T) {
+	d := newTestDownload(t, NewLimits(1))
+	now := time.Now()
+	d.AddPeers([]Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 1}, {IP: net.IPv4(10, 0, 0, 2), Port: 2},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 3}})
+	d.peers["10.0.0.1:1"].Score = 5
+	d.peers["10.0.0.2:2"].Score = 1
+	d.peers["10.0.0.3:3"].RetryAt = now.Add(time.Minute)
+	ready := d.readyCandidates(now)
+	if len(ready) != 2 || ready[0].Peer.Port != 1 || ready[1].Peer.Port != 2 {
+		t.Fatalf("candidates are not ordered by score or include one waiting to retry")
+	}
+
+	// The only slot is held by a connection that has been idle for too long
+	client, server := net.Pipe()
+	defer server.Close()
+	idle := &activeConn{Candidate: d.peers["10.0.0.2:2"], Conn: newPeerConnection(d.File, client),
+		Started: now.Add(-2 * idleTimeout)}
+	d.active[idle] = true
+	d.acquireSlots(slotConn)
+	var dialed []*candidate
+	d.connectCandidates(now, func(c *candidate) { dialed = append(dialed, c) })
+	if len(dialed) != 0 || !idle.Evicted {
+		t.Fatalf("the idle connection was not evicted for a better candidate")
+	}
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Errorf("evicted connection is still open")
+	}
+}
+
+func TestServeUnchokedPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	p := newPeerConnection(&File{}, client)
+	p.Serve = func(index, begin, length int) ([]byte, error) {
+		return make([]byte, length), nil
+	}
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint32(request[0:4], 3)
+	binary.BigEndian.PutUint32(request[8:12], 100)
+	reply := make(chan []byte)
+	go func() {
+		var buf []byte
+		for i := 0; i < 2; i++ {
+			header := make([]byte, 5)
+			io.ReadFull(server, header)
+			payload := make([]byte, binary.BigEndian.Uint32(header)-1)
+			io.ReadFull(server, payload)
+			buf = append(buf, header[4])
+			buf = append(buf, payload...)
+		}
+		reply <- buf
+	}()
+
+	// Requests of a choked peer are dropped
+	if err := p.handleMessage(message{ID: msgRequest, Payload: request}); err != nil {
+		t.Fatal(err)
+	}
+	p.setChoking(false)
+	if err := p.sendQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handleMessage(message{ID: msgRequest, Payload: request}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-reply
+	if got[0] != msgUnchoke || got[1] != msgPiece || len(got) != 2+8+100 || got[5] != 3 {
+		t.Errorf("got messages %x, want an unchoke and the requested block", got[:10])
+	}
+	if stats := p.stats(); stats.Uploaded != 100 || stats.Choking || stats.UploadRate <= 0 {
+		t.Errorf("got stats %+v after sending a block", stats)
+	}
+}
+
+func TestFilePriorities(t *testing.T) {
+	info := &TorrentInfo{Name: "t", PieceLength: 16, Pieces: strings.Repeat("x", 3*20), Files: []fileInfo{
+		{Length: 16, Path: []string{"a"}}, {Length: 16, Path: []string{"b"}}, {Length: 16, Path: []string{"c"}}}}
+	d, err := NewDownload(&File{InfoHash: [20]byte{10}, Metadata: info}, NewMemoryStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetFilePriority(0, PriorityLow)
+	d.SetFilePriority(1, PriorityHigh)
+	if got := d.neededPieces(); fmt.Sprint(got) != "[1 2 0]" {
+		t.Errorf("got pieces in order %v", got)
+	}
+	d.SetFilePriority(2, PriorityNone)
+	d.have.Set(1)
+	if got := d.neededPieces(); fmt.Sprint(got) != "[0]" {
+		t.Errorf("got pieces %v", got)
+	}
+	files := d.Files()
+	if files[1].Priority != PriorityHigh || files[2].Wanted || !files[0].Wanted {
+		t.Errorf("got files %+v", files)
+	}
+	if have := d.Have(); have.Count() != 1 || !have.Has(1) {
+		t.Errorf("got pieces %v", have.Indexes())
+	}
+}
+
+// startTestSeed seeds data, with every piece marked complete, on addr
+func startTestSeed(t *testing.T, info *TorrentInfo, infoHash [20]byte, data []byte, addr string) Peer {
+	storage := NewMemoryStorage()
+	ts, _ := storage.OpenTorrent(info, infoHash)
+	for i := 0; i < info.NumPieces(); i++ {
+		ts.WriteAt(i, data[i*info.PieceLength:i*info.PieceLength+info.PieceSize(i)], 0)
+		ts.MarkComplete(i)
+	}
+	return startTestSeedStorage(t, info, infoHash, storage, addr)
+}
+
+// startTestSeedStorage seeds the pieces of storage on addr
+func startTestSeedStorage(t *testing.T, info *TorrentInfo, infoHash [20]byte, storage Storage, addr string) Peer {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	seed, err := NewDownload(&File{InfoHash: infoHash, Metadata: info}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed.Seed = true
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		seed.Run(ctx)
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := AcceptHandshake(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			seed.AddConn(conn)
+		}
+	}()
+	tcpAddr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)}
+}
+
+func TestBanBadSender(t *testing.T) {
+	pieceLength := 2 * maxRequestLength
+	content := testContent(3*pieceLength, 3)
+	var hashes []byte
+	for i := 0; i < len(content); i += pieceLength {
+		hash := sha1.Sum(content[i : i+pieceLength])
+		hashes = append(hashes, hash[:]...)
+	}
+	info := &TorrentInfo{Name: "ban", PieceLength: pieceLength, Length: len(content), Pieces: string(hashes)}
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := info.PrepareForDownload(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), content...)
+	corrupt[pieceLength+maxRequestLength]++
+	// Bans go by IP, so the poisoner needs an address of its own
+	poisoner := startTestSeed(t, info, infoHash, corrupt, "127.0.0.2:0")
+	honest := startTestSeed(t, info, infoHash, content, "127.0.0.1:0")
+
+	leechInfo, err := parseInfo(info.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	leecher, err := NewDownload(&File{InfoHash: infoHash, Metadata: leechInfo}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banned []Event
+	leecher.OnEvent = func(e Event) {
+		switch e.Type {
+		case EventPieceFailed:
+			// Only then is there anyone else to download piece 1 from, whose
+			// good copy proves the poisoner's block wrong
+			leecher.AddPeers([]Peer{honest})
+		case EventPeerBanned:
+			banned = append(banned, e)
+		}
+	}
+	leecher.AddPeers([]Peer{poisoner})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := leecher.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(banned) != 1 || !banned[0].Peer.IP.Equal(poisoner.IP) {
+		t.Fatalf("got ban events %v, want the poisoner banned", banned)
+	}
+	if !leecher.Limits.Banned(poisoner.IP) || leecher.Limits.Banned(honest.IP) {
+		t.Errorf("the wrong peer was banned")
+	}
+	ts, _ := storage.OpenTorrent(leechInfo, infoHash)
+	got := make([]byte, pieceLength)
+	if _, err := ts.ReadAt(1, got, 0); err != nil || !bytes.Equal(got, content[pieceLength:2*pieceLength]) {
+		t.Errorf("piece 1 was not downloaded again from the honest peer: %v", err)
+	}
+	if ready := leecher.readyCandidates(time.Now()); len(ready) != 1 || ready[0].Peer.Port != honest.Port {
+		t.Errorf("banned peer is still a candidate")
+	}
+}
+
+// flakyStorage corrupts the first block it reads of one piece
+type flakyStorage struct {
+	*MemoryStorage
+	Piece int
+	once  *sync.Once
+}
+
+type flakyTorrent struct {
+	TorrentStorage
+	flakyStorage
+}
+
+func (s flakyStorage) OpenTorrent(info *TorrentInfo, infoHash [20]byte) (TorrentStorage, error) {
+	ts, err := s.MemoryStorage.OpenTorrent(info, infoHash)
+	return flakyTorrent{ts, s}, err
+}
+
+func (t flakyTorrent) ReadAt(piece int, p []byte, off int64) (int, error) {
+	n, err := t.TorrentStorage.ReadAt(piece, p, off)
+	if piece == t.Piece && n > 0 {
+		t.once.Do(func() { p[0]++ })
+	}
+	return n, err
+}
+
+func TestForgiveOneBadPiece(t *testing.T) {
+	pieceLength := 2 * maxRequestLength
+	content := testContent(3*pieceLength, 4)
+	var hashes []byte
+	for i := 0; i < len(content); i += pieceLength {
+		hash := sha1.Sum(content[i : i+pieceLength])
+		hashes = append(hashes, hash[:]...)
+	}
+	info := &TorrentInfo{Name: "flaky", PieceLength: pieceLength, Length: len(content), Pieces: string(hashes)}
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := info.PrepareForDownload(); err != nil {
+		t.Fatal(err)
+	}
+	storage := flakyStorage{NewMemoryStorage(), 1, &sync.Once{}}
+	ts, _ := storage.OpenTorrent(info, infoHash)
+	for i := 0; i < info.NumPieces(); i++ {
+		ts.WriteAt(i, content[i*pieceLength:(i+1)*pieceLength], 0)
+		ts.MarkComplete(i)
+	}
+	// The seed sends piece 1 wrong once, then every piece right
+	flaky := startTestSeedStorage(t, info, infoHash, storage, "127.0.0.1:0")
+
+	leechInfo, err := parseInfo(info.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher, err := NewDownload(&File{InfoHash: infoHash, Metadata: leechInfo}, NewMemoryStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed, banned int
+	leecher.OnEvent = func(e Event) {
+		switch e.Type {
+		case EventPieceFailed:
+			failed++
+		case EventPeerBanned:
+			banned++
+		}
+	}
+	leecher.AddPeers([]Peer{flaky})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := leecher.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 || banned != 0 || leecher.Limits.Banned(flaky.IP) {
+		t.Errorf("got %d failed pieces and %d bans, want the peer let off after one mistake", failed, banned)
+	}
+	// Every block it sent, less the penalty for the bad piece
+	blocks := 4 * pieceLength / maxRequestLength
+	if score := leecher.peers[flaky.String()].Score; score != blocks-violationPenalty {
+		t.Errorf("got score %d want %d", score, blocks-violationPenalty)
+	}
+}
+
+func TestScorePenalties(t *testing.T) {
+	d := newTestDownload(t, nil)
+	now := time.Now()
+	violator, slow := &candidate{}, &candidate{}
+	d.connDone(violator, true, 0, protocolError{errors.New("bad message")}, now)
+	d.connDone(slow, true, 0, errWaitTimeout, now)
+	if violator.Score >= slow.Score || slow.Score >= 0 {
+		t.Errorf("got scores %d for a protocol violation and %d for a timeout", violator.Score, slow.Score)
+	}
+
+	p := newPeerConnection(d.File, nil)
+	if err := p.handleMessage(message{ID: msgHave, Payload: []byte{0}}); err == nil {
+		t.Errorf("expected a short have message to be a violation")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	pieceLength := 2 * maxRequestLength
+	content := testContent(3*pieceLength+100, 8)
+	var hashes []byte
+	for i := 0; i < len(content); i += pieceLength {
+		end := i + pieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		hash := sha1.Sum(content[i:end])
+		hashes = append(hashes, hash[:]...)
+	}
+	info := &TorrentInfo{Name: "seed", PieceLength: pieceLength, Length: len(content), Pieces: string(hashes)}
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The data is in the storage but was never marked complete, and piece 1 is corrupt
+	storage := NewMemoryStorage()
+	if err := info.PrepareForDownload(); err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := storage.OpenTorrent(info, infoHash)
+	corrupt := append([]byte(nil), content...)
+	corrupt[pieceLength]++
+	for i := 0; i < info.NumPieces(); i++ {
+		ts.WriteAt(i, corrupt[i*pieceLength:i*pieceLength+info.PieceSize(i)], 0)
+	}
+	have, err := VerifyStorage(info, infoHash, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Count() != 3 || have.Has(1) {
+		t.Fatalf("verified pieces %v", have.Indexes())
+	}
+	ts.WriteAt(1, content[pieceLength:2*pieceLength], 0)
+	if have, _ := VerifyStorage(info, infoHash, storage, nil); have.Count() != info.NumPieces() {
+		t.Fatalf("verified pieces %v after the repair", have.Indexes())
+	}
+
+	seeder, err := NewDownload(&File{InfoHash: infoHash, Metadata: info}, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder.Seed = true
+	completed := make(chan struct{})
+	seeder.OnEvent = func(e Event) {
+		if e.Type == EventCompleted {
+			close(completed)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := AcceptHandshake(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			seeder.AddConn(conn)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	seeding := make(chan error)
+	go func() { seeding <- seeder.Run(ctx) }()
+	<-completed
+
+	leechInfo, err := parseInfo(info.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leechStorage := NewMemoryStorage()
+	leecher, err := NewDownload(&File{InfoHash: infoHash, Metadata: leechInfo}, leechStorage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	leecher.AddPeers([]Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	if err := leecher.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := leechStorage.OpenTorrent(leechInfo, infoHash)
+	for i := 0; i < leechInfo.NumPieces(); i++ {
+		piece := make([]byte, leechInfo.PieceSize(i))
+		if _, err := got.ReadAt(i, piece, 0); err != nil || !bytes.Equal(piece, content[i*pieceLength:i*pieceLength+len(piece)]) {
+			t.Errorf("piece %d was not downloaded from the seed: %v", i, err)
+		}
+	}
+
+	// Seeding goes on until it is cancelled
+	select {
+	case err := <-seeding:
+		t.Fatalf("seeding stopped on its own: %v", err)
+	default:
+	}
+	cancel()
+	if err := <-seeding; !errors.Is(err, context.Canceled) {
+		t.Errorf("seeding returned %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	minPieceLength   = 16 * 1024
+	maxPieceLength   = 16 * 1024 * 1024
+	targetPieceCount = 1500
+	createdBy        = "bitty"
+)
+
+// MetaInfo is the contents of a .torrent file (BEP 3)
+type MetaInfo struct {
+	Announce     string
+	AnnounceList [][]string
+	URLList      []string
+	Comment      string
+	CreatedBy    string
+	CreationDate int64
+	Info         TorrentInfo
+	InfoHash     [20]byte // the v2 infohash truncated for a v2 only torrent
+	InfoHashV2   [32]byte // SHA-256 of the info dictionary of a v2 or hybrid torrent (BEP 52)
+}
+
+// CreateOptions are the optional parts of a torrent made by CreateTorrent
+type CreateOptions struct {
+	PieceLength int // chosen from the content size when 0
+	Trackers    []string
+	WebSeeds    []string
+	Private     bool
+	Comment     string
+	Source      string
+}
+
+// sourceFile is a file on disk and where it starts in the torrent's byte stream
+type sourceFile struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// CreateTorrent hashes a file or directory into a MetaInfo
+func CreateTorrent(root string, opts CreateOptions) (*MetaInfo, error) {
+	root = filepath.Clean(root)
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	info := TorrentInfo{Name: filepath.Base(root)}
+	var sources []sourceFile
+	var totalLength int64
+	if !stat.IsDir() {
+		info.Length = int(stat.Size())
+		sources = append(sources, sourceFile{root, 0, stat.Size()})
+		totalLength = stat.Size()
+	} else {
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			fileStat, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			info.Files = append(info.Files, fileInfo{
+				Length: int(fileStat.Size()),
+				Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+			sources = append(sources, sourceFile{path, totalLength, fileStat.Size()})
+			totalLength += fileStat.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("No files to add in %s", root)
+		}
+	}
+	if totalLength == 0 {
+		return nil, errors.New("Cannot create a torrent of empty files")
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(totalLength)
+	}
+	if info.PieceLength < minPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("Piece length %d must be a power of two of at least %d", info.PieceLength, minPieceLength)
+	}
+	pieces, err := hashPieces(sources, totalLength, info.PieceLength)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces = string(pieces)
+	if opts.Private {
+		info.Private = 1
+	}
+	info.Source = opts.Source
+
+	mi := &MetaInfo{
+		URLList:      opts.WebSeeds,
+		Comment:      opts.Comment,
+		CreatedBy:    createdBy,
+		CreationDate: time.Now().Unix(),
+		Info:         info,
+	}
+	if len(opts.Trackers) > 0 {
+		mi.Announce = opts.Trackers[0]
+		for _, tracker := range opts.Trackers {
+			mi.AnnounceList = append(mi.AnnounceList, []string{tracker})
+		}
+	}
+	mi.InfoHash, err = mi.Info.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+// choosePieceLength picks the power of two that gives roughly targetPieceCount pieces
+func choosePieceLength(totalLength int64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/int64(pieceLength) > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces reads and hashes every piece, spreading the pieces across one worker per CPU
+func hashPieces(sources []sourceFile, totalLength int64, pieceLength int) ([]byte, error) {
+	numPieces := int((totalLength + int64(pieceLength) - 1) / int64(pieceLength))
+	hashes := make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int, numPieces)
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				offset := int64(index) * int64(pieceLength)
+				length := int64(pieceLength)
+				if offset+length > totalLength {
+					length = totalLength - offset
+				}
+				err := readSources(sources, offset, buf[:length])
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				hash := sha1.Sum(buf[:length])
+				copy(hashes[index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+	wg.Wait()
+	return hashes, firstErr
+}
+
+// readSources fills buf from the torrent's byte stream starting at offset
+func readSources(sources []sourceFile, offset int64, buf []byte) error {
+	for _, src := range sources {
+		if len(buf) == 0 {
+			break
+		}
+		if offset >= src.Offset+src.Length || src.Length == 0 {
+			continue
+		}
+		f, err := os.Open(src.Path)
+		if err != nil {
+			return err
+		}
+		n := src.Offset + src.Length - offset
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		_, err = f.ReadAt(buf[:n], offset-src.Offset)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	if len(buf) != 0 {
+		return errors.New("Files changed size while hashing")
+	}
+	return nil
+}
+
+// infoDict is the bencoded form of TorrentInfo, with only the keys the torrent uses
+func (t *TorrentInfo) infoDict() map[string]interface{} {
+	dict := map[string]interface{}{
+		"name":         t.Name,
+		"piece length": t.PieceLength,
+	}
+	if len(t.FileTree) > 0 {
+		dict["meta version"] = t.MetaVersion
+		dict["file tree"] = t.fileTreeDict()
+	}
+	if t.v2Only() {
+		// There is no v1 part to describe
+	} else if len(t.Files) > 0 {
+		files := make([]map[string]interface{}, len(t.Files))
+		for i, file := range t.Files {
+			files[i] = map[string]interface{}{"length": file.Length, "path": file.Path}
+			if file.Attr != "" {
+				files[i]["attr"] = file.Attr
+			}
+			if len(file.SymlinkPath) > 0 {
+				files[i]["symlink path"] = file.SymlinkPath
+			}
+			if file.SHA1 != "" {
+				files[i]["sha1"] = file.SHA1
+			}
+		}
+		dict["files"] = files
+	} else {
+		dict["length"] = t.Length
+		if t.Attr != "" {
+			dict["attr"] = t.Attr
+		}
+	}
+	if !t.v2Only() {
+		dict["pieces"] = t.Pieces
+	}
+	if t.Private != 0 {
+		dict["private"] = t.Private
+	}
+	if t.Source != "" {
+		dict["source"] = t.Source
+	}
+	return dict
+}
+
+// Hash is the SHA-1 infohash of the bencoded info dictionary
+func (t *TorrentInfo) Hash() ([20]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, t.infoDict())
+	if err != nil {
+		return [20]byte{}, err
+	}
+	t.Raw = buf.Bytes()
+	t.MetadataSize = len(t.Raw)
+	return sha1.Sum(t.Raw), nil
+}
+
+// Write encodes the MetaInfo as a .torrent file
+func (mi *MetaInfo) Write(w io.Writer) error {
+	dict := map[string]interface{}{
+		"info":          mi.Info.infoDict(),
+		"created by":    mi.CreatedBy,
+		"creation date": mi.CreationDate,
+	}
+	if mi.Announce != "" {
+		dict["announce"] = mi.Announce
+	}
+	if len(mi.AnnounceList) > 0 {
+		dict["announce-list"] = mi.AnnounceList
+	}
+	if len(mi.URLList) > 0 {
+		dict["url-list"] = mi.URLList
+	}
+	if mi.Comment != "" {
+		dict["comment"] = mi.Comment
+	}
+	if layers := mi.Info.pieceLayerDict(); len(layers) > 0 {
+		dict["piece layers"] = layers
+	}
+	return bencode.Marshal(w, dict)
+}
+
+// ReadTorrentFile decodes a .torrent file, the infohash is computed from the
+// bytes of its info dictionary as they are in the file
+func ReadTorrentFile(r io.Reader) (*MetaInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Torrent file is not a dictionary")
+	}
+	if _, ok := dict["info"].(map[string]interface{}); !ok {
+		return nil, errors.New("Torrent file has no info dictionary")
+	}
+	// Encoding the decoded dictionary again would sort keys a sloppy encoder
+	// left unsorted, and give a hash no other peer has
+	raw, err := rawDictValue(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	mi := &MetaInfo{Info: *info, InfoHash: sha1.Sum(raw)}
+	if len(mi.Info.FileTree) > 0 {
+		mi.InfoHashV2 = sha256.Sum256(raw)
+		if mi.Info.v2Only() {
+			copy(mi.InfoHash[:], mi.InfoHashV2[:])
+		}
+		layers, _ := dict["piece layers"].(map[string]interface{})
+		for root, layer := range layers {
+			var key [32]byte
+			copy(key[:], root)
+			value, _ := layer.(string)
+			err = mi.Info.SetPieceLayer(key, []byte(value))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	mi.Announce, _ = dict["announce"].(string)
+	mi.Comment, _ = dict["comment"].(string)
+	mi.CreatedBy, _ = dict["created by"].(string)
+	mi.CreationDate, _ = dict["creation date"].(int64)
+	if tiers, ok := dict["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			mi.AnnounceList = append(mi.AnnounceList, toStrings(tier))
+		}
+	}
+	// url-list may be a single string or a list of them (BEP 19)
+	if url, ok := dict["url-list"].(string); ok {
+		mi.URLList = []string{url}
+	} else {
+		mi.URLList = toStrings(dict["url-list"])
+	}
+	return mi, nil
+}
+
+// rawDictValue finds the bencoded value of key in the dictionary data holds
+func rawDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("Torrent file is not a dictionary")
+	}
+	for i := 1; i < len(data) && data[i] != 'e'; {
+		keyEnd, err := bencodeEnd(data, i)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := bencodeEnd(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		colon := bytes.IndexByte(data[i:keyEnd], ':')
+		if colon >= 0 && string(data[i+colon+1:keyEnd]) == key {
+			return data[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, fmt.Errorf("Dictionary has no %q key", key)
+}
+
+// bencodeEnd returns where the bencoded value starting at data[i] ends. Lists
+// and dictionaries are walked with a depth count rather than recursion.
+func bencodeEnd(data []byte, i int) (int, error) {
+	depth := 0
+	for {
+		if i >= len(data) {
+			return 0, errors.New("Bencoded data ends early")
+		}
+		switch c := data[i]; {
+		case c == 'i':
+			end := bytes.IndexByte(data[i:], 'e')
+			if end < 0 {
+				return 0, errors.New("Bencoded integer has no end")
+			}
+			i += end + 1
+		case c == 'l' || c == 'd':
+			depth++
+			i++
+			continue
+		case c == 'e' && depth > 0:
+			depth--
+			i++
+		case c >= '0' && c <= '9':
+			colon := bytes.IndexByte(data[i:], ':')
+			if colon < 0 {
+				return 0, errors.New("Bencoded string has no length")
+			}
+			n, err := strconv.Atoi(string(data[i : i+colon]))
+			start := i + colon + 1
+			if err != nil || n < 0 || n > len(data)-start {
+				return 0, errors.New("Bencoded string is longer than the data")
+			}
+			i = start + n
+		default:
+			return 0, fmt.Errorf("Unexpected %q in bencoded data", c)
+		}
+		if depth == 0 {
+			return i, nil
+		}
+	}
+}
+
+// parseInfo decodes a bencoded info dictionary, v1, v2 or hybrid
+func parseInfo(raw []byte) (*TorrentInfo, error) {
+	var info TorrentInfo
+	err := bencode.Unmarshal(bytes.NewReader(raw), &info)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Info is not a dictionary")
+	}
+	err = info.parseFileTree(dict)
+	if err != nil {
+		return nil, err
+	}
+	info.MetadataSize = len(raw)
+	info.Raw = raw
+	return &info, nil
+}
+
+// matchesInfoHash reports whether raw is the info dictionary of infoHash,
+// which is either its SHA-1 or its SHA-256 truncated (BEP 52)
+func matchesInfoHash(raw []byte, infoHash [20]byte) bool {
+	v2 := sha256.Sum256(raw)
+	return sha1.Sum(raw) == infoHash || bytes.Equal(v2[:20], infoHash[:])
+}
+
+// Trackers lists every tracker of the torrent, announce-list first (BEP 12)
+func (mi *MetaInfo) Trackers() []string {
+	var trackers []string
+	seen := map[string]bool{}
+	for _, tier := range mi.AnnounceList {
+		for _, tracker := range tier {
+			if !seen[tracker] {
+				seen[tracker] = true
+				trackers = append(trackers, tracker)
+			}
+		}
+	}
+	if mi.Announce != "" && !seen[mi.Announce] {
+		trackers = append(trackers, mi.Announce)
+	}
+	return trackers
+}
+
+func toStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var strs []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateTorrent(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content")
+	files := map[string][]byte{
+		"a.txt":        bytes.Repeat([]byte("a"), 40000),
+		"sub/b.bin":    bytes.Repeat([]byte("b"), 1000),
+		"sub/deep/c.c": bytes.Repeat([]byte("c"), 20000),
+	}
+	var stream []byte
+	for _, name := range []string{"a.txt", "sub/b.bin", "sub/deep/c.c"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, files[name]...)
+	}
+
+	mi, err := CreateTorrent(root, CreateOptions{
+		Trackers: []string{"udp://tracker.example:6969/announce"},
+		WebSeeds: []string{"http://mirror.example/content/"},
+		Private:  true,
+		Source:   "build",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mi.Info.PieceLength != minPieceLength || len(mi.Info.Files) != 3 {
+		t.Fatalf("got piece length %d and %d files", mi.Info.PieceLength, len(mi.Info.Files))
+	}
+	for i := 0; i*mi.Info.PieceLength < len(stream); i++ {
+		end := (i + 1) * mi.Info.PieceLength
+		if end > len(stream) {
+			end = len(stream)
+		}
+		hash := sha1.Sum(stream[i*mi.Info.PieceLength : end])
+		if string(hash[:]) != mi.Info.Pieces[i*20:(i+1)*20] {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTorrentFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHash != mi.InfoHash {
+		t.Errorf("got infohash %x want %x", got.InfoHash, mi.InfoHash)
+	}
+	if got.Info.Private != 1 || got.Info.Source != "build" || got.URLList[0] != mi.URLList[0] {
+		t.Errorf("got info %+v", got.Info)
+	}
+	if len(got.Trackers()) != 1 || got.Info.Files[2].Path[2] != "c.c" {
+		t.Errorf("got trackers %v files %v", got.Trackers(), got.Info.Files)
+	}
+}
+
+func TestReadTorrentFileHashesRawInfo(t *testing.T) {
+	// Keys out of order and one this client does not know, both part of the hash
+	info := "d6:lengthi5e4:name1:x12:piece lengthi16384e6:pieces20:" + string(make([]byte, 20)) + "5:extrai1ee"
+	file := "d8:announce9:udp://a:14:info" + info + "e"
+	mi, err := ReadTorrentFile(bytes.NewReader([]byte(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mi.InfoHash != sha1.Sum([]byte(info)) {
+		t.Error("infohash is not the hash of the info dictionary as written")
+	}
+	if mi.Info.Name != "x" || mi.Info.Length != 5 || mi.Announce != "udp://a:1" {
+		t.Errorf("got %+v", mi)
+	}
+	if !bytes.Equal(mi.Info.Raw, []byte(info)) {
+		t.Error("metadata served to peers is not the info dictionary as written")
+	}
+}
@@ -0,0 +1,35 @@
+package peer
+
+// VerifyStorage checks every piece of the torrent in storage against its hash
+// and marks the ones that match complete, so a download or seed of data that is
+// already there starts from them. onPiece, when not nil, is called after each
+// piece. It returns the pieces that matched.
+func VerifyStorage(info *TorrentInfo, infoHash [20]byte, storage Storage, onPiece func(index int, ok bool)) (Bitfield, error) {
+	err := info.PrepareForDownload()
+	if err != nil {
+		return Bitfield{}, err
+	}
+	ts, err := storage.OpenTorrent(info, infoHash)
+	if err != nil {
+		return Bitfield{}, err
+	}
+	have := NewBitfield(info.NumPieces())
+	buf := make([]byte, info.PieceLength)
+	for i := 0; i < have.Len(); i++ {
+		piece := buf[:info.PieceSize(i)]
+		_, err := ts.ReadAt(i, piece, 0)
+		ok := err == nil && info.VerifyPiece(i, piece) == nil
+		if ok {
+			have.Set(i)
+			err = ts.MarkComplete(i)
+			if err != nil {
+				ts.Close()
+				return have, err
+			}
+		}
+		if onPiece != nil {
+			onPiece(i, ok)
+		}
+	}
+	return have, ts.Close()
+}
@@ -0,0 +1,181 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webSeedBackoff doubles after each failure of a web seed in a row, after
+// maxFailures the seed is not used again until the next run
+var webSeedBackoff = retryBackoff
+
+var webSeedClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: requestTimeout,
+	},
+}
+
+// webSeed is an HTTP server holding the torrent's files (BEP 19). It takes
+// pieces from the same queue as the peers and never chokes us.
+type webSeed struct {
+	URL      string
+	Failures int // in a row
+}
+
+// webSeedURL is where a file of the torrent is on a web seed. A seed of a
+// single file torrent ending in a slash is a directory holding the file,
+// otherwise it is the file itself. For several files it is always a directory.
+func webSeedURL(seed string, info *TorrentInfo, file TorrentFile) string {
+	if info.singleFile() {
+		if strings.HasSuffix(seed, "/") {
+			return seed + url.PathEscape(info.Name)
+		}
+		return seed
+	}
+	if !strings.HasSuffix(seed, "/") {
+		seed += "/"
+	}
+	parts := make([]string, len(file.Path))
+	for i, part := range file.Path {
+		parts[i] = url.PathEscape(part)
+	}
+	return seed + strings.Join(parts, "/")
+}
+
+// runWebSeed downloads pieces from a web seed until ctx is done or it failed
+// maxFailures times in a row
+func (d *Download) runWebSeed(ctx context.Context, ws *webSeed,
+	inputPieces chan *inputPiece, outputPieces chan *outputPiece) {
+	for ws.Failures < maxFailures {
+		var piece *inputPiece
+		select {
+		case piece = <-inputPieces:
+		case <-ctx.Done():
+			return
+		}
+		if piece.Excluded[ws.URL] {
+			// Leave the piece to the peers
+			inputPieces <- piece
+			if sleep(ctx, time.Second) != nil {
+				return
+			}
+			continue
+		}
+		buf, err := d.fetchPiece(ctx, ws.URL, piece)
+		if err == nil {
+			err = d.File.Metadata.VerifyPiece(piece.Index, buf)
+			if errors.Is(err, errNoPieceLayer) {
+				// Only peers can send the piece layer
+				inputPieces <- piece
+				if sleep(ctx, time.Second) != nil {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				if piece.Excluded == nil {
+					piece.Excluded = map[string]bool{}
+				}
+				piece.Excluded[ws.URL] = true
+				e := NewEvent(EventPieceFailed, d.File.InfoHash)
+				e.Piece, e.WebSeed, e.Err = piece.Index, ws.URL, err
+				d.emit(e)
+				select {
+				case outputPieces <- &outputPiece{Index: piece.Index, Buff: buf, WebSeed: ws.URL, Input: piece, Failed: true}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		} else {
+			inputPieces <- piece
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ws.Failures++
+			e := NewEvent(EventWebSeedFailed, d.File.InfoHash)
+			e.WebSeed, e.Err = ws.URL, err
+			d.emit(e)
+			if sleep(ctx, webSeedBackoff<<uint(ws.Failures-1)) != nil {
+				return
+			}
+			continue
+		}
+		ws.Failures = 0
+		select {
+		case outputPieces <- &outputPiece{Index: piece.Index, Buff: buf, WebSeed: ws.URL, Input: piece}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchPiece downloads a piece from a web seed, with a range request for each
+// file it covers
+func (d *Download) fetchPiece(ctx context.Context, seed string, piece *inputPiece) ([]byte, error) {
+	info := d.File.Metadata
+	files := info.FileList()
+	begin := pieceOffset(info, piece.Index)
+	buf := make([]byte, piece.Length)
+	for _, seg := range segments(files, begin, begin+int64(piece.Length)) {
+		if seg.Begin == seg.End || files[seg.File].Padding() {
+			// Padding is left as zeros
+			continue
+		}
+		err := d.fetchRange(ctx, webSeedURL(seed, info, files[seg.File]), seg.FileOffset, buf[seg.Begin:seg.End])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// fetchRange reads len(buf) bytes at offset of the file at rawURL, charged to
+// the download limits
+func (d *Download) fetchRange(ctx context.Context, rawURL string, offset int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	resp, err := webSeedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		// The server ignored the range, what we want is at the start anyway
+	case resp.StatusCode == http.StatusOK:
+		return fmt.Errorf("Web seed %s does not support range requests", rawURL)
+	default:
+		return fmt.Errorf("Web seed %s returned %s", rawURL, resp.Status)
+	}
+	for n := 0; n < len(buf); {
+		end := n + rateLimitChunk
+		if end > len(buf) {
+			end = len(buf)
+		}
+		read, err := io.ReadFull(resp.Body, buf[n:end])
+		n += read
+		if err != nil {
+			return err
+		}
+		for _, l := range []*RateLimiter{d.Limits.Download, d.DownloadLimit} {
+			err = l.WaitN(ctx, read)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebSeedURL(t *testing.T) {
+	single := &TorrentInfo{Name: "a file.mkv", Length: 10}
+	multi, _ := testStorageInfo()
+	for _, tc := range []struct {
+		seed string
+		info *TorrentInfo
+		file int
+		want string
+	}{
+		{"http://host/dir/", single, 0, "http://host/dir/a%20file.mkv"},
+		{"http://host/other.mkv", single, 0, "http://host/other.mkv"},
+		{"http://host/dir", multi, 2, "http://host/dir/t/dir/b"},
+		{"http://host/dir/", multi, 0, "http://host/dir/t/a"},
+	} {
+		if got := webSeedURL(tc.seed, tc.info, tc.info.FileList()[tc.file]); got != tc.want {
+			t.Errorf("webSeedURL(%s) = %s want %s", tc.seed, got, tc.want)
+		}
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	defer func(backoff time.Duration) { webSeedBackoff = backoff }(webSeedBackoff)
+	webSeedBackoff = 10 * time.Millisecond
+
+	info, content := testStorageInfo()
+	info.Pieces = ""
+	for i := 0; i < len(content); i += info.PieceLength {
+		end := i + info.PieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		hash := sha1.Sum(content[i:end])
+		info.Pieces += string(hash[:])
+	}
+	files := map[string][]byte{"/seed/t/a": content[:10], "/seed/t/empty": nil, "/seed/t/dir/b": content[10:]}
+	var mu sync.Mutex
+	failing := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failing > 0
+		failing--
+		mu.Unlock()
+		data, ok := files[r.URL.Path]
+		if fail || !ok {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	storage := NewMemoryStorage()
+	file := &File{InfoHash: [20]byte{7}, Metadata: info, WebSeeds: []string{server.URL + "/seed/"}}
+	d, err := NewDownload(file, storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures int
+	d.OnEvent = func(e Event) {
+		if e.Type == EventWebSeedFailed {
+			failures++
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = d.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 2 {
+		t.Errorf("got %d web seed failures want 2", failures)
+	}
+	ts, err := storage.OpenTorrent(info, file.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	for i := 0; i < info.NumPieces(); i++ {
+		got := make([]byte, info.PieceSize(i))
+		ts.ReadAt(i, got, 0)
+		if want := content[i*info.PieceLength : i*info.PieceLength+len(got)]; !bytes.Equal(got, want) {
+			t.Errorf("piece %d is %x want %x", i, got, want)
+		}
+	}
+}
+
+func TestEnableSkippedFile(t *testing.T) {
+	info, content := testStorageInfo()
+	info.Pieces = ""
+	for i := 0; i < len(content); i += info.PieceLength {
+		end := i + info.PieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		hash := sha1.Sum(content[i:end])
+		info.Pieces += string(hash[:])
+	}
+	files := map[string][]byte{"/t/a": content[:10], "/t/empty": nil, "/t/dir/b": content[10:]}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	file := &File{InfoHash: [20]byte{8}, Metadata: info, WebSeeds: []string{server.URL + "/"}}
+	d, err := NewDownload(file, NewFileStorage(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Piece 0 is shared by a and the start of b, only a is written
+	d.SetFileWanted(2, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if files := d.Files(); files[0].Completed != 10 || files[2].Completed != 0 {
+		t.Errorf("got files %+v with b skipped", files)
+	}
+	if d.Have().Has(0) {
+		t.Error("piece 0 is offered to peers without the part in b")
+	}
+	// Running again with b still skipped does not fetch piece 0 again
+	atomic.StoreInt32(&requests, 0)
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("made %d requests for pieces already stored", n)
+	}
+
+	d.SetFileWanted(2, true)
+	if err := d.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "t", "dir", "b"))
+	if err != nil || !bytes.Equal(got, content[10:]) {
+		t.Errorf("b is %x want %x, %v", got, content[10:], err)
+	}
+}
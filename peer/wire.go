@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// keepAliveInterval is how long the writer stays quiet before sending a keep-alive
+	keepAliveInterval = 2 * time.Minute
+	// connIdleTimeout drops a peer that sent nothing, not even a keep-alive, for this long
+	connIdleTimeout = 3 * time.Minute
+)
+
+const (
+	// maxMessageLength bounds the messages of unknown or variable length, a
+	// bitfield may be longer when the torrent has that many pieces
+	maxMessageLength = 256 * 1024
+	// requestTimeout is how long to wait for the blocks requested from a peer
+	requestTimeout = 30 * time.Second
+)
+
+// messageLengths are the lengths, ID included, of the messages with a fixed size
+var messageLengths = map[uint8]uint32{
+	msgChoke:         1,
+	msgUnchoke:       1,
+	msgInterested:    1,
+	msgNotInterested: 1,
+	msgHave:          5,
+	msgRequest:       13,
+	msgCancel:        13,
+	msgPort:          3,
+	msgHashRequest:   49,
+	msgHashReject:    49,
+}
+
+// errWaitTimeout is returned by readMessageWithin when no message came in time
+var errWaitTimeout error = waitTimeout{}
+
+type waitTimeout struct{}
+
+func (waitTimeout) Error() string   { return "Timed out waiting for a message" }
+func (waitTimeout) Timeout() bool   { return true }
+func (waitTimeout) Temporary() bool { return true }
+
+// startIO starts the reader and writer goroutines of the connection, the first
+// time a message is read or written. They return once the socket is closed.
+func (p *peerConnection) startIO() {
+	p.ioOnce.Do(func() {
+		p.incoming = make(chan message)
+		p.outgoing = make(chan []byte, maxBacklog)
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.readLoop()
+		go p.writeLoop()
+	})
+}
+
+// close closes the socket and stops the reader and writer
+func (p *peerConnection) close() {
+	p.startIO()
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.Socket.Close()
+}
+
+// readLoop hands every message but keep-alives to readMessage
+func (p *peerConnection) readLoop() {
+	defer close(p.done)
+	for {
+		m, err := p.readFrame()
+		if err != nil {
+			p.readErr = err
+			p.Socket.Close()
+			return
+		}
+		if m == nil {
+			continue
+		}
+		select {
+		case p.incoming <- *m:
+		case <-p.stop:
+			p.readErr = errors.New("Connection closed")
+			return
+		}
+	}
+}
+
+// readFrame reads one message, nil for a keep-alive. A length that does not
+// fit the message is a protocolError.
+func (p *peerConnection) readFrame() (*message, error) {
+	var header [5]byte
+	p.Socket.SetReadDeadline(time.Now().Add(connIdleTimeout))
+	_, err := io.ReadFull(p.Socket, header[:4])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 {
+		return nil, nil
+	}
+	_, err = io.ReadFull(p.Socket, header[4:])
+	if err != nil {
+		return nil, err
+	}
+	m := &message{Length: length, ID: header[4]}
+	if length > p.maxLength(m.ID) {
+		return nil, protocolError{fmt.Errorf("Message %d of %d bytes is too long", m.ID, length)}
+	}
+	if want, ok := messageLengths[m.ID]; ok && length != want {
+		return nil, protocolError{fmt.Errorf("Message %d of %d bytes, want %d", m.ID, length, want)}
+	}
+	m.Payload = make([]byte, length-1)
+	_, err = io.ReadFull(p.Socket, m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// maxLength is the longest a message with the ID may be, ID included
+func (p *peerConnection) maxLength(id uint8) uint32 {
+	switch id {
+	case msgPiece:
+		return 9 + maxRequestLength
+	case msgBitfield:
+		// The reader runs beside handleMessage, which replaces the bitfield
+		p.mu.Lock()
+		n := uint32(len(p.Bitfield.Bytes())) + 1
+		p.mu.Unlock()
+		if n > maxMessageLength {
+			return n
+		}
+	}
+	return maxMessageLength
+}
+
+// writeLoop writes the queued frames, and a keep-alive whenever nothing was
+// written for keepAliveInterval
+func (p *peerConnection) writeLoop() {
+	keepAlive := time.NewTimer(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var frame []byte
+		select {
+		case frame = <-p.outgoing:
+		case <-keepAlive.C:
+			frame = make([]byte, 4)
+		case <-p.done:
+			return
+		}
+		_, err := p.Socket.Write(frame)
+		if err != nil {
+			// The reader fails too and reports the connection closed
+			p.Socket.Close()
+			return
+		}
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+		keepAlive.Reset(keepAliveInterval)
+	}
+}
@@ -0,0 +1,98 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageFraming(t *testing.T) {
+	defer func(interval, idle time.Duration) {
+		keepAliveInterval, connIdleTimeout = interval, idle
+	}(keepAliveInterval, connIdleTimeout)
+	keepAliveInterval, connIdleTimeout = 50*time.Millisecond, 300*time.Millisecond
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	info, _ := testStorageInfo()
+	p := newPeerConnection(&File{Metadata: info}, local)
+	defer p.close()
+
+	// Keep-alives from the peer are skipped
+	go remote.Write([]byte{0, 0, 0, 0, 0, 0, 0, 5, msgHave, 0, 0, 0, 2})
+	m, err := p.readMessage()
+	if err != nil || m.ID != msgHave {
+		t.Fatalf("got message %d, %v want a have", m.ID, err)
+	}
+
+	// A quiet connection sends keep-alives
+	buf := make([]byte, 4)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(remote, buf); err != nil || !bytes.Equal(buf, []byte{0, 0, 0, 0}) {
+		t.Fatalf("got %x, %v want a keep-alive", buf, err)
+	}
+
+	// The peer never answered, so the connection is dropped once it is idle
+	if _, err := p.readMessage(); !isTimeout(err) {
+		t.Errorf("got %v want the idle connection to time out", err)
+	}
+}
+
+func TestMessageLengthLimits(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"huge piece":    {0xff, 0xff, 0xff, 0xff, msgPiece},
+		"long have":     {0, 0, 0, 9, msgHave, 0, 0, 0, 0, 0, 0, 0, 0},
+		"short request": {0, 0, 0, 2, msgRequest, 0},
+	} {
+		local, remote := net.Pipe()
+		p := newPeerConnection(&File{}, local)
+		go remote.Write(frame)
+		_, err := p.readMessage()
+		var violation protocolError
+		if !errors.As(err, &violation) {
+			t.Errorf("%s: got %v want a protocol violation", name, err)
+		}
+		p.close()
+		remote.Close()
+	}
+}
+
+// bufferConn is a connection that reads from a buffer and throws writes away
+type bufferConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c bufferConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c bufferConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c bufferConn) Close() error                       { return nil }
+func (c bufferConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c bufferConn) SetReadDeadline(time.Time) error    { return nil }
+func (c bufferConn) SetDeadline(time.Time) error        { return nil }
+func (c bufferConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 5, msgHave, 0, 0, 0, 1})
+	f.Add([]byte{0, 0, 0, 2, msgBitfield, 0xff})
+	f.Add([]byte{0, 0, 0, 13, msgPiece, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 3, msgExtended, 0, 'd'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, msgPort})
+	info, _ := testStorageInfo()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := newPeerConnection(&File{Metadata: info}, bufferConn{r: bytes.NewReader(data)})
+		defer p.close()
+		for {
+			m, err := p.readMessage()
+			if err != nil {
+				return
+			}
+			if m.Length > maxMessageLength || int(m.Length) != len(m.Payload)+1 {
+				t.Fatalf("message %d of length %d with %d bytes of payload", m.ID, m.Length, len(m.Payload))
+			}
+			p.handleMessage(m)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// progressInterval is how often the progress lines are redrawn on a terminal,
+// progressLogInterval how often they are printed anywhere else
+const (
+	progressInterval    = 500 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// watch shows the progress of the torrents until they have all completed or
+// failed, or ctx is done. Seeding torrents never finish, only ctx stops them.
+func watch(ctx context.Context, c *client.Client, torrents []*client.Torrent, cf *clientFlags) error {
+	events, unsubscribe := c.Subscribe(256)
+	defer unsubscribe()
+	display := newProgressDisplay(os.Stdout, *cf.Quiet)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			line := describeEvent(e, *cf.Verbose)
+			if line != "" && !*cf.Quiet {
+				if len(torrents) > 1 {
+					line = e.Torrent.Name() + ": " + line
+				}
+				display.log(line)
+			}
+			if e.Type != peer.EventStateChanged {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			display.draw(torrents, true)
+			return ctx.Err()
+		}
+		if finished(torrents) {
+			display.draw(torrents, true)
+			return torrentErrors(torrents)
+		}
+		display.draw(torrents, false)
+	}
+}
+
+// finished is whether every torrent has completed, failed or been stopped
+func finished(torrents []*client.Torrent) bool {
+	for _, t := range torrents {
+		switch t.Stats().State {
+		case client.StateCompleted, client.StateFailed, client.StateStopped:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// torrentErrors reports the torrents that failed, nil when they all completed
+func torrentErrors(torrents []*client.Torrent) error {
+	var failures []string
+	for _, t := range torrents {
+		err := t.Wait(context.Background())
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", t.Name(), err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, "\n"))
+}
+
+// describeEvent is the line printed for an event, empty for the ones left out.
+// Tracker announces, failed pieces and banned peers are only verbose.
+func describeEvent(e client.Event, verbose bool) string {
+	switch e.Type {
+	case peer.EventMetadataReceived:
+		return "Got metadata, beginning download..."
+	case peer.EventStateChanged:
+		switch e.State {
+		case client.StateCompleted:
+			return "Download complete"
+		case client.StateSeeding:
+			return "Download complete, seeding"
+		}
+	}
+	if !verbose {
+		return ""
+	}
+	switch e.Type {
+	case peer.EventTrackerAnnounce:
+		if e.Err != nil {
+			return fmt.Sprintf("Announce to %s failed: %v", e.Tracker, e.Err)
+		}
+		return fmt.Sprintf("Announced to %s: %d seeders, %d leechers, %d peers",
+			e.Tracker, e.Seeders, e.Leechers, e.NumPeers)
+	case peer.EventPieceFailed:
+		return fmt.Sprintf("Piece #%d from %s failed its integrity check", e.Piece, eventSource(e.Event))
+	case peer.EventWebSeedFailed:
+		return fmt.Sprintf("Web seed %s failed: %v", e.WebSeed, e.Err)
+	case peer.EventPeerBanned:
+		return fmt.Sprintf("Banned %s: %v", e.Peer.IP, e.Err)
+	}
+	return ""
+}
+
+// eventSource is the peer or web seed an event came from
+func eventSource(e peer.Event) string {
+	if e.WebSeed != "" {
+		return e.WebSeed
+	}
+	return e.Peer.String()
+}
+
+// progressDisplay keeps a line per torrent at the bottom of a terminal, redrawn
+// in place, with the logged lines scrolling above. Anywhere else, such as a
+// pipe, the progress lines are printed every progressLogInterval instead.
+type progressDisplay struct {
+	Out      io.Writer
+	Terminal bool
+	Quiet    bool
+	Width    int       // of the terminal in columns
+	Lines    []string  // drawn at the bottom of the terminal
+	Printed  time.Time // when the lines were last printed off a terminal
+}
+
+func newProgressDisplay(f *os.File, quiet bool) *progressDisplay {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 20 {
+		width = 80
+	}
+	return &progressDisplay{Out: f, Terminal: isTerminal(f), Quiet: quiet, Width: width}
+}
+
+// isTerminal is whether f is a terminal rather than a file or a pipe
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// log prints a line above the progress lines
+func (d *progressDisplay) log(line string) {
+	if !d.Terminal {
+		fmt.Fprintln(d.Out, line)
+		return
+	}
+	d.clear()
+	fmt.Fprintln(d.Out, line)
+	for _, line := range d.Lines {
+		fmt.Fprintln(d.Out, line)
+	}
+}
+
+// draw shows the progress of the torrents, final draws are printed off a
+// terminal whenever the last one was
+func (d *progressDisplay) draw(torrents []*client.Torrent, final bool) {
+	if d.Quiet {
+		return
+	}
+	lines := make([]string, len(torrents))
+	for i, t := range torrents {
+		lines[i] = progressLine(t.Name(), t.Stats())
+	}
+	if !d.Terminal {
+		if final || time.Since(d.Printed) >= progressLogInterval {
+			d.Printed = time.Now()
+			for _, line := range lines {
+				fmt.Fprintln(d.Out, line)
+			}
+		}
+		return
+	}
+	// A line wrapping past the edge of the terminal would throw clear off
+	for i, line := range lines {
+		if runes := []rune(line); len(runes) >= d.Width {
+			lines[i] = string(runes[:d.Width-1])
+		}
+	}
+	d.clear()
+	d.Lines = lines
+	for _, line := range lines {
+		fmt.Fprintln(d.Out, line)
+	}
+}
+
+// clear moves the cursor up to the first progress line and erases them all
+func (d *progressDisplay) clear() {
+	if len(d.Lines) > 0 {
+		fmt.Fprintf(d.Out, "\x1b[%dA\x1b[J", len(d.Lines))
+	}
+}
+
+// progressLine sums up a torrent: its name, how much of the wanted files is
+// there, rates, ETA, peers and state
+func progressLine(name string, stats client.Stats) string {
+	var wanted, completed int64
+	for _, f := range stats.Files {
+		if f.Wanted {
+			wanted += f.Length
+			completed += f.Completed
+		}
+	}
+	percent := 0.0
+	if wanted > 0 {
+		percent = float64(completed) / float64(wanted) * 100
+	}
+	line := fmt.Sprintf("%-24.24s %s %5.1f%% of %s", name, progressBar(percent, 10), percent, formatBytes(wanted))
+	switch stats.State {
+	case client.StateDownloading:
+		line += fmt.Sprintf("  %s/s", formatBytes(int64(stats.DownloadRate)))
+		if stats.ETA > 0 {
+			line += fmt.Sprintf("  ETA %s", stats.ETA.Round(time.Second))
+		}
+		line += fmt.Sprintf("  %d/%d peers", stats.Peers, stats.KnownPeers)
+	case client.StateSeeding:
+		line += fmt.Sprintf("  %s uploaded  %d peers  seeding", formatBytes(stats.Uploaded), stats.Peers)
+	default:
+		line += "  " + stats.State.String()
+	}
+	return line
+}
+
+// progressBar draws percent in width characters
+func progressBar(percent float64, width int) string {
+	filled := int(percent / 100 * float64(width))
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+// formatBytes writes n in binary units like 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < len("KMGTPE")-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[prefix])
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/laurentlousky/stream/rpc"
+)
+
+// rpcTimeout bounds a call to the daemon, pausing waits for announces
+const rpcTimeout = 30 * time.Second
+
+// dialDaemon returns a client of the daemon at addr, nil when none answers
+func dialDaemon(addr string) *rpc.Client {
+	d := rpc.NewClient(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := d.Call(ctx, "session-get", map[string]interface{}{"fields": []string{"version"}}, nil)
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// addRPCFlag adds the -rpc flag of the commands that need a daemon
+func addRPCFlag(flags *flag.FlagSet) *string {
+	return flags.String("rpc", daemonAddr(), "Unix socket or http:// URL of the daemon")
+}
+
+// needDaemon is dialDaemon for the commands that cannot run without one
+func needDaemon(addr string) (*rpc.Client, error) {
+	d := dialDaemon(addr)
+	if d == nil {
+		return nil, fmt.Errorf("No daemon is running on %s, start one with bitty daemon", addr)
+	}
+	return d, nil
+}
+
+// call runs a method of the daemon with the usual timeout
+func call(d *rpc.Client, method string, args, result interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	return d.Call(ctx, method, args, result)
+}
+
+// addedTorrent is how the daemon answers torrent-add
+type addedTorrent struct {
+	ID   int
+	Name string
+}
+
+// addToDaemon hands the torrents of a download command line to the daemon
+// instead of downloading them here. Its flags only apply to these torrents.
+func addToDaemon(d *rpc.Client, flags *flag.FlagSet, selection []int, cf *clientFlags) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	limits := map[string]interface{}{}
+	for _, limit := range []struct {
+		Flag, Field string
+		Rate        *string
+	}{{"down", "download", cf.Down}, {"up", "upload", cf.Up}} {
+		if !set[limit.Flag] {
+			continue
+		}
+		bytes, err := parseRate(*limit.Rate)
+		if err != nil {
+			return usageFailure(flags, err)
+		}
+		limits[limit.Field+"Limit"] = bytes / 1000
+		limits[limit.Field+"Limited"] = bytes > 0
+	}
+
+	for _, arg := range flags.Args() {
+		args := map[string]interface{}{}
+		if set["o"] {
+			dir, err := filepath.Abs(flags.Lookup("o").Value.String())
+			if err != nil {
+				return err
+			}
+			args["download-dir"] = dir
+		}
+		if strings.HasPrefix(arg, "magnet:") {
+			if selection != nil {
+				return errors.New("-files needs the .torrent of a magnet link to hand it to the daemon, or -local")
+			}
+			args["filename"] = arg
+		} else {
+			data, err := os.ReadFile(arg)
+			if err != nil {
+				return err
+			}
+			mi, err := readTorrentFile(arg)
+			if err != nil {
+				return fmt.Errorf("%s: %v", arg, err)
+			}
+			args["metainfo"] = base64.StdEncoding.EncodeToString(data)
+			if selection != nil {
+				args["files-wanted"], args["files-unwanted"] = splitSelection(selection, len(mi.Info.FileList()))
+			}
+		}
+		var result struct {
+			Added     *addedTorrent `json:"torrent-added"`
+			Duplicate *addedTorrent `json:"torrent-duplicate"`
+		}
+		err := call(d, "torrent-add", args, &result)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		added := result.Added
+		if added == nil {
+			added = result.Duplicate
+			fmt.Printf("%s is already in the daemon as #%d \n", added.Name, added.ID)
+		} else if !*cf.Quiet {
+			fmt.Printf("Added %s to the daemon as #%d \n", added.Name, added.ID)
+		}
+		torrentSet := map[string]interface{}{"ids": []int{added.ID}}
+		for name, value := range limits {
+			torrentSet[name] = value
+		}
+		if len(cf.Trackers) > 0 {
+			torrentSet["trackerAdd"] = []string(cf.Trackers)
+		}
+		if len(torrentSet) > 1 {
+			err = call(d, "torrent-set", torrentSet, nil)
+			if err != nil {
+				return fmt.Errorf("%s: %v", arg, err)
+			}
+		}
+	}
+	if !*cf.Quiet {
+		fmt.Println("Follow the downloads with bitty list")
+	}
+	return nil
+}
+
+// splitSelection turns the indexes of the files to download into the wanted
+// and unwanted files of Transmission
+func splitSelection(selection []int, files int) (wanted, unwanted []int) {
+	selected := map[int]bool{}
+	for _, index := range selection {
+		selected[index] = true
+	}
+	for i := 0; i < files; i++ {
+		if selected[i] {
+			wanted = append(wanted, i)
+		} else {
+			unwanted = append(unwanted, i)
+		}
+	}
+	return wanted, unwanted
+}
+
+// remoteTorrent holds the fields list asks the daemon for
+type remoteTorrent struct {
+	ID             int
+	Name           string
+	Status         int
+	Error          int
+	ErrorString    string
+	IsFinished     bool
+	PercentDone    float64
+	SizeWhenDone   int64
+	RateDownload   float64
+	RateUpload     float64
+	ETA            int64
+	PeersConnected int
+}
+
+var remoteTorrentFields = []string{"id", "name", "status", "error", "errorString", "isFinished",
+	"percentDone", "sizeWhenDone", "rateDownload", "rateUpload", "eta", "peersConnected"}
+
+// state describes a torrent the way the rest of bitty does
+func (t remoteTorrent) state() string {
+	switch {
+	case t.Error != 0:
+		return "failed: " + t.ErrorString
+	case t.Status == 4:
+		return "downloading"
+	case t.Status == 6:
+		return "seeding"
+	case t.IsFinished:
+		return "completed"
+	}
+	return "paused"
+}
+
+// runList prints the torrents of the daemon
+func runList(args []string) error {
+	flags := newFlagSet("list")
+	addr := addRPCFlag(flags)
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	d, err := needDaemon(*addr)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Torrents []remoteTorrent
+	}
+	err = call(d, "torrent-get", map[string]interface{}{"fields": remoteTorrentFields}, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Torrents) == 0 {
+		fmt.Println("No torrents, add one with bitty download")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDone\tSize\tDown\tUp\tETA\tPeers\tState\tName")
+	for _, t := range result.Torrents {
+		eta := "-"
+		if t.ETA > 0 {
+			eta = (time.Duration(t.ETA) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%d\t%.1f%%\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", t.ID, t.PercentDone*100,
+			formatBytes(t.SizeWhenDone), formatRate(t.RateDownload), formatRate(t.RateUpload),
+			eta, t.PeersConnected, t.state(), t.Name)
+	}
+	return w.Flush()
+}
+
+func runPause(args []string) error {
+	return runTorrentAction("pause", "torrent-stop", args)
+}
+
+func runResume(args []string) error {
+	return runTorrentAction("resume", "torrent-start", args)
+}
+
+func runRemove(args []string) error {
+	return runTorrentAction("remove", "torrent-remove", args)
+}
+
+// runTorrentAction runs method on the torrents named by ids or infohashes,
+// all of them for "all"
+func runTorrentAction(name, method string, args []string) error {
+	flags := newFlagSet(name)
+	addr := addRPCFlag(flags)
+	err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	ids, err := parseIDs(flags.Args())
+	if err != nil {
+		return usageFailure(flags, err)
+	}
+	d, err := needDaemon(*addr)
+	if err != nil {
+		return err
+	}
+	callArgs := map[string]interface{}{}
+	if ids != nil {
+		callArgs["ids"] = ids
+	}
+	return call(d, method, callArgs, nil)
+}
+
+// runLimit changes the rate limits of the daemon, or of some of its torrents
+func runLimit(args []string) error {
+	flags := newFlagSet("limit")
+	addr := addRPCFlag(flags)
+	down := flags.String("down", "", "download limit in bytes per second, with an optional K, M or G suffix, 0 for unlimited")
+	up := flags.String("up", "", "upload limit in bytes per second, with an optional K, M or G suffix, 0 for unlimited")
+	err := parseArgs(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if *down == "" && *up == "" {
+		return usageFailure(flags, errors.New("-down or -up is required"))
+	}
+	ids, err := parseIDs(flags.Args())
+	if err != nil {
+		return usageFailure(flags, err)
+	}
+	// The session and torrents name their limits differently
+	method, names := "session-set", [2]string{"speed-limit-down", "speed-limit-up"}
+	enabled := [2]string{"speed-limit-down-enabled", "speed-limit-up-enabled"}
+	callArgs := map[string]interface{}{}
+	if len(flags.Args()) > 0 {
+		method, names = "torrent-set", [2]string{"downloadLimit", "uploadLimit"}
+		enabled = [2]string{"downloadLimited", "uploadLimited"}
+		if ids != nil {
+			callArgs["ids"] = ids
+		}
+	}
+	for i, rate := range []string{*down, *up} {
+		if rate == "" {
+			continue
+		}
+		bytes, err := parseRate(rate)
+		if err != nil {
+			return usageFailure(flags, err)
+		}
+		callArgs[names[i]] = bytes / 1000
+		callArgs[enabled[i]] = bytes > 0
+	}
+	d, err := needDaemon(*addr)
+	if err != nil {
+		return err
+	}
+	return call(d, method, callArgs, nil)
+}
+
+// parseIDs reads torrent ids and infohashes, nil for "all"
+func parseIDs(args []string) ([]interface{}, error) {
+	var ids []interface{}
+	for _, arg := range args {
+		if arg == "all" {
+			return nil, nil
+		}
+		if id, err := strconv.Atoi(strings.TrimPrefix(arg, "#")); err == nil && id > 0 {
+			ids = append(ids, id)
+		} else if len(arg) == 40 && strings.Trim(strings.ToLower(arg), "0123456789abcdef") == "" {
+			ids = append(ids, arg)
+		} else {
+			return nil, fmt.Errorf("Bad torrent id %q", arg)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Client calls a Transmission RPC server, such as the one of a bitty daemon
+type Client struct {
+	URL  string
+	HTTP *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+// NewClient calls the server at addr, an http:// URL or the path of a Unix
+// socket. A URL without a path gets the one of Transmission.
+func NewClient(addr string) *Client {
+	if strings.Contains(addr, "://") {
+		if !strings.Contains(strings.SplitN(addr, "://", 2)[1], "/") {
+			addr += Path
+		}
+		return &Client{URL: addr, HTTP: &http.Client{}}
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		},
+	}
+	return &Client{URL: "http://localhost" + Path, HTTP: &http.Client{Transport: transport}}
+}
+
+// Call runs method with args and decodes the arguments of the answer into
+// result, either can be nil. The session id is fetched on the first call.
+func (c *Client) Call(ctx context.Context, method string, args, result interface{}) error {
+	req := request{Method: method}
+	if args != nil {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		req.Arguments = raw
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for retried := false; ; retried = true {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		c.mu.Lock()
+		httpReq.Header.Set(SessionHeader, c.sessionID)
+		c.mu.Unlock()
+		resp, err := c.HTTP.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusConflict && !retried {
+			resp.Body.Close()
+			c.mu.Lock()
+			c.sessionID = resp.Header.Get(SessionHeader)
+			c.mu.Unlock()
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("RPC server answered %s", resp.Status)
+		}
+		var answer struct {
+			Result    string          `json:"result"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&answer)
+		if err != nil {
+			return err
+		}
+		if answer.Result != "success" {
+			return errors.New(answer.Result)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(answer.Arguments, result)
+	}
+}
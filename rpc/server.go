@@ -0,0 +1,427 @@
+// Package rpc controls a client over HTTP with the Transmission RPC protocol, so
+// the remotes written for Transmission can drive it as well as bitty's own
+// command line.
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laurentlousky/stream/client"
+)
+
+// Path is where Transmission remotes send their requests
+const Path = "/transmission/rpc"
+
+// SessionHeader carries the session id a request has to repeat, so a web page
+// cannot post to the server without first reading a response of its own
+const SessionHeader = "X-Transmission-Session-Id"
+
+const (
+	rpcVersion        = 17
+	rpcVersionMinimum = 14
+	speedBytes        = 1000 // Transmission's limits and rates are in kB
+	recentlyActive    = time.Minute
+)
+
+// request is the body of a call, response the body of its answer. Arguments
+// is always an object, and Result "success" or what went wrong.
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string          `json:"result"`
+	Arguments interface{}     `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// handler runs a method on its raw arguments, local is whether the caller is
+// on this machine
+type handler func(s *Server, args json.RawMessage, local bool) (interface{}, error)
+
+var handlers = map[string]handler{
+	"torrent-add":       (*Server).torrentAdd,
+	"torrent-get":       (*Server).torrentGet,
+	"torrent-set":       (*Server).torrentSet,
+	"torrent-start":     (*Server).torrentStart,
+	"torrent-start-now": (*Server).torrentStart,
+	"torrent-stop":      (*Server).torrentStop,
+	"torrent-remove":    (*Server).torrentRemove,
+	"session-get":       (*Server).sessionGet,
+	"session-set":       (*Server).sessionSet,
+	"session-stats":     (*Server).sessionStats,
+}
+
+// Server answers Transmission RPC requests by running them on a client. It
+// gives torrents the small ids remotes expect, in the order it first sees them.
+type Server struct {
+	Client *client.Client
+	// Username and Password are asked of callers over TCP with HTTP basic auth.
+	// Without a password only callers on this machine are answered. Callers on
+	// the Unix socket are let in by its permissions.
+	Username string
+	Password string
+
+	mu        sync.Mutex
+	entries   map[*client.Torrent]*entry
+	removed   map[int]time.Time // ids of torrents gone from the client
+	nextID    int
+	added     int // torrents added through the server
+	started   time.Time
+	sessionID string
+}
+
+// entry is what the server knows of a torrent besides the client
+type entry struct {
+	ID      int
+	Added   time.Time
+	Torrent *client.Torrent
+}
+
+// NewServer creates a server of the client's torrents
+func NewServer(c *client.Client) *Server {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Server{
+		Client:    c,
+		entries:   map[*client.Torrent]*entry{},
+		removed:   map[int]time.Time{},
+		nextID:    1,
+		started:   time.Now(),
+		sessionID: hex.EncodeToString(id),
+	}
+}
+
+// ServeHTTP answers a single call posted as JSON
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	local, unix := isLocal(r.RemoteAddr)
+	switch {
+	case unix:
+	case s.Password != "":
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bitty"`)
+			http.Error(w, "Wrong username or password", http.StatusUnauthorized)
+			return
+		}
+	case !local:
+		http.Error(w, "Callers on other machines need a password", http.StatusForbidden)
+		return
+	case !allowedHost(r.Host):
+		http.Error(w, "Host is not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get(SessionHeader) != s.sessionID {
+		w.Header().Set(SessionHeader, s.sessionID)
+		http.Error(w, "Missing or stale "+SessionHeader, http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Calls have to be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad request body", http.StatusBadRequest)
+		return
+	}
+	resp := response{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	h, ok := handlers[req.Method]
+	if !ok {
+		resp.Result = fmt.Sprintf("Method %q is not supported", req.Method)
+	} else if args, err := h(s, req.Arguments, local); err != nil {
+		resp.Result = err.Error()
+	} else if args != nil {
+		resp.Arguments = args
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isLocal is whether a caller is on this machine, unix whether it came through
+// a Unix socket, whose callers have no host and port
+func isLocal(remoteAddr string) (local, unix bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return true, true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback(), false
+}
+
+// allowedHost only lets in requests naming the server by IP or as localhost,
+// otherwise DNS rebinding would let a web page reach a daemon on this machine
+// under a name of its own. A password keeps such pages out as well.
+func allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+// decodeArgs reads a method's arguments, which may be left out
+func decodeArgs(raw json.RawMessage, args interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(raw, args)
+	if err != nil {
+		return fmt.Errorf("Bad arguments: %v", err)
+	}
+	return nil
+}
+
+// sync gives ids to the torrents new to the server and forgets the ones the
+// client no longer has, then returns every torrent by id
+func (s *Server) sync() []*entry {
+	torrents := s.Client.Torrents()
+	// Torrents added together come out of the client in any order
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].Name() < torrents[j].Name() })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	current := map[*client.Torrent]bool{}
+	for _, t := range torrents {
+		current[t] = true
+		if s.entries[t] == nil {
+			s.entries[t] = &entry{ID: s.nextID, Added: now, Torrent: t}
+			s.nextID++
+		}
+	}
+	for t, e := range s.entries {
+		if !current[t] {
+			s.removed[e.ID] = now
+			delete(s.entries, t)
+		}
+	}
+	for id, at := range s.removed {
+		if now.Sub(at) > recentlyActive {
+			delete(s.removed, id)
+		}
+	}
+	entries := make([]*entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// selectTorrents finds the torrents of an ids argument: left out for all of
+// them, an id, a list of ids and hex infohashes, or "recently-active". Unknown
+// ids are skipped as Transmission does.
+func (s *Server) selectTorrents(raw json.RawMessage) ([]*entry, error) {
+	entries := s.sync()
+	if len(raw) == 0 || string(raw) == "null" {
+		return entries, nil
+	}
+	var ids []interface{}
+	var one interface{}
+	err := json.Unmarshal(raw, &one)
+	if err != nil {
+		return nil, fmt.Errorf("Bad ids: %v", err)
+	}
+	switch v := one.(type) {
+	case []interface{}:
+		ids = v
+	case string:
+		if v == "recently-active" {
+			return recentlyActiveEntries(entries), nil
+		}
+		ids = []interface{}{v}
+	default:
+		ids = []interface{}{v}
+	}
+	var selected []*entry
+	for _, e := range entries {
+		hash := hashString(e.Torrent)
+		for _, id := range ids {
+			switch id := id.(type) {
+			case float64:
+				if int(id) == e.ID {
+					selected = append(selected, e)
+				}
+			case string:
+				if strings.EqualFold(id, hash) {
+					selected = append(selected, e)
+				}
+			default:
+				return nil, fmt.Errorf("Bad id %v", id)
+			}
+		}
+	}
+	return selected, nil
+}
+
+// recentlyActiveEntries keeps the torrents moving data or added in the last minute
+func recentlyActiveEntries(entries []*entry) []*entry {
+	var active []*entry
+	for _, e := range entries {
+		stats := e.Torrent.Stats()
+		if stats.DownloadRate > 0 || stats.UploadRate > 0 || time.Since(e.Added) < recentlyActive {
+			active = append(active, e)
+		}
+	}
+	return active
+}
+
+// recentlyRemoved lists the ids of the torrents removed in the last minute
+func (s *Server) recentlyRemoved() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []int{}
+	for id := range s.removed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// entryOf returns the entry of a torrent that was just added
+func (s *Server) entryOf(t *client.Torrent) *entry {
+	s.sync()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries[t]
+}
+
+func (s *Server) sessionGet(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	config := s.Client.Config
+	down, up := s.Client.RateLimits()
+	port := 0
+	if _, p, err := net.SplitHostPort(config.ListenAddr); err == nil {
+		fmt.Sscan(p, &port)
+	}
+	session := map[string]interface{}{
+		"version":                  "bitty",
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               s.sessionID,
+		"download-dir":             absDir(config.DataDir),
+		"peer-port":                port,
+		"peer-limit-global":        config.MaxConns,
+		"speed-limit-down":         down / speedBytes,
+		"speed-limit-down-enabled": down > 0,
+		"speed-limit-up":           up / speedBytes,
+		"speed-limit-up-enabled":   up > 0,
+		"start-added-torrents":     true,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  speedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	if args.Fields == nil {
+		return session, nil
+	}
+	selected := map[string]interface{}{}
+	for _, field := range args.Fields {
+		if value, ok := session[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+func (s *Server) sessionSet(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		Down        *int64 `json:"speed-limit-down"`
+		DownEnabled *bool  `json:"speed-limit-down-enabled"`
+		Up          *int64 `json:"speed-limit-up"`
+		UpEnabled   *bool  `json:"speed-limit-up-enabled"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	down, up := s.Client.RateLimits()
+	s.Client.SetRateLimits(setLimit(down, args.Down, args.DownEnabled), setLimit(up, args.Up, args.UpEnabled))
+	return nil, nil
+}
+
+// setLimit applies a Transmission limit in kB/s and its switch to a rate in
+// bytes per second. Zero is unlimited here, so switching a limit on that was
+// never given leaves the rate unlimited.
+func setLimit(rate int64, limit *int64, enabled *bool) int64 {
+	if limit != nil {
+		rate = *limit * speedBytes
+	}
+	if enabled != nil && !*enabled {
+		rate = 0
+	}
+	return rate
+}
+
+func (s *Server) sessionStats(raw json.RawMessage, local bool) (interface{}, error) {
+	entries := s.sync()
+	var active, paused int
+	var down, up float64
+	var downloaded, uploaded int64
+	for _, e := range entries {
+		stats := e.Torrent.Stats()
+		switch stats.State {
+		case client.StatePaused:
+			paused++
+		case client.StateFetchingMetadata, client.StateDownloading, client.StateSeeding:
+			active++
+		}
+		down += stats.DownloadRate
+		up += stats.UploadRate
+		downloaded += stats.Downloaded
+		uploaded += stats.Uploaded
+	}
+	s.mu.Lock()
+	// Nothing outlives the daemon, so the cumulative stats are the current ones
+	current := map[string]interface{}{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      s.added,
+		"sessionCount":    1,
+		"secondsActive":   int64(time.Since(s.started) / time.Second),
+	}
+	s.mu.Unlock()
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(entries),
+		"downloadSpeed":      int64(down),
+		"uploadSpeed":        int64(up),
+		"current-stats":      current,
+		"cumulative-stats":   current,
+	}, nil
+}
+
+// absDir is a directory as remotes show it
+func absDir(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	return abs
+}
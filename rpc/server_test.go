@@ -0,0 +1,249 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// newTestServer serves a client without a listener for peers, and returns the
+// base64 metainfo of a two file torrent it can add
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	c, err := client.New(client.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	ts := httptest.NewServer(NewServer(c))
+	t.Cleanup(ts.Close)
+
+	root := filepath.Join(t.TempDir(), "pair")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "a.txt"), bytes.Repeat([]byte("a"), 40000), 0644)
+	os.WriteFile(filepath.Join(root, "b.txt"), bytes.Repeat([]byte("b"), 20000), 0644)
+	mi, err := peer.CreateTorrent(root, peer.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return ts, base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+type testTorrent struct {
+	ID              int
+	Name            string
+	Status          int
+	TotalSize       int64
+	SizeWhenDone    int64
+	DownloadLimit   int64
+	DownloadLimited bool
+	Wanted          []bool
+	Priorities      []int
+	Files           []struct {
+		Name   string
+		Length int64
+	}
+}
+
+func getTorrents(t *testing.T, c *Client, ids interface{}) []testTorrent {
+	var result struct {
+		Torrents []testTorrent
+	}
+	args := map[string]interface{}{
+		"fields": []string{"id", "name", "status", "totalSize", "sizeWhenDone", "downloadLimit",
+			"downloadLimited", "wanted", "priorities", "files"},
+	}
+	if ids != nil {
+		args["ids"] = ids
+	}
+	if err := c.Call(context.Background(), "torrent-get", args, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Torrents
+}
+
+func TestServerTorrents(t *testing.T) {
+	ts, metainfo := newTestServer(t)
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+
+	var added struct {
+		Added     *testTorrent `json:"torrent-added"`
+		Duplicate *testTorrent `json:"torrent-duplicate"`
+	}
+	args := map[string]interface{}{"metainfo": metainfo, "paused": true, "files-unwanted": []int{1}}
+	if err := c.Call(ctx, "torrent-add", args, &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Added == nil || added.Added.ID != 1 || added.Added.Name != "pair" {
+		t.Fatalf("got %+v", added)
+	}
+	added.Added = nil
+	if err := c.Call(ctx, "torrent-add", args, &added); err != nil || added.Duplicate == nil || added.Duplicate.ID != 1 {
+		t.Errorf("adding again got %+v, %v", added, err)
+	}
+
+	torrents := getTorrents(t, c, []int{1})
+	if len(torrents) != 1 {
+		t.Fatalf("got %d torrents", len(torrents))
+	}
+	got := torrents[0]
+	if got.Status != statusStopped || got.TotalSize != 60000 || got.SizeWhenDone != 40000 ||
+		len(got.Files) != 2 || got.Files[0].Name != "pair/a.txt" || got.Wanted[1] {
+		t.Errorf("got %+v", got)
+	}
+
+	set := map[string]interface{}{"ids": 1, "files-wanted": []int{1}, "priority-high": []int{0},
+		"downloadLimit": 100, "downloadLimited": true}
+	if err := c.Call(ctx, "torrent-set", set, nil); err != nil {
+		t.Fatal(err)
+	}
+	got = getTorrents(t, c, nil)[0]
+	if !got.Wanted[1] || got.Priorities[0] != 1 || got.DownloadLimit != 100 || !got.DownloadLimited {
+		t.Errorf("after torrent-set got %+v", got)
+	}
+	if err := c.Call(ctx, "torrent-set", map[string]interface{}{"files-unwanted": []int{5}}, nil); err == nil {
+		t.Error("a file the torrent does not have was accepted")
+	}
+
+	if err := c.Call(ctx, "torrent-remove", map[string]interface{}{"ids": []int{1}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var active struct {
+		Torrents []testTorrent
+		Removed  []int
+	}
+	args = map[string]interface{}{"ids": "recently-active", "fields": []string{"id"}}
+	if err := c.Call(ctx, "torrent-get", args, &active); err != nil {
+		t.Fatal(err)
+	}
+	if len(active.Torrents) != 0 || len(active.Removed) != 1 || active.Removed[0] != 1 {
+		t.Errorf("after torrent-remove got %+v", active)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	ts, _ := newTestServer(t)
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+	limits := map[string]interface{}{"speed-limit-down": 500, "speed-limit-down-enabled": true}
+	if err := c.Call(ctx, "session-set", limits, nil); err != nil {
+		t.Fatal(err)
+	}
+	var session struct {
+		Version   string
+		Down      int64  `json:"speed-limit-down"`
+		DownOn    bool   `json:"speed-limit-down-enabled"`
+		UpOn      bool   `json:"speed-limit-up-enabled"`
+		SessionID string `json:"session-id"`
+	}
+	if err := c.Call(ctx, "session-get", nil, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Version != "bitty" || session.Down != 500 || !session.DownOn || session.UpOn || session.SessionID == "" {
+		t.Errorf("got %+v", session)
+	}
+	if err := c.Call(ctx, "torrent-verify", nil, nil); err == nil {
+		t.Error("an unsupported method succeeded")
+	}
+}
+
+func TestServerRefusesRequests(t *testing.T) {
+	ts, _ := newTestServer(t)
+	body := `{"method":"session-get"}`
+	resp, err := http.Post(ts.URL+Path, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(SessionHeader) == "" {
+		t.Errorf("without a session id got %s", resp.Status)
+	}
+
+	// A name that is not the server's own could be DNS rebinding
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+Path, bytes.NewBufferString(body))
+	req.Host = "attacker.example"
+	req.Header.Set(SessionHeader, resp.Header.Get(SessionHeader))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("with a foreign host got %s", resp.Status)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	ts, _ := newTestServer(t)
+	s := ts.Config.Handler.(*Server)
+	s.Username, s.Password = "me", "secret"
+	ctx := context.Background()
+	if err := NewClient(ts.URL).Call(ctx, "session-get", nil, nil); err == nil {
+		t.Error("a call without the password was answered")
+	}
+	withAuth := strings.Replace(ts.URL, "http://", "http://me:secret@", 1)
+	if err := NewClient(withAuth).Call(ctx, "session-get", nil, nil); err != nil {
+		t.Errorf("with the password got %v", err)
+	}
+
+	// Another machine may add magnets, not make the daemon read its files
+	body := `{"method":"torrent-add","arguments":{"filename":"/etc/hostname"}}`
+	req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.SetBasicAuth("me", "secret")
+	req.Header.Set(SessionHeader, s.sessionID)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "Only callers on this machine") {
+		t.Errorf("remote torrent-add of a path got %d %s", w.Code, w.Body)
+	}
+
+	s.Password = ""
+	req = httptest.NewRequest(http.MethodPost, Path, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:5000"
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("another machine without a password got %d", w.Code)
+	}
+}
+
+func TestClientOverUnixSocket(t *testing.T) {
+	c, err := client.New(client.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix sockets:", err)
+	}
+	server := &http.Server{Handler: NewServer(c)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	var stats struct {
+		TorrentCount int
+	}
+	if err := NewClient(path).Call(context.Background(), "session-stats", nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.TorrentCount != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
@@ -0,0 +1,573 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// Transmission's torrent status
+const (
+	statusStopped     = 0
+	statusDownloading = 4
+	statusSeeding     = 6
+)
+
+// Transmission's file priorities
+var priorities = map[peer.Priority]int{
+	peer.PriorityNone:   0,
+	peer.PriorityLow:    -1,
+	peer.PriorityNormal: 0,
+	peer.PriorityHigh:   1,
+}
+
+// fileArgs pick the files of a torrent to download and how soon, by index
+type fileArgs struct {
+	Wanted   []int `json:"files-wanted"`
+	Unwanted []int `json:"files-unwanted"`
+	High     []int `json:"priority-high"`
+	Normal   []int `json:"priority-normal"`
+	Low      []int `json:"priority-low"`
+}
+
+// apply hands the priorities to the torrent. Transmission keeps whether a file
+// is wanted apart from its priority, here leaving it out is a priority of its
+// own, so a file wanted again takes the normal priority.
+func (f fileArgs) apply(t *client.Torrent) error {
+	changes := map[int]peer.Priority{}
+	files := t.Files()
+	for _, index := range f.Wanted {
+		if index >= len(files) || !files[index].Wanted {
+			changes[index] = peer.PriorityNormal
+		}
+	}
+	for p, indexes := range map[peer.Priority][]int{peer.PriorityHigh: f.High, peer.PriorityNormal: f.Normal, peer.PriorityLow: f.Low} {
+		for _, index := range indexes {
+			changes[index] = p
+		}
+	}
+	for _, index := range f.Unwanted {
+		changes[index] = peer.PriorityNone
+	}
+	for index := range changes {
+		if index < 0 || len(files) > 0 && index >= len(files) {
+			return fmt.Errorf("Torrent has no file %d", index)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return t.SetFilePriorities(changes)
+}
+
+func (s *Server) torrentAdd(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		fileArgs
+		Filename    string `json:"filename"`
+		Metainfo    string `json:"metainfo"`
+		DownloadDir string `json:"download-dir"`
+		Paused      bool   `json:"paused"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if args.DownloadDir != "" && absDir(args.DownloadDir) != absDir(s.Client.Config.DataDir) {
+		return nil, fmt.Errorf("Torrents are saved in %s, download-dir cannot be changed", absDir(s.Client.Config.DataDir))
+	}
+	var m magneturi.MagnetURI
+	var mi *peer.MetaInfo
+	switch {
+	case args.Metainfo != "":
+		data, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, errors.New("Metainfo is not base64")
+		}
+		mi, err = peer.ReadTorrentFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		m, err = magneturi.Parse(args.Filename)
+		if err != nil {
+			return nil, err
+		}
+	case strings.Contains(args.Filename, "://"):
+		return nil, errors.New("Torrents cannot be fetched from URLs, send the metainfo")
+	case args.Filename != "" && !local:
+		// Other machines have no business with the daemon's files
+		return nil, errors.New("Only callers on this machine can add .torrent paths, send the metainfo")
+	case args.Filename != "":
+		f, err := os.Open(args.Filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		mi, err = peer.ReadTorrentFile(f)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Filename or metainfo is required")
+	}
+	if mi != nil {
+		m = magneturi.FromTorrent(mi)
+	}
+	if t := s.Client.Torrent(m.InfoHash); t != nil {
+		return map[string]interface{}{"torrent-duplicate": addedFields(s.entryOf(t))}, nil
+	}
+
+	var t *client.Torrent
+	if mi != nil {
+		t, err = s.Client.AddTorrent(mi)
+	} else {
+		t, err = s.Client.AddMagnet(args.Filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.added++
+	s.mu.Unlock()
+	err = args.fileArgs.apply(t)
+	if err == nil && !args.Paused {
+		err = t.Start()
+	}
+	if err != nil {
+		t.Stop()
+		return nil, err
+	}
+	return map[string]interface{}{"torrent-added": addedFields(s.entryOf(t))}, nil
+}
+
+func addedFields(e *entry) map[string]interface{} {
+	if e == nil {
+		// Removed in the meantime
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"id":         e.ID,
+		"name":       e.Torrent.Name(),
+		"hashString": hashString(e.Torrent),
+	}
+}
+
+func (s *Server) torrentSet(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		fileArgs
+		IDs             json.RawMessage `json:"ids"`
+		DownloadLimit   *int64          `json:"downloadLimit"`
+		DownloadLimited *bool           `json:"downloadLimited"`
+		UploadLimit     *int64          `json:"uploadLimit"`
+		UploadLimited   *bool           `json:"uploadLimited"`
+		TrackerAdd      []string        `json:"trackerAdd"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.selectTorrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		t := e.Torrent
+		down, up := t.RateLimits()
+		t.SetRateLimits(setLimit(down, args.DownloadLimit, args.DownloadLimited),
+			setLimit(up, args.UploadLimit, args.UploadLimited))
+		if len(args.TrackerAdd) > 0 {
+			err = addTrackers(t, args.TrackerAdd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = args.fileArgs.apply(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// addTrackers pauses a running torrent for the trackers to be added
+func addTrackers(t *client.Torrent, trackers []string) error {
+	state := t.Stats().State
+	running := state == client.StateFetchingMetadata || state == client.StateDownloading || state == client.StateSeeding
+	if running {
+		t.Pause()
+	}
+	err := t.AddTrackers(trackers)
+	if running {
+		if startErr := t.Start(); err == nil {
+			err = startErr
+		}
+	}
+	return err
+}
+
+func (s *Server) torrentStart(raw json.RawMessage, local bool) (interface{}, error) {
+	return nil, s.eachTorrent(raw, func(t *client.Torrent) error {
+		if t.Err() != nil {
+			// Finished, there is nothing left to run
+			return nil
+		}
+		return t.Start()
+	})
+}
+
+func (s *Server) torrentStop(raw json.RawMessage, local bool) (interface{}, error) {
+	return nil, s.eachTorrent(raw, func(t *client.Torrent) error {
+		t.Pause()
+		return nil
+	})
+}
+
+func (s *Server) torrentRemove(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if args.DeleteLocalData {
+		return nil, errors.New("Downloaded data cannot be deleted over RPC")
+	}
+	return nil, s.eachTorrent(raw, func(t *client.Torrent) error {
+		t.Stop()
+		return nil
+	})
+}
+
+// eachTorrent runs fn on the torrents of the ids argument at once, pausing
+// has to wait for a torrent's announces, and returns the first error
+func (s *Server) eachTorrent(raw json.RawMessage, fn func(t *client.Torrent) error) error {
+	var args struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return err
+	}
+	entries, err := s.selectTorrents(args.IDs)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, t *client.Torrent) {
+			defer wg.Done()
+			errs[i] = fn(t)
+		}(i, e.Torrent)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %v", entries[i].Torrent.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) torrentGet(raw json.RawMessage, local bool) (interface{}, error) {
+	var args struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+		Format string          `json:"format"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("Fields are required")
+	}
+	entries, err := s.selectTorrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	if string(args.IDs) == `"recently-active"` {
+		result["removed"] = s.recentlyRemoved()
+	}
+	switch args.Format {
+	case "", "objects":
+		torrents := []map[string]interface{}{}
+		for _, e := range entries {
+			torrents = append(torrents, s.torrentFields(e, args.Fields))
+		}
+		result["torrents"] = torrents
+	case "table":
+		// The first row names the fields, every torrent has a row of values after it
+		var names []interface{}
+		for _, field := range args.Fields {
+			names = append(names, field)
+		}
+		table := [][]interface{}{names}
+		for _, e := range entries {
+			values := s.torrentFields(e, args.Fields)
+			row := make([]interface{}, len(args.Fields))
+			for i, field := range args.Fields {
+				row[i] = values[field]
+			}
+			table = append(table, row)
+		}
+		result["torrents"] = table
+	default:
+		return nil, fmt.Errorf("Unknown format %q", args.Format)
+	}
+	return result, nil
+}
+
+// torrentFields looks up the fields of a torrent that are known here, the
+// others are left out
+func (s *Server) torrentFields(e *entry, fields []string) map[string]interface{} {
+	t := e.Torrent
+	stats := t.Stats()
+	// Stats only counts bytes once the torrent has run, the files know them before
+	var total, done, wanted, wantedDone int64
+	for _, f := range stats.Files {
+		total += f.Length
+		done += f.Completed
+		if f.Wanted && !f.Padding {
+			wanted += f.Length
+			wantedDone += f.Completed
+		}
+	}
+	values := map[string]interface{}{}
+	for _, field := range fields {
+		var value interface{}
+		switch field {
+		case "id":
+			value = e.ID
+		case "name":
+			value = t.Name()
+		case "hashString":
+			value = hashString(t)
+		case "addedDate":
+			value = e.Added.Unix()
+		case "status":
+			value = status(stats.State)
+		case "error":
+			value = 0
+			if stats.State == client.StateFailed {
+				value = 3 // a local error rather than one of a tracker
+			}
+		case "errorString":
+			value = ""
+			if err := t.Err(); err != nil && stats.State == client.StateFailed {
+				value = err.Error()
+			}
+		case "isFinished":
+			value = stats.State == client.StateCompleted
+		case "totalSize":
+			value = total
+		case "sizeWhenDone":
+			value = wanted
+		case "leftUntilDone":
+			value = wanted - wantedDone
+		case "haveValid":
+			value = done
+		case "percentDone":
+			value = ratio(wantedDone, wanted)
+		case "percentComplete":
+			value = ratio(done, total)
+		case "metadataPercentComplete":
+			value = 0.0
+			if len(stats.Files) > 0 {
+				value = 1.0
+			}
+		case "downloadedEver":
+			value = stats.Downloaded
+		case "uploadedEver":
+			value = stats.Uploaded
+		case "uploadRatio":
+			value = -1.0
+			if stats.Downloaded > 0 {
+				value = float64(stats.Uploaded) / float64(stats.Downloaded)
+			}
+		case "rateDownload":
+			value = int64(stats.DownloadRate)
+		case "rateUpload":
+			value = int64(stats.UploadRate)
+		case "eta":
+			value = int64(-1)
+			if stats.ETA > 0 {
+				value = int64(stats.ETA / time.Second)
+			}
+		case "peersConnected":
+			value = stats.Peers
+		case "peersSendingToUs", "peersGettingFromUs":
+			n := 0
+			for _, p := range t.Peers() {
+				if field == "peersSendingToUs" && p.DownloadRate > 0 || field == "peersGettingFromUs" && p.UploadRate > 0 {
+					n++
+				}
+			}
+			value = n
+		case "peers":
+			value = peerFields(t.Peers(), stats.Pieces)
+		case "downloadDir":
+			value = absDir(s.Client.Config.DataDir)
+		case "downloadLimit", "downloadLimited", "uploadLimit", "uploadLimited":
+			down, up := t.RateLimits()
+			rate := down
+			if strings.HasPrefix(field, "upload") {
+				rate = up
+			}
+			value = rate / speedBytes
+			if strings.HasSuffix(field, "Limited") {
+				value = rate > 0
+			}
+		case "magnetLink":
+			value = t.MagnetLink()
+		case "pieceCount":
+			value = stats.Pieces
+		case "pieces":
+			value = base64.StdEncoding.EncodeToString(t.Pieces().Bytes())
+		case "files", "fileStats", "wanted", "priorities":
+			value = fileFields(field, stats.Files)
+		case "trackers", "trackerStats":
+			value = trackerFields(field, t.Trackers())
+		default:
+			continue
+		}
+		values[field] = value
+	}
+	return values
+}
+
+func status(state client.State) int {
+	switch state {
+	case client.StateFetchingMetadata, client.StateDownloading:
+		return statusDownloading
+	case client.StateSeeding:
+		return statusSeeding
+	}
+	return statusStopped
+}
+
+func ratio(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// fileFields lists one of the per file fields, padding files included so the
+// indexes stay those of torrent-set
+func fileFields(field string, files []client.File) []interface{} {
+	values := []interface{}{}
+	for _, f := range files {
+		switch field {
+		case "files":
+			values = append(values, map[string]interface{}{
+				"name":           f.Path,
+				"length":         f.Length,
+				"bytesCompleted": f.Completed,
+			})
+		case "fileStats":
+			values = append(values, map[string]interface{}{
+				"bytesCompleted": f.Completed,
+				"wanted":         f.Wanted,
+				"priority":       priorities[f.Priority],
+			})
+		case "wanted":
+			values = append(values, f.Wanted)
+		case "priorities":
+			values = append(values, priorities[f.Priority])
+		}
+	}
+	return values
+}
+
+func trackerFields(field string, trackers []client.TrackerStatus) []interface{} {
+	values := []interface{}{}
+	for i, tracker := range trackers {
+		announce := tracker.URL
+		if !strings.Contains(announce, "://") {
+			// UDP trackers are kept as host:port
+			announce = "udp://" + announce + "/announce"
+		}
+		fields := map[string]interface{}{"id": i, "tier": i, "announce": announce}
+		if field == "trackerStats" {
+			result := "Success"
+			if tracker.Err != nil {
+				result = tracker.Err.Error()
+			}
+			fields["host"] = tracker.URL
+			fields["hasAnnounced"] = !tracker.Announced.IsZero()
+			fields["lastAnnounceTime"] = tracker.Announced.Unix()
+			fields["lastAnnounceSucceeded"] = !tracker.Announced.IsZero() && tracker.Err == nil
+			fields["lastAnnounceResult"] = result
+			fields["lastAnnouncePeerCount"] = tracker.Peers
+			fields["seederCount"] = tracker.Seeders
+			fields["leecherCount"] = tracker.Leechers
+			if tracker.Announced.IsZero() {
+				fields["lastAnnounceTime"] = 0
+				fields["lastAnnounceResult"] = ""
+			}
+		}
+		values = append(values, fields)
+	}
+	return values
+}
+
+// peerFields describes the connected peers, flagStr uses Transmission's letters:
+// D downloading from the peer, d it would send but we are not interested, U
+// uploading to it, u it is interested but choked, I it connected to us
+func peerFields(peers []peer.PeerStats, pieces int) []interface{} {
+	values := []interface{}{}
+	for _, p := range peers {
+		var flags string
+		switch {
+		case !p.Choked && p.DownloadRate > 0:
+			flags += "D"
+		case !p.Choked:
+			flags += "d"
+		}
+		switch {
+		case !p.Choking && p.PeerInterested:
+			flags += "U"
+		case p.PeerInterested:
+			flags += "u"
+		}
+		if p.Incoming {
+			flags += "I"
+		}
+		values = append(values, map[string]interface{}{
+			"address":           p.Peer.IP.String(),
+			"port":              p.Peer.Port,
+			"flagStr":           flags,
+			"isIncoming":        p.Incoming,
+			"clientIsChoked":    p.Choked,
+			"peerIsChoked":      p.Choking,
+			"peerIsInterested":  p.PeerInterested,
+			"isDownloadingFrom": !p.Choked && p.DownloadRate > 0,
+			"isUploadingTo":     !p.Choking && p.UploadRate > 0,
+			"progress":          ratio(int64(p.Pieces), int64(pieces)),
+			"rateToClient":      int64(p.DownloadRate),
+			"rateToPeer":        int64(p.UploadRate),
+		})
+	}
+	return values
+}
+
+// hashString is the infohash in hex, as remotes name torrents
+func hashString(t *client.Torrent) string {
+	infoHash := t.InfoHash()
+	return hex.EncodeToString(infoHash[:])
+}
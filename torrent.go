@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/laurentlousky/stream/magneturi"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// runInfo prints what a magnet link or a .torrent holds
+func runInfo(args []string) error {
+	flags := newFlagSet("info")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	m, mi, err := readMagnet(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if mi == nil {
+		fmt.Fprintf(w, "Name:\t%s\n", m.Name)
+		fmt.Fprintf(w, "Info hash:\t%x\n", m.InfoHash)
+		if m.InfoHashV2 != [32]byte{} {
+			fmt.Fprintf(w, "Info hash v2:\t%x\n", m.InfoHashV2)
+		}
+		printList(w, "Trackers:", m.Trackers)
+		printList(w, "Web seeds:", m.WebSeeds)
+		return w.Flush()
+	}
+	info := &mi.Info
+	files := info.FileList()
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Info hash:\t%x\n", mi.InfoHash)
+	if mi.InfoHashV2 != [32]byte{} {
+		fmt.Fprintf(w, "Info hash v2:\t%x\n", mi.InfoHashV2)
+	}
+	fmt.Fprintf(w, "Size:\t%s in %d files\n", formatBytes(info.TotalLength()), len(files))
+	fmt.Fprintf(w, "Pieces:\t%d of %s\n", info.NumPieces(), formatBytes(int64(info.PieceLength)))
+	if info.Private != 0 {
+		fmt.Fprintf(w, "Private:\tyes\n")
+	}
+	if info.Source != "" {
+		fmt.Fprintf(w, "Source:\t%s\n", info.Source)
+	}
+	if mi.Comment != "" {
+		fmt.Fprintf(w, "Comment:\t%s\n", mi.Comment)
+	}
+	if mi.CreatedBy != "" {
+		fmt.Fprintf(w, "Created by:\t%s\n", mi.CreatedBy)
+	}
+	if mi.CreationDate != 0 {
+		fmt.Fprintf(w, "Created:\t%s\n", time.Unix(mi.CreationDate, 0).Format(time.RFC1123))
+	}
+	printList(w, "Trackers:", mi.Trackers())
+	printList(w, "Web seeds:", mi.URLList)
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// The indexes are the ones download -files takes, padding files keep theirs
+	fmt.Println("\nFiles:")
+	for i, file := range files {
+		if file.Padding() {
+			continue
+		}
+		fmt.Printf("%4d  %10s  %s\n", i, formatBytes(file.Length), strings.Join(file.Path, "/"))
+	}
+	return nil
+}
+
+// printList prints a field of several values, one per line
+func printList(w *tabwriter.Writer, name string, values []string) {
+	for _, value := range values {
+		fmt.Fprintf(w, "%s\t%s\n", name, value)
+		name = ""
+	}
+}
+
+// runMagnet prints the magnet link of a .torrent
+func runMagnet(args []string) error {
+	flags := newFlagSet("magnet")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	mi, err := readTorrentFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(magneturi.FromTorrent(mi).String())
+	return nil
+}
+
+// runCreate writes a .torrent for a file or directory and prints its magnet link
+func runCreate(args []string) error {
+	flags := newFlagSet("create")
+	var trackers, webSeeds stringList
+	flags.Var(&trackers, "t", "tracker announce URL, can be repeated")
+	flags.Var(&webSeeds, "w", "web seed URL, can be repeated")
+	output := flags.String("o", "", "output .torrent path (default <name>.torrent)")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes (default chosen from the size)")
+	private := flags.Bool("private", false, "set the private flag")
+	comment := flags.String("comment", "", "torrent comment")
+	source := flags.String("source", "", "source tag, changes the infohash")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	mi, err := peer.CreateTorrent(flags.Arg(0), peer.CreateOptions{
+		PieceLength: *pieceLength,
+		Trackers:    trackers,
+		WebSeeds:    webSeeds,
+		Private:     *private,
+		Comment:     *comment,
+		Source:      *source,
+	})
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = mi.Info.Name + ".torrent"
+	}
+	err = writeTorrentFile(mi, *output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s \n", *output)
+	fmt.Println(magneturi.FromTorrent(mi).String())
+	return nil
+}
+
+// runVerify checks downloaded data against the hashes of its .torrent, the
+// pieces that match are kept for the next download or seed
+func runVerify(args []string) error {
+	flags := newFlagSet("verify")
+	dir := flags.String("o", "downloads", "directory the torrent was saved in")
+	verbose := flags.Bool("v", false, "list every piece that is missing or corrupt")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	mi, err := readTorrentFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Checking would create the directory
+	_, err = os.Stat(*dir)
+	if err != nil {
+		return err
+	}
+	onPiece := func(index int, ok bool) {
+		if !ok && *verbose {
+			fmt.Printf("Piece #%d is missing or corrupt \n", index)
+		}
+	}
+	have, err := peer.VerifyStorage(&mi.Info, mi.InfoHash, peer.NewFileStorage(*dir), onPiece)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d of %d pieces are good \n", have.Count(), have.Len())
+	if have.Count() < have.Len() {
+		return fmt.Errorf("%d pieces are missing or corrupt", have.Len()-have.Count())
+	}
+	return nil
+}
+
+// checkPieces hashes the data of a torrent under dir before it is seeded, with
+// a progress line on a terminal
+func checkPieces(mi *peer.MetaInfo, dir string, quiet bool) error {
+	live := !quiet && isTerminal(os.Stdout)
+	onPiece := func(index int, ok bool) {
+		if live {
+			fmt.Printf("\r\x1b[KChecking piece %d of %d", index+1, mi.Info.NumPieces())
+		}
+	}
+	have, err := peer.VerifyStorage(&mi.Info, mi.InfoHash, peer.NewFileStorage(dir), onPiece)
+	if live {
+		fmt.Print("\r\x1b[K")
+	}
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("%d of %d pieces are already there \n", have.Count(), have.Len())
+	}
+	return nil
+}
+
+// runScrape prints what each tracker of a torrent knows about its swarm
+func runScrape(args []string) error {
+	flags := newFlagSet("scrape")
+	var trackers stringList
+	flags.Var(&trackers, "t", "tracker announce URL to ask as well, can be repeated")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for the trackers")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	m, _, err := readMagnet(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	m.AddTrackers(trackers...)
+	if len(m.Trackers) == 0 {
+		return errors.New("Torrent has no trackers, add one with -t")
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	answered := 0
+	for _, result := range m.Scrape(ctx) {
+		if result.Err != nil {
+			fmt.Printf("%s: %v \n", result.Tracker, result.Err)
+			continue
+		}
+		answered++
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed \n",
+			result.Tracker, result.Seeders, result.Leechers, result.Completed)
+	}
+	if answered == 0 {
+		return errors.New("No tracker answered")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/laurentlousky/stream/magneturi"
+)
+
+// runTracker serves a UDP and HTTP tracker until one of the listeners fails
+func runTracker(args []string) error {
+	flags := newFlagSet("tracker")
+	udpAddr := flags.String("udp", ":6969", "UDP listen address, empty to disable")
+	httpAddr := flags.String("http", ":6969", "HTTP listen address, empty to disable")
+	interval := flags.Duration("interval", 30*time.Minute, "announce interval handed to peers")
+	allowFile := flags.String("allow", "", "file of hex infohashes to track, one per line")
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	var allowList [][20]byte
+	if *allowFile != "" {
+		allowList, err = readAllowList(*allowFile)
+		if err != nil {
+			return err
+		}
+	}
+	tracker := magneturi.NewTrackerServer(allowList)
+	tracker.Interval = *interval
+	tracker.PeerTimeout = 2 * *interval
+
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Tracker listening on udp %s \n", conn.LocalAddr())
+		go func() { errs <- tracker.ServeUDP(conn) }()
+	}
+	if *httpAddr != "" {
+		listener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Tracker listening on http %s \n", listener.Addr())
+		go func() { errs <- http.Serve(listener, tracker) }()
+	}
+	return <-errs
+}
+
+func readAllowList(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var allowList [][20]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("Invalid infohash %q in %s", line, path)
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], b)
+		allowList = append(allowList, infoHash)
+	}
+	return allowList, scanner.Err()
+}
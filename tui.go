@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/peer"
+)
+
+// The tabs of a torrent's details
+const (
+	tabFiles = iota
+	tabPeers
+	tabTrackers
+	tabPieces
+)
+
+var tabNames = []string{"Files", "Peers", "Trackers", "Pieces"}
+
+// tui is an interactive view of a client's torrents. It is only touched by the
+// goroutine running runTUI, slow calls into the client go to other goroutines
+// and report back through Notices.
+type tui struct {
+	Client   *client.Client
+	Torrents []*client.Torrent // in the order they were added
+	Width    int
+	Height   int
+	Selected int  // index in Torrents
+	Detail   bool // showing the selected torrent rather than the list
+	Tab      int
+	Cursor   int // row of the files tab
+	Scroll   int // first line of the detail tab shown
+	Status   string
+	Input    *string // what was typed at the add prompt, nil when not adding
+	Confirm  bool    // asked whether to remove the selected torrent
+	Notices  chan string
+	Quit     bool
+}
+
+// runTUI manages torrents in an interactive terminal UI until q is pressed
+func runTUI(args []string) error {
+	flags := newFlagSet("tui")
+	dir := flags.String("o", "downloads", "directory to save the torrents in")
+	seed := flags.Bool("seed", false, "keep seeding torrents once downloaded")
+	cf := addClientFlags(flags)
+	err := parseArgs(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !isTerminal(os.Stdout) {
+		return errors.New("The TUI needs a terminal, use download instead")
+	}
+	c, err := cf.newClient(flags, *dir, *seed)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	u := &tui{Client: c, Notices: make(chan string, 16)}
+	for _, arg := range flags.Args() {
+		u.add(arg, cf.Trackers)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	out := bufio.NewWriter(os.Stdout)
+	// The alternate screen leaves the shell's scrollback as it was
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		// Closing the client below tells the trackers, which takes a moment
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049lStopping torrents...\r\n")
+		out.Flush()
+	}()
+
+	keys := make(chan []string)
+	go readKeys(os.Stdin, keys)
+	events, unsubscribe := c.Subscribe(256)
+	defer unsubscribe()
+	ctx, stop := interruptContext()
+	defer stop()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for !u.Quit {
+		u.Width, u.Height, err = term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			u.Width, u.Height = 80, 24
+		}
+		u.draw(out)
+		select {
+		case pressed := <-keys:
+			for _, key := range pressed {
+				u.handleKey(key, cf.Trackers)
+			}
+		case e := <-events:
+			if line := describeEvent(e, false); line != "" {
+				u.Status = e.Torrent.Name() + ": " + line
+			}
+			if e.Type == peer.EventStateChanged && e.State == client.StateFailed {
+				u.Status = e.Torrent.Name() + ": " + fmt.Sprint(e.Torrent.Wait(context.Background()))
+			}
+		case notice := <-u.Notices:
+			u.Status = notice
+		case <-ticker.C:
+		case <-ctx.Done():
+			u.Quit = true
+		}
+	}
+	return nil
+}
+
+// readKeys sends the keys read from the terminal, a read at a time so a paste
+// is handled at once
+func readKeys(f *os.File, keys chan<- []string) {
+	buf := make([]byte, 256)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		keys <- parseKeys(string(buf[:n]))
+	}
+}
+
+// parseKeys splits terminal input into keys, escape sequences are named
+func parseKeys(s string) []string {
+	sequences := map[string]string{
+		"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+		"\x1bOA": "up", "\x1bOB": "down", "\x1bOC": "right", "\x1bOD": "left",
+		"\x1b[5~": "pgup", "\x1b[6~": "pgdown", "\x1b[Z": "backtab",
+	}
+	names := map[rune]string{'\r': "enter", '\n': "enter", '\t': "tab", 0x7f: "backspace", 0x08: "backspace", 0x03: "ctrl-c", 0x1b: "esc"}
+	var keys []string
+	for len(s) > 0 {
+		matched := false
+		for seq, name := range sequences {
+			if strings.HasPrefix(s, seq) {
+				keys = append(keys, name)
+				s = s[len(seq):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		r := []rune(s)[0]
+		if name, ok := names[r]; ok {
+			keys = append(keys, name)
+		} else {
+			keys = append(keys, string(r))
+		}
+		s = s[len(string(r)):]
+	}
+	return keys
+}
+
+// add adds and starts a torrent, reporting a failure on the status line
+func (u *tui) add(arg string, trackers []string) {
+	t, err := addTorrent(u.Client, arg)
+	if err != nil {
+		u.Status = fmt.Sprintf("%s: %v", arg, err)
+		return
+	}
+	t.AddTrackers(trackers)
+	t.Start()
+	u.Torrents = append(u.Torrents, t)
+	u.Selected = len(u.Torrents) - 1
+	u.Status = "Added " + t.Name()
+}
+
+// async runs a call that may block, such as pausing a torrent which waits for
+// its trackers, reporting its error if any
+func (u *tui) async(what string, f func() error) {
+	go func() {
+		err := f()
+		if err != nil {
+			u.Notices <- fmt.Sprintf("%s: %v", what, err)
+		}
+	}()
+}
+
+func (u *tui) selected() *client.Torrent {
+	if u.Selected < 0 || u.Selected >= len(u.Torrents) {
+		return nil
+	}
+	return u.Torrents[u.Selected]
+}
+
+func (u *tui) handleKey(key string, trackers []string) {
+	if u.Input != nil {
+		switch key {
+		case "enter":
+			if *u.Input != "" {
+				u.add(*u.Input, trackers)
+			}
+			u.Input = nil
+		case "esc", "ctrl-c":
+			u.Input = nil
+			u.Status = ""
+		case "backspace":
+			if r := []rune(*u.Input); len(r) > 0 {
+				*u.Input = string(r[:len(r)-1])
+			}
+		default:
+			if len([]rune(key)) == 1 {
+				*u.Input += key
+			}
+		}
+		return
+	}
+	t := u.selected()
+	if u.Confirm {
+		u.Confirm = false
+		u.Status = ""
+		if key == "y" && t != nil {
+			u.remove(t)
+		}
+		return
+	}
+	switch key {
+	case "q", "ctrl-c":
+		u.Quit = true
+	case "a":
+		u.Input = new(string)
+	case "p", " ":
+		if t == nil || u.Detail && u.Tab == tabFiles && key == " " {
+			break
+		}
+		if t.Stats().State == client.StatePaused {
+			u.async(t.Name(), t.Start)
+		} else {
+			u.async(t.Name(), func() error { t.Pause(); return nil })
+		}
+	case "r":
+		if t != nil {
+			u.Confirm = true
+			u.Status = fmt.Sprintf("Remove %s? The data stays on disk (y/n)", t.Name())
+		}
+	}
+	if u.Detail {
+		u.handleDetailKey(key, t)
+		return
+	}
+	switch key {
+	case "up", "k":
+		if u.Selected > 0 {
+			u.Selected--
+		}
+	case "down", "j":
+		if u.Selected < len(u.Torrents)-1 {
+			u.Selected++
+		}
+	case "enter", "right", "l":
+		if t != nil {
+			u.Detail, u.Tab, u.Cursor, u.Scroll = true, tabFiles, 0, 0
+		}
+	}
+}
+
+func (u *tui) handleDetailKey(key string, t *client.Torrent) {
+	if t == nil {
+		u.Detail = false
+		return
+	}
+	switch key {
+	case "esc", "backspace", "left", "h":
+		u.Detail = false
+	case "tab":
+		u.Tab, u.Scroll = (u.Tab+1)%len(tabNames), 0
+	case "backtab":
+		u.Tab, u.Scroll = (u.Tab+len(tabNames)-1)%len(tabNames), 0
+	case "1", "2", "3", "4":
+		u.Tab, u.Scroll = int(key[0]-'1'), 0
+	case "up", "k":
+		if u.Tab == tabFiles && u.Cursor > 0 {
+			u.Cursor--
+		} else if u.Tab != tabFiles && u.Scroll > 0 {
+			u.Scroll--
+		}
+	case "down", "j":
+		if u.Tab == tabFiles {
+			u.Cursor++
+		} else {
+			u.Scroll++
+		}
+	case "pgup":
+		u.Cursor, u.Scroll = u.Cursor-u.pageSize(), u.Scroll-u.pageSize()
+	case "pgdown":
+		u.Cursor, u.Scroll = u.Cursor+u.pageSize(), u.Scroll+u.pageSize()
+	case "+", "=", "-", " ":
+		files := t.Files()
+		rows := fileRows(files)
+		if u.Tab != tabFiles || u.Cursor >= len(rows) {
+			break
+		}
+		index := rows[u.Cursor]
+		priority := files[index].Priority
+		switch {
+		case key == " " && priority == peer.PriorityNone:
+			priority = peer.PriorityNormal
+		case key == " ":
+			priority = peer.PriorityNone
+		case key == "-" && priority > peer.PriorityNone:
+			priority--
+		case key != "-" && priority < peer.PriorityHigh:
+			priority++
+		}
+		u.Status = fmt.Sprintf("%s set to %s", files[index].Path, priority)
+		u.async(t.Name(), func() error { return t.SetFilePriority(index, priority) })
+	}
+	if u.Cursor < 0 {
+		u.Cursor = 0
+	}
+	if u.Scroll < 0 {
+		u.Scroll = 0
+	}
+}
+
+// remove stops a torrent and drops it from the list
+func (u *tui) remove(t *client.Torrent) {
+	for i, other := range u.Torrents {
+		if other == t {
+			u.Torrents = append(u.Torrents[:i], u.Torrents[i+1:]...)
+		}
+	}
+	if u.Selected >= len(u.Torrents) {
+		u.Selected = len(u.Torrents) - 1
+	}
+	u.Detail = false
+	u.Status = "Removed " + t.Name()
+	u.async(t.Name(), func() error { t.Stop(); return nil })
+}
+
+// pageSize is how many lines of a detail tab fit on the screen
+func (u *tui) pageSize() int {
+	if n := u.Height - 6; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// draw redraws the whole screen
+func (u *tui) draw(out *bufio.Writer) {
+	lines := u.render()
+	fmt.Fprint(out, "\x1b[H")
+	for i, line := range lines {
+		if i >= u.Height {
+			break
+		}
+		if i > 0 {
+			fmt.Fprint(out, "\r\n")
+		}
+		fmt.Fprint(out, fit(line, u.Width), "\x1b[K")
+	}
+	fmt.Fprint(out, "\x1b[J")
+	out.Flush()
+}
+
+// render lays out the screen, a footer of status and keys at the bottom
+func (u *tui) render() []string {
+	var body []string
+	var keys string
+	if t := u.selected(); u.Detail && t != nil {
+		body = u.renderDetail(t)
+		keys = "tab switch  ↑↓ scroll  +/- priority  space skip  p pause/resume  r remove  esc back  q quit"
+	} else {
+		body = u.renderList()
+		keys = "↑↓ select  enter details  a add  p pause/resume  r remove  q quit"
+	}
+	height := u.Height - 2
+	if height < 0 {
+		height = 0
+	}
+	for len(body) < height {
+		body = append(body, "")
+	}
+	status := u.Status
+	if u.Input != nil {
+		status = "Add magnet or .torrent: " + *u.Input + "█"
+	}
+	return append(body[:height], status, "\x1b[7m"+fit(keys, u.Width)+"\x1b[0m")
+}
+
+// renderList shows a line per torrent, the selected one highlighted
+func (u *tui) renderList() []string {
+	var down, up float64
+	lines := []string{"", fmt.Sprintf("  %-24s %-19s %10s %10s %8s %7s  %s",
+		"Name", "Progress", "Down", "Up", "ETA", "Peers", "State")}
+	for i, t := range u.Torrents {
+		stats := t.Stats()
+		down += stats.DownloadRate
+		up += stats.UploadRate
+		wanted, completed := wantedBytes(stats.Files)
+		line := fmt.Sprintf("  %-24.24s %s %10s %10s %8s %7s  %s", t.Name(),
+			progressCell(completed, wanted), formatRate(stats.DownloadRate), formatRate(stats.UploadRate),
+			formatETA(stats), fmt.Sprintf("%d/%d", stats.Peers, stats.KnownPeers), stats.State)
+		if i == u.Selected {
+			line = "\x1b[7m" + fit(line, u.Width) + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	lines[0] = fmt.Sprintf("bitty  %d torrents  ↓ %s  ↑ %s", len(u.Torrents), formatRate(down), formatRate(up))
+	if len(u.Torrents) == 0 {
+		lines = append(lines, "", "  No torrents, press a to add a magnet link or a .torrent file")
+	}
+	return lines
+}
+
+// renderDetail shows a torrent's summary, the tab bar and the current tab
+func (u *tui) renderDetail(t *client.Torrent) []string {
+	stats := t.Stats()
+	wanted, completed := wantedBytes(stats.Files)
+	lines := []string{
+		fmt.Sprintf("%s  %s  %s of %s  ↓ %s  ↑ %s  ETA %s  %d/%d peers", t.Name(), stats.State,
+			strings.TrimSpace(progressCell(completed, wanted)), formatBytes(wanted),
+			formatRate(stats.DownloadRate), formatRate(stats.UploadRate), formatETA(stats), stats.Peers, stats.KnownPeers),
+	}
+	var bar []string
+	for i, name := range tabNames {
+		if i == u.Tab {
+			name = "\x1b[7m " + name + " \x1b[0m"
+		} else {
+			name = " " + name + " "
+		}
+		bar = append(bar, fmt.Sprintf("%d%s", i+1, name))
+	}
+	lines = append(lines, strings.Join(bar, "  "), "")
+
+	var content []string
+	switch u.Tab {
+	case tabFiles:
+		rows := fileRows(stats.Files)
+		if u.Cursor >= len(rows) {
+			u.Cursor = len(rows) - 1
+		}
+		if u.Cursor < 0 {
+			u.Cursor = 0
+		}
+		// Keep the cursor on screen
+		if u.Cursor < u.Scroll {
+			u.Scroll = u.Cursor
+		} else if u.Cursor >= u.Scroll+u.pageSize() {
+			u.Scroll = u.Cursor - u.pageSize() + 1
+		}
+		content = append(content, fmt.Sprintf("  %4s  %-8s %-19s %10s  %s", "#", "Priority", "Progress", "Size", "Path"))
+		for row, i := range rows {
+			f := stats.Files[i]
+			line := fmt.Sprintf("  %4d  %-8s %s %10s  %s", i, f.Priority, progressCell(f.Completed, f.Length),
+				formatBytes(f.Length), f.Path)
+			if row == u.Cursor {
+				line = "\x1b[7m" + fit(line, u.Width) + "\x1b[0m"
+			}
+			content = append(content, line)
+		}
+	case tabPeers:
+		content = renderPeers(t.Peers(), stats.Pieces)
+	case tabTrackers:
+		content = renderTrackers(t.Trackers())
+	case tabPieces:
+		content = renderPieceMap(t.Pieces(), u.Width-4, u.pageSize())
+	}
+	if len(content) > 0 && u.Scroll > 0 {
+		// The header line stays
+		if u.Scroll > len(content)-2 {
+			u.Scroll = len(content) - 2
+		}
+		if u.Scroll > 0 {
+			content = append(content[:1:1], content[1+u.Scroll:]...)
+		}
+	}
+	return append(lines, content...)
+}
+
+// renderPeers lists the connected peers. The flags are D downloading from the
+// peer and d choked by it, U uploading to it and u an interested peer we choke,
+// I for a peer that connected to us.
+func renderPeers(peers []peer.PeerStats, pieces int) []string {
+	lines := []string{fmt.Sprintf("  %-40s %-5s %6s %10s %10s %10s %10s",
+		"Address", "Flags", "Has", "Down", "Up", "Received", "Sent")}
+	for _, p := range peers {
+		flags := "D"
+		if p.Choked {
+			flags = "d"
+		}
+		if p.PeerInterested && !p.Choking {
+			flags += "U"
+		} else if p.PeerInterested {
+			flags += "u"
+		}
+		if p.Incoming {
+			flags += "I"
+		}
+		has := "?"
+		if pieces > 0 {
+			has = fmt.Sprintf("%.0f%%", float64(p.Pieces)/float64(pieces)*100)
+		}
+		lines = append(lines, fmt.Sprintf("  %-40s %-5s %6s %10s %10s %10s %10s", p.Peer, flags, has,
+			formatRate(p.DownloadRate), formatRate(p.UploadRate), formatBytes(p.Downloaded), formatBytes(p.Uploaded)))
+	}
+	if len(peers) == 0 {
+		lines = append(lines, "  No peers connected")
+	}
+	return lines
+}
+
+// renderTrackers shows how the last announce to each tracker went
+func renderTrackers(trackers []client.TrackerStatus) []string {
+	lines := []string{fmt.Sprintf("  %-40s %-10s %8s %8s %6s  %s", "Tracker", "Announced", "Seeders", "Leechers", "Peers", "Status")}
+	for _, tr := range trackers {
+		if tr.Announced.IsZero() {
+			lines = append(lines, fmt.Sprintf("  %-40s %-10s", tr.URL, "never"))
+			continue
+		}
+		status := "ok"
+		if tr.Err != nil {
+			status = tr.Err.Error()
+		}
+		ago := time.Since(tr.Announced).Round(time.Second).String() + " ago"
+		lines = append(lines, fmt.Sprintf("  %-40s %-10s %8d %8d %6d  %s", tr.URL, ago, tr.Seeders, tr.Leechers, tr.Peers, status))
+	}
+	if len(trackers) == 0 {
+		lines = append(lines, "  No trackers, peers only come from incoming connections")
+	}
+	return lines
+}
+
+// renderPieceMap draws the verified pieces in at most width by height cells,
+// a cell standing for as many pieces as it takes to fit them all
+func renderPieceMap(have peer.Bitfield, width, height int) []string {
+	if have.Len() == 0 {
+		return []string{"  Waiting for the metadata"}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	perCell := (have.Len() + width*height - 1) / (width * height)
+	shades := []rune(" ░▒▓█")
+	lines := []string{fmt.Sprintf("  %d of %d pieces, %d per cell", have.Count(), have.Len(), perCell)}
+	var row []rune
+	for begin := 0; begin < have.Len(); begin += perCell {
+		end := begin + perCell
+		if end > have.Len() {
+			end = have.Len()
+		}
+		count := 0
+		for i := begin; i < end; i++ {
+			if have.Has(i) {
+				count++
+			}
+		}
+		shade := count * (len(shades) - 1) / (end - begin)
+		if count > 0 && shade == 0 {
+			shade = 1
+		}
+		row = append(row, shades[shade])
+		if len(row) == width {
+			lines = append(lines, "  "+string(row))
+			row = row[:0]
+		}
+	}
+	if len(row) > 0 {
+		lines = append(lines, "  "+string(row))
+	}
+	return lines
+}
+
+// fileRows are the indexes of the files listed in the files tab, padding
+// files are left out
+func fileRows(files []client.File) []int {
+	var rows []int
+	for i, f := range files {
+		if !f.Padding {
+			rows = append(rows, i)
+		}
+	}
+	return rows
+}
+
+// progressCell is a bar and percentage 19 characters wide
+func progressCell(completed, total int64) string {
+	percent := 0.0
+	if total > 0 {
+		percent = float64(completed) / float64(total) * 100
+	}
+	return fmt.Sprintf("%s %5.1f%%", progressBar(percent, 10), percent)
+}
+
+// wantedBytes sums the length and completed bytes of the wanted files
+func wantedBytes(files []client.File) (wanted, completed int64) {
+	for _, f := range files {
+		if f.Wanted && !f.Padding {
+			wanted += f.Length
+			completed += f.Completed
+		}
+	}
+	return wanted, completed
+}
+
+func formatRate(rate float64) string {
+	return formatBytes(int64(rate)) + "/s"
+}
+
+func formatETA(stats client.Stats) string {
+	if stats.State != client.StateDownloading || stats.ETA <= 0 {
+		return "-"
+	}
+	return stats.ETA.Round(time.Second).String()
+}
+
+// fit cuts a line to width columns, escape sequences take none
+func fit(line string, width int) string {
+	var b strings.Builder
+	columns := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case r == 0x1b:
+			escape = true
+		case escape:
+			escape = !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+		case columns >= width:
+			continue
+		default:
+			columns++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/laurentlousky/stream/client"
+	"github.com/laurentlousky/stream/peer"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys("\x1b[Aj\x1b[B\r\t\x1b[Zé\x7f\x1b\x03")
+	want := []string{"up", "j", "down", "enter", "tab", "backtab", "é", "backspace", "esc", "ctrl-c"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestRenderPieceMap(t *testing.T) {
+	have := peer.NewBitfield(40)
+	for i := 0; i < 20; i++ {
+		have.Set(i)
+	}
+	have.Set(30)
+	// Two pieces a cell, one of the pair at 30 and 31 is half shaded
+	lines := renderPieceMap(have, 10, 2)
+	if len(lines) != 3 || lines[1] != "  ██████████" || lines[2] != "       ▒    " {
+		t.Errorf("got map %q", lines)
+	}
+	if lines := renderPieceMap(peer.Bitfield{}, 10, 2); len(lines) != 1 {
+		t.Errorf("got %q without metadata", lines)
+	}
+}
+
+func TestFit(t *testing.T) {
+	if got := fit("\x1b[7mabcdef\x1b[0m", 3); got != "\x1b[7mabc\x1b[0m" {
+		t.Errorf("got %q", got)
+	}
+	if got := fit("↓ é", 10); got != "↓ é" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTUIKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.torrent")
+	mi, err := peer.CreateTorrent("main.go", peer.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTorrentFile(mi, path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.New(client.Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	u := &tui{Client: c, Width: 100, Height: 20, Notices: make(chan string, 16)}
+
+	// Add through the prompt, then look at the details
+	for _, key := range append(append([]string{"a"}, strings.Split(path, "")...), "enter", "enter") {
+		u.handleKey(key, nil)
+	}
+	if len(u.Torrents) != 1 || !u.Detail {
+		t.Fatalf("got %d torrents, detail %v: %s", len(u.Torrents), u.Detail, u.Status)
+	}
+	screen := strings.Join(u.render(), "\n")
+	if !strings.Contains(screen, "main.go") || !strings.Contains(screen, "normal") {
+		t.Errorf("files tab shows:\n%s", screen)
+	}
+	for _, tab := range []string{"2", "3", "4"} {
+		u.handleKey(tab, nil)
+		if lines := u.render(); len(lines) != u.Height {
+			t.Errorf("tab %s rendered %d lines", tab, len(lines))
+		}
+	}
+	u.handleKey("esc", nil)
+	u.handleKey("r", nil)
+	u.handleKey("y", nil)
+	if len(u.Torrents) != 0 || u.Detail {
+		t.Errorf("torrent was not removed")
+	}
+	if !strings.Contains(strings.Join(u.render(), "\n"), "No torrents") {
+		t.Error("empty list is not explained")
+	}
+	u.handleKey("q", nil)
+	if !u.Quit {
+		t.Error("q did not quit")
+	}
+}